@@ -28,6 +28,7 @@ import (
 	"math"
 	"math/rand"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -42,23 +43,27 @@ type jsonError struct {
 
 // ForwardApmData receives agent data as it comes in and posts it to the APM server.
 // Stop checking for, and sending agent data when the function invocation
-// has completed, signaled via a channel.
-func (c *Client) ForwardApmData(ctx context.Context, metadataContainer *MetadataContainer) error {
-	if c.IsUnhealthy() {
+// has completed, signaled via the done channel. The request in flight at that
+// time completes, unless the context is done.
+func (c *Client) ForwardApmData(ctx context.Context, done <-chan struct{}, metadataContainer *MetadataContainer) error {
+	if c.IsUnhealthy() || c.Paused() {
 		return nil
 	}
+	// The backoff entered while forwarding lasts until the end of the invocation at most.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	for {
 		select {
 		case <-ctx.Done():
-			c.logger.Debug("Invocation context cancelled, not processing any more agent data")
+			c.logger.Debug("Context cancelled, not processing any more agent data")
+			return nil
+		case <-done:
+			c.logger.Debug("Invocation completed, not processing any more agent data")
 			return nil
 		case agentData := <-c.DataChannel:
-			if metadataContainer.Metadata == nil {
-				metadata, err := ProcessMetadata(agentData)
-				if err != nil {
-					return fmt.Errorf("failed to extract metadata from agent payload %w", err)
-				}
-				metadataContainer.Metadata = metadata
+			c.unbuffered(agentData)
+			if err := c.processAgentMetadata(agentData, metadataContainer); err != nil {
+				return err
 			}
 			if err := c.PostToApmServer(ctx, agentData); err != nil {
 				return fmt.Errorf("error sending to APM server, skipping: %v", err)
@@ -67,23 +72,83 @@ func (c *Client) ForwardApmData(ctx context.Context, metadataContainer *Metadata
 	}
 }
 
+// processAgentMetadata keeps track of the metadata of every agent sending data,
+// so payloads from multiple agents can be interleaved during an invocation.
+func (c *Client) processAgentMetadata(agentData AgentData, metadataContainer *MetadataContainer) error {
+	metadata, err := ProcessMetadata(agentData)
+	if err != nil {
+		if metadataContainer.Metadata == nil {
+			return fmt.Errorf("failed to extract metadata from agent payload %w", err)
+		}
+		c.logger.Warnf("Failed to extract metadata from agent payload: %v", err)
+		return nil
+	}
+
+	if metadataContainer.Metadata == nil {
+		metadataContainer.Metadata = metadata
+	}
+
+	key, added := metadataContainer.Add(metadata)
+	if added && metadataContainer.Agents() > 1 {
+		c.logger.Infof("Received data from an additional agent (%s), %d agents are sending data", key, metadataContainer.Agents())
+	}
+	if !added && key != "" {
+		conflicts, merged, err := metadataContainer.Merge(key, metadata)
+		switch {
+		case err != nil:
+			c.logger.Warnf("Failed to merge the metadata of agent %s: %v", key, err)
+		case len(conflicts) > 0:
+			c.logger.Warnf("Metadata of agent %s changed, using the new values of %s", key, strings.Join(conflicts, ", "))
+		case merged:
+			c.logger.Debugf("Merged new fields into the metadata of agent %s", key)
+		}
+	}
+
+	return nil
+}
+
 // FlushAPMData reads all the apm data in the apm data channel and sends it to the APM server.
-func (c *Client) FlushAPMData(ctx context.Context) {
+// It returns an error if the flush was skipped or interrupted, leaving agent data buffered,
+// or if agent data could not be sent.
+func (c *Client) FlushAPMData(ctx context.Context) error {
 	if c.IsUnhealthy() {
 		c.logger.Debug("Flush skipped - Transport failing")
-		return
+		return errors.New("flush skipped: transport status is unhealthy")
+	}
+	if c.Paused() {
+		c.logger.Debug("Flush skipped - Forwarding paused")
+		return errors.New("flush skipped: forwarding is paused")
+	}
+	if !c.flushing.CompareAndSwap(false, true) {
+		c.logger.Debug("Flush skipped - Flush already in progress")
+		return errors.New("flush skipped: a flush is already in progress")
 	}
+	defer c.flushing.Store(false)
 	c.logger.Debug("Flush started - Checking for agent data")
+	var failed int
+	var lastErr error
 	for {
+		if err := ctx.Err(); err != nil {
+			c.logger.Debug("Flush interrupted - Context done")
+			return fmt.Errorf("flush interrupted: %w", err)
+		}
 		select {
 		case agentData := <-c.DataChannel:
+			c.unbuffered(agentData)
 			c.logger.Debug("Flush in progress - Processing agent data")
 			if err := c.PostToApmServer(ctx, agentData); err != nil {
 				c.logger.Errorf("Error sending to APM server, skipping: %v", err)
+				failed, lastErr = failed+1, err
 			}
 		default:
 			c.logger.Debug("Flush ended - No agent data on buffer")
-			return
+			if lastErr != nil {
+				return fmt.Errorf("failed to send %d payloads: %w", failed, lastErr)
+			}
+			if c.IsUnhealthy() {
+				return errors.New("the APM server failed during the flush")
+			}
+			return nil
 		}
 	}
 }
@@ -94,18 +159,40 @@ func (c *Client) FlushAPMData(ctx context.Context) {
 // It sets the APM transport status to failing upon errors, as part of the backoff
 // strategy.
 func (c *Client) PostToApmServer(ctx context.Context, agentData AgentData) error {
+	// The agent data is dropped unless the APM server accepts it, or it
+	// is spilled to disk when the failure is transient.
+	dropReason, spillable, err := c.postToApmServer(ctx, agentData)
+	if dropReason != "" && !(spillable && c.spillData(agentData)) {
+		c.dropped(dropReason, agentData)
+	}
+	return err
+}
+
+// postToApmServer posts the agent data to the APM server. Unless the APM
+// server accepted it, it returns why the agent data must be dropped, and
+// whether the failure is transient, for the data to be sent later.
+func (c *Client) postToApmServer(ctx context.Context, agentData AgentData) (DropReason, bool, error) {
 	// todo: can this be a streaming or streaming style call that keeps the
 	//       connection open across invocations?
+	dropReason := DropSendFailed
+	spillable := true
+
 	if c.IsUnhealthy() {
-		return errors.New("transport status is unhealthy")
+		return dropReason, spillable, errors.New("transport status is unhealthy")
+	}
+
+	if c.expired(agentData) {
+		dropReason = ""
+		c.logger.Debugf("Discarding agent data buffered for longer than %s", c.maxDataAge)
+		return dropReason, spillable, nil
 	}
 
 	endpointURI := "intake/v2/events"
 	encoding := agentData.ContentEncoding
 
-	var r io.Reader
+	var body []byte
 	if agentData.ContentEncoding != "" {
-		r = bytes.NewReader(agentData.Data)
+		body = agentData.Data
 	} else {
 		encoding = "gzip"
 		buf := c.bufferPool.Get().(*bytes.Buffer)
@@ -115,48 +202,89 @@ func (c *Client) PostToApmServer(ctx context.Context, agentData AgentData) error
 		}()
 		gw, err := gzip.NewWriterLevel(buf, gzip.BestSpeed)
 		if err != nil {
-			return err
+			return dropReason, spillable, err
 		}
 		if _, err := gw.Write(agentData.Data); err != nil {
-			return fmt.Errorf("failed to compress data: %w", err)
+			return dropReason, spillable, fmt.Errorf("failed to compress data: %w", err)
 		}
 		if err := gw.Close(); err != nil {
-			return fmt.Errorf("failed to write compressed data to buffer: %w", err)
+			return dropReason, spillable, fmt.Errorf("failed to write compressed data to buffer: %w", err)
 		}
-		r = buf
+		body = buf.Bytes()
 	}
+	size := len(body)
 
-	req, err := http.NewRequest(http.MethodPost, c.serverURL+endpointURI, r)
-	if err != nil {
-		return fmt.Errorf("failed to create a new request when posting to APM server: %v", err)
-	}
-	req.Header.Add("Content-Encoding", encoding)
-	req.Header.Add("Content-Type", "application/x-ndjson")
-	if c.ServerAPIKey != "" {
-		req.Header.Add("Authorization", "ApiKey "+c.ServerAPIKey)
-	} else if c.ServerSecretToken != "" {
-		req.Header.Add("Authorization", "Bearer "+c.ServerSecretToken)
-	}
+	var resp *http.Response
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.ServerURL()+endpointURI, bytes.NewReader(body))
+		if err != nil {
+			return dropReason, spillable, fmt.Errorf("failed to create a new request when posting to APM server: %v", err)
+		}
+		req.Header.Add("Content-Encoding", encoding)
+		req.Header.Add("Content-Type", "application/x-ndjson")
+		c.setAuthorizationHeader(req)
 
-	c.logger.Debug("Sending data chunk to APM server")
-	resp, err := c.client.Do(req)
-	if err != nil {
-		c.UpdateStatus(ctx, Failing)
-		return fmt.Errorf("failed to post to APM server: %v", err)
+		c.logger.Debug("Sending data chunk to APM server")
+		resp, err = c.client.Do(req)
+		statusCode := 0
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		backoff, retry := c.retryPolicy.retry(ctx, attempt, statusCode)
+		if retry {
+			if resp != nil {
+				_, _ = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				c.lastContact.Store(time.Now().UnixNano())
+				c.logger.Debugf("Retrying to send data to APM server in %s: response status code: %d", backoff, statusCode)
+			} else {
+				c.logger.Debugf("Retrying to send data to APM server in %s: %v", backoff, err)
+			}
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+				continue
+			case <-ctx.Done():
+				timer.Stop()
+				return dropReason, spillable, fmt.Errorf("request to APM server aborted: %w", ctx.Err())
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				// The request was aborted, e.g. on shutdown, it says
+				// nothing about the health of the APM server.
+				return dropReason, spillable, fmt.Errorf("request to APM server aborted: %w", ctx.Err())
+			}
+			c.UpdateStatus(ctx, Failing)
+			return dropReason, spillable, fmt.Errorf("failed to post to APM server: %v", err)
+		}
+		break
 	}
 	defer resp.Body.Close()
+	c.lastContact.Store(time.Now().UnixNano())
 
 	// On success, the server will respond with a 202 Accepted status code and no body.
 	if resp.StatusCode == http.StatusAccepted {
+		dropReason = ""
 		c.UpdateStatus(ctx, Healthy)
-		return nil
+		c.sentBytes.Add(int64(size))
+		c.countEvents(agentData)
+		c.observeAckLatency(agentData)
+		return dropReason, spillable, nil
+	}
+
+	dropReason = DropRejected
+	spillable = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+	if resp.StatusCode < http.StatusBadRequest {
+		// The APM server does not tell, assume it accepted the data.
+		dropReason = ""
 	}
 
 	// RateLimited
 	if resp.StatusCode == http.StatusTooManyRequests {
 		c.logger.Warnf("Transport has been rate limited: response status code: %d", resp.StatusCode)
 		c.UpdateStatus(ctx, RateLimited)
-		return nil
+		return dropReason, spillable, nil
 	}
 
 	jErr := jsonResult{}
@@ -172,8 +300,14 @@ func (c *Client) PostToApmServer(ctx context.Context, agentData AgentData) error
 		for _, err := range jErr.Errors {
 			c.logger.Warnf("failed to authenticate: document %s: message: %s", err.Document, err.Message)
 		}
+		if c.serverless {
+			c.logger.Warn("Serverless projects require an API key with the privileges to write APM data")
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			c.refreshAuth(ctx)
+		}
 		c.UpdateStatus(ctx, Failing)
-		return nil
+		return dropReason, spillable, nil
 	}
 
 	// ClientErrors
@@ -183,7 +317,7 @@ func (c *Client) PostToApmServer(ctx context.Context, agentData AgentData) error
 			c.logger.Warnf("client error: document %s: message: %s", err.Document, err.Message)
 		}
 		c.UpdateStatus(ctx, ClientFailing)
-		return nil
+		return dropReason, spillable, nil
 	}
 
 	// critical errors
@@ -193,11 +327,17 @@ func (c *Client) PostToApmServer(ctx context.Context, agentData AgentData) error
 			c.logger.Warnf("critical error: document %s: message: %s", err.Document, err.Message)
 		}
 		c.UpdateStatus(ctx, Failing)
-		return nil
+		return dropReason, spillable, nil
 	}
 
 	c.logger.Warnf("unhandled status code: %d", resp.StatusCode)
-	return nil
+	return dropReason, spillable, nil
+}
+
+// SentBytes returns the number of bytes, as sent on the wire, of the
+// data acknowledged by the APM server since the client started.
+func (c *Client) SentBytes() int64 {
+	return c.sentBytes.Load()
 }
 
 // IsUnhealthy returns true if the apmproxy is not healthy.
@@ -228,6 +368,7 @@ func (c *Client) UpdateStatus(ctx context.Context, status Status) {
 	case Healthy:
 		c.mu.Lock()
 		if c.Status == status {
+			c.mu.Unlock()
 			return
 		}
 		c.Status = status
@@ -242,6 +383,17 @@ func (c *Client) UpdateStatus(ctx context.Context, status Status) {
 		c.logger.Debugf("APM server Transport status set to %s", c.Status)
 		c.mu.Unlock()
 	case Failing:
+		if c.dnsCache != nil {
+			// The server may have failed over to other addresses
+			c.dnsCache.invalidate()
+			c.client.CloseIdleConnections()
+		}
+		if len(c.serverURLs) > 1 {
+			// Another server may be faster while this one recovers
+			c.goBackground(func(ctx context.Context) {
+				c.ProbeServers(ctx)
+			})
+		}
 		c.mu.Lock()
 		c.Status = status
 		c.logger.Debugf("APM server Transport status set to %s", c.Status)
@@ -250,18 +402,20 @@ func (c *Client) UpdateStatus(ctx context.Context, status Status) {
 		c.logger.Debugf("Grace period entered, reconnection count : %d", c.ReconnectionCount)
 		c.mu.Unlock()
 
-		go func() {
+		c.goBackground(func(background context.Context) {
 			select {
 			case <-gracePeriodTimer.C:
 				c.logger.Debug("Grace period over - timer timed out")
 			case <-ctx.Done():
 				c.logger.Debug("Grace period over - context done")
+			case <-background.Done():
+				c.logger.Debug("Grace period over - client shut down")
 			}
 			c.mu.Lock()
 			c.Status = Started
 			c.logger.Debugf("APM server Transport status set to %s", c.Status)
 			c.mu.Unlock()
-		}()
+		})
 	default:
 		c.logger.Errorf("Cannot set APM server Transport status to %s", status)
 	}
@@ -284,17 +438,88 @@ func (c *Client) ComputeGracePeriod() time.Duration {
 // EnqueueAPMData adds a AgentData struct to the agent data channel, effectively queueing for a send
 // to the APM server.
 func (c *Client) EnqueueAPMData(agentData AgentData) {
-	select {
-	case c.DataChannel <- agentData:
-		c.logger.Debug("Adding agent data to buffer to be sent to apm server")
-	default:
-		c.logger.Warn("Channel full: dropping a subset of agent data")
+	if agentData.ContentEncoding == "" {
+		agentData.metadataSize = metadataSize(agentData.Data)
+	}
+	if c.compressBuffer && agentData.ContentEncoding == "" {
+		compressed, err := compressAgentData(agentData)
+		if err != nil {
+			c.logger.Warnf("Failed to compress agent data, buffering it uncompressed: %v", err)
+		} else {
+			agentData = compressed
+		}
 	}
+
+	var force bool
+	for {
+		if err := c.bufferAgentData(agentData, force); err == nil {
+			c.logger.Debug("Adding agent data to buffer to be sent to apm server")
+			c.updateBufferHighWatermark()
+			return
+		}
+
+		if c.evictionPolicy != DropOldest {
+			c.logger.Warn("Channel full: dropping a subset of agent data")
+			c.bufferDropped.Add(1)
+			c.dropped(DropBufferFull, agentData)
+			return
+		}
+
+		// Make room for the data by dropping the oldest buffered data.
+		select {
+		case evicted := <-c.DataChannel:
+			c.unbuffered(evicted)
+			c.logger.Warn("Channel full: dropping the oldest buffered agent data")
+			c.bufferEvicted.Add(1)
+			c.dropped(DropEvicted, evicted)
+		default:
+			// There is nothing left to evict, the agent data exceeds
+			// the maximum size of the buffer on its own.
+			force = true
+		}
+	}
+}
+
+// compressAgentData returns the gzip compressed agent data, so that it can be
+// buffered compressed and sent to the APM server as is.
+func compressAgentData(agentData AgentData) (AgentData, error) {
+	var buf bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if err != nil {
+		return AgentData{}, err
+	}
+	if _, err := gw.Write(agentData.Data); err != nil {
+		return AgentData{}, fmt.Errorf("failed to compress data: %w", err)
+	}
+	if err := gw.Close(); err != nil {
+		return AgentData{}, fmt.Errorf("failed to write compressed data to buffer: %w", err)
+	}
+
+	agentData.Data, agentData.ContentEncoding = buf.Bytes(), "gzip"
+	return agentData, nil
+}
+
+// AgentConnected returns true if an agent has sent data or a flush
+// signal to the extension since it started.
+func (c *Client) AgentConnected() bool {
+	return c.agentConnected.Load()
 }
 
-// ShouldFlush returns true if the client should flush APM data after processing the event.
+// ShouldFlush returns true if the client should flush APM data after processing the event,
+// either because of the send strategy or because the buffer is close to full. It returns
+// false while a flush is in progress, the data buffered meanwhile is sent by that flush.
 func (c *Client) ShouldFlush() bool {
-	return c.sendStrategy == SyncFlush
+	if c.Flushing() {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sendStrategy == SyncFlush || c.bufferAboveShipThreshold()
+}
+
+// Flushing returns true while the agent data buffer is being flushed.
+func (c *Client) Flushing() bool {
+	return c.flushing.Load()
 }
 
 // ResetFlush resets the client's "agent flushed" state, such that
@@ -313,3 +538,22 @@ func (c *Client) WaitForFlush() <-chan struct{} {
 	defer c.flushMutex.Unlock()
 	return c.flushCh
 }
+
+// SetSendStrategy changes the send strategy at runtime.
+func (c *Client) SetSendStrategy(strategy SendStrategy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendStrategy = strategy
+}
+
+// SetPaused pauses or resumes the forwarding of agent data to the APM
+// server. While paused, agent data is buffered, and dropped or evicted
+// when the buffer is full.
+func (c *Client) SetPaused(paused bool) {
+	c.paused.Store(paused)
+}
+
+// Paused returns true if the forwarding of agent data is paused.
+func (c *Client) Paused() bool {
+	return c.paused.Load()
+}
@@ -20,9 +20,12 @@ package apmproxy_test
 import (
 	"compress/gzip"
 	"context"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -624,3 +627,332 @@ func BenchmarkPostToAPM(b *testing.B) {
 		}
 	}
 }
+
+func TestPostToApmServerCancelled(t *testing.T) {
+	received := make(chan struct{})
+	unblock := make(chan struct{})
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-unblock
+	}))
+	defer apmServer.Close()
+	defer close(unblock)
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+
+	start := time.Now()
+	err = apmClient.PostToApmServer(ctx, apmproxy.AgentData{Data: []byte("{}")})
+	assert.ErrorIs(t, err, context.Canceled)
+	// The request is aborted rather than waiting for the client timeout,
+	// and the APM server is not considered failing.
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, apmproxy.Started, apmClient.Status)
+}
+
+func TestForwardApmDataMultipleAgents(t *testing.T) {
+	agents := map[string]string{
+		"wrapper": `{"metadata":{"service":{"name":"svc","agent":{"name":"nodejs","version":"3.14.0"}},"process":{"pid":1}}}`,
+		"app":     `{"metadata":{"service":{"name":"svc","agent":{"name":"python","version":"6.12.0"}},"process":{"pid":2}}}`,
+	}
+
+	var mu sync.Mutex
+	var received []string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(gr)
+		require.NoError(t, err)
+		mu.Lock()
+		received = append(received, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	// Simulate two agents posting interleaved payloads concurrently.
+	var wg sync.WaitGroup
+	for name, metadata := range agents {
+		wg.Add(1)
+		go func(name, metadata string) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				body := fmt.Sprintf("%s\n{\"transaction\":{\"name\":\"%s-%d\"}}\n", metadata, name, i)
+				resp, err := newReceiverClient().Post("http://localhost:1234/intake/v2/events", "application/x-ndjson", strings.NewReader(body))
+				if assert.NoError(t, err) {
+					resp.Body.Close()
+				}
+			}
+		}(name, metadata)
+	}
+	wg.Wait()
+
+	done := make(chan struct{})
+	mc := apmproxy.MetadataContainer{}
+	go func() {
+		require.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(received) == 10
+		}, 5*time.Second, 10*time.Millisecond)
+		close(done)
+	}()
+	require.NoError(t, apmClient.ForwardApmData(context.Background(), done, &mc))
+
+	assert.Equal(t, 2, mc.Agents())
+	for _, payload := range received {
+		metadata, _, _ := strings.Cut(payload, "\n")
+		if strings.Contains(payload, "wrapper-") {
+			assert.Equal(t, agents["wrapper"], metadata)
+		} else {
+			assert.Equal(t, agents["app"], metadata)
+		}
+	}
+}
+
+func TestEnqueueAPMDataCompressedBuffer(t *testing.T) {
+	s := "A long time ago in a galaxy far, far away..."
+
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(gr)
+		require.NoError(t, err)
+		assert.Equal(t, s, string(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithCompressedBuffer(),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+
+	apmClient.EnqueueAPMData(apmproxy.AgentData{Data: []byte(s)})
+	agentData := <-apmClient.DataChannel
+	assert.Equal(t, "gzip", agentData.ContentEncoding)
+
+	uncompressed, err := apmproxy.GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	require.NoError(t, err)
+	assert.Equal(t, s, string(uncompressed))
+
+	require.NoError(t, apmClient.PostToApmServer(context.Background(), agentData))
+}
+
+func TestEnqueueAPMDataEvictionPolicy(t *testing.T) {
+	testCases := map[string]struct {
+		opts     []apmproxy.Option
+		expected []string
+		stats    apmproxy.BufferStats
+	}{
+		"default": {
+			expected: []string{"1", "2"},
+			stats:    apmproxy.BufferStats{Depth: 2, Capacity: 2, HighWatermark: 2, Dropped: 2, EvictionPolicy: apmproxy.DropNewest, Bytes: 2, HighWatermarkBytes: 2},
+		},
+		"drop newest": {
+			opts:     []apmproxy.Option{apmproxy.WithEvictionPolicy(apmproxy.DropNewest)},
+			expected: []string{"1", "2"},
+			stats:    apmproxy.BufferStats{Depth: 2, Capacity: 2, HighWatermark: 2, Dropped: 2, EvictionPolicy: apmproxy.DropNewest, Bytes: 2, HighWatermarkBytes: 2},
+		},
+		"drop oldest": {
+			opts:     []apmproxy.Option{apmproxy.WithEvictionPolicy(apmproxy.DropOldest)},
+			expected: []string{"3", "4"},
+			stats:    apmproxy.BufferStats{Depth: 2, Capacity: 2, HighWatermark: 2, Evicted: 2, EvictionPolicy: apmproxy.DropOldest, Bytes: 2, HighWatermarkBytes: 2},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			apmClient, err := apmproxy.NewClient(append(tc.opts,
+				apmproxy.WithURL("https://example.com"),
+				apmproxy.WithAgentDataBufferSize(2),
+				apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+			)...)
+			require.NoError(t, err)
+
+			for _, data := range []string{"1", "2", "3", "4"} {
+				apmClient.EnqueueAPMData(apmproxy.AgentData{Data: []byte(data)})
+			}
+
+			require.Len(t, apmClient.DataChannel, len(tc.expected))
+			assert.Equal(t, tc.stats, apmClient.BufferStats())
+			for _, expected := range tc.expected {
+				assert.Equal(t, expected, string((<-apmClient.DataChannel).Data))
+			}
+		})
+	}
+}
+
+func TestEnqueueAPMDataBufferBytes(t *testing.T) {
+	testCases := map[string]struct {
+		opts     []apmproxy.Option
+		expected []string
+		stats    apmproxy.BufferStats
+	}{
+		"drop newest": {
+			opts:     []apmproxy.Option{apmproxy.WithEvictionPolicy(apmproxy.DropNewest)},
+			expected: []string{"12", "34"},
+			stats:    apmproxy.BufferStats{Depth: 2, Capacity: 10, HighWatermark: 2, Dropped: 2, EvictionPolicy: apmproxy.DropNewest, Bytes: 4, CapacityBytes: 5, HighWatermarkBytes: 4},
+		},
+		"drop oldest": {
+			// The last payload exceeds the maximum size on its own, it
+			// is buffered once all the others are evicted.
+			opts:     []apmproxy.Option{apmproxy.WithEvictionPolicy(apmproxy.DropOldest)},
+			expected: []string{"7890123"},
+			stats:    apmproxy.BufferStats{Depth: 1, Capacity: 10, HighWatermark: 2, Evicted: 3, EvictionPolicy: apmproxy.DropOldest, Bytes: 7, CapacityBytes: 5, HighWatermarkBytes: 7},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			apmClient, err := apmproxy.NewClient(append(tc.opts,
+				apmproxy.WithURL("https://example.com"),
+				apmproxy.WithAgentDataBufferSize(10),
+				apmproxy.WithAgentDataBufferBytes(5),
+				apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+			)...)
+			require.NoError(t, err)
+
+			for _, data := range []string{"12", "34", "56", "7890123"} {
+				apmClient.EnqueueAPMData(apmproxy.AgentData{Data: []byte(data)})
+			}
+
+			require.Len(t, apmClient.DataChannel, len(tc.expected))
+			assert.Equal(t, tc.stats, apmClient.BufferStats())
+			for _, expected := range tc.expected {
+				assert.Equal(t, expected, string((<-apmClient.DataChannel).Data))
+			}
+		})
+	}
+}
+
+func TestBufferStatsBytes(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithAgentDataBufferSize(10),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+
+	metadata := `{"metadata":{"service":{"name":"foo","agent":{"name":"python","version":"6.12.0"}}}}` + "\n"
+	transaction := `{"transaction":{"id":"00xxxxFFaaaa1234"}}` + "\n"
+	apmClient.EnqueueAPMData(apmproxy.AgentData{Data: []byte(metadata + transaction)})
+	apmClient.EnqueueAPMData(apmproxy.AgentData{Data: []byte(transaction)})
+
+	size := int64(len(metadata) + 2*len(transaction))
+	stats := apmClient.BufferStats()
+	assert.Equal(t, size, stats.Bytes)
+	assert.Equal(t, int64(len(metadata)), stats.MetadataBytes)
+	assert.Equal(t, size, stats.HighWatermarkBytes)
+
+	require.NoError(t, apmClient.FlushAPMData(context.Background()))
+	stats = apmClient.BufferStats()
+	assert.Zero(t, stats.Bytes)
+	assert.Zero(t, stats.MetadataBytes)
+	assert.Equal(t, size, stats.HighWatermarkBytes)
+}
+
+func TestShouldFlushShipThreshold(t *testing.T) {
+	testCases := map[string]struct {
+		opts     []apmproxy.Option
+		buffered int
+	}{
+		"default":   {buffered: 9},
+		"custom":    {opts: []apmproxy.Option{apmproxy.WithShipThreshold(0.5)}, buffered: 5},
+		"full only": {opts: []apmproxy.Option{apmproxy.WithShipThreshold(1)}, buffered: 10},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			apmClient, err := apmproxy.NewClient(append(tc.opts,
+				apmproxy.WithURL("https://example.com"),
+				apmproxy.WithSendStrategy(apmproxy.Background),
+				apmproxy.WithAgentDataBufferSize(10),
+				apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+			)...)
+			require.NoError(t, err)
+
+			for i := 0; i < tc.buffered-1; i++ {
+				apmClient.EnqueueAPMData(apmproxy.AgentData{Data: []byte("{}")})
+			}
+			assert.False(t, apmClient.ShouldFlush())
+
+			apmClient.EnqueueAPMData(apmproxy.AgentData{Data: []byte("{}")})
+			assert.True(t, apmClient.ShouldFlush())
+		})
+	}
+}
+
+func TestShipThresholdValidation(t *testing.T) {
+	for _, ratio := range []float64{0, -0.5, 1.5} {
+		_, err := apmproxy.NewClient(
+			apmproxy.WithURL("https://example.com"),
+			apmproxy.WithShipThreshold(ratio),
+			apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		)
+		assert.Error(t, err, ratio)
+	}
+}
+
+func TestShouldFlushWhileFlushing(t *testing.T) {
+	received := make(chan struct{})
+	unblock := make(chan struct{})
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-unblock
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithAgentDataBufferSize(1),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	assert.True(t, apmClient.ShouldFlush())
+
+	apmClient.EnqueueAPMData(apmproxy.AgentData{Data: []byte("{}")})
+	flushed := make(chan error)
+	go func() {
+		flushed <- apmClient.FlushAPMData(context.Background())
+	}()
+	<-received
+
+	assert.True(t, apmClient.Flushing())
+	assert.False(t, apmClient.ShouldFlush())
+	assert.Error(t, apmClient.FlushAPMData(context.Background()))
+
+	close(unblock)
+	require.NoError(t, <-flushed)
+	assert.False(t, apmClient.Flushing())
+	assert.True(t, apmClient.ShouldFlush())
+}
@@ -0,0 +1,181 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// AuthProvider provides the Authorization header of the requests to
+// the APM server, so that new authentication schemes can be added
+// without changing the client.
+type AuthProvider interface {
+	// Authorization returns the value of the Authorization header,
+	// or an empty string if none is sent.
+	Authorization(ctx context.Context) (string, error)
+	// Refresh is called when the APM server rejects the credentials
+	// with 401 Unauthorized, e.g. to load rotated credentials.
+	Refresh(ctx context.Context) error
+}
+
+// AuthorizationHeader returns the value of the Authorization header
+// authenticating with the API key, or with the secret token if the
+// API key is empty.
+func AuthorizationHeader(apiKey, secretToken string) string {
+	if apiKey = normalizeAPIKey(apiKey); apiKey != "" {
+		return "ApiKey " + apiKey
+	}
+	if secretToken != "" {
+		return "Bearer " + secretToken
+	}
+	return ""
+}
+
+// staticAuth sends the same Authorization header with all the requests.
+type staticAuth string
+
+func (a staticAuth) Authorization(context.Context) (string, error) {
+	return string(a), nil
+}
+
+func (a staticAuth) Refresh(context.Context) error {
+	return nil
+}
+
+// APIKeyAuth authenticates with an API key, given either encoded or as
+// "id:api_key".
+func APIKeyAuth(key string) AuthProvider {
+	return staticAuth(AuthorizationHeader(key, ""))
+}
+
+// SecretTokenAuth authenticates with a secret token.
+func SecretTokenAuth(token string) AuthProvider {
+	return staticAuth(AuthorizationHeader("", token))
+}
+
+// refreshingAuth caches the Authorization header loaded by its load
+// function, loaded again on refresh.
+type refreshingAuth struct {
+	load func(ctx context.Context) (string, error)
+
+	mu     sync.Mutex
+	loaded bool
+	value  string
+}
+
+// NewRefreshingAuth returns an AuthProvider sending the value of the
+// Authorization header returned by load. The value is loaded with the
+// first request, and loaded again when the APM server rejects it.
+func NewRefreshingAuth(load func(ctx context.Context) (string, error)) AuthProvider {
+	return &refreshingAuth{load: load}
+}
+
+func (a *refreshingAuth) Authorization(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.loaded {
+		if err := a.refresh(ctx); err != nil {
+			return "", err
+		}
+	}
+	return a.value, nil
+}
+
+func (a *refreshingAuth) Refresh(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.refresh(ctx)
+}
+
+func (a *refreshingAuth) refresh(ctx context.Context) error {
+	value, err := a.load(ctx)
+	if err != nil {
+		return err
+	}
+	a.value = value
+	a.loaded = true
+	return nil
+}
+
+// FileAuth sends the Authorization header read from the file, e.g. a
+// token written by another extension. The file is read again when the
+// APM server rejects the header.
+func FileAuth(path string) AuthProvider {
+	return NewRefreshingAuth(func(context.Context) (string, error) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the authorization file: %w", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	})
+}
+
+// CommandAuth sends the Authorization header printed by the command.
+// The command is run again when the APM server rejects the header.
+func CommandAuth(name string, args ...string) AuthProvider {
+	return NewRefreshingAuth(func(ctx context.Context) (string, error) {
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				err = fmt.Errorf("%w: %s", err, msg)
+			}
+			return "", fmt.Errorf("failed to run the authorization command: %w", err)
+		}
+		value := strings.TrimSpace(string(out))
+		if value == "" {
+			return "", errors.New("the authorization command printed nothing")
+		}
+		return value, nil
+	})
+}
+
+// setAuthorizationHeader sets the authorization header of requests to the APM server.
+func (c *Client) setAuthorizationHeader(req *http.Request) {
+	value, err := c.auth.Authorization(req.Context())
+	if err != nil {
+		c.logger.Warnf("Failed to get the authorization of the request to the APM server: %v", err)
+		return
+	}
+	if value != "" {
+		req.Header.Set("Authorization", value)
+	}
+}
+
+// refreshAuth refreshes the credentials rejected by the APM server.
+// Concurrent refreshes are skipped.
+func (c *Client) refreshAuth(ctx context.Context) {
+	if !c.authRefreshing.CompareAndSwap(false, true) {
+		return
+	}
+	defer c.authRefreshing.Store(false)
+
+	if err := c.auth.Refresh(ctx); err != nil {
+		c.logger.Warnf("Failed to refresh the authorization of the requests to the APM server: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestAuthorizationHeader(t *testing.T) {
+	assert.Equal(t, "ApiKey foo", apmproxy.AuthorizationHeader("foo", "bar"))
+	assert.Equal(t, "ApiKey aWQ6a2V5", apmproxy.AuthorizationHeader("id:key", ""))
+	assert.Equal(t, "Bearer bar", apmproxy.AuthorizationHeader("", "bar"))
+	assert.Empty(t, apmproxy.AuthorizationHeader("", ""))
+}
+
+func TestFileAuthRefreshedOnUnauthorized(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authorization")
+	require.NoError(t, os.WriteFile(path, []byte("ApiKey old\n"), 0o600))
+
+	var mu sync.Mutex
+	var headers []string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers = append(headers, r.Header.Get("Authorization"))
+		mu.Unlock()
+		if r.Header.Get("Authorization") != "ApiKey new" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	provider := apmproxy.FileAuth(path)
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithAPIKey("ignored"),
+		apmproxy.WithAuthProvider(provider),
+		// The rejected request starts a grace period that outlives the test.
+		apmproxy.WithLogger(zap.NewNop().Sugar()),
+	)
+	require.NoError(t, err)
+
+	value, err := provider.Authorization(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ApiKey old", value)
+
+	// The rotated credentials are read again once the cached ones are rejected.
+	require.NoError(t, os.WriteFile(path, []byte("ApiKey new\n"), 0o600))
+	agentData := apmproxy.AgentData{Data: []byte(`{"metadata":{}}` + "\n" + `{"transaction":{}}`)}
+	require.NoError(t, apmClient.PostToApmServer(context.Background(), agentData))
+	assert.Equal(t, apmproxy.Failing, apmClient.Status)
+
+	apmClient.UpdateStatus(context.Background(), apmproxy.Healthy)
+	require.NoError(t, apmClient.PostToApmServer(context.Background(), agentData))
+	assert.Equal(t, apmproxy.Healthy, apmClient.Status)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"ApiKey old", "ApiKey new"}, headers)
+}
+
+func TestCommandAuth(t *testing.T) {
+	provider := apmproxy.CommandAuth("echo", "Bearer", "token")
+	value, err := provider.Authorization(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer token", value)
+
+	_, err = apmproxy.CommandAuth("false").Authorization(context.Background())
+	assert.Error(t, err)
+}
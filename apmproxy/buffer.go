@@ -0,0 +1,171 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBufferFull is returned when the agent data buffer has no room for
+// agent data, either by number of payloads or by size.
+var ErrBufferFull = errors.New("agent data buffer is full")
+
+// BufferStats describes the use of the buffer of agent data
+// between the receiver and the forwarder.
+type BufferStats struct {
+	Depth          int            `json:"depth"`
+	Capacity       int            `json:"capacity"`
+	HighWatermark  int64          `json:"high_watermark"`
+	Dropped        int64          `json:"dropped"`
+	Evicted        int64          `json:"evicted"`
+	Expired        int64          `json:"expired"`
+	EvictionPolicy EvictionPolicy `json:"eviction_policy"`
+
+	// Bytes is the size of the buffered agent data, as it is sent to
+	// the APM server, i.e. compressed if it was received compressed
+	// or if the buffer is compressed.
+	Bytes int64 `json:"bytes"`
+	// CapacityBytes is the maximum size of the buffered agent data,
+	// unlimited if zero, see WithAgentDataBufferBytes.
+	CapacityBytes int64 `json:"capacity_bytes"`
+	// MetadataBytes is the part of Bytes used by the metadata lines
+	// of the buffered agent data. The metadata of agent data received
+	// compressed is not accounted for.
+	MetadataBytes      int64 `json:"metadata_bytes"`
+	HighWatermarkBytes int64 `json:"high_watermark_bytes"`
+	// SpilledBytes is the size of the agent data spilled to disk
+	// waiting to be sent, see WithSpill.
+	SpilledBytes int64 `json:"spilled_bytes"`
+}
+
+// BufferStats returns the statistics of the agent data buffer since
+// the client started. The receiver never blocks on a full buffer,
+// agent data is either dropped or evicted, depending on the eviction
+// policy.
+func (c *Client) BufferStats() BufferStats {
+	return BufferStats{
+		Depth:          len(c.DataChannel),
+		Capacity:       cap(c.DataChannel),
+		HighWatermark:  c.bufferHighWatermark.Load(),
+		Dropped:        c.bufferDropped.Load(),
+		Evicted:        c.bufferEvicted.Load(),
+		Expired:        c.bufferExpired.Load(),
+		EvictionPolicy: c.evictionPolicy,
+
+		Bytes:              c.bufferBytes.Load(),
+		CapacityBytes:      c.bufferMaxBytes,
+		MetadataBytes:      c.bufferMetadataBytes.Load(),
+		HighWatermarkBytes: c.bufferHighWatermarkBytes.Load(),
+		SpilledBytes:       c.SpilledBytes(),
+	}
+}
+
+// updateBufferHighWatermark records the current depth and size of
+// the buffer if they are the highest seen so far.
+func (c *Client) updateBufferHighWatermark() {
+	updateMax(&c.bufferHighWatermark, int64(len(c.DataChannel)))
+	updateMax(&c.bufferHighWatermarkBytes, c.bufferBytes.Load())
+}
+
+func updateMax(max *atomic.Int64, v int64) {
+	for {
+		current := max.Load()
+		if v <= current || max.CompareAndSwap(current, v) {
+			return
+		}
+	}
+}
+
+// bufferAgentData adds the agent data to the buffer, or returns
+// ErrBufferFull if the buffer is full or if the agent data would
+// exceed its maximum size. The size is only ignored when force is
+// set: an empty buffer always accepts agent data, however large.
+func (c *Client) bufferAgentData(agentData AgentData, force bool) error {
+	size := int64(len(agentData.Data))
+	// The size is reserved ahead of adding the agent data, so that
+	// concurrent receivers cannot exceed the maximum size together.
+	for {
+		current := c.bufferBytes.Load()
+		if !force && c.bufferMaxBytes > 0 && current > 0 && current+size > c.bufferMaxBytes {
+			return ErrBufferFull
+		}
+		if c.bufferBytes.CompareAndSwap(current, current+size) {
+			break
+		}
+	}
+
+	// The agent data is tracked before it can be read from the buffer.
+	c.trackQueued(agentData)
+	select {
+	case c.DataChannel <- agentData:
+		c.bufferMetadataBytes.Add(int64(agentData.metadataSize))
+		return nil
+	default:
+		c.untrackQueued(agentData)
+		c.bufferBytes.Add(-size)
+		return ErrBufferFull
+	}
+}
+
+// unbuffered accounts for the agent data read from the buffer, whether
+// it is sent, handed off or discarded.
+func (c *Client) unbuffered(agentData AgentData) {
+	c.untrackQueued(agentData)
+	c.bufferBytes.Add(-int64(len(agentData.Data)))
+	c.bufferMetadataBytes.Add(-int64(agentData.metadataSize))
+}
+
+// metadataSize returns the size of the metadata line of the uncompressed
+// agent data, including its line ending, or 0 if it has none.
+func metadataSize(data []byte) int {
+	if !bytes.HasPrefix(data, []byte(`{"metadata"`)) {
+		return 0
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1
+	}
+	return len(data)
+}
+
+// bufferAboveShipThreshold returns whether the buffer is filled
+// beyond the ship threshold.
+func (c *Client) bufferAboveShipThreshold() bool {
+	if cap(c.DataChannel) == 0 {
+		return false
+	}
+	return float64(len(c.DataChannel)) >= c.shipThreshold*float64(cap(c.DataChannel))
+}
+
+// expired returns whether the agent data stayed buffered for longer
+// than the max age, e.g. across a long freeze of the environment, and
+// must be discarded rather than skew the current data. The age is
+// measured on the wall clock, as the timestamps of the events are.
+func (c *Client) expired(agentData AgentData) bool {
+	if c.maxDataAge <= 0 || agentData.receivedAt.IsZero() {
+		return false
+	}
+	if time.Now().Sub(agentData.receivedAt.Round(0)) <= c.maxDataAge {
+		return false
+	}
+	c.bufferExpired.Add(1)
+	c.dropped(DropExpired, agentData)
+	return true
+}
@@ -19,13 +19,18 @@ package apmproxy
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"math/rand"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/elastic/apm-aws-lambda/extension"
 	"go.uber.org/zap"
 )
 
@@ -46,6 +51,22 @@ const (
 	defaultDataForwarderTimeout time.Duration = 3 * time.Second
 	defaultReceiverAddr                       = ":8200"
 	defaultAgentBufferSize      int           = 100
+	defaultShipThreshold        float64       = 0.9
+)
+
+// EvictionPolicy represents the data the extension drops
+// when the agent data buffer is full
+type EvictionPolicy string
+
+const (
+	// DropNewest eviction policy drops the agent data received
+	// when the buffer is full, keeping the buffered data
+	DropNewest EvictionPolicy = "drop_newest"
+
+	// DropOldest eviction policy drops the oldest buffered agent
+	// data to make room for the data received, keeping the most
+	// recent data when the APM server is unavailable for long
+	DropOldest EvictionPolicy = "drop_oldest"
 )
 
 // Client is the client used to communicate with the apm server.
@@ -54,17 +75,88 @@ type Client struct {
 	bufferPool        sync.Pool
 	DataChannel       chan AgentData
 	client            *http.Client
+	roundTripper      http.RoundTripper
 	Status            Status
 	ReconnectionCount int
 	ServerAPIKey      string
 	ServerSecretToken string
+	auth              AuthProvider
+	authRefreshing    atomic.Bool
 	serverURL         string
+	serverURLs        []string
+	probing           atomic.Bool
+	background        context.Context
+	stopBackground    context.CancelFunc
+	backgroundWg      sync.WaitGroup
 	receiver          *http.Server
 	sendStrategy      SendStrategy
+	evictionPolicy    EvictionPolicy
 	logger            *zap.SugaredLogger
+	stateEndpoint     bool
+	stateComponents   map[string]func() interface{}
+	queuedMu          sync.Mutex
+	queued            []AgentData
+	keepAliveInterval time.Duration
+	retryPolicy       RetryPolicy
+	lastContact       atomic.Int64
+	sentBytes         atomic.Int64
+	agentConnected    atomic.Bool
+	compressBuffer    bool
+	serverless        bool
+	handoffURL        string
+	handoffClient     *http.Client
+	spill             *spill
+	tlsServerName     string
+	forceIPv4         bool
+	dnsCacheTTL       time.Duration
+	dnsCache          *dnsCache
+	sigV4             *SigV4
+	paused            atomic.Bool
+	otlpReceiver      bool
+	pressureHeaders   bool
+	tailSampler       *tailSampler
+	serviceVersion    atomic.Pointer[string]
+
+	receiverMaxConns       int
+	receiverMaxRequests    int
+	maxInvocationBytes     int64
+	invocationBytes        atomic.Int64
+	strictIntakeValidation bool
+	transformations        []Transformation
+	statusComponents       map[string]func() interface{}
+	prefetched             prefetchCache
+
+	metricsChannel  chan AgentData
+	metricsPipeline MetricsPipeline
 
 	flushMutex sync.Mutex
 	flushCh    chan struct{}
+
+	shipThreshold            float64
+	receiverPanics           atomic.Int64
+	flushing                 atomic.Bool
+	bufferHighWatermark      atomic.Int64
+	bufferHighWatermarkBytes atomic.Int64
+	bufferBytes              atomic.Int64
+	bufferMaxBytes           int64
+	bufferMetadataBytes      atomic.Int64
+	bufferDropped            atomic.Int64
+	bufferEvicted            atomic.Int64
+	bufferExpired            atomic.Int64
+	maxDataAge               time.Duration
+
+	latencyMu         sync.Mutex
+	invocationLatency AckLatency
+	lastLatency       AckLatency
+
+	eventsMu         sync.Mutex
+	invocationEvents EventCounts
+	totalEvents      EventCounts
+
+	dropsMu         sync.Mutex
+	invocationDrops DropCounts
+	lastDrops       DropCounts
+	totalDrops      DropCounts
 }
 
 func NewClient(opts ...Option) (*Client, error) {
@@ -84,8 +176,10 @@ func NewClient(opts ...Option) (*Client, error) {
 			WriteTimeout:   defaultDataReceiverTimeout,
 			MaxHeaderBytes: 1 << 20,
 		},
-		sendStrategy: SyncFlush,
-		flushCh:      make(chan struct{}),
+		sendStrategy:   SyncFlush,
+		evictionPolicy: DropNewest,
+		shipThreshold:  defaultShipThreshold,
+		flushCh:        make(chan struct{}),
 	}
 
 	c.client.Timeout = defaultDataForwarderTimeout
@@ -102,12 +196,95 @@ func NewClient(opts ...Option) (*Client, error) {
 		return nil, errors.New("logger cannot be empty")
 	}
 
-	// normalize server URL
+	if c.shipThreshold <= 0 || c.shipThreshold > 1 {
+		return nil, fmt.Errorf("ship threshold must be within (0, 1], got %v", c.shipThreshold)
+	}
+
+	if extension.FIPS {
+		if err := c.validateFIPS(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.handoffURL != "" {
+		// The handoff endpoint is a different host, don't
+		// share the TLS configuration of the APM server.
+		c.handoffClient = &http.Client{
+			Transport: c.newTransport(),
+			Timeout:   c.client.Timeout,
+		}
+	}
+
+	if c.roundTripper != nil {
+		c.client.Transport = c.roundTripper
+	}
+
+	if c.dnsCacheTTL > 0 {
+		c.dnsCache = newDNSCache(c.dnsCacheTTL)
+	}
+
+	if c.tlsServerName != "" || c.forceIPv4 || c.dnsCache != nil {
+		transport, ok := c.client.Transport.(*http.Transport)
+		if !ok {
+			return nil, errors.New("TLS server name, forcing IPv4 and DNS caching require an HTTP transport")
+		}
+		transport.TLSClientConfig = c.tlsConfig()
+		transport.DialContext = c.dialContext()
+	}
+
+	if c.sigV4 != nil {
+		if c.sigV4.Credentials == nil || c.sigV4.Region == "" || c.sigV4.Service == "" {
+			return nil, errors.New("SigV4 signing requires credentials, a region and a service")
+		}
+		if c.ServerAPIKey != "" || c.ServerSecretToken != "" || c.auth != nil {
+			c.logger.Warn("Requests are signed with SigV4, the APM API key, secret token and authorization provider are not used")
+		}
+		c.client.Transport = newSigV4Transport(c.client.Transport, *c.sigV4)
+	}
+
+	c.ServerAPIKey = normalizeAPIKey(c.ServerAPIKey)
+	if c.serverless && c.ServerAPIKey == "" && c.auth == nil {
+		c.logger.Warn("Serverless projects only support API key authentication, set ELASTIC_APM_API_KEY")
+	}
+	if c.auth == nil {
+		c.auth = staticAuth(AuthorizationHeader(c.ServerAPIKey, c.ServerSecretToken))
+	} else if c.ServerAPIKey != "" || c.ServerSecretToken != "" {
+		c.logger.Warn("The authorization provider takes precedence over the APM API key and secret token")
+	}
+
+	// normalize server URLs
 	if !strings.HasSuffix(c.serverURL, "/") {
 		c.serverURL = c.serverURL + "/"
 	}
+	for i, u := range c.serverURLs {
+		if !strings.HasSuffix(u, "/") {
+			c.serverURLs[i] = u + "/"
+		}
+	}
 
 	rand.Seed(time.Now().UnixNano())
 
+	// The tasks started in the background, such as probing the servers,
+	// are stopped on shutdown.
+	c.background, c.stopBackground = context.WithCancel(context.Background())
+
 	return &c, nil
 }
+
+// goBackground runs f in a goroutine, with a context canceled on shutdown.
+func (c *Client) goBackground(f func(ctx context.Context)) {
+	c.backgroundWg.Add(1)
+	go func() {
+		defer c.backgroundWg.Done()
+		f(c.background)
+	}()
+}
+
+// tlsConfig returns the TLS configuration of the connections to
+// the APM server, or nil if the default configuration is used.
+func (c *Client) tlsConfig() *tls.Config {
+	if c.tlsServerName == "" {
+		return nil
+	}
+	return &tls.Config{ServerName: c.tlsServerName}
+}
@@ -18,9 +18,18 @@
 package apmproxy_test
 
 import (
-	"github.com/elastic/apm-aws-lambda/apmproxy"
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap/zaptest"
 )
@@ -46,6 +55,15 @@ func TestClient(t *testing.T) {
 			},
 			expectedErr: true,
 		},
+		"round tripper with forced IPv4": {
+			opts: []apmproxy.Option{
+				apmproxy.WithURL("https://example.com"),
+				apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+				apmproxy.WithRoundTripper(&recordingRoundTripper{}),
+				apmproxy.WithForceIPv4(),
+			},
+			expectedErr: true,
+		},
 		"valid": {
 			opts: []apmproxy.Option{
 				apmproxy.WithURL("https://example.com"),
@@ -65,3 +83,75 @@ func TestClient(t *testing.T) {
 		})
 	}
 }
+
+// recordingRoundTripper records the requests sent through it.
+type recordingRoundTripper struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+}
+
+func (rt *recordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body string
+	if req.Body != nil && req.Header.Get("Content-Encoding") == "gzip" {
+		gr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(gr)
+		if err != nil {
+			return nil, err
+		}
+		body = string(b)
+	}
+	rt.mu.Lock()
+	rt.requests = append(rt.requests, req)
+	rt.bodies = append(rt.bodies, body)
+	n := len(rt.requests)
+	rt.mu.Unlock()
+
+	resp := &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(http.NoBody),
+		Request:    req,
+	}
+	if n > 1 {
+		resp.StatusCode = http.StatusAccepted
+	}
+	return resp, nil
+}
+
+func TestWithRoundTripper(t *testing.T) {
+	rt := &recordingRoundTripper{}
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL("https://example.com"),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithRoundTripper(rt),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithRetryPolicy(apmproxy.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}),
+	)
+	require.NoError(t, err)
+
+	// Every attempt goes through the transport, with the compressed data.
+	data := `{"metadata":{}}` + "\n" + `{"transaction":{"id":"1"}}`
+	require.NoError(t, apmClient.PostToApmServer(context.Background(), apmproxy.AgentData{Data: []byte(data)}))
+	require.Len(t, rt.requests, 2)
+	for i, req := range rt.requests {
+		assert.Equal(t, "https://example.com/intake/v2/events", req.URL.String())
+		assert.Equal(t, data, rt.bodies[i])
+	}
+	assert.Equal(t, apmproxy.Healthy, apmClient.Status)
+
+	// The requests proxied to the APM server go through the transport too.
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+	hosts, _ := net.LookupHost("localhost")
+	resp, err := http.Get("http://" + hosts[0] + ":1234")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Len(t, rt.requests, 3)
+	assert.Equal(t, "https://example.com/", rt.requests[2].URL.String())
+}
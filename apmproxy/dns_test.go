@@ -0,0 +1,111 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDNSCache(t *testing.T) {
+	now := time.Now()
+	var lookups int
+	var lookupErr error
+	d := newDNSCache(time.Minute)
+	d.now = func() time.Time { return now }
+	d.lookup = func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		return []string{"127.0.0.1"}, lookupErr
+	}
+
+	resolve := func() {
+		addrs, err := d.resolve(context.Background(), "apm.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"127.0.0.1"}, addrs)
+	}
+
+	resolve()
+	resolve()
+	assert.Equal(t, 1, lookups)
+
+	// Expired
+	now = now.Add(2 * time.Minute)
+	resolve()
+	assert.Equal(t, 2, lookups)
+
+	// Invalidated
+	d.invalidate()
+	resolve()
+	assert.Equal(t, 3, lookups)
+
+	// Errors are not cached
+	d.invalidate()
+	lookupErr = errors.New("no such host")
+	_, err := d.resolve(context.Background(), "apm.example.com")
+	assert.Error(t, err)
+	lookupErr = nil
+	resolve()
+	assert.Equal(t, 5, lookups)
+}
+
+func TestDNSCacheClient(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+	_, port, err := net.SplitHostPort(apmServer.Listener.Addr().String())
+	require.NoError(t, err)
+
+	apmClient, err := NewClient(
+		WithURL("http://apm.example.com:"+port),
+		WithDNSCacheTTL(time.Hour),
+		// The grace period of the failed requests outlives the test.
+		WithLogger(zap.NewNop().Sugar()),
+	)
+	require.NoError(t, err)
+	var lookups int
+	apmClient.dnsCache.lookup = func(ctx context.Context, host string) ([]string, error) {
+		assert.Equal(t, "apm.example.com", host)
+		lookups++
+		// The first address is unreachable
+		return []string{"127.0.0.2", "127.0.0.1"}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, apmClient.PostToApmServer(context.Background(), AgentData{Data: []byte(`{"metadata":{}}`)}))
+		apmClient.client.CloseIdleConnections()
+	}
+	assert.Equal(t, 1, lookups)
+
+	// Resolved again after a failure
+	ctx, cancel := context.WithCancel(context.Background())
+	apmClient.UpdateStatus(ctx, Failing)
+	cancel()
+	assert.Eventually(t, func() bool { return !apmClient.IsUnhealthy() }, time.Second, time.Millisecond)
+	require.NoError(t, apmClient.PostToApmServer(context.Background(), AgentData{Data: []byte(`{"metadata":{}}`)}))
+	assert.Equal(t, 2, lookups)
+}
@@ -0,0 +1,123 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+// DropReason is the reason agent data was dropped by the extension.
+type DropReason string
+
+const (
+	// DropBufferFull is agent data received while the buffer was full,
+	// with the drop_newest eviction policy.
+	DropBufferFull DropReason = "buffer_full"
+	// DropEvicted is buffered agent data evicted to make room for the
+	// data received, with the drop_oldest eviction policy.
+	DropEvicted DropReason = "evicted"
+	// DropExpired is agent data buffered for longer than the max age.
+	DropExpired DropReason = "expired"
+	// DropSendFailed is agent data which could not be sent to the APM
+	// server, e.g. while in backoff or when the request failed.
+	DropSendFailed DropReason = "send_failed"
+	// DropRejected is agent data the APM server did not accept.
+	DropRejected DropReason = "rejected"
+	// DropInvocationLimit is agent data received once the limit of
+	// the agent data accepted per invocation was reached.
+	DropInvocationLimit DropReason = "invocation_limit"
+	// DropShutdown is agent data which could neither be sent nor handed
+	// off when the environment shut down.
+	DropShutdown DropReason = "shutdown"
+)
+
+// DropStats is the agent data dropped for a reason.
+type DropStats struct {
+	Payloads int64 `json:"payloads"`
+	// Bytes is the size of the payloads, as buffered.
+	Bytes int64 `json:"bytes"`
+	// Events are the events of the payloads, unless they could not be
+	// decompressed.
+	Events EventCounts `json:"events"`
+}
+
+// DropCounts is the agent data dropped, by reason.
+type DropCounts map[DropReason]DropStats
+
+func (d DropCounts) add(reason DropReason, s DropStats) {
+	stats := d[reason]
+	stats.Payloads += s.Payloads
+	stats.Bytes += s.Bytes
+	stats.Events.Add(s.Events)
+	d[reason] = stats
+}
+
+// dropped records the agent data dropped for the reason.
+func (c *Client) dropped(reason DropReason, agentData AgentData) {
+	stats := DropStats{Payloads: 1, Bytes: int64(len(agentData.Data))}
+	if data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding); err == nil {
+		stats.Events = CountEvents(data)
+	}
+
+	c.dropsMu.Lock()
+	defer c.dropsMu.Unlock()
+	if c.invocationDrops == nil {
+		c.invocationDrops = make(DropCounts)
+	}
+	if c.totalDrops == nil {
+		c.totalDrops = make(DropCounts)
+	}
+	c.invocationDrops.add(reason, stats)
+	c.totalDrops.add(reason, stats)
+}
+
+// ResetDropCounts returns the agent data dropped since the last reset,
+// typically during an invocation, and resets the counts. They are then
+// returned by LastDropCounts until the next reset.
+func (c *Client) ResetDropCounts() DropCounts {
+	c.dropsMu.Lock()
+	defer c.dropsMu.Unlock()
+
+	c.lastDrops = c.invocationDrops
+	c.invocationDrops = nil
+	return c.lastDrops
+}
+
+// LastDropCounts returns the drop counts returned by the last reset.
+func (c *Client) LastDropCounts() DropCounts {
+	c.dropsMu.Lock()
+	defer c.dropsMu.Unlock()
+
+	return c.lastDrops
+}
+
+// DropBuffered drops the agent data and metrics left in the buffers,
+// e.g. once they could neither be sent nor handed off on shutdown, and
+// returns the number of payloads dropped.
+func (c *Client) DropBuffered() int {
+	var n int
+	for {
+		select {
+		case agentData := <-c.DataChannel:
+			c.unbuffered(agentData)
+			c.dropped(DropShutdown, agentData)
+			n++
+		case agentData := <-c.metricsChannel:
+			c.dropped(DropShutdown, agentData)
+			n++
+		default:
+			return n
+		}
+	}
+}
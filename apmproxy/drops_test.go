@@ -0,0 +1,107 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestDropCounts(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusAccepted)
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithAgentDataBufferSize(1),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+
+	transaction := apmproxy.AgentData{Data: []byte(`{"transaction":{"id":"00xxxxFFaaaa1234"}}` + "\n")}
+	span := apmproxy.AgentData{Data: []byte(`{"span":{"id":"00xxxxFFaaaa1234"}}` + "\n")}
+
+	// The buffer holds a single payload.
+	apmClient.EnqueueAPMData(transaction)
+	apmClient.EnqueueAPMData(span)
+	require.NoError(t, apmClient.FlushAPMData(context.Background()))
+
+	// The APM server rejects the data.
+	status.Store(http.StatusBadRequest)
+	require.NoError(t, apmClient.PostToApmServer(context.Background(), transaction))
+
+	drops := apmClient.ResetDropCounts()
+	assert.Equal(t, apmproxy.DropCounts{
+		apmproxy.DropBufferFull: {Payloads: 1, Bytes: int64(len(span.Data)), Events: apmproxy.EventCounts{Spans: 1}},
+		apmproxy.DropRejected:   {Payloads: 1, Bytes: int64(len(transaction.Data)), Events: apmproxy.EventCounts{Transactions: 1}},
+	}, drops)
+	assert.Equal(t, drops, apmClient.LastDropCounts())
+	assert.Empty(t, apmClient.ResetDropCounts())
+
+	// The data left in the buffer on shutdown.
+	apmClient.EnqueueAPMData(transaction)
+	assert.Equal(t, 1, apmClient.DropBuffered())
+	assert.Equal(t, apmproxy.DropCounts{
+		apmproxy.DropShutdown: {Payloads: 1, Bytes: int64(len(transaction.Data)), Events: apmproxy.EventCounts{Transactions: 1}},
+	}, apmClient.ResetDropCounts())
+	assert.Zero(t, apmClient.BufferStats().Bytes)
+
+	// The totals are kept in the state of the client.
+	state := apmClient.State()
+	assert.Equal(t, int64(1), state.DroppedData[apmproxy.DropBufferFull].Payloads)
+	assert.Equal(t, int64(1), state.DroppedData[apmproxy.DropRejected].Payloads)
+	assert.Equal(t, int64(1), state.DroppedData[apmproxy.DropShutdown].Payloads)
+}
+
+func TestDropCountsSendFailed(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	apmServer.Close()
+
+	// The grace period of the failing transport ends after the test,
+	// which must not log anymore.
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithLogger(zap.NewNop().Sugar()),
+	)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	data := apmproxy.AgentData{Data: []byte(`{"error":{"id":"00xxxxFFaaaa1234"}}` + "\n")}
+	require.Error(t, apmClient.PostToApmServer(ctx, data))
+	// The transport is failing, the data is not sent anymore.
+	require.Error(t, apmClient.PostToApmServer(ctx, data))
+
+	assert.Equal(t, apmproxy.DropCounts{
+		apmproxy.DropSendFailed: {Payloads: 2, Bytes: 2 * int64(len(data.Data)), Events: apmproxy.EventCounts{Errors: 2}},
+	}, apmClient.ResetDropCounts())
+}
@@ -0,0 +1,127 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// EventCounts holds the number of events of each type in agent data.
+type EventCounts struct {
+	Transactions int `json:"transactions"`
+	Spans        int `json:"spans"`
+	Errors       int `json:"errors"`
+	Metricsets   int `json:"metricsets"`
+	Other        int `json:"other"`
+	// Invalid is the number of corrupted or truncated lines.
+	Invalid int `json:"invalid"`
+}
+
+// Add adds the counts of o to e.
+func (e *EventCounts) Add(o EventCounts) {
+	e.Transactions += o.Transactions
+	e.Spans += o.Spans
+	e.Errors += o.Errors
+	e.Metricsets += o.Metricsets
+	e.Other += o.Other
+	e.Invalid += o.Invalid
+}
+
+// CountEvents returns the number of events of each type in the
+// uncompressed ndjson data. Metadata is not counted as an event.
+// Corrupted lines are counted as invalid and skipped.
+func CountEvents(data []byte) EventCounts {
+	var counts EventCounts
+	for len(data) > 0 {
+		var line []byte
+		line, data, _ = bytes.Cut(data, []byte("\n"))
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		if !json.Valid(line) {
+			counts.Invalid++
+			continue
+		}
+
+		switch eventType(line) {
+		case "":
+			counts.Invalid++
+		case "metadata":
+		case "transaction":
+			counts.Transactions++
+		case "span":
+			counts.Spans++
+		case "error":
+			counts.Errors++
+		case "metricset":
+			counts.Metricsets++
+		default:
+			counts.Other++
+		}
+	}
+	return counts
+}
+
+// eventType returns the first key of the JSON object in line,
+// without decoding the whole object.
+func eventType(line []byte) string {
+	line = bytes.TrimLeft(line, " \t\r")
+	if len(line) == 0 || line[0] != '{' {
+		return ""
+	}
+
+	line = bytes.TrimLeft(line[1:], " \t\r")
+	if len(line) == 0 || line[0] != '"' {
+		return ""
+	}
+
+	key, _, found := bytes.Cut(line[1:], []byte(`"`))
+	if !found {
+		return ""
+	}
+	return string(key)
+}
+
+// countEvents records the events of agent data forwarded to the APM server.
+func (c *Client) countEvents(agentData AgentData) {
+	data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		c.logger.Debugf("Failed to count forwarded events: %v", err)
+		return
+	}
+
+	counts := CountEvents(data)
+
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+	c.invocationEvents.Add(counts)
+	c.totalEvents.Add(counts)
+}
+
+// ResetEventCounts returns the number of events forwarded to the APM
+// server since the last call and resets the counts.
+func (c *Client) ResetEventCounts() EventCounts {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+
+	counts := c.invocationEvents
+	c.invocationEvents = EventCounts{}
+	return counts
+}
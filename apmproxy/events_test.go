@@ -0,0 +1,132 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestCountEvents(t *testing.T) {
+	data := `{"metadata":{}}
+{"transaction":{}}
+{ "span":{}}
+{"span":{}}
+
+{"error":{}}
+{"metricset":{}}
+{"log":{}}
+not json
+["array"]
+`
+	assert.Equal(t, apmproxy.EventCounts{
+		Transactions: 1,
+		Spans:        2,
+		Errors:       1,
+		Metricsets:   1,
+		Other:        1,
+		Invalid:      2,
+	}, apmproxy.CountEvents([]byte(data)))
+}
+
+func TestCountEventsCorruptedLines(t *testing.T) {
+	data := `{"metadata":{}}
+{"transaction":{"id":"1","name":"trunc
+{"span":{"id":"2"}}
+{"span":{"id":"3"}}}
+{"error":{"id":"4"}}
+{"transac`
+	assert.Equal(t, apmproxy.EventCounts{
+		Spans:   1,
+		Errors:  1,
+		Invalid: 3,
+	}, apmproxy.CountEvents([]byte(data)))
+}
+
+func TestCountEventsEdgeCases(t *testing.T) {
+	for name, tc := range map[string]struct {
+		data     string
+		expected apmproxy.EventCounts
+	}{
+		"empty":            {},
+		"blank lines":      {data: "\n\r\n\n"},
+		"metadata only":    {data: `{"metadata":{}}`},
+		"crlf":             {data: "{\"metadata\":{}}\r\n{\"span\":{}}\r\n", expected: apmproxy.EventCounts{Spans: 1}},
+		"leading newlines": {data: "\n\n{\"metadata\":{}}\n{\"span\":{}}", expected: apmproxy.EventCounts{Spans: 1}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, apmproxy.CountEvents([]byte(tc.data)))
+		})
+	}
+}
+
+func FuzzCountEvents(f *testing.F) {
+	f.Add([]byte("{\"metadata\":{}}\n{\"transaction\":{}}\n{\"span\":{}}\n"))
+	f.Add([]byte("{\"metadata\":{}}\r\n{\"error\":{}}\r\n{\"metricset\":"))
+	f.Add([]byte("\n\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		counts := apmproxy.CountEvents(data)
+
+		// Every non-empty line is counted at most once.
+		lines := 0
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				lines++
+			}
+		}
+		total := counts.Transactions + counts.Spans + counts.Errors + counts.Metricsets + counts.Other + counts.Invalid
+		assert.LessOrEqual(t, total, lines)
+
+		// Line endings and blank lines do not change the counts.
+		crlf := bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+		assert.Equal(t, counts, apmproxy.CountEvents(crlf))
+		padded := append(append([]byte("\n\n"), data...), '\n', '\n')
+		assert.Equal(t, counts, apmproxy.CountEvents(padded))
+	})
+}
+
+func TestResetEventCounts(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+
+	agentData := apmproxy.AgentData{Data: []byte("{\"metadata\":{}}\n{\"span\":{}}\n{\"span\":{}}")}
+	require.NoError(t, apmClient.PostToApmServer(context.Background(), agentData))
+	require.NoError(t, apmClient.PostToApmServer(context.Background(), agentData))
+
+	assert.Equal(t, apmproxy.EventCounts{Spans: 4}, apmClient.ResetEventCounts())
+	assert.Equal(t, apmproxy.EventCounts{}, apmClient.ResetEventCounts())
+	assert.Equal(t, apmproxy.EventCounts{Spans: 4}, apmClient.State().ForwardedEvents)
+}
@@ -0,0 +1,50 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// validateFIPS ensures the data is only forwarded over TLS when the
+// extension is built in FIPS mode. The cipher suites, curves and
+// versions negotiated are restricted to the FIPS approved ones by the
+// build, an unencrypted connection would bypass them altogether.
+func (c *Client) validateFIPS() error {
+	for _, u := range append([]string{c.serverURL}, c.serverURLs...) {
+		if err := requireHTTPS("APM Server", u); err != nil {
+			return err
+		}
+	}
+	if c.handoffURL != "" {
+		return requireHTTPS("shutdown handoff", c.handoffURL)
+	}
+	return nil
+}
+
+func requireHTTPS(name, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("failed to parse the %s URL: %w", name, err)
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("the %s URL must use https in FIPS mode, got %q", name, u.Scheme)
+	}
+	return nil
+}
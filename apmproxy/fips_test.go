@@ -0,0 +1,50 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateFIPS(t *testing.T) {
+	testCases := []struct {
+		name       string
+		serverURL  string
+		handoffURL string
+		valid      bool
+	}{
+		{name: "https", serverURL: "https://example.com:8200", valid: true},
+		{name: "http", serverURL: "http://example.com:8200"},
+		{name: "https handoff", serverURL: "https://example.com", handoffURL: "https://handoff.example.com", valid: true},
+		{name: "http handoff", serverURL: "https://example.com", handoffURL: "http://handoff.example.com"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Client{serverURL: tc.serverURL, handoffURL: tc.handoffURL}
+			err := c.validateFIPS()
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Handoff posts the agent data still buffered, typically because the
+// flush to the APM server could not complete during shutdown, to the
+// handoff URL. The endpoint, e.g. a relay in the VPC, accepts the data
+// in the intake v2 format and is expected to have more time to deliver
+// it. It returns the number of payloads handed off, and is a no-op if
+// no handoff URL is configured.
+func (c *Client) Handoff(ctx context.Context) (int, error) {
+	if c.handoffURL == "" {
+		return 0, nil
+	}
+
+	var handedOff, failed int
+	var lastErr error
+	for {
+		if err := ctx.Err(); err != nil {
+			return handedOff, fmt.Errorf("handoff interrupted: %w", err)
+		}
+		select {
+		case agentData := <-c.DataChannel:
+			c.unbuffered(agentData)
+			if c.expired(agentData) {
+				continue
+			}
+			if err := c.postToHandoff(ctx, agentData); err != nil {
+				c.dropped(DropShutdown, agentData)
+				failed, lastErr = failed+1, err
+				continue
+			}
+			handedOff++
+		default:
+			if lastErr != nil {
+				return handedOff, fmt.Errorf("failed to hand off %d payloads: %w", failed, lastErr)
+			}
+			return handedOff, nil
+		}
+	}
+}
+
+func (c *Client) postToHandoff(ctx context.Context, agentData AgentData) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.handoffURL, bytes.NewReader(agentData.Data))
+	if err != nil {
+		return fmt.Errorf("failed to create handoff request: %w", err)
+	}
+	if agentData.ContentEncoding != "" {
+		req.Header.Add("Content-Encoding", agentData.ContentEncoding)
+	}
+	req.Header.Add("Content-Type", "application/x-ndjson")
+	c.setAuthorizationHeader(req)
+
+	resp, err := c.handoffClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("handoff request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("handoff request failed with status %s", resp.Status)
+	}
+	return nil
+}
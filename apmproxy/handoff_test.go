@@ -0,0 +1,82 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestHandoff(t *testing.T) {
+	var received []string
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/relay", r.URL.Path)
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+		assert.Equal(t, "ApiKey foo", r.Header.Get("Authorization"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		if string(body) == "rejected" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, string(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer relay.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL("https://example.com"),
+		apmproxy.WithAPIKey("foo"),
+		apmproxy.WithHandoffURL(relay.URL+"/relay"),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+
+	apmClient.EnqueueAPMData(apmproxy.AgentData{Data: []byte("first")})
+	apmClient.EnqueueAPMData(apmproxy.AgentData{Data: []byte("rejected")})
+	apmClient.EnqueueAPMData(apmproxy.AgentData{Data: []byte("second")})
+
+	n, err := apmClient.Handoff(context.Background())
+	assert.EqualError(t, err, "failed to hand off 1 payloads: handoff request failed with status 503 Service Unavailable")
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"first", "second"}, received)
+	assert.Empty(t, apmClient.DataChannel)
+}
+
+func TestHandoffDisabled(t *testing.T) {
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL("https://example.com"),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+
+	apmClient.EnqueueAPMData(apmproxy.AgentData{Data: []byte("data")})
+	n, err := apmClient.Handoff(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Len(t, apmClient.DataChannel, 1)
+}
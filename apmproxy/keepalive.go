@@ -0,0 +1,92 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// KeepAlive sends a lightweight HEAD request to the APM Server if no
+// request reached it for longer than the keep-alive interval. It keeps
+// NAT and load balancer mappings alive and updates the transport status
+// before the next flush. It is a no-op if no interval is configured.
+func (c *Client) KeepAlive(ctx context.Context) error {
+	if c.keepAliveInterval <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	last := c.lastContact.Load()
+	if now.Sub(time.Unix(0, last)) < c.keepAliveInterval {
+		return nil
+	}
+
+	// Bound the rate of pings when requests are issued concurrently.
+	if !c.lastContact.CompareAndSwap(last, now.UnixNano()) {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.ServerURL(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create keep-alive request: %w", err)
+	}
+	c.setAuthorizationHeader(req)
+
+	c.logger.Debug("Sending keep-alive request to APM server")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("keep-alive request aborted: %w", ctx.Err())
+		}
+		c.UpdateStatus(ctx, Failing)
+		return fmt.Errorf("keep-alive request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		c.UpdateStatus(ctx, Failing)
+		return fmt.Errorf("keep-alive request failed with status %s", resp.Status)
+	}
+
+	c.UpdateStatus(ctx, Healthy)
+	return nil
+}
+
+// ForwardKeepAlive sends keep-alive requests to the APM Server while no
+// other request reaches it, e.g. between invocations, until the context
+// is canceled. It is a no-op if no keep-alive interval is configured.
+func (c *Client) ForwardKeepAlive(ctx context.Context) {
+	if c.keepAliveInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.KeepAlive(ctx); err != nil {
+				c.logger.Warnf("Keep-alive request to the APM server failed: %v", err)
+			}
+		}
+	}
+}
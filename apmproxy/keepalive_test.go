@@ -0,0 +1,191 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestKeepAlive(t *testing.T) {
+	var pings atomic.Int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			assert.Equal(t, "ApiKey foo", r.Header.Get("Authorization"))
+			pings.Add(1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithAPIKey("foo"),
+		apmproxy.WithKeepAliveInterval(100*time.Millisecond),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	apmClient.UpdateStatus(context.Background(), apmproxy.Started)
+
+	require.NoError(t, apmClient.KeepAlive(context.Background()))
+	assert.Equal(t, int32(1), pings.Load())
+	assert.Equal(t, apmproxy.Healthy, apmClient.Status)
+
+	// Pings are rate limited by the keep-alive interval.
+	require.NoError(t, apmClient.KeepAlive(context.Background()))
+	assert.Equal(t, int32(1), pings.Load())
+
+	time.Sleep(150 * time.Millisecond)
+	require.NoError(t, apmClient.KeepAlive(context.Background()))
+	assert.Equal(t, int32(2), pings.Load())
+}
+
+func TestKeepAliveDisabled(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("unexpected request to APM server")
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.KeepAlive(context.Background()))
+}
+
+func TestKeepAliveServerUnavailable(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithKeepAliveInterval(time.Minute),
+		// The unavailable server starts a grace period that outlives the test.
+		apmproxy.WithLogger(zap.NewNop().Sugar()),
+	)
+	require.NoError(t, err)
+	apmClient.ReconnectionCount = 0
+	apmClient.UpdateStatus(context.Background(), apmproxy.Healthy)
+
+	require.Error(t, apmClient.KeepAlive(context.Background()))
+	assert.Equal(t, apmproxy.Failing, apmClient.Status)
+}
+
+func TestForwardKeepAlive(t *testing.T) {
+	var pings atomic.Int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			pings.Add(1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithKeepAliveInterval(20*time.Millisecond),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		apmClient.ForwardKeepAlive(ctx)
+	}()
+
+	// Pings are sent while idle, without any other request.
+	assert.Eventually(t, func() bool {
+		return pings.Load() >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the keep-alive requests to stop")
+	}
+}
+
+func TestKeepAliveConcurrentPost(t *testing.T) {
+	const posts = 5
+	// Answer the posts of each round at once, for the status updates to overlap.
+	var barrier sync.WaitGroup
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			barrier.Done()
+			barrier.Wait()
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithKeepAliveInterval(time.Nanosecond),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+
+	// Keep-alive requests and posts both set the transport status to
+	// healthy, which must not keep the client locked.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			apmClient.UpdateStatus(context.Background(), apmproxy.RateLimited)
+			barrier.Add(posts)
+			var wg sync.WaitGroup
+			for j := 0; j < posts; j++ {
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					assert.NoError(t, apmClient.KeepAlive(context.Background()))
+				}()
+				go func() {
+					defer wg.Done()
+					assert.NoError(t, apmClient.PostToApmServer(context.Background(), apmproxy.AgentData{Data: []byte(`{}`)}))
+				}()
+			}
+			wg.Wait()
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the requests to the APM server")
+	}
+	assert.False(t, apmClient.IsUnhealthy())
+}
@@ -0,0 +1,74 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import "time"
+
+// AckLatency summarizes the delivery delay of agent data, from its
+// reception by the extension to its acknowledgment by the APM server.
+type AckLatency struct {
+	Count int
+	Sum   time.Duration
+	Max   time.Duration
+}
+
+// Avg returns the average delivery delay.
+func (l AckLatency) Avg() time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	return l.Sum / time.Duration(l.Count)
+}
+
+// observeAckLatency records the delivery delay of agent data
+// acknowledged by the APM server.
+func (c *Client) observeAckLatency(agentData AgentData) {
+	if agentData.receivedAt.IsZero() {
+		return
+	}
+	latency := time.Since(agentData.receivedAt)
+
+	c.latencyMu.Lock()
+	defer c.latencyMu.Unlock()
+
+	c.invocationLatency.Count++
+	c.invocationLatency.Sum += latency
+	if latency > c.invocationLatency.Max {
+		c.invocationLatency.Max = latency
+	}
+}
+
+// ResetAckLatency returns the delivery delay of the agent data acknowledged
+// since the last reset, typically during an invocation, and resets it. It
+// is then returned by LastAckLatency until the next reset.
+func (c *Client) ResetAckLatency() AckLatency {
+	c.latencyMu.Lock()
+	defer c.latencyMu.Unlock()
+
+	c.lastLatency = c.invocationLatency
+	c.invocationLatency = AckLatency{}
+	return c.lastLatency
+}
+
+// LastAckLatency returns the delivery delay returned by the last reset.
+func (c *Client) LastAckLatency() AckLatency {
+	c.latencyMu.Lock()
+	defer c.latencyMu.Unlock()
+
+	return c.lastLatency
+}
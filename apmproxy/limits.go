@@ -0,0 +1,99 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// limitListener accepts at most a fixed number of simultaneous
+// connections, further connections wait for one to be closed.
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func newLimitListener(l net.Listener, n int) *limitListener {
+	return &limitListener{Listener: l, sem: make(chan struct{}, n)}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	l.sem <- struct{}{}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: func() { <-l.sem }}, nil
+}
+
+// limitConn releases its slot of the listener once closed.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// limitConcurrentRequests rejects the requests exceeding the maximum
+// number of requests handled concurrently with a 503, so that agents
+// sending data slowly cannot pile up goroutines and memory.
+func (c *Client) limitConcurrentRequests(next http.HandlerFunc) http.HandlerFunc {
+	if c.receiverMaxRequests <= 0 {
+		return next
+	}
+
+	sem := make(chan struct{}, c.receiverMaxRequests)
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			next(w, r)
+		default:
+			c.logger.Warnf("Rejecting agent request, %d requests are already being handled", c.receiverMaxRequests)
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+}
+
+// reserveInvocationBytes accounts for n bytes of agent data received
+// during the invocation. It returns false, without accounting for them,
+// if they exceed the limit of agent data accepted per invocation.
+func (c *Client) reserveInvocationBytes(n int) bool {
+	received := c.invocationBytes.Add(int64(n))
+	if c.maxInvocationBytes > 0 && received > c.maxInvocationBytes {
+		c.invocationBytes.Add(-int64(n))
+		return false
+	}
+	return true
+}
+
+// ResetInvocationBytes returns the number of bytes of agent data
+// accepted since the last reset, and resets it, so that the limit of
+// agent data accepted per invocation applies to the next invocation.
+func (c *Client) ResetInvocationBytes() int64 {
+	return c.invocationBytes.Swap(0)
+}
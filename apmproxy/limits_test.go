@@ -0,0 +1,104 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ln := newLimitListener(inner, 1)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+	}
+
+	first := <-accepted
+	select {
+	case <-accepted:
+		t.Fatal("Connection accepted over the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Closing a connection, even twice, frees a single slot.
+	require.NoError(t, first.Close())
+	first.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("Connection not accepted after another one was closed")
+	}
+}
+
+func TestLimitConcurrentRequests(t *testing.T) {
+	c := &Client{logger: zaptest.NewLogger(t).Sugar(), receiverMaxRequests: 1}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := c.limitConcurrentRequests(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	first := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		handler(first, httptest.NewRequest(http.MethodPost, "/intake/v2/events", nil))
+		close(done)
+	}()
+	<-started
+
+	rejected := httptest.NewRecorder()
+	handler(rejected, httptest.NewRequest(http.MethodPost, "/intake/v2/events", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rejected.Code)
+	assert.Equal(t, "1", rejected.Header().Get("Retry-After"))
+
+	close(release)
+	<-done
+	assert.Equal(t, http.StatusAccepted, first.Code)
+
+	go func() { <-started }()
+	accepted := httptest.NewRecorder()
+	handler(accepted, httptest.NewRequest(http.MethodPost, "/intake/v2/events", nil))
+	assert.Equal(t, http.StatusAccepted, accepted.Code)
+}
@@ -18,27 +18,268 @@
 package apmproxy
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"compress/zlib"
+	"encoding/json"
 	"fmt"
 	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/elastic/apm-aws-lambda/extension"
 )
 
+// utf8BOM is the byte order mark some agents, such as the .NET agent
+// with its default encoding, write at the start of the agent data.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// MetadataContainer holds the metadata of the agents sending data
+// to the extension. Runtimes can run several agents (e.g. a wrapper
+// and the application), each of them sending its own metadata.
 type MetadataContainer struct {
+	// Metadata is the metadata of the first payload, used as reference
+	// metadata for the data generated by the extension.
 	Metadata []byte
+
+	agents map[string][]byte
+}
+
+// agentMetadata is the subset of the metadata used to tell agents apart.
+type agentMetadata struct {
+	Metadata *struct {
+		Service struct {
+			Name  string `json:"name"`
+			Agent struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"agent"`
+		} `json:"service"`
+		Process struct {
+			Pid int `json:"pid"`
+		} `json:"process"`
+	} `json:"metadata"`
+}
+
+// Add records the metadata of the agent that sent a payload and returns
+// the key identifying the agent and whether the agent was seen for the
+// first time. Payloads not starting with a metadata object are ignored.
+func (mc *MetadataContainer) Add(metadata []byte) (string, bool) {
+	var m agentMetadata
+	if err := json.Unmarshal(metadata, &m); err != nil || m.Metadata == nil {
+		return "", false
+	}
+
+	key := fmt.Sprintf("%s/%s/%s/%d", m.Metadata.Service.Agent.Name, m.Metadata.Service.Agent.Version, m.Metadata.Service.Name, m.Metadata.Process.Pid)
+	if _, ok := mc.agents[key]; ok {
+		return key, false
+	}
+
+	if mc.agents == nil {
+		mc.agents = make(map[string][]byte)
+	}
+	mc.agents[key] = metadata
+
+	return key, true
+}
+
+// Merge merges the metadata sent again by a known agent into its recorded
+// metadata, so that the fields the agent learns late, such as the service
+// version, are picked up. The fields of the newer metadata take precedence:
+// the paths of the fields whose value changed are returned as conflicts.
+// The reference metadata is updated if it is the one of the agent. It
+// returns false if the recorded metadata was unchanged.
+func (mc *MetadataContainer) Merge(key string, metadata []byte) ([]string, bool, error) {
+	recorded, ok := mc.agents[key]
+	if !ok || bytes.Equal(recorded, metadata) {
+		return nil, false, nil
+	}
+
+	var current, newer map[string]interface{}
+	if err := unmarshalJSONNumber(recorded, &current); err != nil {
+		return nil, false, fmt.Errorf("failed to decode recorded metadata: %w", err)
+	}
+	if err := unmarshalJSONNumber(metadata, &newer); err != nil {
+		return nil, false, fmt.Errorf("failed to decode metadata: %w", err)
+	}
+
+	var conflicts []string
+	if !mergeJSONObjects(current, newer, "", &conflicts) {
+		return nil, false, nil
+	}
+	sort.Strings(conflicts)
+	merged, err := json.Marshal(current)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode merged metadata: %w", err)
+	}
+
+	if bytes.Equal(mc.Metadata, recorded) {
+		mc.Metadata = merged
+	}
+	mc.agents[key] = merged
+	return conflicts, true, nil
+}
+
+func unmarshalJSONNumber(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// mergeJSONObjects merges src into dst recursively, and returns whether
+// dst changed. The paths of the values of dst replaced by different
+// values of src are appended to conflicts.
+func mergeJSONObjects(dst, src map[string]interface{}, prefix string, conflicts *[]string) bool {
+	changed := false
+	for k, v := range src {
+		path := prefix + k
+		current, ok := dst[k]
+		if !ok {
+			dst[k] = v
+			changed = true
+			continue
+		}
+		currentObject, currentIsObject := current.(map[string]interface{})
+		object, isObject := v.(map[string]interface{})
+		if currentIsObject && isObject {
+			if mergeJSONObjects(currentObject, object, path+".", conflicts) {
+				changed = true
+			}
+			continue
+		}
+		if !reflect.DeepEqual(current, v) {
+			dst[k] = v
+			*conflicts = append(*conflicts, path)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Agents returns the number of distinct agents that sent data.
+func (mc *MetadataContainer) Agents() int {
+	return len(mc.agents)
+}
+
+// AgentMetadata returns the metadata of the agent identified by key.
+func (mc *MetadataContainer) AgentMetadata(key string) ([]byte, bool) {
+	metadata, ok := mc.agents[key]
+	return metadata, ok
 }
 
 // ProcessMetadata return a byte array containing the Metadata marshaled in JSON
 // In case we want to update the Metadata values, usage of https://github.com/tidwall/sjson is advised
+//
+// The metadata is the first non-empty line of the payload, without surrounding
+// whitespace such as the carriage return of CRLF line endings, and of a UTF-8
+// byte order mark. It returns nil for empty payloads.
+//
+// Only the beginning of compressed payloads is decompressed, up to the end
+// of the metadata, so that their forwarding does not pay for decompressing
+// the events.
 func ProcessMetadata(data AgentData) ([]byte, error) {
-	uncompressedData, err := GetUncompressedBytes(data.Data, data.ContentEncoding)
+	reader, err := newUncompressedReader(data.Data, data.ContentEncoding)
 	if err != nil {
 		return nil, fmt.Errorf("error uncompressing agent data for metadata extraction: %w", err)
 	}
+	defer reader.Close()
+
+	lines := bufio.NewReader(reader)
+	if bom, err := lines.Peek(len(utf8BOM)); err == nil && bytes.Equal(bom, utf8BOM) {
+		_, _ = lines.Discard(len(utf8BOM))
+	}
+	for {
+		line, err := lines.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return line, nil
+		}
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error uncompressing agent data for metadata extraction: %w", err)
+		}
+	}
+}
 
-	before, _, _ := bytes.Cut(uncompressedData, []byte("\n"))
-	return before, nil
+// SetServiceVersion sets the service version added to the metadata of the
+// agent data without one, e.g. derived from the version of the function.
+// The metadata is left unchanged if the version is empty.
+func (c *Client) SetServiceVersion(version string) {
+	c.serviceVersion.Store(&version)
+}
+
+// defaultServiceVersion adds the service version set with SetServiceVersion
+// to the metadata of the agent data, unless the agent set one. The agent
+// data is returned uncompressed if its metadata changed.
+func (c *Client) defaultServiceVersion(agentData AgentData) AgentData {
+	version := c.serviceVersion.Load()
+	if version == nil || *version == "" {
+		return agentData
+	}
+	metadata, err := ProcessMetadata(agentData)
+	if err != nil || eventType(metadata) != "metadata" {
+		return agentData
+	}
+
+	var m map[string]map[string]interface{}
+	if err := unmarshalJSONNumber(metadata, &m); err != nil {
+		return agentData
+	}
+	service, ok := m["metadata"]["service"].(map[string]interface{})
+	if !ok {
+		return agentData
+	}
+	if v, ok := service["version"].(string); ok && v != "" {
+		return agentData
+	}
+	service["version"] = *version
+
+	data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		return agentData
+	}
+	i := bytes.Index(data, metadata)
+	if i < 0 {
+		return agentData
+	}
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(m); err != nil {
+		c.logger.Debugf("Failed to encode the metadata with the default service version: %v", err)
+		return agentData
+	}
+	out.Truncate(out.Len() - 1)
+	out.Write(data[i+len(metadata):])
+
+	agentData.Data = out.Bytes()
+	agentData.ContentEncoding = ""
+	return agentData
+}
+
+// newUncompressedReader returns a reader of the rawBytes decompressed
+// according to encodingType.
+func newUncompressedReader(rawBytes []byte, encodingType string) (io.ReadCloser, error) {
+	switch encodingType {
+	case "deflate":
+		zlibreader, err := zlib.NewReader(bytes.NewReader(rawBytes))
+		if err != nil {
+			return nil, fmt.Errorf("could not create zlib.NewReader: %w", err)
+		}
+		return zlibreader, nil
+	case "gzip":
+		gzipreader, err := gzip.NewReader(bytes.NewReader(rawBytes))
+		if err != nil {
+			return nil, fmt.Errorf("could not create gzip.NewReader: %w", err)
+		}
+		return gzipreader, nil
+	default:
+		return io.NopCloser(bytes.NewReader(rawBytes)), nil
+	}
 }
 
 func GetUncompressedBytes(rawBytes []byte, encodingType string) ([]byte, error) {
@@ -71,3 +312,87 @@ func GetUncompressedBytes(rawBytes []byte, encodingType string) ([]byte, error)
 		return rawBytes, nil
 	}
 }
+
+// SynthesizeMetadata builds the metadata of the function from the
+// environment, as an agent would, for the data generated by the
+// extension before any agent sent its metadata.
+func SynthesizeMetadata() ([]byte, error) {
+	type name struct {
+		Name string `json:"name,omitempty"`
+	}
+	type service struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+		Agent   struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"agent"`
+		Runtime *name `json:"runtime,omitempty"`
+	}
+	type cloud struct {
+		Provider string `json:"provider"`
+		Region   string `json:"region,omitempty"`
+		Service  name   `json:"service"`
+	}
+	var metadata struct {
+		Metadata struct {
+			Service service           `json:"service"`
+			Cloud   cloud             `json:"cloud"`
+			Labels  map[string]string `json:"labels,omitempty"`
+		} `json:"metadata"`
+	}
+
+	s := &metadata.Metadata.Service
+	s.Name = os.Getenv("ELASTIC_APM_SERVICE_NAME")
+	if s.Name == "" {
+		s.Name = os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+	}
+	if s.Name == "" {
+		s.Name = "unknown-aws-lambda-service"
+	}
+	s.Version = os.Getenv("ELASTIC_APM_SERVICE_VERSION")
+	if s.Version == "" {
+		s.Version = os.Getenv("AWS_LAMBDA_FUNCTION_VERSION")
+	}
+	s.Agent.Name = "apm-lambda-extension"
+	s.Agent.Version = extension.Version
+	if runtime := os.Getenv("AWS_EXECUTION_ENV"); runtime != "" {
+		s.Runtime = &name{Name: runtime}
+	}
+
+	region := os.Getenv("AWS_REGION")
+	metadata.Metadata.Cloud = cloud{
+		Provider: "aws",
+		Region:   region,
+		Service:  name{Name: "lambda"},
+	}
+	labels := make(map[string]string)
+	if region != "" {
+		labels["aws_partition"] = AWSPartition(region)
+	}
+	if initType := extension.GetInitializationType(); initType != "" {
+		labels["faas_initialization_type"] = string(initType)
+	}
+	if len(labels) > 0 {
+		metadata.Metadata.Labels = labels
+	}
+
+	return json.Marshal(metadata)
+}
+
+// AWSPartition returns the AWS partition of the region, e.g. aws-cn
+// for the China regions or aws-us-gov for the GovCloud regions.
+func AWSPartition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return "aws-cn"
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	case strings.HasPrefix(region, "us-isob-"):
+		return "aws-iso-b"
+	case strings.HasPrefix(region, "us-iso-"):
+		return "aws-iso"
+	default:
+		return "aws"
+	}
+}
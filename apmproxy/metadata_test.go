@@ -21,10 +21,14 @@ import (
 	"bytes"
 	"compress/gzip"
 	"compress/zlib"
+	"encoding/json"
 	"github.com/elastic/apm-aws-lambda/apmproxy"
 	"io"
+	"os"
+	"strings"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -177,3 +181,256 @@ func BenchmarkProcessMetadata(b *testing.B) {
 		})
 	}
 }
+
+func Test_processMetadataLineEndings(t *testing.T) {
+	metadata := `{"metadata":{"service":{"name":"foo"}}}`
+	event := `{"transaction":{}}`
+
+	for name, body := range map[string]string{
+		"lf":                metadata + "\n" + event + "\n",
+		"crlf":              metadata + "\r\n" + event + "\r\n",
+		"leading newlines":  "\n\r\n" + metadata + "\n" + event,
+		"no trailing line":  metadata + "\n" + event,
+		"metadata only":     metadata,
+		"surrounding space": "  " + metadata + " \n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			extractedMetadata, err := apmproxy.ProcessMetadata(apmproxy.AgentData{Data: []byte(body)})
+			require.NoError(t, err)
+			require.Equal(t, metadata, string(extractedMetadata))
+		})
+	}
+
+	for name, body := range map[string]string{
+		"empty":       "",
+		"blank lines": "\n\r\n \n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			extractedMetadata, err := apmproxy.ProcessMetadata(apmproxy.AgentData{Data: []byte(body)})
+			require.NoError(t, err)
+			require.Nil(t, extractedMetadata)
+		})
+	}
+}
+
+func Test_processMetadataLargeCompressedPayload(t *testing.T) {
+	metadata := `{"metadata":{"service":{"name":"foo"}}}`
+	events := strings.Repeat(`{"span":{"name":"SELECT","duration":1}}`+"\n", 100000)
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		t.Run(encoding, func(t *testing.T) {
+			var b bytes.Buffer
+			var w io.WriteCloser
+			if encoding == "gzip" {
+				w = gzip.NewWriter(&b)
+			} else {
+				w = zlib.NewWriter(&b)
+			}
+			_, err := w.Write([]byte("\n" + metadata + "\r\n" + events))
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+
+			extractedMetadata, err := apmproxy.ProcessMetadata(apmproxy.AgentData{Data: b.Bytes(), ContentEncoding: encoding})
+			require.NoError(t, err)
+			require.Equal(t, metadata, string(extractedMetadata))
+		})
+	}
+}
+
+// gzipMembers compresses each part as a separate gzip member, as
+// agents writing their data in several gzip streams do.
+func gzipMembers(t *testing.T, parts ...string) []byte {
+	var b bytes.Buffer
+	for _, part := range parts {
+		w := gzip.NewWriter(&b)
+		_, err := w.Write([]byte(part))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	}
+	return b.Bytes()
+}
+
+func Test_processMetadataAgentQuirks(t *testing.T) {
+	dotnet, err := os.ReadFile("testdata/dotnet.ndjson")
+	require.NoError(t, err)
+	ruby, err := os.ReadFile("testdata/ruby.ndjson")
+	require.NoError(t, err)
+	rubyMetadata, rubyEvents, _ := strings.Cut(string(ruby), "\n")
+
+	for name, tc := range map[string]struct {
+		data     apmproxy.AgentData
+		expected string
+	}{
+		// The .NET agent writes a byte order mark and CRLF line endings.
+		"dotnet": {
+			data:     apmproxy.AgentData{Data: dotnet},
+			expected: `{"metadata":{"service":{"agent":{"name":"dotnet","version":"1.19.0"}`,
+		},
+		// The Ruby agent streams its data, the metadata can be compressed
+		// separately from the events.
+		"ruby": {
+			data:     apmproxy.AgentData{Data: gzipMembers(t, rubyMetadata+"\n", rubyEvents), ContentEncoding: "gzip"},
+			expected: rubyMetadata,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			extractedMetadata, err := apmproxy.ProcessMetadata(tc.data)
+			require.NoError(t, err)
+			require.True(t, strings.HasPrefix(string(extractedMetadata), tc.expected), string(extractedMetadata))
+			require.True(t, strings.HasSuffix(string(extractedMetadata), "}}"))
+		})
+	}
+}
+
+func FuzzProcessMetadata(f *testing.F) {
+	f.Add([]byte("{\"metadata\":{}}\n{\"span\":{}}\n"))
+	f.Add([]byte("\r\n{\"metadata\":{}}\r\n"))
+	f.Add([]byte(""))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		extractedMetadata, err := apmproxy.ProcessMetadata(apmproxy.AgentData{Data: data})
+		require.NoError(t, err)
+		require.NotContains(t, string(extractedMetadata), "\n")
+		require.Equal(t, string(bytes.TrimSpace(extractedMetadata)), string(extractedMetadata))
+		if len(bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))) > 0 {
+			require.NotEmpty(t, extractedMetadata)
+		}
+	})
+}
+
+func FuzzGetUncompressedBytes(f *testing.F) {
+	f.Add([]byte(`{"metadata":{}}`), "")
+	f.Add([]byte(`{"metadata":{}}`), "gzip")
+	f.Add([]byte(`{"metadata":{}}`), "deflate")
+
+	f.Fuzz(func(t *testing.T, data []byte, encoding string) {
+		// Arbitrary input must not panic.
+		_, _ = apmproxy.GetUncompressedBytes(data, encoding)
+
+		// Compressed data round trips.
+		var b bytes.Buffer
+		var w io.WriteCloser
+		switch encoding {
+		case "gzip":
+			w = gzip.NewWriter(&b)
+		case "deflate":
+			w = zlib.NewWriter(&b)
+		default:
+			return
+		}
+		_, err := w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		uncompressed, err := apmproxy.GetUncompressedBytes(b.Bytes(), encoding)
+		require.NoError(t, err)
+		require.Equal(t, string(data), string(uncompressed))
+	})
+}
+
+func TestMetadataContainerAdd(t *testing.T) {
+	wrapper := []byte(`{"metadata":{"service":{"name":"svc","agent":{"name":"nodejs","version":"3.14.0"}},"process":{"pid":1}}}`)
+	app := []byte(`{"metadata":{"service":{"name":"svc","agent":{"name":"python","version":"6.12.0"}},"process":{"pid":2}}}`)
+
+	mc := apmproxy.MetadataContainer{}
+
+	key, added := mc.Add(wrapper)
+	require.True(t, added)
+
+	_, added = mc.Add(wrapper)
+	require.False(t, added)
+
+	appKey, added := mc.Add(app)
+	require.True(t, added)
+	require.NotEqual(t, key, appKey)
+
+	require.Equal(t, 2, mc.Agents())
+
+	metadata, ok := mc.AgentMetadata(appKey)
+	require.True(t, ok)
+	require.Equal(t, app, metadata)
+
+	// Payloads without metadata are ignored.
+	_, added = mc.Add([]byte(`{"metricset":{"samples":{}}}`))
+	require.False(t, added)
+	require.Equal(t, 2, mc.Agents())
+}
+
+func TestMetadataContainerMerge(t *testing.T) {
+	first := []byte(`{"metadata":{"service":{"name":"svc","agent":{"name":"nodejs","version":"3.14.0"},"environment":"dev"},"process":{"pid":1}}}`)
+	other := []byte(`{"metadata":{"service":{"name":"svc","agent":{"name":"python","version":"6.12.0"}},"process":{"pid":2}}}`)
+
+	mc := apmproxy.MetadataContainer{Metadata: first}
+	key, _ := mc.Add(first)
+	otherKey, _ := mc.Add(other)
+
+	// The same metadata is left as is.
+	_, merged, err := mc.Merge(key, first)
+	require.NoError(t, err)
+	assert.False(t, merged)
+
+	// Fields learned late are merged.
+	conflicts, merged, err := mc.Merge(key, []byte(`{"metadata":{"service":{"name":"svc","agent":{"name":"nodejs","version":"3.14.0"},"version":"1.2.3"},"process":{"pid":1}}}`))
+	require.NoError(t, err)
+	assert.True(t, merged)
+	assert.Empty(t, conflicts)
+	assert.JSONEq(t, `{"metadata":{"service":{"name":"svc","agent":{"name":"nodejs","version":"3.14.0"},"environment":"dev","version":"1.2.3"},"process":{"pid":1}}}`, string(mc.Metadata))
+
+	// Changed fields take the new values.
+	conflicts, merged, err = mc.Merge(key, []byte(`{"metadata":{"service":{"environment":"prod","version":"1.2.4"}}}`))
+	require.NoError(t, err)
+	assert.True(t, merged)
+	assert.Equal(t, []string{"metadata.service.environment", "metadata.service.version"}, conflicts)
+	metadata, _ := mc.AgentMetadata(key)
+	assert.JSONEq(t, `{"metadata":{"service":{"name":"svc","agent":{"name":"nodejs","version":"3.14.0"},"environment":"prod","version":"1.2.4"},"process":{"pid":1}}}`, string(metadata))
+	assert.Equal(t, metadata, mc.Metadata)
+
+	// The reference metadata is only updated by the agent it comes from.
+	_, merged, err = mc.Merge(otherKey, []byte(`{"metadata":{"service":{"version":"9.9.9"}}}`))
+	require.NoError(t, err)
+	assert.True(t, merged)
+	assert.Equal(t, metadata, mc.Metadata)
+
+	_, merged, err = mc.Merge("unknown", first)
+	require.NoError(t, err)
+	assert.False(t, merged)
+}
+
+func TestSynthesizeMetadataPartition(t *testing.T) {
+	testCases := map[string]string{
+		"us-east-1":      "aws",
+		"eu-central-1":   "aws",
+		"cn-north-1":     "aws-cn",
+		"us-gov-west-1":  "aws-us-gov",
+		"us-iso-east-1":  "aws-iso",
+		"us-isob-east-1": "aws-iso-b",
+	}
+
+	for region, partition := range testCases {
+		t.Run(region, func(t *testing.T) {
+			t.Setenv("AWS_REGION", region)
+			t.Setenv("AWS_LAMBDA_INITIALIZATION_TYPE", "on-demand")
+			assert.Equal(t, partition, apmproxy.AWSPartition(region))
+
+			metadata, err := apmproxy.SynthesizeMetadata()
+			require.NoError(t, err)
+
+			var m struct {
+				Metadata struct {
+					Cloud struct {
+						Region  string `json:"region"`
+						Service struct {
+							Name string `json:"name"`
+						} `json:"service"`
+					} `json:"cloud"`
+					Labels map[string]string `json:"labels"`
+				} `json:"metadata"`
+			}
+			require.NoError(t, json.Unmarshal(metadata, &m))
+			assert.Equal(t, region, m.Metadata.Cloud.Region)
+			assert.Equal(t, "lambda", m.Metadata.Cloud.Service.Name)
+			assert.Equal(t, partition, m.Metadata.Labels["aws_partition"])
+			assert.Equal(t, "on-demand", m.Metadata.Labels["faas_initialization_type"])
+		})
+	}
+}
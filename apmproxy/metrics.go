@@ -0,0 +1,184 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MetricsPipeline configures the pipeline sending the metrics generated
+// by the extension, e.g. the metrics derived from the platform logs,
+// independently of the agent data, so that heavy agent traffic can
+// neither delay nor evict them, and vice versa.
+type MetricsPipeline struct {
+	// BufferSize is the number of metricsets buffered. When the buffer
+	// is full, the oldest metricsets are evicted.
+	BufferSize int
+	// FlushInterval is the interval at which the buffered metricsets are
+	// sent while the function is running, see ForwardMetricsData. Zero
+	// sends them on flushes only, see FlushMetricsData.
+	FlushInterval time.Duration
+	// MaxBatchSize is the maximum number of metricsets sent in a single
+	// request to the APM server. Zero does not limit the batches.
+	MaxBatchSize int
+}
+
+// EnqueueMetricsData queues the metrics generated by the extension for
+// a send to the APM server. They are queued with the agent data unless
+// a metrics pipeline is configured, see WithMetricsPipeline.
+func (c *Client) EnqueueMetricsData(agentData AgentData) {
+	if c.metricsChannel == nil {
+		c.EnqueueAPMData(agentData)
+		return
+	}
+
+	for {
+		select {
+		case c.metricsChannel <- agentData:
+			c.logger.Debug("Adding metrics to buffer to be sent to apm server")
+			return
+		default:
+		}
+
+		select {
+		case evicted := <-c.metricsChannel:
+			c.logger.Warn("Metrics channel full: dropping the oldest buffered metrics")
+			c.dropped(DropEvicted, evicted)
+		default:
+		}
+	}
+}
+
+// ForwardMetricsData sends the buffered metrics to the APM server at the
+// flush interval of the metrics pipeline, until the function invocation
+// has completed, signaled via the done channel, on which the metrics
+// still buffered are sent one last time. It is a no-op if no metrics
+// pipeline or flush interval is configured.
+func (c *Client) ForwardMetricsData(ctx context.Context, done <-chan struct{}) {
+	if c.metricsChannel == nil || c.metricsPipeline.FlushInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.metricsPipeline.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			if err := c.FlushMetricsData(ctx); err != nil {
+				c.logger.Debugf("Metrics not sent: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := c.FlushMetricsData(ctx); err != nil {
+				c.logger.Debugf("Metrics not sent: %v", err)
+			}
+		}
+	}
+}
+
+// FlushMetricsData sends all the buffered metrics to the APM server, in
+// batches of the metricsets sharing the same metadata. It is a no-op if
+// no metrics pipeline is configured, the metrics being flushed with the
+// agent data.
+func (c *Client) FlushMetricsData(ctx context.Context) error {
+	if c.metricsChannel == nil {
+		return nil
+	}
+	if c.IsUnhealthy() {
+		return errors.New("metrics flush skipped: transport status is unhealthy")
+	}
+	if c.Paused() {
+		return errors.New("metrics flush skipped: forwarding is paused")
+	}
+
+	var pending []AgentData
+drain:
+	for len(pending) < cap(c.metricsChannel) {
+		select {
+		case agentData := <-c.metricsChannel:
+			pending = append(pending, agentData)
+		default:
+			break drain
+		}
+	}
+
+	var failed int
+	var lastErr error
+	batches := batchMetrics(pending, c.metricsPipeline.MaxBatchSize)
+	for i, batch := range batches {
+		if err := ctx.Err(); err != nil {
+			c.requeueMetrics(batches[i:])
+			return fmt.Errorf("metrics flush interrupted: %w", err)
+		}
+		if err := c.PostToApmServer(ctx, batch); err != nil {
+			failed, lastErr = failed+1, err
+		}
+	}
+	if lastErr != nil {
+		return fmt.Errorf("failed to send %d batches of metrics: %w", failed, lastErr)
+	}
+	return nil
+}
+
+// requeueMetrics buffers again the metrics drained by an interrupted
+// flush, for the next flush to send them. The metrics which no longer
+// fit in the buffer are spilled to disk, or dropped.
+func (c *Client) requeueMetrics(batches []AgentData) {
+	for _, batch := range batches {
+		select {
+		case c.metricsChannel <- batch:
+			continue
+		default:
+		}
+		if !c.spillData(batch) {
+			c.dropped(DropBufferFull, batch)
+		}
+	}
+}
+
+// batchMetrics merges the consecutive uncompressed payloads starting with
+// the same metadata line, up to maxSize payloads per batch if positive.
+func batchMetrics(payloads []AgentData, maxSize int) []AgentData {
+	var batches []AgentData
+	var metadata []byte
+	var size int
+	for _, p := range payloads {
+		i := bytes.IndexByte(p.Data, '\n')
+		if p.ContentEncoding != "" || i < 0 {
+			batches, metadata = append(batches, p), nil
+			continue
+		}
+		if metadata == nil || !bytes.Equal(metadata, p.Data[:i]) || (maxSize > 0 && size >= maxSize) {
+			batches = append(batches, AgentData{Data: append([]byte{}, p.Data...)})
+			metadata, size = p.Data[:i], 1
+			continue
+		}
+		last := &batches[len(batches)-1]
+		if !bytes.HasSuffix(last.Data, []byte("\n")) {
+			last.Data = append(last.Data, '\n')
+		}
+		last.Data = append(last.Data, p.Data[i+1:]...)
+		size++
+	}
+	return batches
+}
@@ -0,0 +1,175 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func newMetricsServer(t *testing.T) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(gr)
+		require.NoError(t, err)
+		mu.Lock()
+		received = append(received, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, received...)
+	}
+}
+
+func metricset(metadata, name string) apmproxy.AgentData {
+	return apmproxy.AgentData{Data: []byte(metadata + "\n" + `{"metricset":{"tags":{"name":"` + name + `"}}}`)}
+}
+
+func TestMetricsPipeline(t *testing.T) {
+	server, received := newMetricsServer(t)
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(server.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithMetricsPipeline(apmproxy.MetricsPipeline{BufferSize: 3, MaxBatchSize: 2}),
+	)
+	require.NoError(t, err)
+
+	const metadata1, metadata2 = `{"metadata":{"service":{"name":"1"}}}`, `{"metadata":{"service":{"name":"2"}}}`
+	for _, m := range []apmproxy.AgentData{
+		metricset(metadata1, "a"),
+		metricset(metadata1, "b"),
+		metricset(metadata1, "c"),
+		metricset(metadata1, "d"),
+		metricset(metadata2, "e"),
+	} {
+		apmClient.EnqueueMetricsData(m)
+	}
+	// The metrics are not buffered with the agent data.
+	assert.Equal(t, 0, apmClient.BufferStats().Depth)
+	assert.Equal(t, int64(2), apmClient.ResetDropCounts()[apmproxy.DropEvicted].Payloads)
+
+	require.NoError(t, apmClient.FlushMetricsData(context.Background()))
+	assert.Equal(t, []string{
+		metadata1 + "\n" + `{"metricset":{"tags":{"name":"c"}}}` + "\n" + `{"metricset":{"tags":{"name":"d"}}}`,
+		metadata2 + "\n" + `{"metricset":{"tags":{"name":"e"}}}`,
+	}, received())
+}
+
+func TestMetricsPipelineFlushInterval(t *testing.T) {
+	server, received := newMetricsServer(t)
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(server.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithMetricsPipeline(apmproxy.MetricsPipeline{FlushInterval: 10 * time.Millisecond}),
+	)
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		apmClient.ForwardMetricsData(context.Background(), done)
+		close(stopped)
+	}()
+	apmClient.EnqueueMetricsData(metricset(`{"metadata":{}}`, "a"))
+	assert.Eventually(t, func() bool {
+		return len(received()) == 1
+	}, time.Second, 10*time.Millisecond)
+	close(done)
+	<-stopped
+}
+
+func TestMetricsPipelineFinalFlush(t *testing.T) {
+	server, received := newMetricsServer(t)
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(server.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithMetricsPipeline(apmproxy.MetricsPipeline{FlushInterval: time.Hour}),
+	)
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		apmClient.ForwardMetricsData(context.Background(), done)
+		close(stopped)
+	}()
+	apmClient.EnqueueMetricsData(metricset(`{"metadata":{}}`, "a"))
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the metrics forwarder to stop")
+	}
+	// The metrics buffered at the end of the invocation are sent.
+	assert.Len(t, received(), 1)
+}
+
+func TestMetricsPipelineFlushInterrupted(t *testing.T) {
+	server, received := newMetricsServer(t)
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(server.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithMetricsPipeline(apmproxy.MetricsPipeline{BufferSize: 2}),
+	)
+	require.NoError(t, err)
+
+	apmClient.EnqueueMetricsData(metricset(`{"metadata":{"service":{"name":"1"}}}`, "a"))
+	apmClient.EnqueueMetricsData(metricset(`{"metadata":{"service":{"name":"2"}}}`, "b"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, apmClient.FlushMetricsData(ctx))
+	assert.Empty(t, received())
+	assert.Empty(t, apmClient.ResetDropCounts())
+
+	// The metrics drained by the interrupted flush are sent by the next one.
+	require.NoError(t, apmClient.FlushMetricsData(context.Background()))
+	assert.Len(t, received(), 2)
+}
+
+func TestMetricsWithoutPipeline(t *testing.T) {
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL("https://example.com"),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+
+	apmClient.EnqueueMetricsData(metricset(`{"metadata":{}}`, "a"))
+	assert.Equal(t, 1, apmClient.BufferStats().Depth)
+	require.NoError(t, apmClient.FlushMetricsData(context.Background()))
+	assert.Equal(t, 1, apmClient.BufferStats().Depth)
+}
@@ -0,0 +1,78 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ipv4Dialer has the same settings as the dialer of http.DefaultTransport.
+var ipv4Dialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// dialIPv4 only connects to the IPv4 addresses of the host, regardless
+// of the network requested by the transport.
+func dialIPv4(ctx context.Context, _, addr string) (net.Conn, error) {
+	return ipv4Dialer.DialContext(ctx, "tcp4", addr)
+}
+
+// network returns the network of the receiver. By default, the receiver
+// binds both the IPv4 and IPv6 addresses in dual-stack environments.
+func (c *Client) network() string {
+	if c.forceIPv4 {
+		return "tcp4"
+	}
+	return "tcp"
+}
+
+// dialContext returns the function dialing the connections to the APM
+// server, using the DNS cache if enabled.
+func (c *Client) dialContext() dialFunc {
+	dial := http.DefaultTransport.(*http.Transport).DialContext
+	if c.forceIPv4 {
+		dial = dialIPv4
+	}
+	if c.dnsCache != nil {
+		dial = c.dnsCache.dialer(dial)
+	}
+	return dial
+}
+
+// newServerTransport returns a transport for connections to the APM server.
+func (c *Client) newServerTransport() *http.Transport {
+	transport := c.newTransport()
+	transport.DialContext = c.dialContext()
+	transport.TLSClientConfig = c.tlsConfig()
+	return transport
+}
+
+// newTransport returns a transport for outbound connections. The default
+// dialer resolves both A and AAAA records and races the connections
+// (Happy Eyeballs), unless IPv4 is forced.
+func (c *Client) newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.forceIPv4 {
+		transport.DialContext = dialIPv4
+	}
+	return transport
+}
@@ -0,0 +1,117 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+func skipWithoutIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback is not available")
+	}
+	ln.Close()
+}
+
+func TestReceiverDualStack(t *testing.T) {
+	skipWithoutIPv6(t)
+
+	testCases := map[string]struct {
+		opts         []apmproxy.Option
+		expectedIPv6 bool
+	}{
+		"dual-stack": {expectedIPv6: true},
+		"force ipv4": {opts: []apmproxy.Option{apmproxy.WithForceIPv4()}},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer apmServer.Close()
+
+			apmClient, err := apmproxy.NewClient(append([]apmproxy.Option{
+				apmproxy.WithURL(apmServer.URL),
+				apmproxy.WithReceiverAddress(":1234"),
+				apmproxy.WithReceiverTimeout(15 * time.Second),
+				apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+			}, tc.opts...)...)
+			require.NoError(t, err)
+
+			require.NoError(t, apmClient.StartReceiver())
+			defer func() {
+				require.NoError(t, apmClient.Shutdown())
+			}()
+
+			resp, err := http.Get("http://127.0.0.1:1234")
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			resp, err = http.Get("http://[::1]:1234")
+			if tc.expectedIPv6 {
+				require.NoError(t, err)
+				resp.Body.Close()
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestForwarderForceIPv4(t *testing.T) {
+	skipWithoutIPv6(t)
+
+	apmServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	apmServer.Listener = ln
+	apmServer.Start()
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		// The unreachable address starts a grace period that outlives the test.
+		apmproxy.WithLogger(zap.NewNop().Sugar()),
+	)
+	require.NoError(t, err)
+	assert.NoError(t, apmClient.PostToApmServer(context.Background(), apmproxy.AgentData{Data: []byte(`{"metadata":{}}`)}))
+
+	apmClient, err = apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithForceIPv4(),
+		apmproxy.WithLogger(zap.NewNop().Sugar()),
+	)
+	require.NoError(t, err)
+	assert.Error(t, apmClient.PostToApmServer(context.Background(), apmproxy.AgentData{Data: []byte(`{"metadata":{}}`)}))
+}
@@ -18,6 +18,7 @@
 package apmproxy
 
 import (
+	"net/http"
 	"time"
 
 	"go.uber.org/zap"
@@ -37,9 +38,35 @@ func WithSecretToken(secret string) Option {
 	}
 }
 
+// WithAuthProvider sets the provider of the Authorization header of the
+// requests to the APM server. It takes precedence over the API key and
+// the secret token.
+func WithAuthProvider(provider AuthProvider) Option {
+	return func(c *Client) {
+		c.auth = provider
+	}
+}
+
 func WithURL(url string) Option {
 	return func(c *Client) {
 		c.serverURL = url
+		c.serverURLs = nil
+	}
+}
+
+// WithURLs sets the URLs of several APM servers, e.g. regional clusters.
+// The data is sent to the first one until ProbeServers selects the
+// fastest.
+func WithURLs(urls ...string) Option {
+	return func(c *Client) {
+		c.serverURL = ""
+		c.serverURLs = nil
+		if len(urls) > 0 {
+			c.serverURL = urls[0]
+		}
+		if len(urls) > 1 {
+			c.serverURLs = append([]string(nil), urls...)
+		}
 	}
 }
 
@@ -71,6 +98,32 @@ func WithSendStrategy(strategy SendStrategy) Option {
 	}
 }
 
+// WithReceiverMaxConnections limits the number of simultaneous connections
+// to the receiver. Further connections wait for one to be closed.
+func WithReceiverMaxConnections(n int) Option {
+	return func(c *Client) {
+		c.receiverMaxConns = n
+	}
+}
+
+// WithReceiverMaxConcurrentRequests limits the number of intake requests
+// handled concurrently by the receiver. Further requests are rejected
+// with a 503 status.
+func WithReceiverMaxConcurrentRequests(n int) Option {
+	return func(c *Client) {
+		c.receiverMaxRequests = n
+	}
+}
+
+// WithMaxInvocationBytes limits the size of the agent data, as received,
+// accepted per invocation. Further requests are rejected with a 413
+// status until ResetInvocationBytes is called.
+func WithMaxInvocationBytes(n int64) Option {
+	return func(c *Client) {
+		c.maxInvocationBytes = n
+	}
+}
+
 // WithAgentDataBufferSize sets the agent data buffer size.
 func WithAgentDataBufferSize(size int) Option {
 	return func(c *Client) {
@@ -78,8 +131,226 @@ func WithAgentDataBufferSize(size int) Option {
 	}
 }
 
+// WithAgentDataBufferBytes sets the maximum size in bytes of the agent
+// data buffer, as the agent data is sent to the APM server. Agent data
+// exceeding it is dropped or evicts the oldest data, like when the
+// buffer is full. There is no limit if zero.
+func WithAgentDataBufferBytes(maxBytes int64) Option {
+	return func(c *Client) {
+		c.bufferMaxBytes = maxBytes
+	}
+}
+
+// WithShipThreshold sets the fill ratio of the agent data buffer, within
+// (0, 1], from which the buffer is flushed at the end of the invocation
+// whatever the send strategy. It defaults to 0.9.
+func WithShipThreshold(ratio float64) Option {
+	return func(c *Client) {
+		c.shipThreshold = ratio
+	}
+}
+
+// WithStateEndpoint exposes the internal state of the client as JSON
+// on the /debug/state endpoint of the receiver. It is meant for tests
+// asserting on what would be shipped and should not be used in production.
+func WithStateEndpoint() Option {
+	return func(c *Client) {
+		c.stateEndpoint = true
+	}
+}
+
+// WithStateComponent adds the state of another component of the
+// extension to the state of the client, under name, e.g. the
+// invocations in flight. It is only exposed with WithStateEndpoint.
+func WithStateComponent(name string, state func() interface{}) Option {
+	return func(c *Client) {
+		if c.stateComponents == nil {
+			c.stateComponents = make(map[string]func() interface{})
+		}
+		c.stateComponents[name] = state
+	}
+}
+
+// WithKeepAliveInterval sets the minimum time without requests to the
+// APM Server after which a keep-alive request is sent. Zero disables
+// keep-alive requests.
+func WithKeepAliveInterval(interval time.Duration) Option {
+	return func(c *Client) {
+		c.keepAliveInterval = interval
+	}
+}
+
+// WithRetryPolicy retries the requests sending agent data to the APM
+// server on transient failures according to policy. Requests are not
+// retried by default.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *Client) {
+		c.retryPolicy = policy
+	}
+}
+
+// WithMetricsPipeline sends the metrics generated by the extension
+// on a pipeline of their own, configured by pipeline, rather than
+// with the agent data.
+func WithMetricsPipeline(pipeline MetricsPipeline) Option {
+	return func(c *Client) {
+		if pipeline.BufferSize <= 0 {
+			pipeline.BufferSize = defaultAgentBufferSize
+		}
+		c.metricsPipeline = pipeline
+		c.metricsChannel = make(chan AgentData, pipeline.BufferSize)
+	}
+}
+
+// WithCompressedBuffer compresses agent data before buffering it,
+// trading CPU for memory. The compressed data is sent as is.
+func WithCompressedBuffer() Option {
+	return func(c *Client) {
+		c.compressBuffer = true
+	}
+}
+
+// WithStrictIntakeValidation validates agent data when it is received.
+// Invalid events are dropped and reported to the agent in the response,
+// instead of being rejected by the APM Server.
+func WithStrictIntakeValidation() Option {
+	return func(c *Client) {
+		c.strictIntakeValidation = true
+	}
+}
+
+// WithTransformations applies the transformations, parsed with
+// ParseTransformations, to the agent events when they are received.
+func WithTransformations(transformations []Transformation) Option {
+	return func(c *Client) {
+		c.transformations = transformations
+	}
+}
+
+// WithStatusComponent adds the status of another component
+// of the extension to the /status endpoint, under name.
+func WithStatusComponent(name string, status func() interface{}) Option {
+	return func(c *Client) {
+		if c.statusComponents == nil {
+			c.statusComponents = make(map[string]func() interface{})
+		}
+		c.statusComponents[name] = status
+	}
+}
+
 func WithLogger(logger *zap.SugaredLogger) Option {
 	return func(c *Client) {
 		c.logger = logger
 	}
 }
+
+// WithServerless sets the client up for the managed intake of
+// Elastic serverless projects, which requires API key authentication.
+func WithServerless() Option {
+	return func(c *Client) {
+		c.serverless = true
+	}
+}
+
+// WithEvictionPolicy sets the data dropped when the agent data buffer is full.
+func WithEvictionPolicy(policy EvictionPolicy) Option {
+	return func(c *Client) {
+		c.evictionPolicy = policy
+	}
+}
+
+// WithHandoffURL sets the URL the agent data still buffered
+// at shutdown is handed off to, see Client.Handoff.
+func WithHandoffURL(url string) Option {
+	return func(c *Client) {
+		c.handoffURL = url
+	}
+}
+
+// WithSpill enables the spilling to dir of the agent data which could
+// not be sent to the APM server, up to maxBytes, see Client.ReplaySpilled.
+func WithSpill(dir string, maxBytes int64) Option {
+	return func(c *Client) {
+		c.spill = &spill{dir: dir, maxBytes: maxBytes}
+	}
+}
+
+// WithRoundTripper sets the transport of the requests to the APM server,
+// e.g. to record or instrument them. The requests are compressed, signed
+// and retried by the client, each attempt going through the transport.
+// Setting the TLS server name, forcing IPv4 or caching DNS requires the
+// transport to be an *http.Transport, which is then modified.
+func WithRoundTripper(rt http.RoundTripper) Option {
+	return func(c *Client) {
+		c.roundTripper = rt
+	}
+}
+
+// WithTLSServerName sets the server name used for SNI and to verify the
+// certificate of the APM server, for when it differs from the host of
+// the URL, e.g. behind a shared load balancer or a private link.
+func WithTLSServerName(name string) Option {
+	return func(c *Client) {
+		c.tlsServerName = name
+	}
+}
+
+// WithForceIPv4 restricts the receiver and the connections to the APM
+// server to IPv4, for networks where IPv6 is advertised but not routed.
+func WithForceIPv4() Option {
+	return func(c *Client) {
+		c.forceIPv4 = true
+	}
+}
+
+// WithDNSCacheTTL caches the addresses of the APM server for the given
+// duration across invocations. The addresses are resolved again after
+// sending to the APM server failed.
+func WithDNSCacheTTL(ttl time.Duration) Option {
+	return func(c *Client) {
+		c.dnsCacheTTL = ttl
+	}
+}
+
+// WithSigV4 signs the requests to the APM server with AWS Signature
+// Version 4 instead of sending the API key or secret token.
+func WithSigV4(sigV4 SigV4) Option {
+	return func(c *Client) {
+		c.sigV4 = &sigV4
+	}
+}
+
+// WithMaxDataAge discards the agent data buffered for longer than
+// the given duration instead of sending it.
+func WithMaxDataAge(age time.Duration) Option {
+	return func(c *Client) {
+		c.maxDataAge = age
+	}
+}
+
+// WithOTLPReceiver receives the data of OpenTelemetry SDKs on the OTLP/HTTP
+// endpoints of the receiver, /v1/traces, /v1/metrics and /v1/logs.
+func WithOTLPReceiver() Option {
+	return func(c *Client) {
+		c.otlpReceiver = true
+	}
+}
+
+// WithPressureHeaders sets the X-Elastic-Extension-Queue-Depth and
+// X-Elastic-Extension-Degraded headers on the responses to the agent
+// data, so that agents can adapt the data they send to the state of the
+// extension.
+func WithPressureHeaders() Option {
+	return func(c *Client) {
+		c.pressureHeaders = true
+	}
+}
+
+// WithTailSampling holds the agent data received during an invocation
+// until the end of the invocation, and only sends the transactions and
+// spans of the invocations sampled by the policy.
+func WithTailSampling(policy TailSamplingPolicy) Option {
+	return func(c *Client) {
+		c.tailSampler = &tailSampler{policy: policy}
+	}
+}
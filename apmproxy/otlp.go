@@ -0,0 +1,594 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// otlpPaths are the paths of the OTLP/HTTP endpoints of the receiver.
+var otlpPaths = []string{"/v1/traces", "/v1/metrics", "/v1/logs"}
+
+// otlpSpanKinds are the names of the OTLP span kinds, by value.
+var otlpSpanKinds = []string{"UNSPECIFIED", "INTERNAL", "SERVER", "CLIENT", "PRODUCER", "CONSUMER"}
+
+// otlpInt64 is a 64-bit integer of OTLP/JSON, encoded as a string or a number.
+type otlpInt64 int64
+
+func (i *otlpInt64) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		return nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		u, uerr := strconv.ParseUint(s, 10, 64)
+		if uerr != nil {
+			return fmt.Errorf("invalid integer %s: %w", data, err)
+		}
+		n = int64(u)
+	}
+	*i = otlpInt64(n)
+	return nil
+}
+
+// otlpSpanKind is the kind of a span of OTLP/JSON, encoded as a number
+// or as the name of the enum value.
+type otlpSpanKind int
+
+func (k *otlpSpanKind) UnmarshalJSON(data []byte) error {
+	if s, err := strconv.Unquote(string(data)); err == nil {
+		name := strings.TrimPrefix(s, "SPAN_KIND_")
+		for v, n := range otlpSpanKinds {
+			if n == name {
+				*k = otlpSpanKind(v)
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid span kind %s", data)
+	}
+	var v int
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Errorf("invalid span kind %s: %w", data, err)
+	}
+	*k = otlpSpanKind(v)
+	return nil
+}
+
+func (k otlpSpanKind) String() string {
+	if k < 0 || int(k) >= len(otlpSpanKinds) {
+		return otlpSpanKinds[0]
+	}
+	return otlpSpanKinds[k]
+}
+
+type otlpAnyValue struct {
+	StringValue *string    `json:"stringValue"`
+	BoolValue   *bool      `json:"boolValue"`
+	IntValue    *otlpInt64 `json:"intValue"`
+	DoubleValue *float64   `json:"doubleValue"`
+	ArrayValue  *struct {
+		Values []otlpAnyValue `json:"values"`
+	} `json:"arrayValue"`
+}
+
+// value returns the scalar or array value, or nil for other values.
+func (v otlpAnyValue) value() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.ArrayValue != nil:
+		values := make([]interface{}, 0, len(v.ArrayValue.Values))
+		for _, e := range v.ArrayValue.Values {
+			if ev := e.value(); ev != nil {
+				values = append(values, ev)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+type otlpAttributes []struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// values returns the attributes with a scalar or array value.
+func (a otlpAttributes) values() map[string]interface{} {
+	if len(a) == 0 {
+		return nil
+	}
+	values := make(map[string]interface{}, len(a))
+	for _, kv := range a {
+		if v := kv.Value.value(); v != nil {
+			values[kv.Key] = v
+		}
+	}
+	return values
+}
+
+type otlpResource struct {
+	Attributes otlpAttributes `json:"attributes"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId"`
+	Name              string         `json:"name"`
+	Kind              otlpSpanKind   `json:"kind"`
+	StartTimeUnixNano otlpInt64      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   otlpInt64      `json:"endTimeUnixNano"`
+	Attributes        otlpAttributes `json:"attributes"`
+	Status            struct {
+		Code otlpStatusCode `json:"code"`
+	} `json:"status"`
+}
+
+// otlpStatusCode is the status code of a span of OTLP/JSON, encoded as
+// a number or as the name of the enum value.
+type otlpStatusCode int
+
+func (c *otlpStatusCode) UnmarshalJSON(data []byte) error {
+	switch s, _ := strconv.Unquote(string(data)); s {
+	case "STATUS_CODE_UNSET":
+		*c = 0
+	case "STATUS_CODE_OK":
+		*c = 1
+	case "STATUS_CODE_ERROR":
+		*c = 2
+	default:
+		var v int
+		if err := json.Unmarshal(data, &v); err != nil {
+			return fmt.Errorf("invalid status code %s: %w", data, err)
+		}
+		*c = otlpStatusCode(v)
+	}
+	return nil
+}
+
+type otlpTraces struct {
+	ResourceSpans []struct {
+		Resource   otlpResource `json:"resource"`
+		ScopeSpans []struct {
+			Spans []otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+type otlpDataPoint struct {
+	Attributes   otlpAttributes `json:"attributes"`
+	TimeUnixNano otlpInt64      `json:"timeUnixNano"`
+	AsDouble     *float64       `json:"asDouble"`
+	AsInt        *otlpInt64     `json:"asInt"`
+}
+
+type otlpMetrics struct {
+	ResourceMetrics []struct {
+		Resource     otlpResource `json:"resource"`
+		ScopeMetrics []struct {
+			Metrics []struct {
+				Name  string `json:"name"`
+				Gauge *struct {
+					DataPoints []otlpDataPoint `json:"dataPoints"`
+				} `json:"gauge"`
+				Sum *struct {
+					DataPoints []otlpDataPoint `json:"dataPoints"`
+				} `json:"sum"`
+			} `json:"metrics"`
+		} `json:"scopeMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+// handleOTLP returns the handler of the OTLP/HTTP requests of OpenTelemetry
+// SDKs. The traces and metrics encoded in JSON are translated into intake
+// v2 events and buffered as agent data. The other requests, encoded in
+// protobuf or carrying logs, are forwarded to the OTLP endpoint of the APM
+// server as is.
+func (c *Client) handleOTLP() func(w http.ResponseWriter, r *http.Request) {
+	translators := map[string]func([]byte) ([][]byte, error){
+		"/v1/traces":  translateOTLPTraces,
+		"/v1/metrics": translateOTLPMetrics,
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		contentEncoding, ok := normalizeContentEncoding(r.Header.Get("Content-Encoding"))
+		if !ok {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			c.logger.Errorf("Could not read OTLP request body: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !c.reserveInvocationBytes(len(body)) {
+			c.logger.Warnf("Rejecting OTLP data of %d bytes, more than the %d bytes accepted per invocation", len(body), c.maxInvocationBytes)
+			c.dropped(DropInvocationLimit, AgentData{Data: body, ContentEncoding: contentEncoding})
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		c.agentConnected.Store(true)
+
+		translate, ok := translators[r.URL.Path]
+		if !ok || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			c.forwardOTLP(w, r, body)
+			return
+		}
+
+		data, err := GetUncompressedBytes(body, contentEncoding)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		payloads, err := translate(data)
+		if err != nil {
+			c.logger.Warnf("Rejecting invalid OTLP data: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, payload := range payloads {
+			c.enqueueAgentData(AgentData{Data: payload, receivedAt: time.Now()})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write([]byte("{}")); err != nil {
+			c.logger.Errorf("Failed to send OTLP response: %v", err)
+		}
+	}
+}
+
+// forwardOTLP forwards the OTLP request to the APM server, authenticated
+// by the extension, and copies back the response.
+func (c *Client) forwardOTLP(w http.ResponseWriter, r *http.Request, body []byte) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, c.ServerURL()+strings.TrimPrefix(r.URL.Path, "/"), bytes.NewReader(body))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for _, h := range []string{"Content-Type", "Content-Encoding"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	c.setAuthorizationHeader(req)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.logger.Errorf("Error forwarding OTLP data to the APM server: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	c.lastContact.Store(time.Now().UnixNano())
+
+	if v := resp.Header.Get("Content-Type"); v != "" {
+		w.Header().Set("Content-Type", v)
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		c.logger.Errorf("Failed to send OTLP response: %v", err)
+	}
+}
+
+// translateOTLPTraces translates the OTLP/JSON traces into intake v2
+// payloads, one per resource. The local roots of the traces and the
+// spans received by a service become transactions, the other spans
+// spans. The attributes are sent along for the APM server to map them
+// as it does with the data received with OTLP.
+func translateOTLPTraces(data []byte) ([][]byte, error) {
+	var traces otlpTraces
+	if err := json.Unmarshal(data, &traces); err != nil {
+		return nil, fmt.Errorf("failed to decode OTLP traces: %w", err)
+	}
+
+	var payloads [][]byte
+	for _, rs := range traces.ResourceSpans {
+		var spans []otlpSpan
+		for _, ss := range rs.ScopeSpans {
+			spans = append(spans, ss.Spans...)
+		}
+		if len(spans) == 0 {
+			continue
+		}
+
+		byID := make(map[string]otlpSpan, len(spans))
+		for _, s := range spans {
+			byID[s.SpanID] = s
+		}
+
+		var buf bytes.Buffer
+		if err := writeOTLPMetadata(&buf, rs.Resource); err != nil {
+			return nil, err
+		}
+		enc := json.NewEncoder(&buf)
+		for _, s := range spans {
+			if err := enc.Encode(otlpSpanEvent(s, byID)); err != nil {
+				return nil, fmt.Errorf("failed to encode span: %w", err)
+			}
+		}
+		payloads = append(payloads, bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	}
+	return payloads, nil
+}
+
+// isOTLPTransaction returns whether the span is translated into a transaction.
+func isOTLPTransaction(s otlpSpan) bool {
+	return s.ParentSpanID == "" || s.Kind == 2 || s.Kind == 5
+}
+
+func otlpSpanEvent(s otlpSpan, byID map[string]otlpSpan) map[string]interface{} {
+	event := map[string]interface{}{
+		"id":        otlpID(s.SpanID),
+		"trace_id":  otlpID(s.TraceID),
+		"name":      s.Name,
+		"timestamp": int64(s.StartTimeUnixNano) / 1e3,
+		"duration":  float64(s.EndTimeUnixNano-s.StartTimeUnixNano) / 1e6,
+		"outcome":   "unknown",
+		"otel": map[string]interface{}{
+			"span_kind":  s.Kind.String(),
+			"attributes": s.Attributes.values(),
+		},
+	}
+	switch s.Status.Code {
+	case 1:
+		event["outcome"] = "success"
+	case 2:
+		event["outcome"] = "failure"
+	}
+	if s.ParentSpanID != "" {
+		event["parent_id"] = otlpID(s.ParentSpanID)
+	}
+
+	if isOTLPTransaction(s) {
+		event["type"] = "unknown"
+		switch s.Kind {
+		case 2:
+			event["type"] = "request"
+		case 5:
+			event["type"] = "messaging"
+		}
+		event["sampled"] = true
+		event["span_count"] = map[string]int{"started": 0}
+		return map[string]interface{}{"transaction": event}
+	}
+
+	event["type"] = "app"
+	switch s.Kind {
+	case 3:
+		event["type"] = "external"
+	case 4:
+		event["type"] = "messaging"
+	}
+	// The transaction of the span is its closest ancestor translated
+	// into a transaction, if it is in the same batch.
+	for parent, ok := byID[s.ParentSpanID]; ok; parent, ok = byID[parent.ParentSpanID] {
+		if isOTLPTransaction(parent) {
+			event["transaction_id"] = otlpID(parent.SpanID)
+			break
+		}
+	}
+	return map[string]interface{}{"span": event}
+}
+
+// otlpID returns the hex encoding of the trace or span ID, encoded in hex
+// as required by OTLP/JSON, or in base64 by some proto3 JSON encoders.
+func otlpID(id string) string {
+	if _, err := hex.DecodeString(id); err == nil {
+		return strings.ToLower(id)
+	}
+	if b, err := base64.StdEncoding.DecodeString(id); err == nil {
+		return hex.EncodeToString(b)
+	}
+	return id
+}
+
+// translateOTLPMetrics translates the gauges and sums of the OTLP/JSON
+// metrics into intake v2 metricsets, one per resource. The data points
+// sharing the same timestamp and attributes are grouped in a metricset,
+// the attributes becoming its tags. Histograms and summaries are ignored.
+func translateOTLPMetrics(data []byte) ([][]byte, error) {
+	var metrics otlpMetrics
+	if err := json.Unmarshal(data, &metrics); err != nil {
+		return nil, fmt.Errorf("failed to decode OTLP metrics: %w", err)
+	}
+
+	type metricset struct {
+		Timestamp int64                             `json:"timestamp"`
+		Samples   map[string]map[string]interface{} `json:"samples"`
+		Tags      map[string]interface{}            `json:"tags,omitempty"`
+	}
+
+	var payloads [][]byte
+	for _, rm := range metrics.ResourceMetrics {
+		var keys []string
+		metricsets := make(map[string]*metricset)
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				var points []otlpDataPoint
+				if m.Gauge != nil {
+					points = m.Gauge.DataPoints
+				} else if m.Sum != nil {
+					points = m.Sum.DataPoints
+				}
+				for _, p := range points {
+					var value interface{}
+					switch {
+					case p.AsDouble != nil:
+						value = *p.AsDouble
+					case p.AsInt != nil:
+						value = int64(*p.AsInt)
+					default:
+						continue
+					}
+					tags := otlpTags(p.Attributes)
+					key, err := json.Marshal([]interface{}{p.TimeUnixNano, tags})
+					if err != nil {
+						return nil, fmt.Errorf("failed to encode metric attributes: %w", err)
+					}
+					ms, ok := metricsets[string(key)]
+					if !ok {
+						ms = &metricset{Timestamp: int64(p.TimeUnixNano) / 1e3, Samples: make(map[string]map[string]interface{}), Tags: tags}
+						metricsets[string(key)] = ms
+						keys = append(keys, string(key))
+					}
+					ms.Samples[m.Name] = map[string]interface{}{"value": value}
+				}
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := writeOTLPMetadata(&buf, rm.Resource); err != nil {
+			return nil, err
+		}
+		enc := json.NewEncoder(&buf)
+		for _, key := range keys {
+			if err := enc.Encode(map[string]interface{}{"metricset": metricsets[key]}); err != nil {
+				return nil, fmt.Errorf("failed to encode metricset: %w", err)
+			}
+		}
+		payloads = append(payloads, bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	}
+	return payloads, nil
+}
+
+// otlpTags returns the scalar attributes, as accepted by metricset tags.
+func otlpTags(attributes otlpAttributes) map[string]interface{} {
+	values := attributes.values()
+	for k, v := range values {
+		if _, ok := v.([]interface{}); ok {
+			delete(values, k)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+// writeOTLPMetadata writes the intake v2 metadata line of the resource,
+// mapping the attributes of the OpenTelemetry semantic conventions. The
+// other string attributes are added as labels.
+func writeOTLPMetadata(buf *bytes.Buffer, resource otlpResource) error {
+	attributes := resource.Attributes.values()
+	str := func(key string) string {
+		s, _ := attributes[key].(string)
+		delete(attributes, key)
+		return s
+	}
+
+	type name struct {
+		Name string `json:"name"`
+	}
+	type agent struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	type account struct {
+		ID string `json:"id"`
+	}
+	type cloud struct {
+		Provider string   `json:"provider"`
+		Region   string   `json:"region,omitempty"`
+		Account  *account `json:"account,omitempty"`
+		Service  *name    `json:"service,omitempty"`
+	}
+	var metadata struct {
+		Metadata struct {
+			Service struct {
+				Name        string `json:"name"`
+				Version     string `json:"version,omitempty"`
+				Environment string `json:"environment,omitempty"`
+				Language    *name  `json:"language,omitempty"`
+				Agent       agent  `json:"agent"`
+			} `json:"service"`
+			Cloud  *cloud            `json:"cloud,omitempty"`
+			Labels map[string]string `json:"labels,omitempty"`
+		} `json:"metadata"`
+	}
+
+	m := &metadata.Metadata
+	m.Service.Name = str("service.name")
+	if m.Service.Name == "" {
+		m.Service.Name = "unknown_service"
+	}
+	m.Service.Version = str("service.version")
+	m.Service.Environment = str("deployment.environment")
+	language := str("telemetry.sdk.language")
+	if language != "" {
+		m.Service.Language = &name{Name: language}
+	}
+	m.Service.Agent = agent{Name: "opentelemetry", Version: str("telemetry.sdk.version")}
+	if language != "" {
+		m.Service.Agent.Name += "/" + language
+	}
+	if m.Service.Agent.Version == "" {
+		m.Service.Agent.Version = "unknown"
+	}
+	delete(attributes, "telemetry.sdk.name")
+
+	if provider := str("cloud.provider"); provider != "" {
+		m.Cloud = &cloud{Provider: provider, Region: str("cloud.region")}
+		if id := str("cloud.account.id"); id != "" {
+			m.Cloud.Account = &account{ID: id}
+		}
+		if platform := str("cloud.platform"); platform == "aws_lambda" {
+			m.Cloud.Service = &name{Name: "lambda"}
+		}
+	}
+
+	for k, v := range attributes {
+		if s, ok := v.(string); ok {
+			if m.Labels == nil {
+				m.Labels = make(map[string]string)
+			}
+			m.Labels[strings.ReplaceAll(k, ".", "_")] = s
+		}
+	}
+
+	if err := json.NewEncoder(buf).Encode(metadata); err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+const otlpTraces = `{"resourceSpans":[{"resource":{"attributes":[
+	{"key":"service.name","value":{"stringValue":"checkout"}},
+	{"key":"telemetry.sdk.language","value":{"stringValue":"python"}},
+	{"key":"telemetry.sdk.version","value":{"stringValue":"1.24.0"}},
+	{"key":"cloud.provider","value":{"stringValue":"aws"}},
+	{"key":"cloud.platform","value":{"stringValue":"aws_lambda"}},
+	{"key":"faas.name","value":{"stringValue":"checkout-fn"}}
+]},"scopeSpans":[{"spans":[
+	{"traceId":"5B8EFFF798038103D269B633813FC60C","spanId":"EEE19B7EC3C1B174","name":"POST /checkout","kind":2,
+	 "startTimeUnixNano":"1700000000000000000","endTimeUnixNano":"1700000000250000000","status":{"code":1}},
+	{"traceId":"5B8EFFF798038103D269B633813FC60C","spanId":"EEE19B7EC3C1B173","parentSpanId":"EEE19B7EC3C1B174","name":"render","kind":"SPAN_KIND_INTERNAL",
+	 "startTimeUnixNano":"1700000000010000000","endTimeUnixNano":"1700000000020000000"},
+	{"traceId":"5B8EFFF798038103D269B633813FC60C","spanId":"EEE19B7EC3C1B172","parentSpanId":"EEE19B7EC3C1B173","name":"GET","kind":3,
+	 "startTimeUnixNano":"1700000000011000000","endTimeUnixNano":"1700000000015000000","status":{"code":2},
+	 "attributes":[{"key":"http.request.method","value":{"stringValue":"GET"}},{"key":"http.response.status_code","value":{"intValue":"503"}}]}
+]}]}]}`
+
+const otlpMetrics = `{"resourceMetrics":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]},"scopeMetrics":[{"metrics":[
+	{"name":"orders","sum":{"dataPoints":[{"timeUnixNano":"1700000000000000000","asInt":"3","attributes":[{"key":"region","value":{"stringValue":"eu"}}]}]}},
+	{"name":"cart.size","gauge":{"dataPoints":[{"timeUnixNano":"1700000000000000000","asDouble":2.5,"attributes":[{"key":"region","value":{"stringValue":"eu"}}]}]}},
+	{"name":"latency","histogram":{"dataPoints":[{"timeUnixNano":"1700000000000000000","count":"1"}]}}
+]}]}]}`
+
+type otlpServer struct {
+	mu       sync.Mutex
+	intake   []string
+	otlp     []string
+	authz    []string
+	received []string
+}
+
+func newOTLPServer(t *testing.T) (*httptest.Server, *otlpServer) {
+	s := &otlpServer{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if r.URL.Path == "/intake/v2/events" {
+			gr, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			body, err := io.ReadAll(gr)
+			require.NoError(t, err)
+			s.intake = append(s.intake, strings.Split(string(body), "\n")...)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		s.otlp = append(s.otlp, r.URL.Path)
+		s.authz = append(s.authz, r.Header.Get("Authorization"))
+		s.received = append(s.received, string(body))
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return server, s
+}
+
+// events returns the events sent to the intake endpoint, by type.
+func (s *otlpServer) events(t *testing.T) map[string][]map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := make(map[string][]map[string]interface{})
+	for _, line := range s.intake {
+		var event map[string]map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &event))
+		for k, v := range event {
+			events[k] = append(events[k], v)
+		}
+	}
+	return events
+}
+
+func postOTLP(t *testing.T, path, contentType, body string) *http.Response {
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234" + path
+
+	resp, err := newReceiverClient().Post(url, contentType, strings.NewReader(body))
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func startOTLPReceiver(t *testing.T, serverURL string) *apmproxy.Client {
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(serverURL),
+		apmproxy.WithSecretToken("foo"),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithOTLPReceiver(),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	t.Cleanup(func() {
+		require.NoError(t, apmClient.Shutdown())
+	})
+	return apmClient
+}
+
+func TestOTLPReceiverTraces(t *testing.T) {
+	server, s := newOTLPServer(t)
+	apmClient := startOTLPReceiver(t, server.URL)
+
+	resp := postOTLP(t, "/v1/traces", "application/json", otlpTraces)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, apmClient.AgentConnected())
+	require.NoError(t, apmClient.FlushAPMData(context.Background()))
+
+	events := s.events(t)
+	require.Len(t, events["metadata"], 1)
+	assert.Equal(t, map[string]interface{}{
+		"service": map[string]interface{}{
+			"name":     "checkout",
+			"language": map[string]interface{}{"name": "python"},
+			"agent":    map[string]interface{}{"name": "opentelemetry/python", "version": "1.24.0"},
+		},
+		"cloud":  map[string]interface{}{"provider": "aws", "service": map[string]interface{}{"name": "lambda"}},
+		"labels": map[string]interface{}{"faas_name": "checkout-fn"},
+	}, events["metadata"][0])
+
+	require.Len(t, events["transaction"], 1)
+	tx := events["transaction"][0]
+	assert.Equal(t, "eee19b7ec3c1b174", tx["id"])
+	assert.Equal(t, "5b8efff798038103d269b633813fc60c", tx["trace_id"])
+	assert.Equal(t, "POST /checkout", tx["name"])
+	assert.Equal(t, "request", tx["type"])
+	assert.Equal(t, "success", tx["outcome"])
+	assert.Equal(t, float64(1700000000000000), tx["timestamp"])
+	assert.Equal(t, float64(250), tx["duration"])
+	assert.NotContains(t, tx, "parent_id")
+
+	require.Len(t, events["span"], 2)
+	internal, client := events["span"][0], events["span"][1]
+	assert.Equal(t, "app", internal["type"])
+	assert.Equal(t, "eee19b7ec3c1b174", internal["parent_id"])
+	assert.Equal(t, "eee19b7ec3c1b174", internal["transaction_id"])
+	assert.Equal(t, "external", client["type"])
+	assert.Equal(t, "failure", client["outcome"])
+	assert.Equal(t, "eee19b7ec3c1b173", client["parent_id"])
+	assert.Equal(t, "eee19b7ec3c1b174", client["transaction_id"])
+	assert.Equal(t, map[string]interface{}{
+		"span_kind": "CLIENT",
+		"attributes": map[string]interface{}{
+			"http.request.method":       "GET",
+			"http.response.status_code": float64(503),
+		},
+	}, client["otel"])
+}
+
+func TestOTLPReceiverMetrics(t *testing.T) {
+	server, s := newOTLPServer(t)
+	apmClient := startOTLPReceiver(t, server.URL)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte(otlpMetrics))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	hosts, _ := net.LookupHost("localhost")
+	req, err := http.NewRequest(http.MethodPost, "http://"+hosts[0]+":1234/v1/metrics", &buf)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := newReceiverClient().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, apmClient.FlushAPMData(context.Background()))
+
+	events := s.events(t)
+	require.Len(t, events["metricset"], 1)
+	assert.Equal(t, map[string]interface{}{
+		"timestamp": float64(1700000000000000),
+		"samples": map[string]interface{}{
+			"orders":    map[string]interface{}{"value": float64(3)},
+			"cart.size": map[string]interface{}{"value": 2.5},
+		},
+		"tags": map[string]interface{}{"region": "eu"},
+	}, events["metricset"][0])
+}
+
+func TestOTLPReceiverForwardsProtobuf(t *testing.T) {
+	server, s := newOTLPServer(t)
+	apmClient := startOTLPReceiver(t, server.URL)
+
+	resp := postOTLP(t, "/v1/traces", "application/x-protobuf", "protobuf")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-protobuf", resp.Header.Get("Content-Type"))
+	resp = postOTLP(t, "/v1/logs", "application/json", `{"resourceLogs":[]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	s.mu.Lock()
+	assert.Equal(t, []string{"/v1/traces", "/v1/logs"}, s.otlp)
+	assert.Equal(t, []string{"Bearer foo", "Bearer foo"}, s.authz)
+	assert.Equal(t, []string{"protobuf", `{"resourceLogs":[]}`}, s.received)
+	s.mu.Unlock()
+
+	// The forwarded data is not buffered.
+	assert.Equal(t, 0, apmClient.BufferStats().Depth)
+}
+
+func TestOTLPReceiverInvalidTraces(t *testing.T) {
+	server, _ := newOTLPServer(t)
+	startOTLPReceiver(t, server.URL)
+
+	resp := postOTLP(t, "/v1/traces", "application/json", `{"resourceSpans":[{"scopeSpans":[{"spans":[{"kind":"SPAN_KIND_BOGUS"}]}]}]}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestOTLPReceiverDisabled(t *testing.T) {
+	server, s := newOTLPServer(t)
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(server.URL),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	// Without the OTLP receiver, the request is proxied as an info
+	// request, neither translated nor authenticated by the extension.
+	postOTLP(t, "/v1/traces", "application/json", otlpTraces)
+	require.NoError(t, apmClient.FlushAPMData(context.Background()))
+	assert.Empty(t, s.events(t))
+	s.mu.Lock()
+	assert.Equal(t, []string{"/v1/traces"}, s.otlp)
+	assert.Equal(t, []string{""}, s.authz)
+	s.mu.Unlock()
+}
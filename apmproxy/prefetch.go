@@ -0,0 +1,154 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// agentConfigPath is the path of the central configuration of the
+// agents, which they fetch through the extension.
+const agentConfigPath = "/config/v1/agents"
+
+// prefetchTTL is how long a prefetched response can be served to the
+// agent, so that a stale configuration is not served to later agents.
+const prefetchTTL = 30 * time.Second
+
+// prefetchedResponse is a response of the APM server fetched during the
+// init of the extension.
+type prefetchedResponse struct {
+	serverURL string
+	status    int
+	header    http.Header
+	body      []byte
+	fetchedAt time.Time
+}
+
+// prefetchCache holds the prefetched responses, by request URI.
+type prefetchCache struct {
+	mu        sync.Mutex
+	responses map[string]prefetchedResponse
+}
+
+// PrefetchServerInfo fetches the information of the APM server, e.g.
+// its version, so that the first request of the agent for it is
+// answered without a round trip to the APM server.
+func (c *Client) PrefetchServerInfo(ctx context.Context) error {
+	return c.prefetch(ctx, "/", nil)
+}
+
+// PrefetchAgentConfig fetches the central configuration of the agents of
+// the service, so that the first request of the agent for it is
+// answered without a round trip to the APM server.
+func (c *Client) PrefetchAgentConfig(ctx context.Context, serviceName, environment string) error {
+	query := url.Values{"service.name": []string{serviceName}}
+	if environment != "" {
+		query.Set("service.environment", environment)
+	}
+	return c.prefetch(ctx, agentConfigPath, query)
+}
+
+func (c *Client) prefetch(ctx context.Context, path string, query url.Values) error {
+	serverURL := c.ServerURL()
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return fmt.Errorf("could not parse APM server URL: %w", err)
+	}
+	u = u.JoinPath(path)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create prefetch request: %w", err)
+	}
+	c.setAuthorizationHeader(req)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to prefetch %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read the prefetched %s: %w", path, err)
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("failed to prefetch %s: response status code: %d", path, resp.StatusCode)
+	}
+
+	header := resp.Header.Clone()
+	header.Del("Content-Length")
+	header.Del("Connection")
+	c.prefetched.mu.Lock()
+	defer c.prefetched.mu.Unlock()
+	if c.prefetched.responses == nil {
+		c.prefetched.responses = make(map[string]prefetchedResponse)
+	}
+	c.prefetched.responses[prefetchKey(path, query)] = prefetchedResponse{
+		serverURL: serverURL,
+		status:    resp.StatusCode,
+		header:    header,
+		body:      body,
+		fetchedAt: time.Now(),
+	}
+	return nil
+}
+
+// prefetchKey identifies the request of a prefetched response,
+// regardless of the order of the query parameters.
+func prefetchKey(path string, query url.Values) string {
+	if path == "" {
+		path = "/"
+	}
+	return path + "?" + query.Encode()
+}
+
+// servePrefetched answers the request of the agent with the response
+// prefetched for it, if any. Prefetched responses are served once, as
+// long as they are fresh and the data is still sent to the APM server
+// they were fetched from. Conditional requests are not served.
+func (c *Client) servePrefetched(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	key := prefetchKey(r.URL.Path, r.URL.Query())
+
+	c.prefetched.mu.Lock()
+	resp, ok := c.prefetched.responses[key]
+	delete(c.prefetched.responses, key)
+	c.prefetched.mu.Unlock()
+	if !ok || resp.serverURL != c.ServerURL() || time.Since(resp.fetchedAt) > prefetchTTL {
+		return false
+	}
+
+	c.logger.Debugf("Serving the prefetched response of %s", r.URL.Path)
+	for k, v := range resp.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.status)
+	if _, err := w.Write(resp.body); err != nil {
+		c.logger.Warnf("Failed to send the prefetched response to the APM agent: %v", err)
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestPrefetch(t *testing.T) {
+	var infoRequests, configRequests atomic.Int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Forwarded-For") == "" {
+			// Prefetched by the extension, rather than proxied
+			assert.Equal(t, "ApiKey foo", r.Header.Get("Authorization"))
+		}
+		switch r.URL.Path {
+		case "/":
+			infoRequests.Add(1)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"version":"8.10.0"}`))
+		case "/config/v1/agents":
+			configRequests.Add(1)
+			assert.Equal(t, "my-function", r.URL.Query().Get("service.name"))
+			assert.Equal(t, "prod", r.URL.Query().Get("service.environment"))
+			w.Header().Set("Etag", `"abc"`)
+			_, _ = w.Write([]byte(`{"transaction_sample_rate":"0.5"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithAPIKey("foo"),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithReceiverTimeout(15*time.Second),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	require.NoError(t, apmClient.PrefetchServerInfo(context.Background()))
+	require.NoError(t, apmClient.PrefetchAgentConfig(context.Background(), "my-function", "prod"))
+	assert.Equal(t, int32(1), infoRequests.Load())
+	assert.Equal(t, int32(1), configRequests.Load())
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234"
+	get := func(path string) (*http.Response, string) {
+		resp, err := http.Get(url + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	// The first requests of the agent are answered with the prefetched
+	// responses, regardless of the order of the query parameters.
+	resp, body := get("/")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `{"version":"8.10.0"}`, body)
+	resp, body = get("/config/v1/agents?service.environment=prod&service.name=my-function")
+	assert.Equal(t, `{"transaction_sample_rate":"0.5"}`, body)
+	assert.Equal(t, `"abc"`, resp.Header.Get("Etag"))
+	assert.Equal(t, int32(1), infoRequests.Load())
+	assert.Equal(t, int32(1), configRequests.Load())
+
+	// The prefetched responses are served once.
+	_, body = get("/")
+	assert.Equal(t, `{"version":"8.10.0"}`, body)
+	assert.Equal(t, int32(2), infoRequests.Load())
+}
+
+func TestPrefetchConditionalRequest(t *testing.T) {
+	var configRequests atomic.Int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		configRequests.Add(1)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithReceiverTimeout(15*time.Second),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	require.NoError(t, apmClient.PrefetchAgentConfig(context.Background(), "my-function", ""))
+
+	hosts, _ := net.LookupHost("localhost")
+	req, err := http.NewRequest(http.MethodGet, "http://"+hosts[0]+":1234/config/v1/agents?service.name=my-function", nil)
+	require.NoError(t, err)
+	req.Header.Set("If-None-Match", `"abc"`)
+	resp, err := newReceiverClient().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int32(2), configRequests.Load())
+}
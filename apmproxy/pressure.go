@@ -0,0 +1,89 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const (
+	// queueDepthHeader is the number of agent data payloads buffered
+	// when the response is written.
+	queueDepthHeader = "X-Elastic-Extension-Queue-Depth"
+	// degradedHeader is true while the APM server is failing or rate
+	// limiting, or while the buffer is above the ship threshold, so
+	// that agents can reduce the data they send.
+	degradedHeader = "X-Elastic-Extension-Degraded"
+)
+
+// withPressureHeaders sets the pressure headers on the responses of the
+// handler, if enabled with WithPressureHeaders. They are computed when
+// the response headers are written, i.e. after the data is buffered.
+func (c *Client) withPressureHeaders(next http.HandlerFunc) http.HandlerFunc {
+	if !c.pressureHeaders {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(&pressureWriter{ResponseWriter: w, c: c}, r)
+	}
+}
+
+// Degraded returns true while the APM server is failing or rate limiting
+// the extension, or while the agent data buffer is filled above the ship
+// threshold, in count or in bytes.
+func (c *Client) Degraded() bool {
+	c.mu.RLock()
+	status := c.Status
+	c.mu.RUnlock()
+	switch status {
+	case Failing, RateLimited, ClientFailing:
+		return true
+	}
+	if c.bufferAboveShipThreshold() {
+		return true
+	}
+	return c.bufferMaxBytes > 0 && float64(c.bufferBytes.Load()) >= c.shipThreshold*float64(c.bufferMaxBytes)
+}
+
+// pressureWriter sets the pressure headers before the response headers
+// are written.
+type pressureWriter struct {
+	http.ResponseWriter
+	c           *Client
+	wroteHeader bool
+}
+
+func (w *pressureWriter) setHeaders() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.Header().Set(queueDepthHeader, strconv.Itoa(len(w.c.DataChannel)))
+	w.Header().Set(degradedHeader, strconv.FormatBool(w.c.Degraded()))
+}
+
+func (w *pressureWriter) WriteHeader(code int) {
+	w.setHeaders()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *pressureWriter) Write(b []byte) (int, error) {
+	w.setHeaders()
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,126 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultProbeTimeout = 2 * time.Second
+
+// serverProbe is the result of probing an APM server.
+type serverProbe struct {
+	url string
+	rtt time.Duration
+	err error
+}
+
+// ServerURL returns the URL of the APM server the data is sent to.
+func (c *Client) ServerURL() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.serverURL
+}
+
+// ProbeServers measures the round trip time to each of the configured
+// APM servers and sends the data to the fastest one. Unreachable servers
+// are ordered last, in the configured order. It is a no-op if a single
+// server is configured or if the servers are already being probed, and
+// returns whether the servers were probed.
+func (c *Client) ProbeServers(ctx context.Context) bool {
+	if len(c.serverURLs) < 2 || !c.probing.CompareAndSwap(false, true) {
+		return false
+	}
+	defer c.probing.Store(false)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultProbeTimeout)
+	defer cancel()
+
+	c.mu.RLock()
+	probes := make([]serverProbe, len(c.serverURLs))
+	for i, u := range c.serverURLs {
+		probes[i].url = u
+	}
+	c.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for i := range probes {
+		wg.Add(1)
+		go func(p *serverProbe) {
+			defer wg.Done()
+			p.rtt, p.err = c.probeServer(ctx, p.url)
+		}(&probes[i])
+	}
+	wg.Wait()
+
+	sort.SliceStable(probes, func(i, j int) bool {
+		if (probes[i].err == nil) != (probes[j].err == nil) {
+			return probes[i].err == nil
+		}
+		return probes[i].err == nil && probes[i].rtt < probes[j].rtt
+	})
+
+	urls := make([]string, len(probes))
+	for i, p := range probes {
+		urls[i] = p.url
+		if p.err != nil {
+			c.logger.Debugf("APM server %s is unreachable: %v", p.url, p.err)
+		} else {
+			c.logger.Debugf("APM server %s answered in %s", p.url, p.rtt)
+		}
+	}
+
+	c.mu.Lock()
+	previous := c.serverURL
+	c.serverURLs = urls
+	c.serverURL = urls[0]
+	c.mu.Unlock()
+
+	if urls[0] != previous {
+		c.logger.Infof("Sending data to APM server %s, previously %s", urls[0], previous)
+	}
+	return true
+}
+
+// probeServer returns the time it takes the APM server to answer a HEAD
+// request. Server errors count as the server being unreachable.
+func (c *Client) probeServer(ctx context.Context, url string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create probe request: %w", err)
+	}
+	c.setAuthorizationHeader(req)
+
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return 0, fmt.Errorf("probe failed with status %s", resp.Status)
+	}
+	return rtt, nil
+}
@@ -0,0 +1,112 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestProbeServers(t *testing.T) {
+	newServer := func(delay time.Duration, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				time.Sleep(delay)
+			}
+			w.WriteHeader(status)
+		}))
+	}
+	slow := newServer(100*time.Millisecond, http.StatusOK)
+	defer slow.Close()
+	fast := newServer(0, http.StatusOK)
+	defer fast.Close()
+	unavailable := newServer(0, http.StatusServiceUnavailable)
+	defer unavailable.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURLs(unavailable.URL, slow.URL, fast.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, unavailable.URL+"/", apmClient.ServerURL())
+
+	assert.True(t, apmClient.ProbeServers(context.Background()))
+	assert.Equal(t, fast.URL+"/", apmClient.ServerURL())
+}
+
+func TestProbeServersAfterFailure(t *testing.T) {
+	var failing atomic.Bool
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer secondary.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURLs(primary.URL, secondary.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	// Stop the grace period and the probes started by the failure.
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+	require.True(t, apmClient.ProbeServers(context.Background()))
+	require.Equal(t, primary.URL+"/", apmClient.ServerURL())
+
+	failing.Store(true)
+	require.NoError(t, apmClient.PostToApmServer(context.Background(), apmproxy.AgentData{Data: []byte(`{}`)}))
+	assert.Eventually(t, func() bool {
+		return apmClient.ServerURL() == secondary.URL+"/"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSingleServerNotProbed(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("unexpected request to APM server")
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURLs(apmServer.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	assert.False(t, apmClient.ProbeServers(context.Background()))
+	assert.Equal(t, apmServer.URL+"/", apmClient.ServerURL())
+}
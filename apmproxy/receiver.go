@@ -18,7 +18,9 @@
 package apmproxy
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -26,12 +28,25 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
+	"syscall"
 	"time"
 )
 
+// acceptedContentEncodings are the encodings of the agent data
+// the receiver accepts, advertised in the Accept-Encoding header.
+const acceptedContentEncodings = "gzip, deflate"
+
 type AgentData struct {
 	Data            []byte
 	ContentEncoding string
+
+	// receivedAt is the time the agent data was received by the
+	// extension, zero for the data generated by the extension.
+	receivedAt time.Time
+	// metadataSize is the size of the metadata line of the data,
+	// accounted for while it is buffered.
+	metadataSize int
 }
 
 // StartHttpServer starts the server listening for APM agent data.
@@ -44,13 +59,32 @@ func (c *Client) StartReceiver() error {
 	}
 
 	mux.HandleFunc("/", handleInfoRequest)
-	mux.HandleFunc("/intake/v2/events", c.handleIntakeV2Events())
+	mux.HandleFunc("/intake/v2/events", c.withPressureHeaders(c.limitConcurrentRequests(c.handleIntakeV2Events())))
+	mux.HandleFunc("/flush", c.handleFlush())
+	mux.HandleFunc("/status", c.handleStatus())
+	if c.stateEndpoint {
+		mux.HandleFunc("/debug/state", c.handleState())
+	}
+	if c.otlpReceiver {
+		for _, path := range otlpPaths {
+			mux.HandleFunc(path, c.withPressureHeaders(c.limitConcurrentRequests(c.handleOTLP())))
+		}
+	}
 
-	c.receiver.Handler = mux
+	c.receiver.Handler = c.recoverPanics(mux)
 
-	ln, err := net.Listen("tcp", c.receiver.Addr)
+	ln, err := net.Listen(c.network(), c.receiver.Addr)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		// The agents send their data to the configured port, the
+		// receiver cannot listen on another one.
+		return fmt.Errorf("failed to listen on addr %s, the port is used by another process, such as the extension of another vendor: "+
+			"set ELASTIC_APM_DATA_RECEIVER_SERVER_PORT, and the ELASTIC_APM_SERVER_URL of the agent, to a free port: %w", c.receiver.Addr, err)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to listen on addr %s", c.receiver.Addr)
+		return fmt.Errorf("failed to listen on addr %s: %w", c.receiver.Addr, err)
+	}
+	if c.receiverMaxConns > 0 {
+		ln = newLimitListener(ln, c.receiverMaxConns)
 	}
 
 	go func() {
@@ -64,35 +98,61 @@ func (c *Client) StartReceiver() error {
 	return nil
 }
 
-// Shutdown shutdowns the apm receiver gracefully.
+// Shutdown shutdowns the apm receiver gracefully, and waits for the
+// tasks of the client running in the background to stop.
 func (c *Client) Shutdown() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	return c.receiver.Shutdown(ctx)
+	err := c.receiver.Shutdown(ctx)
+	if c.stopBackground != nil {
+		c.stopBackground()
+		c.backgroundWg.Wait()
+	}
+	return err
 }
 
 // URL: http://server/
 func (c *Client) handleInfoRequest() (func(w http.ResponseWriter, r *http.Request), error) {
-	// Init reverse proxy
-	parsedApmServerUrl, err := url.Parse(c.serverURL)
-	if err != nil {
-		return nil, fmt.Errorf("could not parse APM server URL: %w", err)
+	var transport http.RoundTripper = c.roundTripper
+	if transport == nil {
+		customTransport := c.newServerTransport()
+		customTransport.ResponseHeaderTimeout = c.client.Timeout
+		transport = customTransport
+	}
+	if c.sigV4 != nil {
+		transport = newSigV4Transport(transport, *c.sigV4)
 	}
 
-	reverseProxy := httputil.NewSingleHostReverseProxy(parsedApmServerUrl)
+	// Init a reverse proxy per APM server, the request is forwarded to
+	// the server the data is currently sent to.
+	reverseProxies := make(map[string]*httputil.ReverseProxy)
+	parsedApmServerUrls := make(map[string]*url.URL)
+	for _, serverURL := range append([]string{c.serverURL}, c.serverURLs...) {
+		parsedApmServerUrl, err := url.Parse(serverURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse APM server URL: %w", err)
+		}
 
-	customTransport := http.DefaultTransport.(*http.Transport).Clone()
-	customTransport.ResponseHeaderTimeout = c.client.Timeout
-	reverseProxy.Transport = customTransport
+		reverseProxy := httputil.NewSingleHostReverseProxy(parsedApmServerUrl)
+		reverseProxy.Transport = transport
+		reverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			c.UpdateStatus(r.Context(), Failing)
+			c.logger.Errorf("Error querying version from the APM server: %v", err)
+		}
 
-	reverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		c.UpdateStatus(r.Context(), Failing)
-		c.logger.Errorf("Error querying version from the APM server: %v", err)
+		reverseProxies[serverURL] = reverseProxy
+		parsedApmServerUrls[serverURL] = parsedApmServerUrl
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		c.logger.Debug("Handling APM server Info Request")
+		if c.servePrefetched(w, r) {
+			return
+		}
+
+		serverURL := c.ServerURL()
+		reverseProxy, parsedApmServerUrl := reverseProxies[serverURL], parsedApmServerUrls[serverURL]
 
 		// Process request (the Golang doc suggests removing any pre-existing X-Forwarded-For header coming
 		// from the client or an untrusted proxy to prevent IP spoofing : https://pkg.go.dev/net/http/httputil#ReverseProxy
@@ -112,7 +172,28 @@ func (c *Client) handleInfoRequest() (func(w http.ResponseWriter, r *http.Reques
 // URL: http://server/intake/v2/events
 func (c *Client) handleIntakeV2Events() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Agents can negotiate the encoding of the data before sending it.
+		w.Header().Set("Accept-Encoding", acceptedContentEncodings)
+		switch r.Method {
+		case http.MethodOptions:
+			w.Header().Set("Allow", "POST, HEAD, OPTIONS")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
 		c.logger.Debug("Handling APM Data Intake")
+		contentEncoding, ok := normalizeContentEncoding(r.Header.Get("Content-Encoding"))
+		if !ok {
+			c.logger.Warnf("Rejecting agent data with unsupported encoding %q", r.Header.Get("Content-Encoding"))
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		// Bodies with a chunked transfer encoding are decoded by
+		// the server, and fail to be read if truncated.
 		rawBytes, err := io.ReadAll(r.Body)
 		defer r.Body.Close()
 		if err != nil {
@@ -121,34 +202,54 @@ func (c *Client) handleIntakeV2Events() func(w http.ResponseWriter, r *http.Requ
 			return
 		}
 
+		if contentEncoding == "" {
+			rawBytes = bytes.TrimPrefix(rawBytes, utf8BOM)
+		}
+
 		agentFlushed := r.URL.Query().Get("flushed") == "true"
 
+		if !c.reserveInvocationBytes(len(rawBytes)) {
+			c.logger.Warnf("Rejecting agent data of %d bytes, more than the %d bytes accepted per invocation", len(rawBytes), c.maxInvocationBytes)
+			c.dropped(DropInvocationLimit, AgentData{Data: rawBytes, ContentEncoding: contentEncoding})
+			if agentFlushed {
+				c.signalAgentFlush()
+			}
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
 		agentData := AgentData{
 			Data:            rawBytes,
-			ContentEncoding: r.Header.Get("Content-Encoding"),
+			ContentEncoding: contentEncoding,
+			receivedAt:      time.Now(),
+		}
+
+		c.agentConnected.Store(true)
+
+		var result *intakeResult
+		if c.strictIntakeValidation && len(agentData.Data) != 0 {
+			agentData, result = c.validateAgentData(agentData)
+		}
+
+		if len(c.transformations) > 0 && len(agentData.Data) != 0 {
+			agentData = c.transformAgentData(agentData)
 		}
 
 		if len(agentData.Data) != 0 {
-			c.EnqueueAPMData(agentData)
+			c.enqueueAgentData(agentData)
 		}
 
 		if agentFlushed {
-			c.flushMutex.Lock()
-
-			select {
-			case <-c.flushCh:
-				// the channel is closed.
-				// the extension received at least a flush request already but the
-				// data have not been flushed yet.
-				// We can reuse the closed channel.
-			default:
-				// no pending flush requests
-				// close the channel to signal a flush request has
-				// been received.
-				close(c.flushCh)
-			}
+			c.signalAgentFlush()
+		}
 
-			c.flushMutex.Unlock()
+		if result != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			if err := json.NewEncoder(w).Encode(result); err != nil {
+				c.logger.Errorf("Failed to send intake response to APM agent : %v", err)
+			}
+			return
 		}
 
 		w.WriteHeader(http.StatusAccepted)
@@ -157,3 +258,85 @@ func (c *Client) handleIntakeV2Events() func(w http.ResponseWriter, r *http.Requ
 		}
 	}
 }
+
+// normalizeContentEncoding returns the encoding of agent data given
+// in the Content-Encoding header, or false if it is not supported.
+func normalizeContentEncoding(header string) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(header)) {
+	case "", "identity":
+		return "", true
+	case "gzip", "x-gzip":
+		return "gzip", true
+	case "deflate":
+		return "deflate", true
+	default:
+		return "", false
+	}
+}
+
+// validateAgentData drops the invalid events of the agent data. It returns
+// the valid data, uncompressed, and the result to report to the agent if
+// any event is invalid.
+func (c *Client) validateAgentData(agentData AgentData) (AgentData, *intakeResult) {
+	data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		c.logger.Warnf("Rejecting agent data: %v", err)
+		return AgentData{}, &intakeResult{Errors: []jsonError{{Message: err.Error()}}}
+	}
+
+	valid, accepted, errs := validateIntakeData(bytes.TrimPrefix(data, utf8BOM))
+	if len(errs) == 0 {
+		if accepted == 0 {
+			// Nothing to forward without events, e.g. metadata only.
+			return AgentData{}, nil
+		}
+		return agentData, nil
+	}
+
+	c.logger.Warnf("Rejecting %d invalid agent events, accepting %d", len(errs), accepted)
+	for _, e := range errs {
+		c.logger.Debugf("Invalid agent event: %s: document %s", e.Message, e.Document)
+	}
+	return AgentData{Data: valid, receivedAt: agentData.receivedAt}, &intakeResult{Accepted: accepted, Errors: errs}
+}
+
+// URL: http://server/flush
+//
+// Lightweight endpoint agents can hit at the end of the handler to signal
+// that all the data for the invocation has been submitted, without
+// sending an intake request.
+func (c *Client) handleFlush() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		c.logger.Debug("Handling agent flush signal")
+		c.agentConnected.Store(true)
+		c.signalAgentFlush()
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// signalAgentFlush signals that the agent has flushed all the data
+// for the current invocation.
+func (c *Client) signalAgentFlush() {
+	c.flushMutex.Lock()
+	defer c.flushMutex.Unlock()
+
+	select {
+	case <-c.flushCh:
+		// the channel is closed.
+		// the extension received at least a flush request already but the
+		// data have not been flushed yet.
+		// We can reuse the closed channel.
+	default:
+		// no pending flush requests
+		// close the channel to signal a flush request has
+		// been received.
+		close(c.flushCh)
+	}
+}
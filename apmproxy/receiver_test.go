@@ -19,20 +19,40 @@ package apmproxy_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/elastic/apm-aws-lambda/apmproxy"
+	"github.com/elastic/apm-aws-lambda/extension"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
 )
 
+// newReceiverClient returns an HTTP client for the receivers started by
+// the tests. Connections are not reused, so that no connection left open
+// by the client delays the shutdown of the receiver, and requests time
+// out rather than hang the tests.
+func newReceiverClient() *http.Client {
+	return &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+}
+
 func TestInfoProxy(t *testing.T) {
 	headers := map[string]string{"Authorization": "test-value"}
 	wantResp := "{\"foo\": \"bar\"}"
@@ -292,3 +312,914 @@ func Test_handleIntakeV2EventsQueryParamEmptyData(t *testing.T) {
 		t.Fatal("Timed out waiting for server to send flush signal")
 	}
 }
+
+func Test_handleState(t *testing.T) {
+	body := []byte(`{"metadata": {}`)
+
+	// Create apm server and handler
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	defer apmServer.Close()
+
+	// Create extension config and start the server
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithReceiverTimeout(15*time.Second),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithStateEndpoint(),
+		apmproxy.WithStateComponent("invocations", func() interface{} {
+			return []map[string]string{{"request_id": "1"}}
+		}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234"
+	client := newReceiverClient()
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, err = zw.Write([]byte(`{"transaction":{"id":"1"}}`))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	req, err := http.NewRequest(http.MethodPost, url+"/intake/v2/events", bytes.NewReader(compressed.Bytes()))
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	resp, err = client.Post(url+"/intake/v2/events?flushed=true", "application/x-ndjson", bytes.NewReader(body))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	resp, err = client.Get(url + "/debug/state")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var state apmproxy.State
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&state))
+	assert.Equal(t, apmproxy.State{
+		Status:            apmproxy.Started,
+		ReconnectionCount: -1,
+		SendStrategy:      apmproxy.SyncFlush,
+		AgentFlushed:      true,
+		QueuedAgentData:   2,
+		QueueCapacity:     100,
+		Buffer: apmproxy.BufferStats{
+			Depth:              2,
+			Capacity:           100,
+			HighWatermark:      2,
+			EvictionPolicy:     apmproxy.DropNewest,
+			Bytes:              int64(compressed.Len() + len(body)),
+			MetadataBytes:      int64(len(body)),
+			HighWatermarkBytes: int64(compressed.Len() + len(body)),
+		},
+		QueuedPayloads: []apmproxy.StatePayload{
+			{ContentEncoding: "gzip", Size: compressed.Len(), Data: `{"transaction":{"id":"1"}}`},
+			{Size: len(body), Data: string(body)},
+		},
+		Components: map[string]interface{}{
+			"invocations": []interface{}{map[string]interface{}{"request_id": "1"}},
+		},
+	}, state)
+
+	// The payloads read from the buffer are not queued anymore.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, apmClient.FlushAPMData(ctx))
+	assert.Empty(t, apmClient.State().QueuedPayloads)
+}
+
+func Test_handleStatus(t *testing.T) {
+	// Create apm server and handler
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	defer apmServer.Close()
+
+	// Create extension config and start the server
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithReceiverTimeout(15*time.Second),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithStatusComponent("logs_api", func() interface{} {
+			return map[string]bool{"subscribed": true}
+		}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234/status"
+
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var report apmproxy.StatusReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal(t, apmproxy.StatusReport{
+		Build:  extension.GetBuildInfo(),
+		Status: apmproxy.Started,
+		Buffer: apmproxy.BufferStats{
+			Capacity:       100,
+			EvictionPolicy: apmproxy.DropNewest,
+		},
+		Components: map[string]interface{}{
+			"logs_api": map[string]interface{}{"subscribed": true},
+		},
+	}, report)
+}
+
+func Test_handleStatusAfterHealthyTransitions(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithReceiverTimeout(15*time.Second),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithStateEndpoint(),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	// Successful requests repeatedly set the transport status to healthy,
+	// possibly at the same time.
+	for i := 0; i < 3; i++ {
+		apmClient.UpdateStatus(context.Background(), apmproxy.RateLimited)
+		var wg sync.WaitGroup
+		for j := 0; j < 5; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				apmClient.UpdateStatus(context.Background(), apmproxy.Healthy)
+			}()
+		}
+		wg.Wait()
+	}
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234"
+	client := newReceiverClient()
+
+	resp, err := client.Get(url + "/status")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var report apmproxy.StatusReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal(t, apmproxy.Healthy, report.Status)
+
+	resp, err = client.Get(url + "/debug/state")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var state apmproxy.State
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&state))
+	assert.Equal(t, apmproxy.Healthy, state.Status)
+}
+
+func Test_handleFlush(t *testing.T) {
+	// Create apm server and handler
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	defer apmServer.Close()
+
+	// Create extension config and start the server
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithReceiverTimeout(15*time.Second),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234/flush"
+
+	// Only POST requests signal a flush
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	select {
+	case <-apmClient.WaitForFlush():
+		t.Fatal("Unexpected flush signal")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.False(t, apmClient.AgentConnected())
+
+	resp, err = newReceiverClient().Post(url, "", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.True(t, apmClient.AgentConnected())
+
+	select {
+	case <-apmClient.WaitForFlush():
+	case <-time.After(1 * time.Second):
+		t.Fatal("Timed out waiting for server to send flush signal")
+	}
+
+	// Repeated signals are idempotent
+	resp, err = newReceiverClient().Post(url, "", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+}
+
+func Test_handleIntakeV2EventsNoFlushSignal(t *testing.T) {
+	body := []byte(`{"metadata": {}`)
+
+	// Create apm server and handler
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	defer apmServer.Close()
+
+	// Create extension config and start the server
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithReceiverTimeout(15*time.Second),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234/intake/v2/events"
+
+	resp, err := newReceiverClient().Post(url, "application/x-ndjson", bytes.NewReader(body))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	select {
+	case <-apmClient.WaitForFlush():
+		t.Fatal("Unexpected flush signal")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_handleIntakeV2EventsStrictValidation(t *testing.T) {
+	metadata := `{"metadata":{"service":{"agent":{"name":"go","version":"2.0.0"}}}}`
+	transaction := `{"transaction":{"id":"945254c567a5417e","trace_id":"0123456789abcdef0123456789abcdef","type":"request","duration":32.5,"timestamp":1496170407154000}}`
+
+	// Create apm server and handler
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	defer apmServer.Close()
+
+	// Create extension config and start the server
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithReceiverTimeout(15*time.Second),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithStrictIntakeValidation(),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234/intake/v2/events"
+
+	for name, tc := range map[string]struct {
+		body           string
+		expectedStatus int
+		expectedData   string
+		expectedErrors []string
+	}{
+		"valid": {
+			body:           metadata + "\n" + transaction + "\n",
+			expectedStatus: http.StatusAccepted,
+			expectedData:   metadata + "\n" + transaction + "\n",
+		},
+		"invalid events": {
+			body: metadata + "\n" + transaction + "\n" +
+				`{"span":{"id":"1"}}` + "\n" +
+				`{"unknown":{}}` + "\n" +
+				`{"error":{"id":"1","timestamp":"now"}}` + "\n" +
+				`{"transaction":{"id":`,
+			expectedStatus: http.StatusBadRequest,
+			expectedData:   metadata + "\n" + transaction + "\n",
+			expectedErrors: []string{
+				"invalid span: missing required field trace_id",
+				"unknown event type unknown",
+				`invalid error: invalid timestamp "now"`,
+				"invalid JSON",
+			},
+		},
+		"corrupted line before metadata": {
+			body:           `{"metadata":{"serv` + "\n" + metadata + "\n" + transaction + "\n",
+			expectedStatus: http.StatusBadRequest,
+			expectedData:   metadata + "\n" + transaction + "\n",
+			expectedErrors: []string{"invalid JSON"},
+		},
+		"metadata only": {
+			body:           "\r\n" + metadata + "\r\n",
+			expectedStatus: http.StatusAccepted,
+		},
+		"crlf": {
+			body:           metadata + "\r\n" + transaction + "\r\n",
+			expectedStatus: http.StatusAccepted,
+			expectedData:   metadata + "\r\n" + transaction + "\r\n",
+		},
+		"invalid metadata": {
+			body:           `{"metadata":{"service":{}}}` + "\n" + transaction,
+			expectedStatus: http.StatusBadRequest,
+			expectedErrors: []string{"invalid metadata: missing required field service.agent.name"},
+		},
+		"missing metadata": {
+			body:           transaction,
+			expectedStatus: http.StatusBadRequest,
+			expectedErrors: []string{"expected metadata as first line, got transaction"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp, err := newReceiverClient().Post(url, "application/x-ndjson", strings.NewReader(tc.body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+
+			if tc.expectedErrors != nil {
+				var result struct {
+					Errors []struct {
+						Message string `json:"message"`
+					} `json:"errors"`
+				}
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+				require.Len(t, result.Errors, len(tc.expectedErrors))
+				for i, e := range tc.expectedErrors {
+					assert.Contains(t, result.Errors[i].Message, e)
+				}
+			}
+
+			select {
+			case agentData := <-apmClient.DataChannel:
+				assert.Equal(t, tc.expectedData, string(agentData.Data))
+			default:
+				assert.Empty(t, tc.expectedData)
+			}
+		})
+	}
+}
+
+func FuzzIntakeV2Events(f *testing.F) {
+	f.Add([]byte(`{"metadata":{"service":{"agent":{"name":"go","version":"2.0.0"}}}}`+"\n"+`{"span":{"id":"1","trace_id":"2","parent_id":"3","name":"n","type":"t","duration":1}}`), uint8(0), true)
+	f.Add([]byte(`{"metadata":{}}`), uint8(1), false)
+	f.Add([]byte("\x78\x9c"), uint8(2), false)
+
+	encodings := []string{"", "gzip", "deflate", "br"}
+
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	defer apmServer.Close()
+
+	// Fuzzing runs several worker processes: each needs its own port.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(f, err)
+	addr := ln.Addr().String()
+	require.NoError(f, ln.Close())
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(addr),
+		apmproxy.WithLogger(zap.NewNop().Sugar()),
+		apmproxy.WithStrictIntakeValidation(),
+	)
+	require.NoError(f, err)
+	require.NoError(f, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(f, apmClient.Shutdown())
+	}()
+
+	url := "http://" + addr + "/intake/v2/events"
+
+	f.Fuzz(func(t *testing.T, body []byte, encoding uint8, flushed bool) {
+		u := url
+		if flushed {
+			u += "?flushed=true"
+		}
+		req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Encoding", encodings[int(encoding)%len(encodings)])
+
+		resp, err := newReceiverClient().Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Contains(t, []int{http.StatusAccepted, http.StatusBadRequest}, resp.StatusCode)
+
+		// Keep the buffer from filling up.
+		for len(apmClient.DataChannel) > 0 {
+			<-apmClient.DataChannel
+		}
+		apmClient.ResetFlush()
+	})
+}
+
+func TestMaxDataAge(t *testing.T) {
+	var requests atomic.Int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithMaxDataAge(50*time.Millisecond),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	send := func() {
+		resp, err := newReceiverClient().Post("http://localhost:1234/intake/v2/events", "application/x-ndjson", strings.NewReader(`{"metadata":{}}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	// Buffered for longer than the max age, e.g. across a freeze
+	send()
+	time.Sleep(100 * time.Millisecond)
+	send()
+	apmClient.FlushAPMData(context.Background())
+
+	assert.Equal(t, int32(1), requests.Load())
+	assert.Equal(t, int64(1), apmClient.BufferStats().Expired)
+}
+
+func Test_handleIntakeV2EventsTransformations(t *testing.T) {
+	transformations, err := apmproxy.ParseTransformations(`[
+		{"event": "transaction", "field": "context.tags.route_group", "template": "{{index (split .transaction.name \"/\") 1}}"},
+		{"field": "context.tags.origin", "from": "context.tags.source"}
+	]`)
+	require.NoError(t, err)
+
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithReceiverTimeout(15*time.Second),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithTransformations(transformations),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234/intake/v2/events"
+
+	body := `{"metadata":{"service":{"name":"<svc>"}}}` + "\n" +
+		`{"transaction":{"name":"GET /users/{id}","duration":32.5,"context":{"tags":{"source":"api"}}}}` + "\n" +
+		`{"span":{"name":"SELECT","duration":1}}` + "\n" +
+		`{"transaction":` + "\n"
+	resp, err := newReceiverClient().Post(url, "application/x-ndjson", strings.NewReader(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	select {
+	case data := <-apmClient.DataChannel:
+		assert.Empty(t, data.ContentEncoding)
+		assert.Equal(t, `{"metadata":{"service":{"name":"<svc>"}}}`+"\n"+
+			`{"transaction":{"context":{"tags":{"origin":"api","route_group":"users"}},"duration":32.5,"name":"GET /users/{id}"}}`+"\n"+
+			`{"span":{"name":"SELECT","duration":1}}`+"\n"+
+			`{"transaction":`+"\n", string(data.Data))
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the agent data")
+	}
+}
+
+func Test_handleIntakeV2EventsTransformationsPassThrough(t *testing.T) {
+	transformations, err := apmproxy.ParseTransformations(`[
+		{"event": "error", "field": "context.tags.origin", "from": "context.tags.source"}
+	]`)
+	require.NoError(t, err)
+
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithReceiverTimeout(15*time.Second),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithTransformations(transformations),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234/intake/v2/events"
+
+	var body bytes.Buffer
+	gw := gzip.NewWriter(&body)
+	_, err = gw.Write([]byte(`{"metadata":{"service":{"name":"<svc>"}}}` + "\n" +
+		`{"transaction":{"name":"GET /users/{id}","context":{"tags":{"source":"api"}}}}` + "\n" +
+		`{"error":{"id":"1"}}` + "\n"))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	compressed := body.Bytes()
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(compressed))
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := newReceiverClient().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	select {
+	case data := <-apmClient.DataChannel:
+		assert.Equal(t, "gzip", data.ContentEncoding)
+		assert.Equal(t, compressed, data.Data)
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the agent data")
+	}
+}
+
+func Test_handleIntakeV2EventsMaxInvocationBytes(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithReceiverTimeout(15*time.Second),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithMaxInvocationBytes(100),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234/intake/v2/events"
+
+	body := `{"metadata":{}}` + "\n" + `{"span":{"name":"` + strings.Repeat("x", 30) + `"}}` + "\n"
+	send := func() int {
+		resp, err := newReceiverClient().Post(url, "application/x-ndjson", strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusAccepted, send())
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send())
+	assert.Len(t, apmClient.DataChannel, 1)
+	assert.Equal(t, apmproxy.DropStats{
+		Payloads: 1,
+		Bytes:    int64(len(body)),
+		Events:   apmproxy.EventCounts{Spans: 1},
+	}, apmClient.ResetDropCounts()[apmproxy.DropInvocationLimit])
+
+	// The limit applies to each invocation.
+	assert.Equal(t, int64(len(body)), apmClient.ResetInvocationBytes())
+	assert.Equal(t, http.StatusAccepted, send())
+	assert.Len(t, apmClient.DataChannel, 2)
+}
+
+func TestStartReceiverPortCollision(t *testing.T) {
+	// Another extension listens on the port of the receiver
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer other.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL("http://localhost:8200"),
+		apmproxy.WithReceiverAddress(other.Addr().String()),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	err = apmClient.StartReceiver()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ELASTIC_APM_DATA_RECEIVER_SERVER_PORT")
+}
+
+func TestParseTransformationsInvalid(t *testing.T) {
+	for name, config := range map[string]string{
+		"not json":          `{`,
+		"no field":          `[{"template": "x"}]`,
+		"template and from": `[{"field": "a", "template": "x", "from": "b"}]`,
+		"neither":           `[{"field": "a"}]`,
+		"invalid template":  `[{"field": "a", "template": "{{"}]`,
+		"unknown function":  `[{"field": "a", "template": "{{unknown .x}}"}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := apmproxy.ParseTransformations(config)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func Test_handleIntakeV2EventsEncodingNegotiation(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithReceiverTimeout(15*time.Second),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234/intake/v2/events"
+
+	req, err := http.NewRequest(http.MethodOptions, url, nil)
+	require.NoError(t, err)
+	resp, err := newReceiverClient().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "gzip, deflate", resp.Header.Get("Accept-Encoding"))
+	assert.Equal(t, "POST, HEAD, OPTIONS", resp.Header.Get("Allow"))
+
+	resp, err = http.Head(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "gzip, deflate", resp.Header.Get("Accept-Encoding"))
+
+	req, err = http.NewRequest(http.MethodPost, url, strings.NewReader(`{"metadata":{}}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", "br")
+	resp, err = newReceiverClient().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	assert.Equal(t, "gzip, deflate", resp.Header.Get("Accept-Encoding"))
+	assert.Len(t, apmClient.DataChannel, 0)
+}
+
+func Test_handleIntakeV2EventsChunked(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithReceiverTimeout(15*time.Second),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234/intake/v2/events"
+
+	for _, size := range []int{1, 100, 10000} {
+		var ndjson bytes.Buffer
+		ndjson.WriteString(`{"metadata":{}}` + "\n")
+		for i := 0; i < size; i++ {
+			fmt.Fprintf(&ndjson, `{"transaction":{"id":"%d"}}`+"\n", i)
+		}
+
+		for name, gzipped := range map[string]bool{"plain": false, "gzip": true} {
+			t.Run(fmt.Sprint(name, "-", size), func(t *testing.T) {
+				body := ndjson.Bytes()
+				if gzipped {
+					var buf bytes.Buffer
+					gw := gzip.NewWriter(&buf)
+					_, err := gw.Write(body)
+					require.NoError(t, err)
+					require.NoError(t, gw.Close())
+					body = buf.Bytes()
+				}
+
+				// Hiding the length of the body makes the client use
+				// a chunked transfer encoding.
+				req, err := http.NewRequest(http.MethodPost, url, io.MultiReader(bytes.NewReader(body)))
+				require.NoError(t, err)
+				if gzipped {
+					req.Header.Set("Content-Encoding", "GZIP")
+				}
+				resp, err := newReceiverClient().Do(req)
+				require.NoError(t, err)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+				select {
+				case data := <-apmClient.DataChannel:
+					uncompressed, err := apmproxy.GetUncompressedBytes(data.Data, data.ContentEncoding)
+					require.NoError(t, err)
+					assert.Equal(t, ndjson.String(), string(uncompressed))
+					if gzipped {
+						assert.Equal(t, "gzip", data.ContentEncoding)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("Timed out waiting for the agent data")
+				}
+			})
+		}
+	}
+}
+
+func Test_handleIntakeV2EventsAgentQuirks(t *testing.T) {
+	dotnet, err := os.ReadFile("testdata/dotnet.ndjson")
+	require.NoError(t, err)
+	ruby, err := os.ReadFile("testdata/ruby.ndjson")
+	require.NoError(t, err)
+	rubyMetadata, rubyEvents, _ := strings.Cut(string(ruby), "\n")
+
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	defer apmServer.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithReceiverTimeout(15*time.Second),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithStrictIntakeValidation(),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234/intake/v2/events"
+
+	for name, tc := range map[string]struct {
+		body            []byte
+		contentEncoding string
+	}{
+		"dotnet": {body: dotnet},
+		"ruby":   {body: gzipMembers(t, rubyMetadata+"\n", rubyEvents), contentEncoding: "gzip"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Streamed bodies are sent with a chunked transfer encoding.
+			req, err := http.NewRequest(http.MethodPost, url, io.MultiReader(bytes.NewReader(tc.body)))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/x-ndjson; charset=utf-8")
+			req.Header.Set("Content-Encoding", tc.contentEncoding)
+			resp, err := newReceiverClient().Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+			select {
+			case data := <-apmClient.DataChannel:
+				uncompressed, err := apmproxy.GetUncompressedBytes(data.Data, data.ContentEncoding)
+				require.NoError(t, err)
+				assert.True(t, strings.HasPrefix(string(uncompressed), `{"metadata":`))
+				assert.Equal(t, 1, apmproxy.CountEvents(uncompressed).Transactions)
+			case <-time.After(time.Second):
+				t.Fatal("Timed out waiting for the agent data")
+			}
+		})
+	}
+}
+
+func Test_handleIntakeV2EventsServiceVersion(t *testing.T) {
+	server, s := newOTLPServer(t)
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(server.URL),
+		apmproxy.WithReceiverAddress(":1234"),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, apmClient.StartReceiver())
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+	apmClient.SetServiceVersion("12")
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234/intake/v2/events"
+	client := newReceiverClient()
+	post := func(body []byte, contentEncoding string) {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Encoding", contentEncoding)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, err = zw.Write([]byte(`{"metadata":{"service":{"name":"foo","agent":{"name":"<python>","version":"6.12.0"}}}}` + "\n" + `{"transaction":{"id":"1"}}`))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	post(compressed.Bytes(), "gzip")
+	post([]byte(`{"metadata":{"service":{"name":"foo","version":"1.2.3"}}}`+"\n"+`{"transaction":{"id":"2"}}`), "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, apmClient.FlushAPMData(ctx))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Equal(t, []string{
+		`{"metadata":{"service":{"agent":{"name":"<python>","version":"6.12.0"},"name":"foo","version":"12"}}}`,
+		`{"transaction":{"id":"1"}}`,
+		// The version set by the agent is kept.
+		`{"metadata":{"service":{"name":"foo","version":"1.2.3"}}}`,
+		`{"transaction":{"id":"2"}}`,
+	}, s.intake)
+}
+
+func Test_handleIntakeV2EventsPressureHeaders(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			opts := []apmproxy.Option{
+				apmproxy.WithURL("http://example.com"),
+				apmproxy.WithReceiverAddress(":1234"),
+				apmproxy.WithAgentDataBufferSize(2),
+				apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+			}
+			if enabled {
+				opts = append(opts, apmproxy.WithPressureHeaders())
+			}
+			apmClient, err := apmproxy.NewClient(opts...)
+			require.NoError(t, err)
+			require.NoError(t, apmClient.StartReceiver())
+			defer func() {
+				require.NoError(t, apmClient.Shutdown())
+			}()
+
+			hosts, _ := net.LookupHost("localhost")
+			url := "http://" + hosts[0] + ":1234/intake/v2/events"
+			post := func() http.Header {
+				req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(`{"transaction":{"id":"1"}}`))
+				require.NoError(t, err)
+				// The receiver is restarted for each case.
+				req.Close = true
+				resp, err := newReceiverClient().Do(req)
+				require.NoError(t, err)
+				require.NoError(t, resp.Body.Close())
+				assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+				return resp.Header
+			}
+
+			header := post()
+			if !enabled {
+				assert.Empty(t, header.Get("X-Elastic-Extension-Queue-Depth"))
+				assert.Empty(t, header.Get("X-Elastic-Extension-Degraded"))
+				return
+			}
+			assert.Equal(t, "1", header.Get("X-Elastic-Extension-Queue-Depth"))
+			assert.Equal(t, "false", header.Get("X-Elastic-Extension-Degraded"))
+
+			// The buffer is now above the ship threshold.
+			header = post()
+			assert.Equal(t, "2", header.Get("X-Elastic-Extension-Queue-Depth"))
+			assert.Equal(t, "true", header.Get("X-Elastic-Extension-Degraded"))
+		})
+	}
+}
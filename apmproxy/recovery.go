@@ -0,0 +1,86 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverPanics converts the panics of the receiver handlers into 500
+// responses, so that a bad request fails on its own rather than leaving
+// the agent with a reset connection. The panics are logged with their
+// stack trace and counted, the logger holds the current invocation.
+func (c *Client) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &headerTracker{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// Aborting the response is intended, let the server do it.
+				panic(v)
+			}
+			c.receiverPanics.Add(1)
+			c.logger.Errorw("Recovered from a panic while handling an agent request",
+				"http.request.method", r.Method,
+				"url.path", r.URL.Path,
+				"error.message", fmt.Sprint(v),
+				"error.stack_trace", string(debug.Stack()),
+			)
+			if !rw.wroteHeader {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// ReceiverPanics returns the number of panics recovered while
+// handling the requests of the agents since the client started.
+func (c *Client) ReceiverPanics() int64 {
+	return c.receiverPanics.Load()
+}
+
+// headerTracker records whether the response headers were written,
+// after which the status of the response can't be changed.
+type headerTracker struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *headerTracker) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerTracker) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher, used by the reverse proxy of the
+// info requests.
+func (w *headerTracker) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
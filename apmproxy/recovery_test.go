@@ -0,0 +1,70 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	core, logs := observer.New(zap.ErrorLevel)
+	c := Client{logger: zap.New(core).Sugar()}
+
+	handler := c.recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/written" {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		panic("malformed request")
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/intake/v2/events", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	// The status can't be changed once the headers are written.
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/written", nil))
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	assert.Equal(t, int64(2), c.ReceiverPanics())
+	require.Equal(t, 2, logs.Len())
+	fields := logs.All()[0].ContextMap()
+	assert.Equal(t, "POST", fields["http.request.method"])
+	assert.Equal(t, "/intake/v2/events", fields["url.path"])
+	assert.Equal(t, "malformed request", fields["error.message"])
+	assert.Contains(t, fields["error.stack_trace"], "TestRecoverPanics")
+}
+
+func TestRecoverPanicsAbortHandler(t *testing.T) {
+	c := Client{logger: zap.NewNop().Sugar()}
+	handler := c.recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+	assert.Zero(t, c.ReceiverPanics())
+}
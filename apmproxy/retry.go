@@ -0,0 +1,100 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy configures how the requests sending agent data to the APM
+// server are retried on transient failures: network errors, and 429 or
+// 5xx responses. The delay between two attempts grows exponentially,
+// from InitialBackoff up to MaxBackoff, with a random jitter so that
+// environments failing together don't retry together.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the
+	// first one. Values below 2 disable retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between two attempts.
+	MaxBackoff time.Duration
+	// Multiplier is the factor applied to the delay after each retry.
+	// It defaults to 2.
+	Multiplier float64
+	// Jitter is the fraction, within [0, 1], of the delay randomly
+	// added or removed.
+	Jitter float64
+}
+
+// DefaultRetryPolicy returns a retry policy suited to the short
+// network blips seen in VPCs, retrying up to maxAttempts-1 times.
+func DefaultRetryPolicy(maxAttempts int) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    maxAttempts,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// Retryable returns whether a request to the APM server which ended up
+// with the response status code, or with an error if statusCode is 0,
+// may succeed if retried.
+func (p RetryPolicy) Retryable(statusCode int) bool {
+	return statusCode == 0 ||
+		statusCode == http.StatusTooManyRequests ||
+		statusCode >= http.StatusInternalServerError
+}
+
+// Backoff returns the delay before the retry following the attempt,
+// numbered from 1.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	backoff := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 {
+		backoff = math.Min(backoff, float64(p.MaxBackoff))
+	}
+	if jitter := math.Min(math.Max(p.Jitter, 0), 1); jitter > 0 {
+		backoff += backoff * jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(backoff)
+}
+
+// retry returns the delay before retrying the attempt, numbered from 1,
+// which ended up with the response status code, or with an error if
+// statusCode is 0. It returns false if the attempt must not be retried,
+// including when the context would be done before the retry.
+func (p RetryPolicy) retry(ctx context.Context, attempt int, statusCode int) (time.Duration, bool) {
+	if attempt >= p.MaxAttempts || !p.Retryable(statusCode) || ctx.Err() != nil {
+		return 0, false
+	}
+	backoff := p.Backoff(attempt)
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= backoff {
+		return 0, false
+	}
+	return backoff, true
+}
@@ -0,0 +1,148 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := apmproxy.RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	}
+	assert.Equal(t, 100*time.Millisecond, policy.Backoff(1))
+	assert.Equal(t, 200*time.Millisecond, policy.Backoff(2))
+	assert.Equal(t, 800*time.Millisecond, policy.Backoff(4))
+	assert.Equal(t, time.Second, policy.Backoff(5))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := policy.Backoff(1)
+		assert.GreaterOrEqual(t, backoff, 50*time.Millisecond)
+		assert.LessOrEqual(t, backoff, 150*time.Millisecond)
+	}
+
+	assert.True(t, policy.Retryable(0))
+	assert.True(t, policy.Retryable(http.StatusTooManyRequests))
+	assert.True(t, policy.Retryable(http.StatusBadGateway))
+	assert.False(t, policy.Retryable(http.StatusBadRequest))
+	assert.False(t, policy.Retryable(http.StatusUnauthorized))
+}
+
+// The grace period of the failing transport ends after the tests of the
+// retry policy, which must not log anymore.
+func TestRetryPolicy(t *testing.T) {
+	testCases := map[string]struct {
+		statusCodes    []int
+		maxAttempts    int
+		expectRequests int64
+		expectStatus   apmproxy.Status
+		expectDropped  bool
+	}{
+		"transient failures": {
+			statusCodes:    []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusAccepted},
+			maxAttempts:    3,
+			expectRequests: 3,
+			expectStatus:   apmproxy.Healthy,
+		},
+		"attempts exhausted": {
+			statusCodes:    []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusAccepted},
+			maxAttempts:    2,
+			expectRequests: 2,
+			expectStatus:   apmproxy.Failing,
+			expectDropped:  true,
+		},
+		"client error": {
+			statusCodes:    []int{http.StatusBadRequest, http.StatusAccepted},
+			maxAttempts:    3,
+			expectRequests: 1,
+			expectStatus:   apmproxy.ClientFailing,
+			expectDropped:  true,
+		},
+		"no retry policy": {
+			statusCodes:    []int{http.StatusServiceUnavailable, http.StatusAccepted},
+			expectRequests: 1,
+			expectStatus:   apmproxy.Failing,
+			expectDropped:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var requests atomic.Int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := requests.Add(1)
+				w.WriteHeader(tc.statusCodes[n-1])
+			}))
+			defer server.Close()
+
+			apmClient, err := apmproxy.NewClient(
+				apmproxy.WithURL(server.URL),
+				apmproxy.WithLogger(zap.NewNop().Sugar()),
+				apmproxy.WithRetryPolicy(apmproxy.RetryPolicy{
+					MaxAttempts:    tc.maxAttempts,
+					InitialBackoff: time.Millisecond,
+					Jitter:         0.5,
+				}),
+			)
+			require.NoError(t, err)
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(cancel)
+
+			require.NoError(t, apmClient.PostToApmServer(ctx, apmproxy.AgentData{Data: []byte(`{"metadata":{}}`)}))
+			assert.Equal(t, tc.expectRequests, requests.Load())
+			assert.Equal(t, tc.expectStatus, apmClient.Status)
+			assert.Equal(t, tc.expectDropped, len(apmClient.ResetDropCounts()) > 0)
+		})
+	}
+}
+
+func TestRetryPolicyDeadline(t *testing.T) {
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(server.URL),
+		apmproxy.WithLogger(zap.NewNop().Sugar()),
+		apmproxy.WithRetryPolicy(apmproxy.DefaultRetryPolicy(5)),
+	)
+	require.NoError(t, err)
+
+	// The retry would happen past the deadline of the flush.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.NoError(t, apmClient.PostToApmServer(ctx, apmproxy.AgentData{Data: []byte(`{"metadata":{}}`)}))
+	assert.Equal(t, int64(1), requests.Load())
+}
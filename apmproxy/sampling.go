@@ -0,0 +1,203 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// TailSamplingPolicy decides which invocations have their transactions
+// and spans sent to the APM server, once the invocation is over. The
+// invocations with errors, failed transactions or slow transactions are
+// always sent. The other events of the agent, e.g. metricsets and logs,
+// are sent regardless.
+type TailSamplingPolicy struct {
+	// LatencyThreshold is the duration from which a transaction is slow,
+	// no transaction is considered slow if zero.
+	LatencyThreshold time.Duration
+	// SampleRate is the ratio, between 0 and 1, of the other invocations
+	// which are sent.
+	SampleRate float64
+	// MaxHeldBytes bounds the size of the agent data held until the
+	// end of the invocation. Once exceeded, the invocation is sampled
+	// right away. There is no limit if zero.
+	MaxHeldBytes int
+}
+
+// tailSampler holds the agent data of the current invocation until the
+// invocation is sampled.
+type tailSampler struct {
+	policy TailSamplingPolicy
+
+	mu        sync.Mutex
+	held      []AgentData
+	heldBytes int
+	// decided tells whether the invocation was sampled before its end,
+	// keep whether its transactions and spans are sent.
+	decided bool
+	keep    bool
+}
+
+// enqueueAgentData enqueues the agent data received during an invocation,
+// or holds it until the invocation is sampled with tail sampling. The
+// default service version is added to its metadata first.
+func (c *Client) enqueueAgentData(agentData AgentData) {
+	agentData = c.defaultServiceVersion(agentData)
+
+	s := c.tailSampler
+	if s == nil {
+		c.EnqueueAPMData(agentData)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.decided {
+		c.releaseSampled(agentData, s.keep)
+		return
+	}
+
+	s.held = append(s.held, agentData)
+	s.heldBytes += len(agentData.Data)
+	switch {
+	case c.mustKeep(agentData):
+		s.keep = true
+	case s.policy.MaxHeldBytes > 0 && s.heldBytes > s.policy.MaxHeldBytes:
+		s.keep = rand.Float64() < s.policy.SampleRate
+	default:
+		return
+	}
+	s.decided = true
+	c.releaseHeld()
+}
+
+// SampleInvocation ends the tail sampling of the invocation, if enabled:
+// the agent data held is enqueued, without its transactions and spans if
+// the invocation is not sampled.
+func (c *Client) SampleInvocation() {
+	s := c.tailSampler
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.decided {
+		s.keep = rand.Float64() < s.policy.SampleRate
+	}
+	c.releaseHeld()
+	s.decided, s.keep = false, false
+}
+
+// releaseHeld enqueues the agent data held by the tail sampler, which
+// must be locked.
+func (c *Client) releaseHeld() {
+	s := c.tailSampler
+	if len(s.held) > 0 {
+		c.logger.Debugf("Tail sampling of the invocation: %d payloads of agent data held, sampled: %t", len(s.held), s.keep)
+	}
+	for _, agentData := range s.held {
+		c.releaseSampled(agentData, s.keep)
+	}
+	s.held, s.heldBytes = nil, 0
+}
+
+// releaseSampled enqueues the agent data of a sampled invocation, or its
+// events other than transactions and spans if the invocation was not
+// sampled.
+func (c *Client) releaseSampled(agentData AgentData, keep bool) {
+	if keep {
+		c.EnqueueAPMData(agentData)
+		return
+	}
+
+	data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		// The data cannot be filtered, send it rather than losing
+		// events other than transactions and spans.
+		c.EnqueueAPMData(agentData)
+		return
+	}
+
+	var filtered bytes.Buffer
+	var events int
+	for len(data) > 0 {
+		var line []byte
+		line, data, _ = bytes.Cut(data, []byte("\n"))
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		switch eventType(line) {
+		case "transaction", "span":
+			continue
+		case "metadata":
+		default:
+			events++
+		}
+		if filtered.Len() > 0 {
+			filtered.WriteByte('\n')
+		}
+		filtered.Write(line)
+	}
+	if events == 0 {
+		return
+	}
+	c.EnqueueAPMData(AgentData{Data: filtered.Bytes(), receivedAt: agentData.receivedAt})
+}
+
+// mustKeep returns whether the agent data has errors, failed transactions
+// or transactions slower than the latency threshold of the tail sampling
+// policy. Agent data which cannot be decoded is kept.
+func (c *Client) mustKeep(agentData AgentData) bool {
+	data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		return true
+	}
+
+	threshold := c.tailSampler.policy.LatencyThreshold
+	for len(data) > 0 {
+		var line []byte
+		line, data, _ = bytes.Cut(data, []byte("\n"))
+		switch eventType(line) {
+		case "error":
+			return true
+		case "transaction":
+			var event struct {
+				Transaction struct {
+					Duration float64 `json:"duration"`
+					Outcome  string  `json:"outcome"`
+				} `json:"transaction"`
+			}
+			if err := json.Unmarshal(line, &event); err != nil {
+				return true
+			}
+			tx := event.Transaction
+			if tx.Outcome == "failure" {
+				return true
+			}
+			if threshold > 0 && time.Duration(tx.Duration*float64(time.Millisecond)) >= threshold {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestTailSampling(t *testing.T) {
+	const metadata = `{"metadata":{"service":{"name":"foo"}}}`
+	const fastTransaction = `{"transaction":{"id":"1","duration":10,"outcome":"success"}}`
+	const slowTransaction = `{"transaction":{"id":"2","duration":600,"outcome":"success"}}`
+	const failedTransaction = `{"transaction":{"id":"3","duration":10,"outcome":"failure"}}`
+	const span = `{"span":{"id":"4"}}`
+	const errorEvent = `{"error":{"id":"5"}}`
+	const metricset = `{"metricset":{"samples":{}}}`
+
+	for name, tc := range map[string]struct {
+		policy   apmproxy.TailSamplingPolicy
+		payloads []string
+		// released is the number of payloads enqueued before the end
+		// of the invocation, once it was sampled.
+		released int
+		expected []string
+	}{
+		"fast invocation not sampled": {
+			policy:   apmproxy.TailSamplingPolicy{LatencyThreshold: 500 * time.Millisecond},
+			payloads: []string{span + "\n" + metricset, fastTransaction},
+			expected: []string{metadata, metricset},
+		},
+		"fast invocation sampled": {
+			policy:   apmproxy.TailSamplingPolicy{LatencyThreshold: 500 * time.Millisecond, SampleRate: 1},
+			payloads: []string{span, fastTransaction},
+			expected: []string{metadata, span, metadata, fastTransaction},
+		},
+		"slow invocation": {
+			policy:   apmproxy.TailSamplingPolicy{LatencyThreshold: 500 * time.Millisecond},
+			payloads: []string{span, slowTransaction},
+			released: 2,
+			expected: []string{metadata, span, metadata, slowTransaction},
+		},
+		"failed invocation": {
+			payloads: []string{span, failedTransaction},
+			released: 2,
+			expected: []string{metadata, span, metadata, failedTransaction},
+		},
+		"invocation with errors": {
+			payloads: []string{span, errorEvent, fastTransaction},
+			released: 3,
+			expected: []string{metadata, span, metadata, errorEvent, metadata, fastTransaction},
+		},
+		"held bytes exceeded": {
+			policy:   apmproxy.TailSamplingPolicy{MaxHeldBytes: 1},
+			payloads: []string{span, errorEvent, fastTransaction},
+			released: 1,
+			expected: []string{metadata, errorEvent},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server, s := newOTLPServer(t)
+			apmClient, err := apmproxy.NewClient(
+				apmproxy.WithURL(server.URL),
+				apmproxy.WithReceiverAddress(":1234"),
+				apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+				apmproxy.WithTailSampling(tc.policy),
+			)
+			require.NoError(t, err)
+			require.NoError(t, apmClient.StartReceiver())
+			defer func() {
+				require.NoError(t, apmClient.Shutdown())
+			}()
+
+			hosts, _ := net.LookupHost("localhost")
+			url := "http://" + hosts[0] + ":1234/intake/v2/events"
+			client := newReceiverClient()
+			for _, payload := range tc.payloads {
+				resp, err := client.Post(url, "application/x-ndjson", strings.NewReader(metadata+"\n"+payload))
+				require.NoError(t, err)
+				require.NoError(t, resp.Body.Close())
+				assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+			}
+			assert.Equal(t, tc.released, apmClient.BufferStats().Depth)
+
+			apmClient.SampleInvocation()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			require.NoError(t, apmClient.FlushAPMData(ctx))
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			assert.Equal(t, tc.expected, s.intake)
+		})
+	}
+}
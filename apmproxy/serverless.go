@@ -0,0 +1,49 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+)
+
+// serverlessDomain is the domain of the managed intake
+// of Elastic serverless projects.
+const serverlessDomain = ".elastic.cloud"
+
+// IsServerlessURL returns true if the URL is the managed
+// intake of an Elastic serverless project.
+func IsServerlessURL(serverURL string) bool {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(strings.ToLower(u.Hostname()), serverlessDomain)
+}
+
+// normalizeAPIKey returns the API key encoded as expected in the
+// Authorization header. Keys given as "id:api_key", the format
+// returned by the Elasticsearch API, are base64 encoded.
+func normalizeAPIKey(key string) string {
+	key = strings.TrimSpace(key)
+	if strings.Contains(key, ":") {
+		return base64.StdEncoding.EncodeToString([]byte(key))
+	}
+	return key
+}
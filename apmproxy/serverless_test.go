@@ -0,0 +1,67 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestIsServerlessURL(t *testing.T) {
+	assert.True(t, apmproxy.IsServerlessURL("https://my-project-c2e4f1.apm.eu-west-1.aws.elastic.cloud:443"))
+	assert.True(t, apmproxy.IsServerlessURL("https://my-project-c2e4f1.apm.us-east-1.aws.Elastic.Cloud"))
+	assert.False(t, apmproxy.IsServerlessURL("https://my-deployment.apm.us-east-1.aws.cloud.es.io:443"))
+	assert.False(t, apmproxy.IsServerlessURL("http://localhost:8200"))
+	assert.False(t, apmproxy.IsServerlessURL("://elastic.cloud"))
+}
+
+func TestAPIKeyFormats(t *testing.T) {
+	testCases := map[string]string{
+		"encoded":        "VnVhQ2ZHY0JDZGJrUW0tZTVhT3g6dWkybHAyYXhUTm1zeWFrdzl0dk5udw==",
+		"id and api key": "VuaCfGcBCdbkQm-e5aOx:ui2lp2axTNmsyakw9tvNnw",
+		"trailing space": "VnVhQ2ZHY0JDZGJrUW0tZTVhT3g6dWkybHAyYXhUTm1zeWFrdzl0dk5udw==\n",
+	}
+
+	for name, key := range testCases {
+		t.Run(name, func(t *testing.T) {
+			apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "ApiKey VnVhQ2ZHY0JDZGJrUW0tZTVhT3g6dWkybHAyYXhUTm1zeWFrdzl0dk5udw==", r.Header.Get("Authorization"))
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			defer apmServer.Close()
+
+			apmClient, err := apmproxy.NewClient(
+				apmproxy.WithURL(apmServer.URL),
+				apmproxy.WithAPIKey(key),
+				apmproxy.WithServerless(),
+				apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+			)
+			require.NoError(t, err)
+			require.NoError(t, apmClient.PostToApmServer(context.Background(), apmproxy.AgentData{Data: []byte(`{}`)}))
+			assert.Equal(t, apmproxy.Healthy, apmClient.Status)
+		})
+	}
+}
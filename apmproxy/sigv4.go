@@ -0,0 +1,101 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// SigV4 holds the settings to sign the requests to the APM server with
+// AWS Signature Version 4, for intake endpoints requiring IAM auth such
+// as Amazon OpenSearch Ingestion pipelines or collectors behind API Gateway.
+type SigV4 struct {
+	Credentials aws.CredentialsProvider
+	Region      string
+	// Service is the signing name of the endpoint, e.g. osis
+	// or execute-api.
+	Service string
+}
+
+// sigV4Transport signs the requests before sending them with the
+// underlying transport.
+type sigV4Transport struct {
+	base   http.RoundTripper
+	sigV4  SigV4
+	signer *v4.Signer
+	now    func() time.Time
+}
+
+func newSigV4Transport(base http.RoundTripper, sigV4 SigV4) *sigV4Transport {
+	return &sigV4Transport{
+		base:   base,
+		sigV4:  sigV4,
+		signer: v4.NewSigner(),
+		now:    time.Now,
+	}
+}
+
+func (t *sigV4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	credentials, err := t.sigV4.Credentials.Retrieve(req.Context())
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve AWS credentials: %w", err)
+	}
+
+	// The request must not be modified by the transport.
+	signed := req.Clone(req.Context())
+	signed.Header.Del("Authorization")
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		r := req.Body
+		if req.GetBody != nil {
+			if r, err = req.GetBody(); err != nil {
+				return nil, fmt.Errorf("failed to read request body: %w", err)
+			}
+		}
+		body, err = io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+		signed.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	payloadHash := sha256.Sum256(body)
+	signed.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	if err := t.signer.SignHTTP(req.Context(), credentials, signed, hex.EncodeToString(payloadHash[:]), t.sigV4.Service, t.sigV4.Region, t.now()); err != nil {
+		return nil, fmt.Errorf("failed to sign request: %w", err)
+	}
+	return t.base.RoundTrip(signed)
+}
+
+// CloseIdleConnections closes the idle connections of the underlying transport.
+func (t *sigV4Transport) CloseIdleConnections() {
+	if ci, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,255 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spillSuffixes are the suffixes of the spill files by content
+// encoding of the agent data.
+var spillSuffixes = map[string]string{
+	"":        ".ndjson",
+	"gzip":    ".ndjson.gz",
+	"deflate": ".ndjson.zz",
+}
+
+// spill stores on disk the agent data which could not be sent to the
+// APM server, e.g. while it is unreachable, so that it is sent later
+// rather than dropped. One file is written per payload, named after the
+// time it was received so that payloads are replayed in order, and their
+// age is known.
+type spill struct {
+	dir      string
+	maxBytes int64
+
+	mu sync.Mutex
+	// size is the size of the spill files, computed from the directory
+	// on first use as files may be left by a previous instance.
+	size   int64
+	loaded bool
+	seq    int64
+}
+
+// load computes the size of the spill files, once.
+func (s *spill) load() error {
+	if s.loaded {
+		return nil
+	}
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			s.size += info.Size()
+		}
+	}
+	s.loaded = true
+	return nil
+}
+
+// files returns the paths of the spill files, oldest first.
+func (s *spill) files() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spill directory: %w", err)
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.Contains(e.Name(), ".ndjson") && !strings.HasSuffix(e.Name(), ".tmp") {
+			files = append(files, filepath.Join(s.dir, e.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// write stores the agent data on disk, unless it would exceed the
+// maximum disk usage. The file is written atomically, a partially
+// written payload would be rejected by the APM server.
+func (s *spill) write(agentData AgentData) error {
+	suffix, ok := spillSuffixes[agentData.ContentEncoding]
+	if !ok {
+		return fmt.Errorf("unsupported content encoding %q", agentData.ContentEncoding)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	if s.size+int64(len(agentData.Data)) > s.maxBytes {
+		return fmt.Errorf("spill directory full: %d bytes used out of %d", s.size, s.maxBytes)
+	}
+
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create spill directory: %w", err)
+	}
+	received := agentData.receivedAt
+	if received.IsZero() {
+		received = time.Now()
+	}
+	s.seq++
+	path := filepath.Join(s.dir, fmt.Sprintf("%019d-%06d%s", received.UnixNano(), s.seq%1e6, suffix))
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, agentData.Data, 0o644); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write spill file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write spill file: %w", err)
+	}
+	s.size += int64(len(agentData.Data))
+	return nil
+}
+
+// read reads the agent data of the spill file.
+func (s *spill) read(path string) (AgentData, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return AgentData{}, fmt.Errorf("failed to read spill file: %w", err)
+	}
+
+	agentData := AgentData{Data: data}
+	if received, _, found := strings.Cut(filepath.Base(path), "-"); found {
+		if ns, err := strconv.ParseInt(received, 10, 64); err == nil {
+			agentData.receivedAt = time.Unix(0, ns)
+		}
+	}
+	for encoding, suffix := range spillSuffixes {
+		if encoding != "" && strings.HasSuffix(path, suffix) {
+			agentData.ContentEncoding = encoding
+		}
+	}
+	return agentData, nil
+}
+
+// remove removes the spill file, once its agent data is sent or dropped.
+func (s *spill) remove(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to remove spill file: %w", err)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove spill file: %w", err)
+	}
+	s.size -= info.Size()
+	if s.size < 0 {
+		s.size = 0
+	}
+	return nil
+}
+
+// bytes returns the size of the spill files.
+func (s *spill) bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return 0
+	}
+	return s.size
+}
+
+// spillData stores the agent data which could not be sent on disk, and
+// returns false if it is not spilled and must be dropped.
+func (c *Client) spillData(agentData AgentData) bool {
+	if c.spill == nil {
+		return false
+	}
+	if err := c.spill.write(agentData); err != nil {
+		c.logger.Warnf("Failed to spill agent data to disk: %v", err)
+		return false
+	}
+	c.logger.Debug("Spilled agent data which could not be sent to disk")
+	return true
+}
+
+// ReplaySpilled sends the agent data spilled to disk to the APM server,
+// oldest first. A spill file is only removed once its agent data is
+// sent, or dropped if the APM server rejected it. It stops at the first
+// transient failure, leaving the agent data which could not be sent on
+// disk. It returns the number of payloads sent, and is a no-op if
+// spilling is disabled or the APM server is failing.
+func (c *Client) ReplaySpilled(ctx context.Context) (int, error) {
+	if c.spill == nil || c.IsUnhealthy() {
+		return 0, nil
+	}
+	files, err := c.spill.files()
+	if err != nil {
+		return 0, err
+	}
+
+	var replayed int
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return replayed, fmt.Errorf("replay interrupted: %w", err)
+		}
+		agentData, err := c.spill.read(f)
+		if err != nil {
+			return replayed, err
+		}
+		dropReason, spillable, err := c.postToApmServer(ctx, agentData)
+		if dropReason != "" && spillable {
+			if err == nil {
+				err = errors.New("the APM server failed during the replay")
+			}
+			return replayed, fmt.Errorf("failed to replay spilled agent data: %w", err)
+		}
+		if err := c.spill.remove(f); err != nil {
+			return replayed, err
+		}
+		if dropReason != "" {
+			c.dropped(dropReason, agentData)
+			continue
+		}
+		if err != nil {
+			return replayed, fmt.Errorf("failed to replay spilled agent data: %w", err)
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+// SpilledBytes returns the size of the agent data spilled to disk
+// waiting to be sent.
+func (c *Client) SpilledBytes() int64 {
+	if c.spill == nil {
+		return 0
+	}
+	return c.spill.bytes()
+}
@@ -0,0 +1,176 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestSpill(t *testing.T) {
+	var available atomic.Bool
+	var mu sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(gr)
+		require.NoError(t, err)
+		mu.Lock()
+		received = append(received, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(server.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithSpill(dir, 1024),
+	)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+	ctx := context.Background()
+
+	// The APM server is unavailable, then in backoff: the data is spilled.
+	first := `{"metadata":{}}` + "\n" + `{"transaction":{"id":"1"}}`
+	second := `{"metadata":{}}` + "\n" + `{"transaction":{"id":"2"}}`
+	require.NoError(t, apmClient.PostToApmServer(ctx, apmproxy.AgentData{Data: []byte(first)}))
+	require.Error(t, apmClient.PostToApmServer(ctx, apmproxy.AgentData{Data: []byte(second)}))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, int64(len(first)+len(second)), apmClient.SpilledBytes())
+	assert.Equal(t, int64(len(first)+len(second)), apmClient.BufferStats().SpilledBytes)
+	assert.Empty(t, apmClient.ResetDropCounts())
+
+	// The replay waits for the APM server to recover.
+	n, err := apmClient.ReplaySpilled(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	available.Store(true)
+	apmClient.UpdateStatus(ctx, apmproxy.Healthy)
+	n, err = apmClient.ReplaySpilled(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{first, second}, received)
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.Equal(t, int64(0), apmClient.SpilledBytes())
+
+	// Data exceeding the maximum disk usage is dropped.
+	available.Store(false)
+	large := `{"metadata":{}}` + "\n" + `{"transaction":{"name":"` + strings.Repeat("x", 2048) + `"}}`
+	require.NoError(t, apmClient.PostToApmServer(ctx, apmproxy.AgentData{Data: []byte(large)}))
+	assert.Equal(t, int64(1), apmClient.ResetDropCounts()[apmproxy.DropRejected].Payloads)
+	assert.Equal(t, int64(0), apmClient.SpilledBytes())
+}
+
+func TestSpillLeftByPreviousInstance(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(dir+"/0000000000000000001-000001.ndjson", []byte(`{"metadata":{}}`), 0o644))
+
+	var received atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(server.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		apmproxy.WithSpill(dir, 1024),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, int64(15), apmClient.SpilledBytes())
+
+	n, err := apmClient.ReplaySpilled(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, int64(1), received.Load())
+}
+
+func TestSpillReplayFailure(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(dir+"/0000000000000000001-000001.ndjson", []byte(`{"metadata":{}}`), 0o644))
+	require.NoError(t, os.WriteFile(dir+"/0000000000000000002-000002.ndjson", []byte(`{"metadata":{}}`), 0o644))
+
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(server.URL),
+		apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		// The spill directory is full.
+		apmproxy.WithSpill(dir, 30),
+	)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, apmClient.Shutdown())
+	}()
+
+	// The data which could not be sent is left on disk.
+	n, err := apmClient.ReplaySpilled(context.Background())
+	require.Error(t, err)
+	assert.Equal(t, 0, n)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, int64(30), apmClient.SpilledBytes())
+	assert.Empty(t, apmClient.ResetDropCounts())
+
+	// The data rejected by the APM server is dropped.
+	status.Store(http.StatusBadRequest)
+	apmClient.UpdateStatus(context.Background(), apmproxy.Healthy)
+	n, err = apmClient.ReplaySpilled(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.Equal(t, int64(0), apmClient.SpilledBytes())
+	assert.Equal(t, int64(2), apmClient.ResetDropCounts()[apmproxy.DropRejected].Payloads)
+}
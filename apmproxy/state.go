@@ -0,0 +1,219 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/elastic/apm-aws-lambda/extension"
+)
+
+// State is a snapshot of the internal state of the client.
+type State struct {
+	Status            Status       `json:"status"`
+	ReconnectionCount int          `json:"reconnection_count"`
+	SendStrategy      SendStrategy `json:"send_strategy"`
+	Paused            bool         `json:"paused"`
+	AgentFlushed      bool         `json:"agent_flushed"`
+	QueuedAgentData   int          `json:"queued_agent_data"`
+	QueueCapacity     int          `json:"queue_capacity"`
+	Buffer            BufferStats  `json:"buffer"`
+	ForwardedEvents   EventCounts  `json:"forwarded_events"`
+	DroppedData       DropCounts   `json:"dropped_data,omitempty"`
+
+	// QueuedPayloads is the agent data buffered for the forwarder, in
+	// the order it was buffered. It is only tracked with the state
+	// endpoint, see WithStateEndpoint.
+	QueuedPayloads []StatePayload `json:"queued_payloads,omitempty"`
+	// HeldPayloads is the agent data of the invocation held until the
+	// invocation is sampled, see WithTailSampling.
+	HeldPayloads []StatePayload `json:"held_payloads,omitempty"`
+	// Components is the state of the other components of the extension,
+	// such as the invocations in flight, see WithStateComponent.
+	Components map[string]interface{} `json:"components,omitempty"`
+}
+
+// maxStatePayloadBytes truncates the payloads of the state, so that
+// large payloads don't make the state endpoint unusable.
+const maxStatePayloadBytes = 64 * 1024
+
+// StatePayload is agent data of the state of the client.
+type StatePayload struct {
+	// ContentEncoding is the encoding of the agent data as buffered.
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	// Size is the size of the agent data as buffered.
+	Size int `json:"size"`
+	// Data is the uncompressed agent data, truncated after
+	// maxStatePayloadBytes bytes.
+	Data      string `json:"data"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+func newStatePayload(agentData AgentData) StatePayload {
+	p := StatePayload{ContentEncoding: agentData.ContentEncoding, Size: len(agentData.Data)}
+	r, err := newUncompressedReader(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		return p
+	}
+	defer r.Close()
+	// Truncated or corrupted data is exposed up to the error.
+	data, _ := io.ReadAll(io.LimitReader(r, maxStatePayloadBytes+1))
+	if len(data) > maxStatePayloadBytes {
+		data, p.Truncated = data[:maxStatePayloadBytes], true
+	}
+	p.Data = string(data)
+	return p
+}
+
+// trackQueued records the agent data added to the buffer, for the state
+// endpoint to expose it without reading the buffer.
+func (c *Client) trackQueued(agentData AgentData) {
+	if !c.stateEndpoint {
+		return
+	}
+	c.queuedMu.Lock()
+	defer c.queuedMu.Unlock()
+	c.queued = append(c.queued, agentData)
+}
+
+// untrackQueued forgets the agent data read from the buffer.
+func (c *Client) untrackQueued(agentData AgentData) {
+	if !c.stateEndpoint {
+		return
+	}
+	c.queuedMu.Lock()
+	defer c.queuedMu.Unlock()
+	for i, queued := range c.queued {
+		if sameAgentData(queued, agentData) {
+			c.queued = append(c.queued[:i], c.queued[i+1:]...)
+			return
+		}
+	}
+}
+
+// sameAgentData returns whether a and b share the same data.
+func sameAgentData(a, b AgentData) bool {
+	return len(a.Data) == len(b.Data) && (len(a.Data) == 0 || &a.Data[0] == &b.Data[0])
+}
+
+// State returns a snapshot of the current state of the client.
+func (c *Client) State() State {
+	c.mu.RLock()
+	s := State{
+		Status:            c.Status,
+		ReconnectionCount: c.ReconnectionCount,
+		SendStrategy:      c.sendStrategy,
+	}
+	c.mu.RUnlock()
+
+	s.Paused = c.Paused()
+	s.QueuedAgentData = len(c.DataChannel)
+	s.QueueCapacity = cap(c.DataChannel)
+	s.Buffer = c.BufferStats()
+
+	c.eventsMu.Lock()
+	s.ForwardedEvents = c.totalEvents
+	c.eventsMu.Unlock()
+
+	c.dropsMu.Lock()
+	if len(c.totalDrops) > 0 {
+		s.DroppedData = make(DropCounts, len(c.totalDrops))
+		for reason, stats := range c.totalDrops {
+			s.DroppedData[reason] = stats
+		}
+	}
+	c.dropsMu.Unlock()
+
+	select {
+	case <-c.WaitForFlush():
+		s.AgentFlushed = true
+	default:
+	}
+
+	c.queuedMu.Lock()
+	for _, agentData := range c.queued {
+		s.QueuedPayloads = append(s.QueuedPayloads, newStatePayload(agentData))
+	}
+	c.queuedMu.Unlock()
+
+	if ts := c.tailSampler; ts != nil {
+		ts.mu.Lock()
+		for _, agentData := range ts.held {
+			s.HeldPayloads = append(s.HeldPayloads, newStatePayload(agentData))
+		}
+		ts.mu.Unlock()
+	}
+
+	if len(c.stateComponents) > 0 {
+		s.Components = make(map[string]interface{}, len(c.stateComponents))
+		for name, state := range c.stateComponents {
+			s.Components[name] = state()
+		}
+	}
+
+	return s
+}
+
+// URL: http://server/debug/state
+func (c *Client) handleState() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.State()); err != nil {
+			c.logger.Errorf("Failed to encode state: %v", err)
+		}
+	}
+}
+
+// StatusReport is the status of the extension, served at /status.
+type StatusReport struct {
+	Build      extension.BuildInfo    `json:"build"`
+	Status     Status                 `json:"status"`
+	Buffer     BufferStats            `json:"buffer"`
+	Components map[string]interface{} `json:"components,omitempty"`
+	// ReceiverPanics is the number of panics recovered while handling
+	// the requests of the agents.
+	ReceiverPanics int64 `json:"receiver_panics,omitempty"`
+}
+
+// URL: http://server/status
+func (c *Client) handleStatus() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.mu.RLock()
+		report := StatusReport{
+			Build:  extension.GetBuildInfo(),
+			Status: c.Status,
+		}
+		c.mu.RUnlock()
+		report.Buffer = c.BufferStats()
+		report.ReceiverPanics = c.ReceiverPanics()
+
+		if len(c.statusComponents) > 0 {
+			report.Components = make(map[string]interface{}, len(c.statusComponents))
+			for name, status := range c.statusComponents {
+				report.Components[name] = status()
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			c.logger.Errorf("Failed to encode status: %v", err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestTLSServerName(t *testing.T) {
+	// The certificate of the test server is issued for example.com
+	apmServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "example.com", r.TLS.ServerName)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	testCases := map[string]struct {
+		serverName string
+		expectErr  bool
+	}{
+		"certificate name": {serverName: "example.com"},
+		"other name":       {serverName: "apm.example.org", expectErr: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			apmClient, err := NewClient(
+				WithURL(apmServer.URL),
+				WithTLSServerName(tc.serverName),
+				// The failing transport logs after the test, at the end of its grace period.
+				WithLogger(zap.NewNop().Sugar()),
+			)
+			require.NoError(t, err)
+			// Trust the certificate of the test server
+			transport := apmClient.client.Transport.(*http.Transport)
+			if transport.TLSClientConfig == nil {
+				transport.TLSClientConfig = apmServer.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+			} else {
+				transport.TLSClientConfig.RootCAs = apmServer.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+			}
+
+			err = apmClient.PostToApmServer(context.Background(), AgentData{Data: []byte(`{"metadata":{}}`)})
+			if tc.expectErr {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "x509: certificate")
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
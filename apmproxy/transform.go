@@ -0,0 +1,242 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// transformFuncs are the functions available to the templates
+// of the transformations, in addition to the builtin ones.
+var transformFuncs = template.FuncMap{
+	"split":      strings.Split,
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"replace":    strings.ReplaceAll,
+	"trimPrefix": strings.TrimPrefix,
+	"trimSuffix": strings.TrimSuffix,
+}
+
+// Transformation sets or renames a field of the agent events before they
+// are forwarded, e.g. to derive a label from the transaction name without
+// changing the ingest pipelines.
+type Transformation struct {
+	// Event is the type of the events transformed, e.g. "transaction".
+	// All the events are transformed when empty.
+	Event string `json:"event,omitempty"`
+	// Field is the path of the field set, relative to the event,
+	// e.g. "context.tags.route_group".
+	Field string `json:"field"`
+	// Template is a Go template computing the value of the field from
+	// the event, e.g. `{{index (split .transaction.name "/") 1}}`.
+	// The field is not set when the template renders an empty string.
+	Template string `json:"template,omitempty"`
+	// From is the path of the field renamed to Field, relative to
+	// the event. It is exclusive with Template.
+	From string `json:"from,omitempty"`
+
+	tmpl *template.Template
+}
+
+// ParseTransformations parses the JSON array of the transformations
+// and compiles their templates.
+func ParseTransformations(s string) ([]Transformation, error) {
+	var transformations []Transformation
+	if err := json.Unmarshal([]byte(s), &transformations); err != nil {
+		return nil, err
+	}
+	for i := range transformations {
+		if err := transformations[i].compile(); err != nil {
+			return nil, fmt.Errorf("invalid transformation %d: %w", i, err)
+		}
+	}
+	return transformations, nil
+}
+
+func (t *Transformation) compile() error {
+	if t.Field == "" {
+		return errors.New("field cannot be empty")
+	}
+	if (t.Template == "") == (t.From == "") {
+		return errors.New("exactly one of template and from must be set")
+	}
+	if t.Template == "" {
+		return nil
+	}
+
+	tmpl, err := template.New(t.Field).Funcs(transformFuncs).Option("missingkey=zero").Parse(t.Template)
+	if err != nil {
+		return err
+	}
+	t.tmpl = tmpl
+	return nil
+}
+
+// appliesTo returns whether the transformation applies to the events
+// of the given type.
+func (t *Transformation) appliesTo(eventType string) bool {
+	return t.Event == "" || t.Event == eventType
+}
+
+// apply applies the transformation to the decoded event of the given type,
+// and returns whether the event changed.
+func (t *Transformation) apply(eventType string, event map[string]interface{}) (bool, error) {
+	if !t.appliesTo(eventType) {
+		return false, nil
+	}
+	fields, ok := event[eventType].(map[string]interface{})
+	if !ok {
+		return false, nil
+	}
+
+	if t.From != "" {
+		if value, ok := deleteField(fields, t.From); ok {
+			setField(fields, t.Field, value)
+			return true, nil
+		}
+		return false, nil
+	}
+
+	var b strings.Builder
+	if err := t.tmpl.Execute(&b, event); err != nil {
+		return false, err
+	}
+	if value := b.String(); value != "" && value != "<no value>" {
+		setField(fields, t.Field, value)
+		return true, nil
+	}
+	return false, nil
+}
+
+// setField sets the field at the dotted path, creating the
+// intermediate objects as needed.
+func setField(fields map[string]interface{}, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := fields[k].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			fields[k] = next
+		}
+		fields = next
+	}
+	fields[keys[len(keys)-1]] = value
+}
+
+// deleteField removes the field at the dotted path and returns its value.
+func deleteField(fields map[string]interface{}, path string) (interface{}, bool) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := fields[k].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		fields = next
+	}
+	value, ok := fields[keys[len(keys)-1]]
+	delete(fields, keys[len(keys)-1])
+	return value, ok
+}
+
+// transformAgentData applies the transformations to the events of the
+// agent data, which is forwarded uncompressed. Lines that cannot be
+// transformed are forwarded unchanged. The agent data is returned as is,
+// still compressed, when no event changed.
+func (c *Client) transformAgentData(agentData AgentData) AgentData {
+	data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		c.logger.Warnf("Failed to decompress agent data to transform it: %v", err)
+		return agentData
+	}
+
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	changed := false
+	for len(data) > 0 {
+		var line []byte
+		line, data, _ = bytes.Cut(data, []byte("\n"))
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		if transformed, err := c.transformEvent(line, enc); err != nil {
+			c.logger.Debugf("Failed to transform agent event: %v", err)
+			out.Write(line)
+			out.WriteByte('\n')
+		} else if !transformed {
+			out.Write(line)
+			out.WriteByte('\n')
+		} else {
+			changed = true
+		}
+	}
+	if !changed {
+		return agentData
+	}
+
+	agentData.Data = out.Bytes()
+	agentData.ContentEncoding = ""
+	return agentData
+}
+
+// transformEvent encodes the transformed event with enc, if it is not
+// the metadata and a transformation changed it. It returns false if the
+// event was not encoded. The events of the types no transformation
+// applies to are not decoded.
+func (c *Client) transformEvent(line []byte, enc *json.Encoder) (bool, error) {
+	eventType := eventType(line)
+	if eventType == "" || eventType == "metadata" || !c.transforms(eventType) {
+		return false, nil
+	}
+
+	var event map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	if err := dec.Decode(&event); err != nil {
+		return false, err
+	}
+	changed := false
+	for i := range c.transformations {
+		applied, err := c.transformations[i].apply(eventType, event)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || applied
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, enc.Encode(event)
+}
+
+// transforms returns whether a transformation applies to the events
+// of the given type.
+func (c *Client) transforms(eventType string) bool {
+	for i := range c.transformations {
+		if c.transformations[i].appliesTo(eventType) {
+			return true
+		}
+	}
+	return false
+}
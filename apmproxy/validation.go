@@ -0,0 +1,165 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// maxErrorDocumentSize is the maximum size of the invalid document
+// reported back to the agent.
+const maxErrorDocumentSize = 256
+
+// requiredFields lists the fields events of each known type must have.
+var requiredFields = map[string][]string{
+	"transaction": {"id", "trace_id", "type", "duration"},
+	"span":        {"id", "trace_id", "parent_id", "name", "type", "duration"},
+	"error":       {"id"},
+	"metricset":   {"samples"},
+	"log":         {},
+}
+
+// intakeResult is the response to an intake request with invalid events,
+// in the format of the APM Server.
+type intakeResult struct {
+	Accepted int         `json:"accepted"`
+	Errors   []jsonError `json:"errors"`
+}
+
+// validateIntakeData validates the uncompressed ndjson agent data. It
+// returns the metadata and the valid events, the number of valid events
+// and the errors of the invalid lines.
+func validateIntakeData(data []byte) ([]byte, int, []jsonError) {
+	var (
+		valid    bytes.Buffer
+		accepted int
+		errs     []jsonError
+		metadata bool
+	)
+
+	for len(data) > 0 {
+		var line []byte
+		line, data, _ = bytes.Cut(data, []byte("\n"))
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		eventType, err := validateEvent(line, !metadata)
+		if err != nil {
+			errs = append(errs, jsonError{Message: err.Error(), Document: truncateDocument(line)})
+			if !metadata && json.Valid(line) {
+				// Events cannot be processed without metadata. Corrupted
+				// lines are skipped to resync on the metadata.
+				return nil, 0, errs
+			}
+			continue
+		}
+
+		if eventType == "metadata" {
+			metadata = true
+		} else {
+			accepted++
+		}
+		valid.Write(line)
+		valid.WriteByte('\n')
+	}
+
+	if accepted == 0 {
+		return nil, 0, errs
+	}
+	return valid.Bytes(), accepted, errs
+}
+
+// validateEvent validates a single ndjson line and returns its event type.
+func validateEvent(line []byte, first bool) (string, error) {
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal(line, &event); err != nil {
+		return "", fmt.Errorf("invalid JSON: %w", err)
+	}
+	if len(event) != 1 {
+		return "", fmt.Errorf("expected a single event, got %d keys", len(event))
+	}
+
+	var (
+		eventType string
+		raw       json.RawMessage
+	)
+	for k, v := range event {
+		eventType, raw = k, v
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return "", fmt.Errorf("invalid %s: %w", eventType, err)
+	}
+
+	if first {
+		if eventType != "metadata" {
+			return "", fmt.Errorf("expected metadata as first line, got %s", eventType)
+		}
+		return eventType, validateMetadata(fields)
+	}
+
+	required, ok := requiredFields[eventType]
+	if !ok {
+		return "", fmt.Errorf("unknown event type %s", eventType)
+	}
+	for _, field := range required {
+		if _, ok := fields[field]; !ok {
+			return "", fmt.Errorf("invalid %s: missing required field %s", eventType, field)
+		}
+	}
+
+	if timestamp, ok := fields["timestamp"]; ok {
+		var t float64
+		if err := json.Unmarshal(timestamp, &t); err != nil || t < 0 {
+			return "", fmt.Errorf("invalid %s: invalid timestamp %s", eventType, timestamp)
+		}
+	}
+
+	return eventType, nil
+}
+
+func validateMetadata(fields map[string]json.RawMessage) error {
+	var service struct {
+		Agent struct {
+			Name string `json:"name"`
+		} `json:"agent"`
+	}
+	raw, ok := fields["service"]
+	if !ok {
+		return fmt.Errorf("invalid metadata: missing required field service")
+	}
+	if err := json.Unmarshal(raw, &service); err != nil {
+		return fmt.Errorf("invalid metadata: %w", err)
+	}
+	if service.Agent.Name == "" {
+		return fmt.Errorf("invalid metadata: missing required field service.agent.name")
+	}
+	return nil
+}
+
+func truncateDocument(line []byte) string {
+	if len(line) > maxErrorDocumentSize {
+		return string(line[:maxErrorDocumentSize]) + "..."
+	}
+	return string(line)
+}
@@ -20,11 +20,16 @@ package app
 import (
 	"context"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/elastic/apm-aws-lambda/apmproxy"
 	"github.com/elastic/apm-aws-lambda/extension"
 	"github.com/elastic/apm-aws-lambda/logger"
@@ -32,6 +37,7 @@ import (
 
 	"go.elastic.co/ecszap"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 // App is the main application.
@@ -39,8 +45,55 @@ type App struct {
 	extensionName   string
 	extensionClient *extension.Client
 	logsClient      *logsapi.Client
+	logsEventTypes  []logsapi.EventType
 	apmClient       *apmproxy.Client
 	logger          *zap.SugaredLogger
+	setLogLevel     func(zapcore.Level)
+	instanceLockDir string
+
+	// invocationFields are added to all log entries during an invocation.
+	invocationFields *logger.Fields
+	events           chan LifecycleEvent
+
+	// agentFlushGracePeriod is how long to wait for the agent flush
+	// signal after the runtimeDone event was received.
+	agentFlushGracePeriod time.Duration
+
+	// heartbeatInterval is the minimum interval between heartbeats,
+	// heartbeats are disabled if zero.
+	heartbeatInterval time.Duration
+	lastHeartbeat     time.Time
+
+	// initPhases records the duration of the init of the extension,
+	// reportInitDuration enables sending it as a metricset.
+	initPhases         initPhases
+	reportInitDuration bool
+
+	// authProvider is the provider of the authorization of the requests
+	// to the APM server, if any. resolveSecrets tells whether it resolves
+	// secrets, which the prefetch of the init then loads.
+	authProvider   apmproxy.AuthProvider
+	resolveSecrets bool
+	// prefetchServerInfo and prefetchAgentConfig enable the prefetch of
+	// the APM server information and of the central configuration of
+	// the agent during the init.
+	prefetchServerInfo  bool
+	prefetchAgentConfig bool
+
+	// functionVersion is the version of the function the environment
+	// runs, the agent metadata is reset when it changes.
+	functionVersion string
+	// defaultServiceVersion enables setting the service version of the
+	// agent data without one from the function version.
+	defaultServiceVersion bool
+
+	// flushJournal records the flushes in progress, lostFlush is the
+	// flush interrupted in the previous instance of the extension, if any.
+	flushJournal *flushJournal
+	lostFlush    *flushJournalEntry
+
+	// deadMan alerts when no data is sent for consecutive invocations.
+	deadMan deadManSwitch
 }
 
 // New returns an App or an error if the
@@ -53,90 +106,669 @@ func New(ctx context.Context, opts ...configOption) (*App, error) {
 	}
 
 	app := &App{
-		extensionName: c.extensionName,
+		extensionName:   c.extensionName,
+		instanceLockDir: c.instanceLockDir,
+		initPhases:      initPhases{start: time.Now()},
+		events:          make(chan LifecycleEvent, lifecycleEventsBuffer),
 	}
 
-	var err error
+	if c.flushJournalPath != "" {
+		app.flushJournal = &flushJournal{path: c.flushJournalPath}
+	}
+
+	var (
+		err             error
+		componentLogger func(string) *zap.SugaredLogger
+	)
 
-	if app.logger, err = buildLogger(c.logLevel); err != nil {
+	app.invocationFields = &logger.Fields{}
+	if app.logger, componentLogger, app.setLogLevel, err = buildLogger(c.logLevel, app.invocationFields); err != nil {
 		return nil, err
 	}
 
-	apmServerApiKey, apmServerSecretToken, err := loadAWSOptions(ctx, c.awsConfig, app.logger)
+	if partition := apmproxy.AWSPartition(c.awsConfig.Region); partition != "aws" {
+		app.logger.Infof("Using the AWS %s partition of region %s", partition, c.awsConfig.Region)
+	}
+
+	fips, err := resolveFIPSEndpoint(ctx, c.awsConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	app.extensionClient = extension.NewClient(c.awsLambdaRuntimeAPI, app.logger)
+	if roleARN := os.Getenv("ELASTIC_APM_LAMBDA_AWS_ROLE_ARN"); roleARN != "" {
+		c.awsConfig = assumeRole(c.awsConfig, fips, roleARN, os.Getenv("ELASTIC_APM_LAMBDA_AWS_ROLE_EXTERNAL_ID"))
+		app.logger.Infof("Using the AWS credentials of the role %s", roleARN)
+	}
+
+	app.authProvider, app.resolveSecrets = loadAuthProvider(c.awsConfig, fips, app.logger)
+
+	app.extensionClient = extension.NewClient(c.awsLambdaRuntimeAPI, componentLogger("extension"))
+
+	forceIPv4, err := envBool("ELASTIC_APM_LAMBDA_FORCE_IPV4")
+	if err != nil {
+		return nil, err
+	}
 
 	if !c.disableLogsAPI {
-		addr := "sandbox:0"
-		if c.logsapiAddr != "" {
-			addr = c.logsapiAddr
+		if err := app.buildLogsClient(c, forceIPv4, componentLogger("logsapi")); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := app.loadLifecycleSettings(); err != nil {
+		return nil, err
+	}
+
+	var apmOpts []apmproxy.Option
+	for _, build := range []func() ([]apmproxy.Option, error){
+		app.receiverOptions,
+		func() ([]apmproxy.Option, error) { return app.bufferOptions(c.spillDir) },
+		func() ([]apmproxy.Option, error) { return app.transportOptions(c.awsConfig, forceIPv4) },
+		app.statusOptions,
+	} {
+		opts, err := build()
+		if err != nil {
+			return nil, err
 		}
+		apmOpts = append(apmOpts, opts...)
+	}
 
-		lc, err := logsapi.NewClient(
-			logsapi.WithLogsAPIBaseURL(fmt.Sprintf("http://%s", c.awsLambdaRuntimeAPI)),
-			logsapi.WithListenerAddress(addr),
-			logsapi.WithLogBuffer(100),
-			logsapi.WithLogger(app.logger),
+	serverURLs := apmServerURLs(app.logger)
+	serverless, err := parseServerless(serverURLs)
+	if err != nil {
+		return nil, err
+	}
+	if serverless {
+		app.logger.Debug("Sending data to the managed intake of a serverless project")
+		apmOpts = append(apmOpts, apmproxy.WithServerless())
+	}
+
+	// Log the configuration once it is known to be valid
+	config := effectiveConfig(configSettings())
+	app.logger.Infow("Effective configuration", "config", config)
+	apmOpts = append(apmOpts, apmproxy.WithStatusComponent("config", func() interface{} {
+		return config
+	}))
+
+	apmOpts = append(apmOpts,
+		apmproxy.WithURLs(serverURLs...),
+		apmproxy.WithLogger(componentLogger("apmproxy")),
+	)
+	if app.authProvider != nil {
+		apmOpts = append(apmOpts, apmproxy.WithAuthProvider(app.authProvider))
+	} else {
+		apmOpts = append(apmOpts,
+			apmproxy.WithAPIKey(os.Getenv("ELASTIC_APM_API_KEY")),
+			apmproxy.WithSecretToken(os.Getenv("ELASTIC_APM_SECRET_TOKEN")),
 		)
+	}
+
+	ac, err := apmproxy.NewClient(apmOpts...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	app.apmClient = ac
+
+	return app, nil
+}
+
+// buildLogsClient creates the client of the logs API, subscribed to the
+// function logs when a feature of the extension processes them.
+func (app *App) buildLogsClient(c appConfig, forceIPv4 bool, l *zap.SugaredLogger) error {
+	addr := "sandbox:0"
+	if c.logsapiAddr != "" {
+		addr = c.logsapiAddr
+	}
+
+	logsOpts := []logsapi.ClientOption{
+		logsapi.WithLogsAPIBaseURL(fmt.Sprintf("http://%s", c.awsLambdaRuntimeAPI)),
+		logsapi.WithListenerAddress(addr),
+		logsapi.WithLogBuffer(100),
+		logsapi.WithLogger(l),
+	}
+
+	opts, err := logsAPIOptions(app.logger, forceIPv4)
+	if err != nil {
+		return err
+	}
+	logsOpts = append(logsOpts, opts...)
+
+	opts, functionLogs, err := app.functionLogsOptions()
+	if err != nil {
+		return err
+	}
+	logsOpts = append(logsOpts, opts...)
+
+	if len(c.logProcessors) > 0 {
+		functionLogs = true
+	}
+
+	app.logsEventTypes = []logsapi.EventType{logsapi.Platform}
+	if functionLogs {
+		app.logsEventTypes = append(app.logsEventTypes, logsapi.Function)
+	}
+
+	lc, err := logsapi.NewClient(logsOpts...)
+	if err != nil {
+		return err
+	}
+	for _, p := range c.logProcessors {
+		lc.RegisterProcessor(p)
+	}
+
+	app.logsClient = lc
+	return nil
+}
+
+// logsAPIOptions returns the options of the subscription to the logs API
+// and of the processing of the platform events.
+func logsAPIOptions(l *zap.SugaredLogger, forceIPv4 bool) ([]logsapi.ClientOption, error) {
+	var opts []logsapi.ClientOption
+
+	pricing, ok, err := parsePricing(l)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		opts = append(opts, logsapi.WithCostEstimation(pricing))
+	}
+
+	if forceIPv4 {
+		opts = append(opts, logsapi.WithForceIPv4())
+	}
+
+	if enabled, err := envBool("ELASTIC_APM_LAMBDA_TELEMETRY_API"); err != nil || enabled {
 		if err != nil {
 			return nil, err
 		}
+		opts = append(opts, logsapi.WithTelemetryAPI())
+	}
 
-		app.logsClient = lc
+	if d, ok, err := envDuration("ELASTIC_APM_LAMBDA_LOGS_RECEIVER_TIMEOUT"); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, logsapi.WithServerTimeout(d))
 	}
 
-	var apmOpts []apmproxy.Option
+	if d, ok, err := envDuration("ELASTIC_APM_LAMBDA_LOGS_LAG_THRESHOLD"); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, logsapi.WithLagThreshold(d))
+	}
+
+	if fallback := os.Getenv("ELASTIC_APM_LAMBDA_MISSING_METADATA_FALLBACK"); fallback != "" {
+		f, err := logsapi.ParseMetadataFallback(fallback)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_MISSING_METADATA_FALLBACK: %w", err)
+		}
+		opts = append(opts, logsapi.WithMetadataFallback(f))
+	}
+
+	return opts, nil
+}
+
+// functionLogsOptions returns the options of the processing of the logs
+// of the function and whether the function logs must be subscribed to.
+func (app *App) functionLogsOptions() ([]logsapi.ClientOption, bool, error) {
+	var (
+		opts         []logsapi.ClientOption
+		functionLogs bool
+	)
+
+	features := []struct {
+		env string
+		opt logsapi.ClientOption
+		// functionLogs tells whether the feature reads the function logs.
+		functionLogs bool
+	}{
+		{env: "ELASTIC_APM_LAMBDA_CRASH_REPORTING", opt: logsapi.WithCrashReporting(), functionLogs: true},
+		{env: "ELASTIC_APM_LAMBDA_POWERTOOLS_LOGS", opt: logsapi.WithPowertoolsLogs(), functionLogs: true},
+		{env: "ELASTIC_APM_LAMBDA_FUNCTION_LOGS", opt: logsapi.WithFunctionLogs(), functionLogs: true},
+		{env: "ELASTIC_APM_LAMBDA_CONTROL_RECORDS", opt: logsapi.WithControlHandler(app.applyControlRecord), functionLogs: true},
+		{env: "ELASTIC_APM_LAMBDA_OTEL_ATTRIBUTES", opt: logsapi.WithOTelAttributes()},
+		{env: "ELASTIC_APM_LAMBDA_LOGS_TRACE_CONTEXT", opt: logsapi.WithTraceContextInjection()},
+	}
+	for _, f := range features {
+		enabled, err := envBool(f.env)
+		if err != nil {
+			return nil, false, err
+		}
+		if enabled {
+			opts = append(opts, f.opt)
+			functionLogs = functionLogs || f.functionLogs
+		}
+	}
+
+	if teeURL := os.Getenv("ELASTIC_APM_LAMBDA_LOGS_TEE_URL"); teeURL != "" {
+		if u, err := url.Parse(teeURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, false, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_LOGS_TEE_URL: not an http(s) URL: %q", teeURL)
+		}
+		opts = append(opts, logsapi.WithTee(logsapi.Tee{
+			URL:           teeURL,
+			Authorization: os.Getenv("ELASTIC_APM_LAMBDA_LOGS_TEE_AUTHORIZATION"),
+		}))
+		functionLogs = true
+	}
+
+	return opts, functionLogs, nil
+}
+
+// loadLifecycleSettings loads the settings of the handling of the
+// invocations and of the init by the extension.
+func (app *App) loadLifecycleSettings() error {
+	var err error
+
+	if app.agentFlushGracePeriod, _, err = envDuration("ELASTIC_APM_LAMBDA_AGENT_FLUSH_GRACE_PERIOD"); err != nil {
+		return err
+	}
+
+	if app.heartbeatInterval, _, err = envDuration("ELASTIC_APM_LAMBDA_HEARTBEAT_INTERVAL"); err != nil {
+		return err
+	}
+
+	if app.defaultServiceVersion, err = envBool("ELASTIC_APM_LAMBDA_DEFAULT_SERVICE_VERSION"); err != nil {
+		return err
+	}
+
+	if app.deadMan.threshold, _, err = envInt("ELASTIC_APM_LAMBDA_SILENT_INVOCATIONS_THRESHOLD"); err != nil {
+		return err
+	}
+
+	emf, err := envBool("ELASTIC_APM_LAMBDA_SILENT_INVOCATIONS_EMF")
+	if err != nil {
+		return err
+	}
+	if emf {
+		app.deadMan.emf = os.Stdout
+	}
+
+	if app.reportInitDuration, err = envBool("ELASTIC_APM_LAMBDA_REPORT_INIT_DURATION"); err != nil {
+		return err
+	}
+
+	prefetch, err := envBool("ELASTIC_APM_LAMBDA_PREFETCH")
+	if err != nil {
+		return err
+	}
+	app.prefetchServerInfo = prefetch
+	// The agents do not fetch their central configuration if disabled.
+	app.prefetchAgentConfig = prefetch && !strings.EqualFold(os.Getenv("ELASTIC_APM_CENTRAL_CONFIG"), "false")
+
+	return nil
+}
+
+// receiverOptions returns the options of the server receiving the data
+// of the agents.
+func (app *App) receiverOptions() ([]apmproxy.Option, error) {
+	var opts []apmproxy.Option
 
 	if receiverTimeout, ok, err := parseDurationTimeout(app.logger, "ELASTIC_APM_DATA_RECEIVER_TIMEOUT", "ELASTIC_APM_DATA_RECEIVER_TIMEOUT_SECONDS"); err != nil || ok {
 		if err != nil {
 			return nil, err
 		}
-		apmOpts = append(apmOpts, apmproxy.WithReceiverTimeout(receiverTimeout))
+		opts = append(opts, apmproxy.WithReceiverTimeout(receiverTimeout))
 	}
 
-	if dataForwarderTimeout, ok, err := parseDurationTimeout(app.logger, "ELASTIC_APM_DATA_FORWARDER_TIMEOUT", "ELASTIC_APM_DATA_FORWARDER_TIMEOUT_SECONDS"); err != nil || ok {
+	if port := receiverPort(); port != "" {
+		opts = append(opts, apmproxy.WithReceiverAddress(fmt.Sprintf(":%s", port)))
+	}
+
+	if n, ok, err := envInt("ELASTIC_APM_LAMBDA_RECEIVER_MAX_CONNECTIONS"); err != nil || ok {
 		if err != nil {
 			return nil, err
 		}
-		apmOpts = append(apmOpts, apmproxy.WithDataForwarderTimeout(dataForwarderTimeout))
+		opts = append(opts, apmproxy.WithReceiverMaxConnections(n))
 	}
 
-	if port := os.Getenv("ELASTIC_APM_DATA_RECEIVER_SERVER_PORT"); port != "" {
-		apmOpts = append(apmOpts, apmproxy.WithReceiverAddress(fmt.Sprintf(":%s", port)))
+	if n, ok, err := envInt("ELASTIC_APM_LAMBDA_RECEIVER_MAX_CONCURRENT_REQUESTS"); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, apmproxy.WithReceiverMaxConcurrentRequests(n))
 	}
 
+	if n, ok, err := envInt64("ELASTIC_APM_LAMBDA_MAX_INVOCATION_BYTES"); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, apmproxy.WithMaxInvocationBytes(n))
+	}
+
+	if enabled, err := envBool("ELASTIC_APM_LAMBDA_OTLP_RECEIVER"); err != nil || enabled {
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, apmproxy.WithOTLPReceiver())
+	}
+
+	if enabled, err := envBool("ELASTIC_APM_LAMBDA_PRESSURE_HEADERS"); err != nil || enabled {
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, apmproxy.WithPressureHeaders())
+	}
+
+	if enabled, err := envBool("ELASTIC_APM_LAMBDA_STRICT_INTAKE_VALIDATION"); err != nil || enabled {
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, apmproxy.WithStrictIntakeValidation())
+	}
+
+	if transformations := os.Getenv("ELASTIC_APM_LAMBDA_FIELD_TRANSFORMATIONS"); transformations != "" {
+		t, err := apmproxy.ParseTransformations(transformations)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_FIELD_TRANSFORMATIONS: %w", err)
+		}
+		opts = append(opts, apmproxy.WithTransformations(t))
+	}
+
+	return opts, nil
+}
+
+// bufferOptions returns the options of the buffering of the agent data
+// until it is sent to the APM server. The data is spilled to spillDir,
+// if not empty, when ELASTIC_APM_LAMBDA_SPILL_MAX_BYTES is set.
+func (app *App) bufferOptions(spillDir string) ([]apmproxy.Option, error) {
+	var opts []apmproxy.Option
+
+	initType := extension.GetInitializationType()
+	if initType != "" {
+		app.logger.Debugf("Execution environment initialization type: %s", initType)
+	}
 	if strategy, ok := parseStrategy(os.Getenv("ELASTIC_APM_SEND_STRATEGY")); ok {
-		apmOpts = append(apmOpts, apmproxy.WithSendStrategy(strategy))
+		opts = append(opts, apmproxy.WithSendStrategy(strategy))
+	} else {
+		opts = append(opts, apmproxy.WithSendStrategy(defaultSendStrategy(initType)))
 	}
 
-	if bufferSize := os.Getenv("ELASTIC_APM_LAMBDA_AGENT_DATA_BUFFER_SIZE"); bufferSize != "" {
-		size, err := strconv.Atoi(bufferSize)
+	if policy, ok, err := parseTailSamplingPolicy(); err != nil || ok {
 		if err != nil {
 			return nil, err
 		}
+		opts = append(opts, apmproxy.WithTailSampling(policy))
+	}
 
-		apmOpts = append(apmOpts, apmproxy.WithAgentDataBufferSize(size))
+	if size, ok, err := envInt("ELASTIC_APM_LAMBDA_AGENT_DATA_BUFFER_SIZE"); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, apmproxy.WithAgentDataBufferSize(size))
 	}
 
-	apmOpts = append(apmOpts,
-		apmproxy.WithURL(os.Getenv("ELASTIC_APM_LAMBDA_APM_SERVER")),
-		apmproxy.WithLogger(app.logger),
-		apmproxy.WithAPIKey(apmServerApiKey),
-		apmproxy.WithSecretToken(apmServerSecretToken),
-	)
+	if n, ok, err := envInt64("ELASTIC_APM_LAMBDA_AGENT_DATA_BUFFER_BYTES"); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, apmproxy.WithAgentDataBufferBytes(n))
+	}
 
-	ac, err := apmproxy.NewClient(apmOpts...)
+	if pipeline, ok, err := parseMetricsPipeline(); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, apmproxy.WithMetricsPipeline(pipeline))
+	}
+
+	if ratio, ok, err := envFloat("ELASTIC_APM_LAMBDA_AGENT_DATA_BUFFER_SHIP_THRESHOLD"); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, apmproxy.WithShipThreshold(ratio))
+	}
+
+	if d, ok, err := envDuration("ELASTIC_APM_LAMBDA_AGENT_DATA_MAX_AGE"); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, apmproxy.WithMaxDataAge(d))
+	}
+
+	if spillDir != "" {
+		if n, _, err := envInt64("ELASTIC_APM_LAMBDA_SPILL_MAX_BYTES"); err != nil || n > 0 {
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, apmproxy.WithSpill(spillDir, n))
+		}
+	}
+
+	if evictionPolicy := os.Getenv("ELASTIC_APM_LAMBDA_AGENT_DATA_BUFFER_EVICTION"); evictionPolicy != "" {
+		policy, ok := parseEvictionPolicy(evictionPolicy)
+		if !ok {
+			return nil, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_AGENT_DATA_BUFFER_EVICTION: unknown policy %q", evictionPolicy)
+		}
+		opts = append(opts, apmproxy.WithEvictionPolicy(policy))
+	}
+
+	if enabled, err := envBool("ELASTIC_APM_LAMBDA_COMPRESS_BUFFER"); err != nil || enabled {
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, apmproxy.WithCompressedBuffer())
+	}
+
+	return opts, nil
+}
+
+// transportOptions returns the options of the requests sent to the APM
+// server.
+func (app *App) transportOptions(awsConfig aws.Config, forceIPv4 bool) ([]apmproxy.Option, error) {
+	var opts []apmproxy.Option
+
+	if dataForwarderTimeout, ok, err := parseDurationTimeout(app.logger, "ELASTIC_APM_DATA_FORWARDER_TIMEOUT", "ELASTIC_APM_DATA_FORWARDER_TIMEOUT_SECONDS"); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, apmproxy.WithDataForwarderTimeout(dataForwarderTimeout))
+	}
+
+	if d, ok, err := envDuration("ELASTIC_APM_LAMBDA_KEEPALIVE_INTERVAL"); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, apmproxy.WithKeepAliveInterval(d))
+	}
+
+	if n, _, err := envInt("ELASTIC_APM_LAMBDA_SEND_RETRIES"); err != nil || n > 0 {
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, apmproxy.WithRetryPolicy(apmproxy.DefaultRetryPolicy(n+1)))
+	}
+
+	if handoffURL := os.Getenv("ELASTIC_APM_LAMBDA_SHUTDOWN_HANDOFF_URL"); handoffURL != "" {
+		if _, err := url.ParseRequestURI(handoffURL); err != nil {
+			return nil, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_SHUTDOWN_HANDOFF_URL: %w", err)
+		}
+		opts = append(opts, apmproxy.WithHandoffURL(handoffURL))
+	}
+
+	if forceIPv4 {
+		opts = append(opts, apmproxy.WithForceIPv4())
+	}
+
+	if d, ok, err := envDuration("ELASTIC_APM_LAMBDA_DNS_CACHE_TTL"); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, apmproxy.WithDNSCacheTTL(d))
+	}
+
+	if service := os.Getenv("ELASTIC_APM_LAMBDA_SIGV4_SERVICE"); service != "" {
+		region := os.Getenv("ELASTIC_APM_LAMBDA_SIGV4_REGION")
+		if region == "" {
+			region = awsConfig.Region
+		}
+		opts = append(opts, apmproxy.WithSigV4(apmproxy.SigV4{
+			Credentials: awsConfig.Credentials,
+			Region:      region,
+			Service:     service,
+		}))
+	}
+
+	if tlsServerName := os.Getenv("ELASTIC_APM_LAMBDA_TLS_SERVER_NAME"); tlsServerName != "" {
+		opts = append(opts, apmproxy.WithTLSServerName(tlsServerName))
+	}
+
+	return opts, nil
+}
 
+// statusOptions returns the options of the status and debug state
+// endpoints of the receiver.
+func (app *App) statusOptions() ([]apmproxy.Option, error) {
+	var opts []apmproxy.Option
+
+	stateEndpoint, err := envBool("ELASTIC_APM_LAMBDA_DEBUG_STATE_ENDPOINT")
 	if err != nil {
 		return nil, err
 	}
+	if stateEndpoint {
+		app.logger.Warn("Debug state endpoint enabled, this should only be used for testing")
+		opts = append(opts, apmproxy.WithStateEndpoint())
+		if lc := app.logsClient; lc != nil {
+			opts = append(opts, apmproxy.WithStateComponent("invocations", func() interface{} {
+				return lc.InFlightInvocations()
+			}))
+		}
+	}
 
-	app.apmClient = ac
+	if lc := app.logsClient; lc != nil {
+		opts = append(opts, apmproxy.WithStatusComponent("logs_api", func() interface{} {
+			return lc.Capabilities()
+		}))
+	}
 
-	return app, nil
+	return opts, nil
+}
+
+// parseTailSamplingPolicy returns the tail sampling policy and whether
+// tail sampling is enabled, with a sample rate or a latency threshold.
+func parseTailSamplingPolicy() (apmproxy.TailSamplingPolicy, bool, error) {
+	rate, rateOK, err := envFloat("ELASTIC_APM_LAMBDA_TAIL_SAMPLING_RATE")
+	if err != nil {
+		return apmproxy.TailSamplingPolicy{}, false, err
+	}
+	if rate < 0 || rate > 1 {
+		return apmproxy.TailSamplingPolicy{}, false, fmt.Errorf("invalid ELASTIC_APM_LAMBDA_TAIL_SAMPLING_RATE %v: must be between 0 and 1", rate)
+	}
+
+	latencyThreshold, latencyOK, err := envDuration("ELASTIC_APM_LAMBDA_TAIL_SAMPLING_LATENCY_THRESHOLD")
+	if err != nil {
+		return apmproxy.TailSamplingPolicy{}, false, err
+	}
+
+	if !rateOK && !latencyOK {
+		return apmproxy.TailSamplingPolicy{}, false, nil
+	}
+
+	maxHeldBytes, _, err := envInt("ELASTIC_APM_LAMBDA_TAIL_SAMPLING_MAX_BYTES")
+	if err != nil {
+		return apmproxy.TailSamplingPolicy{}, false, err
+	}
+
+	return apmproxy.TailSamplingPolicy{
+		SampleRate:       rate,
+		LatencyThreshold: latencyThreshold,
+		MaxHeldBytes:     maxHeldBytes,
+	}, true, nil
+}
+
+// parseMetricsPipeline returns the pipeline of the metricsets and whether
+// it is enabled, with a positive ELASTIC_APM_LAMBDA_METRICS_BUFFER_SIZE.
+func parseMetricsPipeline() (apmproxy.MetricsPipeline, bool, error) {
+	bufferSize, ok, err := envInt("ELASTIC_APM_LAMBDA_METRICS_BUFFER_SIZE")
+	if err != nil || !ok {
+		return apmproxy.MetricsPipeline{}, false, err
+	}
+
+	flushInterval, _, err := envDuration("ELASTIC_APM_LAMBDA_METRICS_FLUSH_INTERVAL")
+	if err != nil {
+		return apmproxy.MetricsPipeline{}, false, err
+	}
+
+	maxBatchSize, _, err := envInt("ELASTIC_APM_LAMBDA_METRICS_MAX_BATCH_SIZE")
+	if err != nil {
+		return apmproxy.MetricsPipeline{}, false, err
+	}
+
+	pipeline := apmproxy.MetricsPipeline{
+		BufferSize:    bufferSize,
+		FlushInterval: flushInterval,
+		MaxBatchSize:  maxBatchSize,
+	}
+	return pipeline, pipeline.BufferSize > 0, nil
+}
+
+// parseServerless returns whether the data is sent to the managed intake
+// of a serverless project, detected from the first APM server URL unless
+// ELASTIC_APM_LAMBDA_SERVERLESS is set.
+func parseServerless(serverURLs []string) (bool, error) {
+	if value := os.Getenv("ELASTIC_APM_LAMBDA_SERVERLESS"); value != "" {
+		serverless, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_SERVERLESS: %w", err)
+		}
+		return serverless, nil
+	}
+
+	return len(serverURLs) > 0 && apmproxy.IsServerlessURL(serverURLs[0]), nil
+}
+
+// apmServerURLs returns the URLs of the APM Servers. ELASTIC_APM_LAMBDA_APM_SERVER,
+// a comma separated list, takes precedence over ELASTIC_APM_SERVER_URL, shared with
+// the agents, which is ignored when it points to the extension itself.
+func apmServerURLs(l *zap.SugaredLogger) []string {
+	if value := os.Getenv("ELASTIC_APM_LAMBDA_APM_SERVER"); value != "" {
+		var serverURLs []string
+		for _, serverURL := range strings.Split(value, ",") {
+			if serverURL = strings.TrimSpace(serverURL); serverURL != "" {
+				serverURLs = append(serverURLs, serverURL)
+			}
+		}
+		return serverURLs
+	}
+
+	serverURL := os.Getenv("ELASTIC_APM_SERVER_URL")
+	if serverURL == "" {
+		return nil
+	}
+
+	if u, err := url.Parse(serverURL); err != nil || isLoopback(u.Hostname()) {
+		return nil
+	}
+
+	l.Infof("ELASTIC_APM_LAMBDA_APM_SERVER is not set, using ELASTIC_APM_SERVER_URL")
+	return []string{serverURL}
+}
+
+// receiverPort returns the port the extension listens on for agent data.
+// ELASTIC_APM_DATA_RECEIVER_SERVER_PORT takes precedence over the port of
+// ELASTIC_APM_SERVER_URL when the agents are configured to send data locally.
+func receiverPort() string {
+	if port := os.Getenv("ELASTIC_APM_DATA_RECEIVER_SERVER_PORT"); port != "" {
+		return port
+	}
+
+	u, err := url.Parse(os.Getenv("ELASTIC_APM_SERVER_URL"))
+	if err != nil || !isLoopback(u.Hostname()) {
+		return ""
+	}
+
+	return u.Port()
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 func parseDurationTimeout(l *zap.SugaredLogger, flag string, deprecatedFlag string) (time.Duration, bool, error) {
@@ -163,6 +795,49 @@ func parseDurationTimeout(l *zap.SugaredLogger, flag string, deprecatedFlag stri
 	return 0, false, nil
 }
 
+// parsePricing returns the pricing used to estimate the cost of invocations
+// and whether the cost estimation is enabled.
+func parsePricing(l *zap.SugaredLogger) (logsapi.Pricing, bool, error) {
+	enabled, err := strconv.ParseBool(os.Getenv("ELASTIC_APM_LAMBDA_COST_ESTIMATION"))
+	if err != nil || !enabled {
+		return logsapi.Pricing{}, false, nil
+	}
+
+	pricing, ok := logsapi.DefaultPricing(runtime.GOARCH)
+	if !ok {
+		l.Warnf("No default pricing for architecture %s", runtime.GOARCH)
+	}
+
+	if price, ok := os.LookupEnv("ELASTIC_APM_LAMBDA_COST_PER_GB_SECOND"); ok {
+		if pricing.GBSecond, err = strconv.ParseFloat(price, 64); err != nil {
+			return logsapi.Pricing{}, false, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_COST_PER_GB_SECOND: %w", err)
+		}
+	}
+
+	if price, ok := os.LookupEnv("ELASTIC_APM_LAMBDA_COST_PER_REQUEST"); ok {
+		if pricing.Request, err = strconv.ParseFloat(price, 64); err != nil {
+			return logsapi.Pricing{}, false, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_COST_PER_REQUEST: %w", err)
+		}
+	}
+
+	return pricing, true, nil
+}
+
+// defaultSendStrategy returns the send strategy of the environments of
+// the initialization type when ELASTIC_APM_SEND_STRATEGY is not set.
+// Provisioned concurrency environments are kept warm and serve steady
+// traffic: the data is flushed in the background on the next invocations
+// rather than delaying the end of each one. On-demand environments may
+// not be invoked again and SnapStart environments are restored from the
+// same snapshot many times, so their data is flushed at the end of each
+// invocation.
+func defaultSendStrategy(initType extension.InitializationType) apmproxy.SendStrategy {
+	if initType == extension.ProvisionedConcurrency {
+		return apmproxy.Background
+	}
+	return apmproxy.SyncFlush
+}
+
 func parseStrategy(value string) (apmproxy.SendStrategy, bool) {
 	switch strings.ToLower(value) {
 	case "background":
@@ -174,18 +849,105 @@ func parseStrategy(value string) (apmproxy.SendStrategy, bool) {
 	return "", false
 }
 
-func buildLogger(level string) (*zap.SugaredLogger, error) {
+// applyControlRecord applies the settings changed at runtime by
+// a control record logged by the function.
+func (app *App) applyControlRecord(record logsapi.ControlRecord) {
+	if record.LogLevel != "" {
+		level, err := logger.ParseLogLevel(record.LogLevel)
+		if err != nil {
+			app.logger.Warnf("Ignoring the log level of the control record: %v", err)
+		} else {
+			app.setLogLevel(level)
+			app.logger.Infof("Log level changed to %s by a control record", record.LogLevel)
+		}
+	}
+
+	if record.SendStrategy != "" {
+		if strategy, ok := parseStrategy(record.SendStrategy); ok {
+			app.apmClient.SetSendStrategy(strategy)
+			app.logger.Infof("Send strategy changed to %s by a control record", strategy)
+		} else {
+			app.logger.Warnf("Ignoring the unknown send strategy of the control record: %s", record.SendStrategy)
+		}
+	}
+
+	if record.Paused != nil {
+		app.apmClient.SetPaused(*record.Paused)
+		app.logger.Infof("Forwarding of agent data paused=%t by a control record", *record.Paused)
+	}
+}
+
+func parseEvictionPolicy(value string) (apmproxy.EvictionPolicy, bool) {
+	switch strings.ToLower(value) {
+	case "drop_newest":
+		return apmproxy.DropNewest, true
+	case "drop_oldest":
+		return apmproxy.DropOldest, true
+	}
+
+	return "", false
+}
+
+// buildLogger returns the application logger, adding the given fields
+// to all entries if not nil, and a function returning
+// the named logger of a component, honouring per-component log levels.
+// The returned setLevel function overrides the level of all loggers at
+// runtime.
+func buildLogger(level string, fields *logger.Fields) (l *zap.SugaredLogger, componentLogger func(string) *zap.SugaredLogger, setLevel func(zapcore.Level), err error) {
 	if level == "" {
 		level = "info"
 	}
 
-	l, err := logger.ParseLogLevel(level)
+	defaultLevel, componentLevels, err := logger.ParseComponentLogLevels(level)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
-	return logger.New(
+	// The base logger must be built with the most verbose level
+	// in use, each component logger filters out the rest.
+	minLevel := defaultLevel
+	for _, l := range componentLevels {
+		if l < minLevel {
+			minLevel = l
+		}
+	}
+
+	baseLevel := zap.NewAtomicLevelAt(minLevel)
+	l, err = logger.New(
 		logger.WithEncoderConfig(ecszap.NewDefaultEncoderConfig().ToZapCoreEncoderConfig()),
-		logger.WithLevel(l),
+		logger.WithAtomicLevel(baseLevel),
 	)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if fields != nil {
+		l = logger.WithFields(l, fields)
+	}
+
+	var mu sync.Mutex
+	var levels []zap.AtomicLevel
+
+	componentLogger = func(name string) *zap.SugaredLogger {
+		componentLevel, ok := componentLevels[name]
+		if !ok {
+			componentLevel = defaultLevel
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		atomicLevel := zap.NewAtomicLevelAt(componentLevel)
+		levels = append(levels, atomicLevel)
+		return logger.Named(l, name, atomicLevel)
+	}
+
+	setLevel = func(level zapcore.Level) {
+		mu.Lock()
+		defer mu.Unlock()
+		baseLevel.SetLevel(level)
+		for _, atomicLevel := range levels {
+			atomicLevel.SetLevel(level)
+		}
+	}
+
+	return componentLogger(""), componentLogger, setLevel, nil
 }
@@ -0,0 +1,163 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"testing"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+	"github.com/elastic/apm-aws-lambda/extension"
+	"github.com/elastic/apm-aws-lambda/logsapi"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestAPMServerURLs(t *testing.T) {
+	for name, tc := range map[string]struct {
+		lambdaServer string
+		agentServer  string
+		expected     []string
+	}{
+		"extension setting": {
+			lambdaServer: "https://apm.example.com",
+			agentServer:  "https://other.example.com",
+			expected:     []string{"https://apm.example.com"},
+		},
+		"extension setting with several servers": {
+			lambdaServer: "https://eu.apm.example.com, https://us.apm.example.com,",
+			expected:     []string{"https://eu.apm.example.com", "https://us.apm.example.com"},
+		},
+		"agent setting fallback": {
+			agentServer: "https://apm.example.com",
+			expected:    []string{"https://apm.example.com"},
+		},
+		"agent setting pointing to the extension": {
+			agentServer: "http://localhost:8200",
+		},
+		"agent setting pointing to a loopback address": {
+			agentServer: "http://127.0.0.1:8200",
+		},
+		"no setting": {},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", tc.lambdaServer)
+			t.Setenv("ELASTIC_APM_SERVER_URL", tc.agentServer)
+			assert.Equal(t, tc.expected, apmServerURLs(zaptest.NewLogger(t).Sugar()))
+		})
+	}
+}
+
+func TestReceiverPort(t *testing.T) {
+	for name, tc := range map[string]struct {
+		receiverPort string
+		agentServer  string
+		expected     string
+	}{
+		"extension setting": {
+			receiverPort: "8201",
+			agentServer:  "http://localhost:8202",
+			expected:     "8201",
+		},
+		"local agent setting": {
+			agentServer: "http://localhost:8202",
+			expected:    "8202",
+		},
+		"remote agent setting": {
+			agentServer: "https://apm.example.com:8202",
+		},
+		"no setting": {},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("ELASTIC_APM_DATA_RECEIVER_SERVER_PORT", tc.receiverPort)
+			t.Setenv("ELASTIC_APM_SERVER_URL", tc.agentServer)
+			assert.Equal(t, tc.expected, receiverPort())
+		})
+	}
+}
+
+func TestApplyControlRecord(t *testing.T) {
+	l, componentLogger, setLevel, err := buildLogger("info,logsapi=warn", nil)
+	require.NoError(t, err)
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL("https://example.com"),
+		apmproxy.WithLogger(l),
+	)
+	require.NoError(t, err)
+	app := &App{logger: l, setLogLevel: setLevel, apmClient: apmClient}
+
+	logsLogger := componentLogger("logsapi")
+	assert.False(t, l.Desugar().Core().Enabled(zapcore.DebugLevel))
+	assert.False(t, logsLogger.Desugar().Core().Enabled(zapcore.InfoLevel))
+
+	paused := true
+	app.applyControlRecord(logsapi.ControlRecord{LogLevel: "debug", SendStrategy: "background", Paused: &paused})
+	assert.True(t, l.Desugar().Core().Enabled(zapcore.DebugLevel))
+	assert.True(t, logsLogger.Desugar().Core().Enabled(zapcore.DebugLevel))
+	assert.False(t, apmClient.ShouldFlush())
+	assert.True(t, apmClient.Paused())
+
+	// Invalid settings are ignored.
+	app.applyControlRecord(logsapi.ControlRecord{LogLevel: "verbose", SendStrategy: "eventually"})
+	assert.True(t, l.Desugar().Core().Enabled(zapcore.DebugLevel))
+	assert.False(t, apmClient.ShouldFlush())
+
+	paused = false
+	app.applyControlRecord(logsapi.ControlRecord{Paused: &paused})
+	assert.False(t, apmClient.Paused())
+}
+
+func TestCheckFunctionVersion(t *testing.T) {
+	app := &App{logger: zaptest.NewLogger(t).Sugar(), functionVersion: "1"}
+	metadata := []byte(`{"metadata":{"service":{"name":"foo","agent":{"name":"nodejs","version":"3.14.0"}}}}`)
+	metadataContainer := apmproxy.MetadataContainer{Metadata: metadata}
+	metadataContainer.Add(metadata)
+
+	invoke := func(arn string) {
+		app.checkFunctionVersion(&extension.NextEventResponse{InvokedFunctionArn: arn}, &metadataContainer)
+	}
+
+	// Invocations through an alias don't tell the version.
+	invoke("arn:aws:lambda:us-east-1:123456789012:function:foo:prod")
+	invoke("arn:aws:lambda:us-east-1:123456789012:function:foo:1")
+	assert.Equal(t, metadata, metadataContainer.Metadata)
+	assert.Equal(t, 1, metadataContainer.Agents())
+
+	invoke("arn:aws:lambda:us-east-1:123456789012:function:foo:2")
+	assert.Nil(t, metadataContainer.Metadata)
+	assert.Zero(t, metadataContainer.Agents())
+	assert.Equal(t, "2", app.functionVersion)
+}
+
+func TestServiceVersion(t *testing.T) {
+	app := &App{functionVersion: "7"}
+	assert.Equal(t, "7", app.serviceVersion(&extension.NextEventResponse{InvokedFunctionArn: "arn:aws:lambda:us-east-1:123456789012:function:foo:prod"}))
+
+	app.functionVersion = "$LATEST"
+	assert.Equal(t, "prod", app.serviceVersion(&extension.NextEventResponse{InvokedFunctionArn: "arn:aws:lambda:us-east-1:123456789012:function:foo:prod"}))
+	assert.Equal(t, "$LATEST", app.serviceVersion(&extension.NextEventResponse{InvokedFunctionArn: "arn:aws:lambda:us-east-1:123456789012:function:foo"}))
+}
+
+func TestDefaultSendStrategy(t *testing.T) {
+	assert.Equal(t, apmproxy.SyncFlush, defaultSendStrategy(""))
+	assert.Equal(t, apmproxy.SyncFlush, defaultSendStrategy(extension.OnDemand))
+	assert.Equal(t, apmproxy.SyncFlush, defaultSendStrategy(extension.SnapStart))
+	assert.Equal(t, apmproxy.Background, defaultSendStrategy(extension.ProvisionedConcurrency))
+}
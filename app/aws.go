@@ -22,47 +22,239 @@ import (
 	"encoding/base64"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/elastic/apm-aws-lambda/apmproxy"
 	"go.uber.org/zap"
 )
 
-func loadAWSOptions(ctx context.Context, cfg aws.Config, logger *zap.SugaredLogger) (string, string, error) {
-	manager := secretsmanager.NewFromConfig(cfg)
+// assumeRoleSessionName identifies the sessions of the extension
+// in the CloudTrail logs of the assumed role.
+const assumeRoleSessionName = "elastic-apm-lambda-extension"
 
-	apmServerApiKey := os.Getenv("ELASTIC_APM_API_KEY")
-	if apmServerApiKeySMSecretId, ok := os.LookupEnv("ELASTIC_APM_SECRETS_MANAGER_API_KEY_ID"); ok {
-		result, err := loadSecret(ctx, manager, apmServerApiKeySMSecretId)
+// secretsTimeout bounds the resolution of the secrets, including the
+// retries of the AWS SDK, so that an unreachable Secrets Manager fails
+// the initialization of the extension rather than its whole budget.
+const secretsTimeout = 5 * time.Second
+
+// assumeRole returns a copy of the AWS configuration using the
+// credentials of the given IAM role, assumed with the credentials of
+// the configuration, e.g. to resolve secrets of another account. The
+// credentials are cached and refreshed before they expire.
+func assumeRole(cfg aws.Config, fips aws.FIPSEndpointState, roleARN, externalID string) aws.Config {
+	client := sts.NewFromConfig(cfg, func(o *sts.Options) {
+		if fips != aws.FIPSEndpointStateUnset {
+			o.EndpointOptions.UseFIPSEndpoint = fips
+		}
+	})
+	provider := stscreds.NewAssumeRoleProvider(client, roleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = assumeRoleSessionName
+		if externalID != "" {
+			o.ExternalID = aws.String(externalID)
+		}
+	})
+
+	assumed := cfg.Copy()
+	assumed.Credentials = aws.NewCredentialsCache(provider)
+	return assumed
+}
+
+// fipsEndpointSource is implemented by the AWS configuration sources
+// resolving the FIPS endpoint state, such as the AWS_USE_FIPS_ENDPOINT
+// environment variable or the use_fips_endpoint shared config setting.
+type fipsEndpointSource interface {
+	GetUseFIPSEndpoint(context.Context) (aws.FIPSEndpointState, bool, error)
+}
+
+// resolveFIPSEndpoint returns whether the extension calls the FIPS
+// endpoints of the AWS services. ELASTIC_APM_LAMBDA_AWS_USE_FIPS_ENDPOINT
+// takes precedence over the AWS SDK configuration, so that the
+// extension can use FIPS endpoints independently of the function. The
+// state is validated against the partition of the region, as not all
+// partitions provide FIPS endpoints.
+func resolveFIPSEndpoint(ctx context.Context, cfg aws.Config) (aws.FIPSEndpointState, error) {
+	fips := aws.FIPSEndpointStateUnset
+	if v := os.Getenv("ELASTIC_APM_LAMBDA_AWS_USE_FIPS_ENDPOINT"); v != "" {
+		enabled, err := strconv.ParseBool(v)
 		if err != nil {
-			return "", "", fmt.Errorf("failed loading APM Server ApiKey from Secrets Manager: %w", err)
+			return fips, fmt.Errorf("failed to parse ELASTIC_APM_LAMBDA_AWS_USE_FIPS_ENDPOINT: %w", err)
+		}
+		fips = aws.FIPSEndpointStateDisabled
+		if enabled {
+			fips = aws.FIPSEndpointStateEnabled
+		}
+	} else {
+		for _, source := range cfg.ConfigSources {
+			s, ok := source.(fipsEndpointSource)
+			if !ok {
+				continue
+			}
+			state, found, err := s.GetUseFIPSEndpoint(ctx)
+			if err != nil {
+				return fips, fmt.Errorf("failed to resolve the FIPS endpoint configuration: %w", err)
+			}
+			if found {
+				fips = state
+				break
+			}
 		}
+	}
+
+	if fips == aws.FIPSEndpointStateEnabled {
+		switch partition := apmproxy.AWSPartition(cfg.Region); partition {
+		case "aws", "aws-us-gov":
+		default:
+			return fips, fmt.Errorf("FIPS endpoints are not available in the %s partition of region %s", partition, cfg.Region)
+		}
+	}
+	return fips, nil
+}
 
-		logger.Infof("Using the APM API key retrieved from Secrets Manager.")
-		apmServerApiKey = result
+// loadAuthProvider returns the provider of the authorization of the
+// requests to the APM server, or nil if they authenticate with the API
+// key or secret token of the environment, and whether it resolves
+// secrets of Secrets Manager or parameters of SSM Parameter Store. The
+// API key and secret token may reference the ARN of such a secret or
+// parameter. An authorization file or command takes precedence over the
+// secrets, which are loaded again when the APM server rejects them.
+func loadAuthProvider(cfg aws.Config, fips aws.FIPSEndpointState, logger *zap.SugaredLogger) (apmproxy.AuthProvider, bool) {
+	if path := os.Getenv("ELASTIC_APM_LAMBDA_AUTHORIZATION_FILE"); path != "" {
+		logger.Infof("Using the authorization read from %s.", path)
+		return apmproxy.FileAuth(path), false
+	}
+	if command := strings.Fields(os.Getenv("ELASTIC_APM_LAMBDA_AUTHORIZATION_COMMAND")); len(command) > 0 {
+		logger.Infof("Using the authorization printed by %s.", command[0])
+		return apmproxy.CommandAuth(command[0], command[1:]...), false
 	}
 
+	apiKeySecretID, hasAPIKeySecret := os.LookupEnv("ELASTIC_APM_SECRETS_MANAGER_API_KEY_ID")
+	secretTokenSecretID, hasSecretTokenSecret := os.LookupEnv("ELASTIC_APM_SECRETS_MANAGER_SECRET_TOKEN_ID")
+	apmServerApiKey := os.Getenv("ELASTIC_APM_API_KEY")
 	apmServerSecretToken := os.Getenv("ELASTIC_APM_SECRET_TOKEN")
-	if apmServerSecretTokenSMSecretId, ok := os.LookupEnv("ELASTIC_APM_SECRETS_MANAGER_SECRET_TOKEN_ID"); ok {
-		result, err := loadSecret(ctx, manager, apmServerSecretTokenSMSecretId)
-		if err != nil {
-			return "", "", fmt.Errorf("failed loading APM Server Secret Token from Secrets Manager: %w", err)
+	_, _, apiKeyReference := secretReference(apmServerApiKey)
+	_, _, secretTokenReference := secretReference(apmServerSecretToken)
+	if !hasAPIKeySecret && !hasSecretTokenSecret && !apiKeyReference && !secretTokenReference {
+		return nil, false
+	}
+
+	resolver := newSecretsResolver(cfg, fips)
+	return apmproxy.NewRefreshingAuth(func(ctx context.Context) (string, error) {
+		ctx, cancel := context.WithTimeout(ctx, secretsTimeout)
+		defer cancel()
+
+		apiKey := apmServerApiKey
+		if hasAPIKeySecret {
+			result, err := loadSecret(ctx, resolver.manager, apiKeySecretID)
+			if err != nil {
+				return "", fmt.Errorf("failed loading APM Server ApiKey from Secrets Manager: %w", err)
+			}
+			logger.Infof("Using the APM API key retrieved from Secrets Manager.")
+			apiKey = result
+		} else if apiKeyReference {
+			result, err := resolver.resolve(ctx, apmServerApiKey)
+			if err != nil {
+				return "", fmt.Errorf("failed loading APM Server ApiKey from %s: %w", apmServerApiKey, err)
+			}
+			logger.Infof("Using the APM API key retrieved from %s.", apmServerApiKey)
+			apiKey = result
 		}
 
-		logger.Infof("Using the APM secret token retrieved from Secrets Manager.")
-		apmServerSecretToken = result
+		secretToken := apmServerSecretToken
+		if hasSecretTokenSecret {
+			result, err := loadSecret(ctx, resolver.manager, secretTokenSecretID)
+			if err != nil {
+				return "", fmt.Errorf("failed loading APM Server Secret Token from Secrets Manager: %w", err)
+			}
+			logger.Infof("Using the APM secret token retrieved from Secrets Manager.")
+			secretToken = result
+		} else if secretTokenReference {
+			result, err := resolver.resolve(ctx, apmServerSecretToken)
+			if err != nil {
+				return "", fmt.Errorf("failed loading APM Server Secret Token from %s: %w", apmServerSecretToken, err)
+			}
+			logger.Infof("Using the APM secret token retrieved from %s.", apmServerSecretToken)
+			secretToken = result
+		}
+
+		return apmproxy.AuthorizationHeader(apiKey, secretToken), nil
+	}), true
+}
+
+// secretReference returns the service and region of the ARN of a
+// Secrets Manager secret or SSM parameter referenced by the value of
+// ELASTIC_APM_API_KEY or ELASTIC_APM_SECRET_TOKEN, or false if the
+// value is the credential itself.
+func secretReference(value string) (service, region string, ok bool) {
+	// arn:partition:service:region:account-id:resource
+	parts := strings.SplitN(value, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || !strings.HasPrefix(parts[1], "aws") || parts[3] == "" {
+		return "", "", false
+	}
+	service, region, resource := parts[2], parts[3], parts[5]
+	switch {
+	case service == "secretsmanager" && strings.HasPrefix(resource, "secret:"):
+	case service == "ssm" && strings.HasPrefix(resource, "parameter/"):
+	default:
+		return "", "", false
+	}
+	return service, region, true
+}
+
+// secretsResolver resolves the credentials referencing a Secrets Manager
+// secret or SSM parameter, from the region of the referenced ARN.
+type secretsResolver struct {
+	manager *secretsmanager.Client
+	ssm     *ssm.Client
+}
+
+func newSecretsResolver(cfg aws.Config, fips aws.FIPSEndpointState) *secretsResolver {
+	manager := secretsmanager.NewFromConfig(cfg, func(o *secretsmanager.Options) {
+		if fips != aws.FIPSEndpointStateUnset {
+			o.EndpointOptions.UseFIPSEndpoint = fips
+		}
+	})
+	parameters := ssm.NewFromConfig(cfg, func(o *ssm.Options) {
+		if fips != aws.FIPSEndpointStateUnset {
+			o.EndpointOptions.UseFIPSEndpoint = fips
+		}
+	})
+	return &secretsResolver{
+		manager: manager,
+		ssm:     parameters,
 	}
+}
 
-	return apmServerApiKey, apmServerSecretToken, nil
+// resolve returns the value of the secret or parameter referenced by the
+// given ARN.
+func (r *secretsResolver) resolve(ctx context.Context, arn string) (string, error) {
+	service, region, ok := secretReference(arn)
+	if !ok {
+		return "", fmt.Errorf("not a secret or parameter ARN: %s", arn)
+	}
+	if service == "ssm" {
+		return loadParameter(ctx, r.ssm, arn, func(o *ssm.Options) {
+			o.Region = region
+		})
+	}
+	return loadSecret(ctx, r.manager, arn, func(o *secretsmanager.Options) {
+		o.Region = region
+	})
 }
 
-func loadSecret(ctx context.Context, manager *secretsmanager.Client, secretID string) (string, error) {
+func loadSecret(ctx context.Context, manager *secretsmanager.Client, secretID string, optFns ...func(*secretsmanager.Options)) (string, error) {
 	input := &secretsmanager.GetSecretValueInput{
 		SecretId:     ptrFromString(secretID),
 		VersionStage: ptrFromString("AWSCURRENT"),
 	}
 
-	result, err := manager.GetSecretValue(ctx, input)
+	result, err := manager.GetSecretValue(ctx, input, optFns...)
 	if err != nil {
 		return "", fmt.Errorf("failed to retrieve sercet value: %w", err)
 	}
@@ -79,6 +271,23 @@ func loadSecret(ctx context.Context, manager *secretsmanager.Client, secretID st
 	return string(decodedBinarySecretBytes), nil
 }
 
+// loadParameter returns the decrypted value of the SSM parameter.
+func loadParameter(ctx context.Context, client *ssm.Client, name string, optFns ...func(*ssm.Options)) (string, error) {
+	input := &ssm.GetParameterInput{
+		Name:           ptrFromString(name),
+		WithDecryption: aws.Bool(true),
+	}
+
+	result, err := client.GetParameter(ctx, input, optFns...)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve parameter value: %w", err)
+	}
+	if result.Parameter == nil || result.Parameter.Value == nil {
+		return "", fmt.Errorf("parameter %s has no value", name)
+	}
+	return *result.Parameter.Value, nil
+}
+
 func ptrFromString(v string) *string {
 	return &v
 }
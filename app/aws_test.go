@@ -0,0 +1,211 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestAssumeRole(t *testing.T) {
+	var calls int
+	stsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "AssumeRole", r.Form.Get("Action"))
+		assert.Equal(t, "arn:aws:iam::123456789012:role/telemetry", r.Form.Get("RoleArn"))
+		assert.Equal(t, "external-id", r.Form.Get("ExternalId"))
+		assert.Equal(t, assumeRoleSessionName, r.Form.Get("RoleSessionName"))
+		assert.Contains(t, r.Header.Get("Authorization"), "Credential=AKID/")
+		calls++
+		fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASSUMED</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer stsServer.Close()
+
+	cfg := aws.Config{
+		Region: "us-east-1",
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+		}),
+		EndpointResolverWithOptions: aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+			return aws.Endpoint{URL: stsServer.URL}, nil
+		}),
+	}
+
+	assumed := assumeRole(cfg, aws.FIPSEndpointStateUnset, "arn:aws:iam::123456789012:role/telemetry", "external-id")
+	for i := 0; i < 2; i++ {
+		credentials, err := assumed.Credentials.Retrieve(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "ASSUMED", credentials.AccessKeyID)
+	}
+	// Credentials are cached
+	assert.Equal(t, 1, calls)
+
+	// The original configuration is unchanged
+	credentials, err := cfg.Credentials.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "AKID", credentials.AccessKeyID)
+}
+
+func TestResolveFIPSEndpoint(t *testing.T) {
+	testCases := []struct {
+		name     string
+		region   string
+		env      string
+		sources  []interface{}
+		expected aws.FIPSEndpointState
+		err      bool
+	}{
+		{name: "unset", region: "us-east-1", expected: aws.FIPSEndpointStateUnset},
+		{name: "enabled", region: "us-east-1", env: "true", expected: aws.FIPSEndpointStateEnabled},
+		{name: "disabled", region: "us-east-1", env: "false", expected: aws.FIPSEndpointStateDisabled},
+		{name: "govcloud", region: "us-gov-west-1", env: "true", expected: aws.FIPSEndpointStateEnabled},
+		{name: "china", region: "cn-north-1", env: "true", err: true},
+		{name: "china disabled", region: "cn-north-1", env: "false", expected: aws.FIPSEndpointStateDisabled},
+		{name: "invalid", region: "us-east-1", env: "maybe", err: true},
+		{
+			name:     "sdk config",
+			region:   "us-gov-east-1",
+			sources:  []interface{}{config.EnvConfig{UseFIPSEndpoint: aws.FIPSEndpointStateEnabled}},
+			expected: aws.FIPSEndpointStateEnabled,
+		},
+		{
+			name:     "sdk config overridden",
+			region:   "us-east-1",
+			env:      "false",
+			sources:  []interface{}{config.EnvConfig{UseFIPSEndpoint: aws.FIPSEndpointStateEnabled}},
+			expected: aws.FIPSEndpointStateDisabled,
+		},
+		{
+			name:    "sdk config china",
+			region:  "cn-northwest-1",
+			sources: []interface{}{config.EnvConfig{UseFIPSEndpoint: aws.FIPSEndpointStateEnabled}},
+			err:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("ELASTIC_APM_LAMBDA_AWS_USE_FIPS_ENDPOINT", tc.env)
+
+			fips, err := resolveFIPSEndpoint(context.Background(), aws.Config{Region: tc.region, ConfigSources: tc.sources})
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, fips)
+		})
+	}
+}
+
+func TestSecretReference(t *testing.T) {
+	testCases := []struct {
+		value   string
+		service string
+		region  string
+	}{
+		{value: "arn:aws:secretsmanager:eu-west-1:123456789012:secret:apm-token-AbCdEf", service: "secretsmanager", region: "eu-west-1"},
+		{value: "arn:aws-us-gov:ssm:us-gov-west-1:123456789012:parameter/apm/api-key", service: "ssm", region: "us-gov-west-1"},
+		{value: "arn:aws:ssm:eu-west-1:123456789012:document/apm"},
+		{value: "arn:aws:iam::123456789012:role/telemetry"},
+		{value: "arn:aws:secretsmanager::123456789012:secret:apm-token"},
+		{value: "c2VjcmV0OnRva2Vu"},
+		{value: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			service, region, ok := secretReference(tc.value)
+			assert.Equal(t, tc.service != "", ok)
+			assert.Equal(t, tc.service, service)
+			assert.Equal(t, tc.region, region)
+		})
+	}
+}
+
+func TestLoadAuthProviderParameter(t *testing.T) {
+	const parameterARN = "arn:aws:ssm:eu-west-1:123456789012:parameter/apm/api-key"
+	var calls int
+	ssmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "AmazonSSM.GetParameter", r.Header.Get("X-Amz-Target"))
+		assert.Contains(t, r.Header.Get("Authorization"), "Credential=AKID/")
+		assert.Contains(t, r.Header.Get("Authorization"), "/eu-west-1/ssm/aws4_request")
+		var input struct {
+			Name           string
+			WithDecryption bool
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&input))
+		assert.Equal(t, parameterARN, input.Name)
+		assert.True(t, input.WithDecryption)
+		calls++
+		fmt.Fprint(w, `{"Parameter":{"Name":"/apm/api-key","Type":"SecureString","Value":"api-key"}}`)
+	}))
+	defer ssmServer.Close()
+
+	cfg := aws.Config{
+		Region: "us-east-1",
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+		}),
+		EndpointResolverWithOptions: aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+			return aws.Endpoint{URL: ssmServer.URL}, nil
+		}),
+	}
+	t.Setenv("ELASTIC_APM_API_KEY", parameterARN)
+	t.Setenv("ELASTIC_APM_SECRET_TOKEN", "")
+
+	provider, resolveSecrets := loadAuthProvider(cfg, aws.FIPSEndpointStateUnset, zap.NewNop().Sugar())
+	require.NotNil(t, provider)
+	assert.True(t, resolveSecrets)
+	for i := 0; i < 2; i++ {
+		authorization, err := provider.Authorization(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "ApiKey api-key", authorization)
+	}
+	// The parameter is resolved once
+	assert.Equal(t, 1, calls)
+}
+
+func TestLoadAuthProviderPlainCredentials(t *testing.T) {
+	t.Setenv("ELASTIC_APM_API_KEY", "api-key")
+	t.Setenv("ELASTIC_APM_SECRET_TOKEN", "")
+
+	provider, resolveSecrets := loadAuthProvider(aws.Config{}, aws.FIPSEndpointStateUnset, zap.NewNop().Sugar())
+	assert.Nil(t, provider)
+	assert.False(t, resolveSecrets)
+}
@@ -0,0 +1,39 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import "time"
+
+// maxInvocationDuration is the maximum timeout of a Lambda function.
+const maxInvocationDuration = 15 * time.Minute
+
+// untilDeadline returns the time left at now until the deadline of an
+// invocation set by the platform. The wall clock of the environment
+// may be off after a thaw until it is synchronized again, so the result
+// is bounded by the maximum duration of an invocation. It is computed
+// once per invocation, the timers based on it use the monotonic clock.
+func untilDeadline(deadline, now time.Time) time.Duration {
+	d := deadline.Sub(now)
+	if d < 0 {
+		return 0
+	}
+	if d > maxInvocationDuration {
+		return maxInvocationDuration
+	}
+	return d
+}
@@ -0,0 +1,36 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUntilDeadline(t *testing.T) {
+	now := time.Now()
+	deadline := now.Add(3 * time.Second)
+
+	assert.Equal(t, 3*time.Second, untilDeadline(deadline, now))
+	// The clock jumped forward past the deadline after a thaw
+	assert.Equal(t, time.Duration(0), untilDeadline(deadline, now.Add(time.Hour)))
+	// The clock lags behind after a thaw
+	assert.Equal(t, maxInvocationDuration, untilDeadline(deadline, now.Add(-time.Hour)))
+}
@@ -17,7 +17,10 @@
 
 package app
 
-import "github.com/aws/aws-sdk-go-v2/aws"
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/elastic/apm-aws-lambda/logsapi"
+)
 
 type appConfig struct {
 	awsLambdaRuntimeAPI string
@@ -26,6 +29,10 @@ type appConfig struct {
 	disableLogsAPI      bool
 	logLevel            string
 	logsapiAddr         string
+	instanceLockDir     string
+	flushJournalPath    string
+	spillDir            string
+	logProcessors       []logsapi.Processor
 }
 
 type configOption func(*appConfig)
@@ -53,7 +60,8 @@ func WithoutLogsAPI() configOption {
 	}
 }
 
-// WithLogLevel sets the log level.
+// WithLogLevel sets the log level. Per-component levels can be
+// set with a comma separated list, e.g. "info,apmproxy=debug".
 func WithLogLevel(level string) configOption {
 	return func(c *appConfig) {
 		c.logLevel = level
@@ -74,3 +82,39 @@ func WithAWSConfig(awsConfig aws.Config) configOption {
 		c.awsConfig = awsConfig
 	}
 }
+
+// WithInstanceLockDir sets the directory used to coordinate the
+// copies of the extension running in the same environment. Only
+// one copy is active, the newest one unless an older one already
+// started, the others idle.
+func WithInstanceLockDir(dir string) configOption {
+	return func(c *appConfig) {
+		c.instanceLockDir = dir
+	}
+}
+
+// WithFlushJournal sets the file recording the flushes in progress, so
+// that the data lost when the extension is killed during a flush is
+// reported on the next start.
+func WithFlushJournal(path string) configOption {
+	return func(c *appConfig) {
+		c.flushJournalPath = path
+	}
+}
+
+// WithSpillDir sets the directory the agent data which could not be sent
+// is spilled to, when enabled with ELASTIC_APM_LAMBDA_SPILL_MAX_BYTES.
+func WithSpillDir(dir string) configOption {
+	return func(c *appConfig) {
+		c.spillDir = dir
+	}
+}
+
+// WithLogProcessor registers a processor of the records delivered by the
+// Logs API, including the function logs, see logsapi.RegisterProcessor.
+// It has no effect if the Logs API is disabled.
+func WithLogProcessor(p logsapi.Processor) configOption {
+	return func(c *appConfig) {
+		c.logProcessors = append(c.logProcessors, p)
+	}
+}
@@ -0,0 +1,126 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+)
+
+// deadManNamespace is the CloudWatch namespace of the EMF metric of the
+// dead-man switch.
+const deadManNamespace = "ElasticAPMLambdaExtension"
+
+// deadManSwitch detects broken telemetry: invocations keep happening but
+// no data reaches the APM server.
+type deadManSwitch struct {
+	// threshold is the number of consecutive invocations without any
+	// data sent after which the switch trips, it is disabled if zero.
+	threshold int
+	// emf writes the alert as a CloudWatch embedded metric format log
+	// line to the writer, for it to be reported even if the APM server
+	// cannot be reached.
+	emf io.Writer
+
+	// sentBytes is the number of bytes sent when the previous
+	// invocation ended, silent the number of consecutive invocations
+	// without any data sent.
+	sentBytes int64
+	silent    int
+}
+
+// checkDataSent counts the invocations after which no data was sent to
+// the APM server since the previous one, sent being the number of bytes
+// sent when the invocation ended. Every threshold consecutive silent
+// invocations, it logs an error and reports the extension.silent_invocations
+// metric. The data sent by the extension on its own, such as heartbeats,
+// is not taken into account.
+func (app *App) checkDataSent(ctx context.Context, metadataContainer *apmproxy.MetadataContainer, sent int64) {
+	d := &app.deadMan
+	if d.threshold <= 0 {
+		return
+	}
+	defer func() {
+		d.sentBytes = app.apmClient.SentBytes()
+	}()
+
+	if sent > d.sentBytes {
+		if d.silent >= d.threshold {
+			app.logger.Infof("Data was sent to the APM server again after %d invocations", d.silent)
+		}
+		d.silent = 0
+		return
+	}
+	d.silent++
+	if d.silent%d.threshold != 0 {
+		return
+	}
+
+	app.logger.Errorw("No data was sent to the APM server for consecutive invocations: the telemetry of the function is broken. "+
+		"Check the configuration of the APM agent and of the extension, and the reachability of the APM server.",
+		"extension.silent_invocations", d.silent)
+
+	if d.emf != nil {
+		if err := writeDeadManEMF(d.emf, time.Now(), d.silent); err != nil {
+			app.logger.Warnf("Failed to write the silent invocations EMF metric: %v", err)
+		}
+	}
+
+	data, err := metricsetData(metadataContainer, time.Now(), map[string]float64{
+		"extension.silent_invocations": float64(d.silent),
+	})
+	if err != nil {
+		app.logger.Warnf("Failed to create the silent invocations metricset: %v", err)
+		return
+	}
+	if err := app.apmClient.PostToApmServer(ctx, data); err != nil {
+		app.logger.Warnf("Failed to send the silent invocations metricset: %v", err)
+	}
+}
+
+// writeDeadManEMF writes the SilentInvocations metric in the CloudWatch
+// embedded metric format, extracted by CloudWatch from the function logs.
+func writeDeadManEMF(w io.Writer, now time.Time, silent int) error {
+	type metric struct {
+		Name string
+		Unit string
+	}
+	type directive struct {
+		Namespace  string
+		Dimensions [][]string
+		Metrics    []metric
+	}
+	line := map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": now.UnixMilli(),
+			"CloudWatchMetrics": []directive{{
+				Namespace:  deadManNamespace,
+				Dimensions: [][]string{{"FunctionName"}},
+				Metrics:    []metric{{Name: "SilentInvocations", Unit: "Count"}},
+			}},
+		},
+		"FunctionName":      os.Getenv("AWS_LAMBDA_FUNCTION_NAME"),
+		"SilentInvocations": silent,
+	}
+	return json.NewEncoder(w).Encode(line)
+}
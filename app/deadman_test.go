@@ -0,0 +1,102 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestCheckDataSent(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "my-function")
+
+	var mu sync.Mutex
+	var metricsets []string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := apmproxy.GetUncompressedBytes(readAll(t, r.Body), r.Header.Get("Content-Encoding"))
+		require.NoError(t, err)
+		_, metricset, _ := bytes.Cut(body, []byte("\n"))
+		mu.Lock()
+		metricsets = append(metricsets, string(metricset))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	l := zaptest.NewLogger(t).Sugar()
+	apmClient, err := apmproxy.NewClient(apmproxy.WithURL(apmServer.URL), apmproxy.WithLogger(l))
+	require.NoError(t, err)
+	var emf bytes.Buffer
+	app := &App{logger: l, apmClient: apmClient, deadMan: deadManSwitch{threshold: 2, emf: &emf}}
+	metadataContainer := &apmproxy.MetadataContainer{}
+	ctx := context.Background()
+
+	silentInvocations := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, metricsets...)
+	}
+
+	app.checkDataSent(ctx, metadataContainer, apmClient.SentBytes())
+	assert.Empty(t, silentInvocations())
+
+	// The metricset sent when tripping does not count as data sent.
+	app.checkDataSent(ctx, metadataContainer, apmClient.SentBytes())
+	require.Len(t, silentInvocations(), 1)
+	assert.Contains(t, silentInvocations()[0], `"extension.silent_invocations":{"value":2}`)
+
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(emf.Bytes(), &line))
+	assert.Equal(t, "my-function", line["FunctionName"])
+	assert.Equal(t, float64(2), line["SilentInvocations"])
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"Namespace":  "ElasticAPMLambdaExtension",
+		"Dimensions": []interface{}{[]interface{}{"FunctionName"}},
+		"Metrics":    []interface{}{map[string]interface{}{"Name": "SilentInvocations", "Unit": "Count"}},
+	}}, line["_aws"].(map[string]interface{})["CloudWatchMetrics"])
+
+	app.checkDataSent(ctx, metadataContainer, apmClient.SentBytes())
+	assert.Len(t, silentInvocations(), 1)
+	app.checkDataSent(ctx, metadataContainer, apmClient.SentBytes())
+	require.Len(t, silentInvocations(), 2)
+	assert.Contains(t, silentInvocations()[1], `"extension.silent_invocations":{"value":4}`)
+
+	// Data sent during the invocation resets the count.
+	app.checkDataSent(ctx, metadataContainer, apmClient.SentBytes()+1)
+	assert.Equal(t, 0, app.deadMan.silent)
+	app.checkDataSent(ctx, metadataContainer, apmClient.SentBytes())
+	assert.Len(t, silentInvocations(), 2)
+
+	// Disabled
+	app.deadMan = deadManSwitch{}
+	for i := 0; i < 3; i++ {
+		app.checkDataSent(ctx, metadataContainer, apmClient.SentBytes())
+	}
+	assert.Len(t, silentInvocations(), 2)
+}
@@ -0,0 +1,171 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/elastic/apm-aws-lambda/extension"
+)
+
+// redacted replaces the values of the secret settings.
+const redacted = "[REDACTED]"
+
+// configSetting is a setting of the extension, configured with an
+// environment variable.
+type configSetting struct {
+	env string
+	// def is the value used when the variable is not set, if any.
+	def string
+	// secret settings are redacted, and the credentials of the URLs
+	// of url settings.
+	secret bool
+	url    bool
+}
+
+// configValue is the effective value of a setting.
+type configValue struct {
+	Value   string `json:"value"`
+	Default bool   `json:"default,omitempty"`
+}
+
+// configSettings returns the settings of the extension, grouped by the
+// feature they configure. This is the list of the environment variables
+// read by New and its helpers, which parse them in the same groups.
+func configSettings() []configSetting {
+	return []configSetting{
+		// APM server and authorization, see apmServerURLs and loadAuthProvider.
+		{env: "ELASTIC_APM_LAMBDA_APM_SERVER", url: true},
+		{env: "ELASTIC_APM_API_KEY", secret: true},
+		{env: "ELASTIC_APM_SECRET_TOKEN", secret: true},
+		{env: "ELASTIC_APM_SECRETS_MANAGER_API_KEY_ID"},
+		{env: "ELASTIC_APM_SECRETS_MANAGER_SECRET_TOKEN_ID"},
+		{env: "ELASTIC_APM_LAMBDA_AUTHORIZATION_FILE"},
+		{env: "ELASTIC_APM_LAMBDA_AUTHORIZATION_COMMAND", secret: true},
+		{env: "ELASTIC_APM_LAMBDA_AWS_ROLE_ARN"},
+		{env: "ELASTIC_APM_LAMBDA_AWS_ROLE_EXTERNAL_ID", secret: true},
+		{env: "ELASTIC_APM_LAMBDA_AWS_USE_FIPS_ENDPOINT"},
+		{env: "ELASTIC_APM_LAMBDA_SERVERLESS"},
+		{env: "ELASTIC_APM_SERVICE_NAME"},
+		{env: "ELASTIC_APM_LOG_LEVEL"},
+		{env: "ELASTIC_APM_LAMBDA_LOG_LEVEL"},
+
+		// Logs API, see logsAPIOptions and functionLogsOptions.
+		{env: "ELASTIC_APM_LAMBDA_TELEMETRY_API", def: "false"},
+		{env: "ELASTIC_APM_LAMBDA_LOGS_RECEIVER_TIMEOUT"},
+		{env: "ELASTIC_APM_LAMBDA_LOGS_LAG_THRESHOLD", def: "1s"},
+		{env: "ELASTIC_APM_LAMBDA_COST_ESTIMATION", def: "false"},
+		{env: "ELASTIC_APM_LAMBDA_COST_PER_GB_SECOND"},
+		{env: "ELASTIC_APM_LAMBDA_COST_PER_REQUEST"},
+		{env: "ELASTIC_APM_LAMBDA_MISSING_METADATA_FALLBACK", def: "none"},
+		{env: "ELASTIC_APM_LAMBDA_CRASH_REPORTING", def: "false"},
+		{env: "ELASTIC_APM_LAMBDA_POWERTOOLS_LOGS", def: "false"},
+		{env: "ELASTIC_APM_LAMBDA_FUNCTION_LOGS", def: "false"},
+		{env: "ELASTIC_APM_LAMBDA_CONTROL_RECORDS", def: "false"},
+		{env: "ELASTIC_APM_LAMBDA_OTEL_ATTRIBUTES", def: "false"},
+		{env: "ELASTIC_APM_LAMBDA_LOGS_TRACE_CONTEXT", def: "false"},
+		{env: "ELASTIC_APM_LAMBDA_LOGS_TEE_URL", url: true},
+		{env: "ELASTIC_APM_LAMBDA_LOGS_TEE_AUTHORIZATION", secret: true},
+
+		// Invocations and init, see loadLifecycleSettings.
+		{env: "ELASTIC_APM_LAMBDA_AGENT_FLUSH_GRACE_PERIOD", def: "0"},
+		{env: "ELASTIC_APM_LAMBDA_HEARTBEAT_INTERVAL"},
+		{env: "ELASTIC_APM_LAMBDA_DEFAULT_SERVICE_VERSION", def: "false"},
+		{env: "ELASTIC_APM_LAMBDA_SILENT_INVOCATIONS_THRESHOLD"},
+		{env: "ELASTIC_APM_LAMBDA_SILENT_INVOCATIONS_EMF", def: "false"},
+		{env: "ELASTIC_APM_LAMBDA_REPORT_INIT_DURATION", def: "false"},
+		{env: "ELASTIC_APM_LAMBDA_PREFETCH", def: "false"},
+
+		// Receiver of the agent data, see receiverOptions.
+		{env: "ELASTIC_APM_DATA_RECEIVER_SERVER_PORT", def: "8200"},
+		{env: "ELASTIC_APM_DATA_RECEIVER_TIMEOUT", def: "15s"},
+		{env: "ELASTIC_APM_DATA_RECEIVER_TIMEOUT_SECONDS"},
+		{env: "ELASTIC_APM_LAMBDA_RECEIVER_MAX_CONNECTIONS"},
+		{env: "ELASTIC_APM_LAMBDA_RECEIVER_MAX_CONCURRENT_REQUESTS"},
+		{env: "ELASTIC_APM_LAMBDA_MAX_INVOCATION_BYTES"},
+		{env: "ELASTIC_APM_LAMBDA_OTLP_RECEIVER", def: "false"},
+		{env: "ELASTIC_APM_LAMBDA_PRESSURE_HEADERS", def: "false"},
+		{env: "ELASTIC_APM_LAMBDA_STRICT_INTAKE_VALIDATION", def: "false"},
+		{env: "ELASTIC_APM_LAMBDA_FIELD_TRANSFORMATIONS"},
+
+		// Buffering of the agent data, see bufferOptions.
+		{env: "ELASTIC_APM_SEND_STRATEGY", def: string(defaultSendStrategy(extension.GetInitializationType()))},
+		{env: "ELASTIC_APM_LAMBDA_TAIL_SAMPLING_RATE"},
+		{env: "ELASTIC_APM_LAMBDA_TAIL_SAMPLING_LATENCY_THRESHOLD"},
+		{env: "ELASTIC_APM_LAMBDA_TAIL_SAMPLING_MAX_BYTES"},
+		{env: "ELASTIC_APM_LAMBDA_AGENT_DATA_BUFFER_SIZE", def: "100"},
+		{env: "ELASTIC_APM_LAMBDA_AGENT_DATA_BUFFER_BYTES"},
+		{env: "ELASTIC_APM_LAMBDA_METRICS_BUFFER_SIZE"},
+		{env: "ELASTIC_APM_LAMBDA_METRICS_FLUSH_INTERVAL"},
+		{env: "ELASTIC_APM_LAMBDA_METRICS_MAX_BATCH_SIZE"},
+		{env: "ELASTIC_APM_LAMBDA_AGENT_DATA_BUFFER_SHIP_THRESHOLD", def: "0.9"},
+		{env: "ELASTIC_APM_LAMBDA_AGENT_DATA_MAX_AGE"},
+		{env: "ELASTIC_APM_LAMBDA_SPILL_MAX_BYTES"},
+		{env: "ELASTIC_APM_LAMBDA_AGENT_DATA_BUFFER_EVICTION", def: "drop_newest"},
+		{env: "ELASTIC_APM_LAMBDA_COMPRESS_BUFFER", def: "false"},
+
+		// Requests to the APM server, see transportOptions.
+		{env: "ELASTIC_APM_DATA_FORWARDER_TIMEOUT", def: "3s"},
+		{env: "ELASTIC_APM_DATA_FORWARDER_TIMEOUT_SECONDS"},
+		{env: "ELASTIC_APM_LAMBDA_KEEPALIVE_INTERVAL"},
+		{env: "ELASTIC_APM_LAMBDA_SEND_RETRIES", def: "0"},
+		{env: "ELASTIC_APM_LAMBDA_SHUTDOWN_HANDOFF_URL", url: true},
+		{env: "ELASTIC_APM_LAMBDA_FORCE_IPV4", def: "false"},
+		{env: "ELASTIC_APM_LAMBDA_DNS_CACHE_TTL"},
+		{env: "ELASTIC_APM_LAMBDA_SIGV4_SERVICE"},
+		{env: "ELASTIC_APM_LAMBDA_SIGV4_REGION"},
+		{env: "ELASTIC_APM_LAMBDA_TLS_SERVER_NAME"},
+
+		// ELASTIC_APM_LAMBDA_DEBUG_STATE_ENDPOINT, see statusOptions, is
+		// only meant for testing and deliberately not listed.
+	}
+}
+
+// effectiveConfig returns the effective value of the settings, keyed by
+// their environment variable. Settings which are neither set nor have a
+// default value are omitted.
+func effectiveConfig(settings []configSetting) map[string]configValue {
+	config := make(map[string]configValue, len(settings))
+	for _, s := range settings {
+		value := os.Getenv(s.env)
+		switch {
+		case value != "" && s.secret:
+			config[s.env] = configValue{Value: redacted}
+		case value != "" && s.url:
+			config[s.env] = configValue{Value: redactURLs(value)}
+		case value != "":
+			config[s.env] = configValue{Value: value}
+		case s.def != "":
+			config[s.env] = configValue{Value: s.def, Default: true}
+		}
+	}
+	return config
+}
+
+// redactURLs redacts the credentials of the comma separated URLs.
+func redactURLs(value string) string {
+	urls := strings.Split(value, ",")
+	for i, raw := range urls {
+		if u, err := url.Parse(strings.TrimSpace(raw)); err == nil && u.User != nil {
+			urls[i] = u.Redacted()
+		}
+	}
+	return strings.Join(urls, ",")
+}
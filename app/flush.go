@@ -0,0 +1,37 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import "context"
+
+// Flush sends all the agent data buffered by the extension to the APM
+// server, e.g. for embedders and tests which cannot wait for the end
+// of an invocation.
+//
+// Flush returns once the buffer is drained. Agent data received while
+// Flush is running, e.g. during an in-flight invocation, is sent if it
+// is buffered before the buffer is drained; otherwise it is forwarded
+// with the rest of the invocation's data. Flush does not wait for the
+// invocation to end nor finalize its platform metrics.
+//
+// It returns an error if agent data could not be sent, or is still
+// buffered because the APM server is failing, forwarding is paused or
+// ctx is done.
+func (app *App) Flush(ctx context.Context) error {
+	return app.flush(ctx)
+}
@@ -0,0 +1,70 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestFlush(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusAccepted)
+	var requests atomic.Int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer apmServer.Close()
+
+	// Failing flushes start a grace period that outlives the test.
+	l := zap.NewNop().Sugar()
+	apmClient, err := apmproxy.NewClient(apmproxy.WithURL(apmServer.URL), apmproxy.WithLogger(l))
+	require.NoError(t, err)
+	app := &App{logger: l, apmClient: apmClient}
+
+	apmClient.EnqueueAPMData(apmproxy.AgentData{Data: []byte(`{"metadata":{}}`)})
+	apmClient.EnqueueAPMData(apmproxy.AgentData{Data: []byte(`{"metadata":{}}`)})
+	require.NoError(t, app.Flush(context.Background()))
+	assert.Equal(t, int32(2), requests.Load())
+	assert.Empty(t, apmClient.DataChannel)
+
+	// Nothing to flush
+	require.NoError(t, app.Flush(context.Background()))
+
+	// Done context
+	apmClient.EnqueueAPMData(apmproxy.AgentData{Data: []byte(`{"metadata":{}}`)})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, app.Flush(ctx), context.Canceled)
+	require.NoError(t, app.Flush(context.Background()))
+
+	// Failing APM server
+	status.Store(http.StatusServiceUnavailable)
+	apmClient.EnqueueAPMData(apmproxy.AgentData{Data: []byte(`{"metadata":{}}`)})
+	assert.Error(t, app.Flush(context.Background()))
+}
@@ -0,0 +1,88 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+	"github.com/elastic/apm-aws-lambda/extension"
+	"github.com/elastic/apm-aws-lambda/logsapi"
+
+	"go.elastic.co/apm/v2/model"
+	"go.elastic.co/fastjson"
+)
+
+// heartbeat sends a heartbeat metricset to the APM server if none was
+// sent for longer than the heartbeat interval, so that an environment
+// without invocations, e.g. with provisioned concurrency, can be told
+// apart from broken telemetry. Lambda freezes the environment between
+// invocations: heartbeats are only sent during the init phase and after
+// invocations. It is a no-op if no heartbeat interval is configured.
+func (app *App) heartbeat(ctx context.Context, metadataContainer *apmproxy.MetadataContainer, now time.Time) {
+	if app.heartbeatInterval <= 0 || now.Sub(app.lastHeartbeat) < app.heartbeatInterval {
+		return
+	}
+
+	data, err := metricsetData(metadataContainer, now, map[string]float64{"faas.heartbeat": 1})
+	if err != nil {
+		app.logger.Warnf("Failed to create heartbeat: %v", err)
+		return
+	}
+
+	app.logger.Debug("Sending heartbeat to the APM server")
+	if err := app.apmClient.PostToApmServer(ctx, data); err != nil {
+		app.logger.Warnf("Failed to send heartbeat: %v", err)
+		return
+	}
+	app.lastHeartbeat = now
+}
+
+// metricsetData returns a metricset generated by the extension, with the
+// metadata of the agent if available, or metadata built from the environment.
+func metricsetData(metadataContainer *apmproxy.MetadataContainer, now time.Time, samples map[string]float64) (apmproxy.AgentData, error) {
+	metadata := metadataContainer.Metadata
+	if metadata == nil {
+		var err error
+		if metadata, err = apmproxy.SynthesizeMetadata(); err != nil {
+			return apmproxy.AgentData{}, err
+		}
+	}
+
+	metricsContainer := logsapi.MetricsContainer{
+		Metrics: &model.Metrics{
+			Timestamp: model.Time(now),
+			Labels: model.StringMap{
+				{Key: "apm_lambda_extension_commit", Value: extension.Commit},
+				{Key: "apm_lambda_extension_version", Value: extension.Version},
+			},
+		},
+	}
+	for name, value := range samples {
+		metricsContainer.Add(name, value)
+	}
+
+	var jsonWriter fastjson.Writer
+	if err := metricsContainer.MarshalFastJSON(&jsonWriter); err != nil {
+		return apmproxy.AgentData{}, err
+	}
+
+	data := append(append(append([]byte{}, metadata...), '\n'), jsonWriter.Bytes()...)
+	return apmproxy.AgentData{Data: data}, nil
+}
@@ -0,0 +1,77 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestHeartbeat(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "my-function")
+
+	var heartbeats atomic.Int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := apmproxy.GetUncompressedBytes(readAll(t, r.Body), r.Header.Get("Content-Encoding"))
+		require.NoError(t, err)
+		metadata, metricset, _ := bytes.Cut(body, []byte("\n"))
+		assert.Contains(t, string(metadata), `"name":"my-function"`)
+		assert.Contains(t, string(metricset), `"faas.heartbeat":{"value":1}`)
+		heartbeats.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	l := zaptest.NewLogger(t).Sugar()
+	apmClient, err := apmproxy.NewClient(apmproxy.WithURL(apmServer.URL), apmproxy.WithLogger(l))
+	require.NoError(t, err)
+	app := &App{logger: l, apmClient: apmClient, heartbeatInterval: time.Minute}
+
+	now := time.Now()
+	app.heartbeat(context.Background(), &apmproxy.MetadataContainer{}, now)
+	assert.Equal(t, int32(1), heartbeats.Load())
+
+	app.heartbeat(context.Background(), &apmproxy.MetadataContainer{}, now.Add(30*time.Second))
+	assert.Equal(t, int32(1), heartbeats.Load())
+
+	app.heartbeat(context.Background(), &apmproxy.MetadataContainer{}, now.Add(2*time.Minute))
+	assert.Equal(t, int32(2), heartbeats.Load())
+
+	// Disabled
+	app.heartbeatInterval = 0
+	app.heartbeat(context.Background(), &apmproxy.MetadataContainer{}, now.Add(time.Hour))
+	assert.Equal(t, int32(2), heartbeats.Load())
+}
+
+func readAll(t *testing.T, r io.Reader) []byte {
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return b
+}
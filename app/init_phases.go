@@ -0,0 +1,96 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+)
+
+// initPhase is a phase of the init of the extension.
+type initPhase struct {
+	name     string
+	duration time.Duration
+}
+
+// initPhases records the duration of the phases of the init of the
+// extension, to attribute the cold start overhead.
+type initPhases struct {
+	start    time.Time
+	end      time.Time
+	phases   []initPhase
+	reported bool
+}
+
+// record records the end of the phase started at start.
+func (p *initPhases) record(name string, start time.Time) {
+	p.add(name, time.Since(start))
+}
+
+// add records a phase which took duration.
+func (p *initPhases) add(name string, duration time.Duration) {
+	p.phases = append(p.phases, initPhase{name: name, duration: duration})
+}
+
+// done records the end of the init.
+func (p *initPhases) done() {
+	p.end = time.Now()
+}
+
+// fields returns the durations of the init and its phases, in
+// milliseconds, keyed by the name of the metric reporting them.
+func (p *initPhases) fields() map[string]float64 {
+	fields := map[string]float64{
+		"extension.init.duration": float64(p.end.Sub(p.start).Microseconds()) / 1e3,
+	}
+	for _, phase := range p.phases {
+		fields["extension.init."+phase.name+".duration"] = float64(phase.duration.Microseconds()) / 1e3
+	}
+	return fields
+}
+
+// logInit logs the duration of the init of the extension and its phases.
+func (app *App) logInit() {
+	app.initPhases.done()
+	keysAndValues := make([]interface{}, 0, 2*len(app.initPhases.phases))
+	for _, phase := range app.initPhases.phases {
+		keysAndValues = append(keysAndValues, phase.name+"_ms", float64(phase.duration.Microseconds())/1e3)
+	}
+	app.logger.Infow("Extension initialized in "+app.initPhases.end.Sub(app.initPhases.start).String(), keysAndValues...)
+}
+
+// reportInit sends the durations of the init of the extension and its
+// phases as a metricset, once. It is sent after the first invocation,
+// when the metadata of the agent is available.
+func (app *App) reportInit(ctx context.Context, metadataContainer *apmproxy.MetadataContainer) {
+	if app.initPhases.reported || app.initPhases.end.IsZero() {
+		return
+	}
+	app.initPhases.reported = true
+
+	data, err := metricsetData(metadataContainer, app.initPhases.end, app.initPhases.fields())
+	if err != nil {
+		app.logger.Warnf("Failed to create the init metricset: %v", err)
+		return
+	}
+	if err := app.apmClient.PostToApmServer(ctx, data); err != nil {
+		app.logger.Warnf("Failed to send the init metricset: %v", err)
+	}
+}
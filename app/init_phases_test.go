@@ -0,0 +1,72 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestReportInit(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "my-function")
+
+	var reports atomic.Int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := apmproxy.GetUncompressedBytes(readAll(t, r.Body), r.Header.Get("Content-Encoding"))
+		require.NoError(t, err)
+		_, metricset, _ := bytes.Cut(body, []byte("\n"))
+		assert.Contains(t, string(metricset), `"extension.init.duration":{"value":1500}`)
+		assert.Contains(t, string(metricset), `"extension.init.registration.duration":{"value":250}`)
+		reports.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	l := zaptest.NewLogger(t).Sugar()
+	apmClient, err := apmproxy.NewClient(apmproxy.WithURL(apmServer.URL), apmproxy.WithLogger(l))
+	require.NoError(t, err)
+	app := &App{logger: l, apmClient: apmClient}
+
+	// Not reported before the init is done
+	app.reportInit(context.Background(), &apmproxy.MetadataContainer{})
+	assert.Equal(t, int32(0), reports.Load())
+
+	start := time.Now()
+	app.initPhases = initPhases{
+		start:  start,
+		end:    start.Add(1500 * time.Millisecond),
+		phases: []initPhase{{name: "registration", duration: 250 * time.Millisecond}},
+	}
+	app.reportInit(context.Background(), &apmproxy.MetadataContainer{})
+	assert.Equal(t, int32(1), reports.Load())
+
+	// Reported once
+	app.reportInit(context.Background(), &apmproxy.MetadataContainer{})
+	assert.Equal(t, int32(1), reports.Load())
+}
@@ -0,0 +1,189 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+)
+
+// maxJournaledRequestIDs bounds the request IDs written to the flush
+// journal, the most recent ones are kept.
+const maxJournaledRequestIDs = 32
+
+// flushJournal records the flushes in progress in a file, so that the
+// data lost when the extension is killed during a flush, e.g. when the
+// environment runs out of memory, can be reported on the next start.
+type flushJournal struct {
+	path string
+
+	mu sync.Mutex
+	// requestIDs are the request IDs of the invocations since the
+	// last successful flush, whose data may be buffered.
+	requestIDs []string
+	// inFlight is the number of flushes in progress.
+	inFlight int
+}
+
+// flushJournalEntry describes a flush in progress.
+type flushJournalEntry struct {
+	Started    time.Time `json:"started"`
+	Bytes      int64     `json:"bytes"`
+	Payloads   int       `json:"payloads"`
+	RequestIDs []string  `json:"request_ids,omitempty"`
+}
+
+// invocation records the request ID of an invocation.
+func (j *flushJournal) invocation(requestID string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.requestIDs = append(j.requestIDs, requestID)
+	if n := len(j.requestIDs); n > maxJournaledRequestIDs {
+		j.requestIDs = append(j.requestIDs[:0], j.requestIDs[n-maxJournaledRequestIDs:]...)
+	}
+}
+
+// begin records the start of a flush of the buffer. The file is replaced
+// atomically, a partially written entry would be mistaken for a lost flush.
+func (j *flushJournal) begin(started time.Time, buffer apmproxy.BufferStats) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.inFlight++
+	if j.inFlight > 1 {
+		return nil
+	}
+
+	data, err := json.Marshal(flushJournalEntry{
+		Started:    started,
+		Bytes:      buffer.Bytes,
+		Payloads:   buffer.Depth,
+		RequestIDs: j.requestIDs,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode flush journal entry: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create flush journal directory: %w", err)
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write flush journal: %w", err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("failed to write flush journal: %w", err)
+	}
+	return nil
+}
+
+// end records the end of a flush. The extension survived the flush
+// whatever its outcome, the request IDs are only forgotten if it
+// succeeded.
+func (j *flushJournal) end(succeeded bool) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if succeeded {
+		j.requestIDs = j.requestIDs[:0]
+	}
+	if j.inFlight--; j.inFlight > 0 {
+		return nil
+	}
+	return j.clear()
+}
+
+func (j *flushJournal) clear() error {
+	if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to clear flush journal: %w", err)
+	}
+	return nil
+}
+
+// recover returns the entry of a flush which never ended, if any, and
+// clears it.
+func (j *flushJournal) recover() (*flushJournalEntry, error) {
+	data, err := os.ReadFile(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read flush journal: %w", err)
+	}
+	if err := j.clear(); err != nil {
+		return nil, err
+	}
+
+	var entry flushJournalEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("failed to decode flush journal entry: %w", err)
+	}
+	return &entry, nil
+}
+
+// recoverFlushJournal logs a data loss report if the previous instance
+// of the extension was killed during a flush. The report is sent as a
+// metricset by reportDataLoss.
+func (app *App) recoverFlushJournal() {
+	if app.flushJournal == nil {
+		return
+	}
+	entry, err := app.flushJournal.recover()
+	if err != nil {
+		app.logger.Warnf("Failed to recover the flush journal: %v", err)
+		return
+	}
+	if entry == nil {
+		return
+	}
+	app.lostFlush = entry
+	app.logger.Warnw("The extension was stopped during a flush, the agent data being flushed may have been lost",
+		"flush.started", entry.Started,
+		"flush.bytes", entry.Bytes,
+		"flush.payloads", entry.Payloads,
+		"flush.request_ids", entry.RequestIDs,
+	)
+}
+
+// reportDataLoss sends the data lost during the flush interrupted in a
+// previous instance of the extension as a metricset, once. It is sent
+// after the first invocation, when the metadata of the agent is available.
+func (app *App) reportDataLoss(ctx context.Context, metadataContainer *apmproxy.MetadataContainer) {
+	if app.lostFlush == nil {
+		return
+	}
+	entry := app.lostFlush
+	app.lostFlush = nil
+
+	data, err := metricsetData(metadataContainer, time.Now(), map[string]float64{
+		"extension.flush.lost_bytes":    float64(entry.Bytes),
+		"extension.flush.lost_payloads": float64(entry.Payloads),
+	})
+	if err != nil {
+		app.logger.Warnf("Failed to create the data loss metricset: %v", err)
+		return
+	}
+	if err := app.apmClient.PostToApmServer(ctx, data); err != nil {
+		app.logger.Warnf("Failed to send the data loss metricset: %v", err)
+	}
+}
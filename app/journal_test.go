@@ -0,0 +1,82 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlushJournal(t *testing.T) {
+	j := &flushJournal{path: filepath.Join(t.TempDir(), "journal", "flush.json")}
+
+	entry, err := j.recover()
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+
+	// A flush which ended is not reported.
+	j.invocation("req-1")
+	require.NoError(t, j.begin(time.Now(), apmproxy.BufferStats{Depth: 1, Bytes: 10}))
+	require.NoError(t, j.end(false))
+	entry, err = j.recover()
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+
+	// The request IDs are kept until a flush succeeds.
+	j.invocation("req-2")
+	started := time.Now().Truncate(time.Millisecond)
+	require.NoError(t, j.begin(started, apmproxy.BufferStats{Depth: 3, Bytes: 1024}))
+
+	// Overlapping flushes don't clear the entry of the first one.
+	require.NoError(t, j.begin(time.Now(), apmproxy.BufferStats{}))
+	require.NoError(t, j.end(false))
+
+	// The flush never ended, as if the extension was killed.
+	entry, err = j.recover()
+	require.NoError(t, err)
+	require.NotNil(t, entry)
+	assert.True(t, started.Equal(entry.Started))
+	assert.Equal(t, int64(1024), entry.Bytes)
+	assert.Equal(t, 3, entry.Payloads)
+	assert.Equal(t, []string{"req-1", "req-2"}, entry.RequestIDs)
+
+	// The entry is only reported once.
+	entry, err = j.recover()
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+}
+
+func TestFlushJournalRequestIDs(t *testing.T) {
+	j := &flushJournal{path: filepath.Join(t.TempDir(), "flush.json")}
+	for i := 0; i < 2*maxJournaledRequestIDs; i++ {
+		j.invocation(fmt.Sprintf("req-%d", i))
+	}
+	require.Len(t, j.requestIDs, maxJournaledRequestIDs)
+	assert.Equal(t, fmt.Sprintf("req-%d", maxJournaledRequestIDs), j.requestIDs[0])
+
+	require.NoError(t, j.begin(time.Now(), apmproxy.BufferStats{}))
+	require.NoError(t, j.end(true))
+	assert.Empty(t, j.requestIDs)
+}
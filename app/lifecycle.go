@@ -0,0 +1,118 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/extension"
+)
+
+// LifecycleEventType is the type of a LifecycleEvent.
+type LifecycleEventType string
+
+const (
+	// InvocationStart is emitted when the extension receives an invocation.
+	InvocationStart LifecycleEventType = "invocation_start"
+	// RuntimeDone is emitted when the extension receives the runtimeDone
+	// event of the invocation before the agent flush signal.
+	RuntimeDone LifecycleEventType = "runtime_done"
+	// FlushCompleted is emitted when a flush of the agent data ends.
+	FlushCompleted LifecycleEventType = "flush_completed"
+	// Shutdown is emitted when the extension receives the shutdown event.
+	Shutdown LifecycleEventType = "shutdown"
+)
+
+// lifecycleEventsBuffer is the number of lifecycle events buffered
+// for a slow consumer.
+const lifecycleEventsBuffer = 64
+
+// LifecycleEvent describes a step of the lifecycle of the extension.
+type LifecycleEvent struct {
+	Type LifecycleEventType
+	Time time.Time
+	// RequestID is the request ID of the invocation,
+	// for InvocationStart and RuntimeDone events.
+	RequestID string
+	// Bytes is the number of bytes sent, Duration the duration
+	// and Err the error of the flush, for FlushCompleted events.
+	Bytes    int64
+	Duration time.Duration
+	Err      error
+	// ShutdownReason is the reason of the shutdown, for Shutdown events.
+	ShutdownReason extension.ShutdownReason
+}
+
+// Events returns the lifecycle events of the extension, e.g. for
+// monitoring wrappers and tests. The events are buffered, and dropped
+// if the consumer falls behind: the extension never waits on it.
+func (app *App) Events() <-chan LifecycleEvent {
+	return app.events
+}
+
+// emit sends the lifecycle event without blocking.
+func (app *App) emit(event LifecycleEvent) {
+	if app.events == nil {
+		return
+	}
+	event.Time = time.Now()
+	select {
+	case app.events <- event:
+	default:
+	}
+}
+
+// flush sends all the agent data buffered and emits a
+// FlushCompleted event.
+func (app *App) flush(ctx context.Context) error {
+	start := time.Now()
+	sent := app.apmClient.SentBytes()
+	if app.flushJournal != nil {
+		if err := app.flushJournal.begin(start, app.apmClient.BufferStats()); err != nil {
+			app.logger.Warnf("Failed to journal the flush: %v", err)
+		}
+	}
+	err := app.apmClient.FlushAPMData(ctx)
+	if metricsErr := app.apmClient.FlushMetricsData(ctx); metricsErr != nil && err == nil {
+		app.logger.Warnf("Error while sending the platform metrics: %v", metricsErr)
+	}
+	if err == nil {
+		// The APM server is reachable again, send the data spilled
+		// while it was not.
+		n, replayErr := app.apmClient.ReplaySpilled(ctx)
+		if n > 0 {
+			app.logger.Infof("Sent %d payloads of agent data spilled to disk", n)
+		}
+		if replayErr != nil {
+			app.logger.Warnf("Error while sending the agent data spilled to disk: %v", replayErr)
+		}
+	}
+	if app.flushJournal != nil {
+		if err := app.flushJournal.end(err == nil); err != nil {
+			app.logger.Warnf("Failed to journal the flush: %v", err)
+		}
+	}
+	app.emit(LifecycleEvent{
+		Type:     FlushCompleted,
+		Bytes:    app.apmClient.SentBytes() - sent,
+		Duration: time.Since(start),
+		Err:      err,
+	})
+	return err
+}
@@ -0,0 +1,62 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestLifecycleEvents(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	l := zaptest.NewLogger(t).Sugar()
+	apmClient, err := apmproxy.NewClient(apmproxy.WithURL(apmServer.URL), apmproxy.WithLogger(l))
+	require.NoError(t, err)
+	app := &App{logger: l, apmClient: apmClient, events: make(chan LifecycleEvent, 1)}
+
+	apmClient.EnqueueAPMData(apmproxy.AgentData{Data: []byte(`{"metadata":{}}`), ContentEncoding: "identity"})
+	require.NoError(t, app.Flush(context.Background()))
+
+	event := <-app.Events()
+	assert.Equal(t, FlushCompleted, event.Type)
+	assert.Equal(t, int64(len(`{"metadata":{}}`)), event.Bytes)
+	assert.NoError(t, event.Err)
+	assert.False(t, event.Time.IsZero())
+
+	// The extension never waits on the consumer
+	app.emit(LifecycleEvent{Type: InvocationStart, RequestID: "1"})
+	app.emit(LifecycleEvent{Type: InvocationStart, RequestID: "2"})
+	assert.Equal(t, "1", (<-app.Events()).RequestID)
+	assert.Empty(t, app.Events())
+
+	// Events are optional
+	app.events = nil
+	app.emit(LifecycleEvent{Type: Shutdown})
+}
@@ -0,0 +1,186 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// instanceLockFile is the file of the lock directory recording the
+// active instance.
+const instanceLockFile = "instance.lock"
+
+// instanceLock coordinates the copies of the extension running in the same
+// execution environment, e.g. when the layer is attached twice, so that
+// only one of them is active. The active instance is recorded in a single
+// file, read and written under an exclusive flock. A newer version takes
+// over from an older one until the older one commits, i.e. starts its
+// receiver, after which the other copies stay idle.
+type instanceLock struct {
+	path    string
+	pid     int
+	version string
+}
+
+// instanceRecord is the content of the lock file: the pid and version of
+// the active instance, and whether it committed to being active.
+type instanceRecord struct {
+	pid       int
+	version   string
+	committed bool
+}
+
+func parseInstanceRecord(b []byte) (instanceRecord, bool) {
+	fields := strings.Fields(string(b))
+	if len(fields) != 3 {
+		return instanceRecord{}, false
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return instanceRecord{}, false
+	}
+	return instanceRecord{pid: pid, version: fields[1], committed: fields[2] == "committed"}, true
+}
+
+func (r instanceRecord) String() string {
+	state := "candidate"
+	if r.committed {
+		state = "committed"
+	}
+	return fmt.Sprintf("%d %s %s\n", r.pid, r.version, state)
+}
+
+// acquireInstanceLock records the instance as the active one in dir and
+// returns true, unless another live instance is recorded which either
+// committed or has the same or a newer version.
+func acquireInstanceLock(dir string, version string) (*instanceLock, bool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, false, fmt.Errorf("failed to create instance lock directory: %w", err)
+	}
+
+	l := &instanceLock{path: filepath.Join(dir, instanceLockFile), pid: os.Getpid(), version: version}
+	var active bool
+	err := l.update(func(current instanceRecord, ok bool) (instanceRecord, bool) {
+		if ok && current.pid != l.pid && processAlive(current.pid) &&
+			(current.committed || compareVersions(current.version, version) >= 0) {
+			return current, false
+		}
+		active = true
+		return instanceRecord{pid: l.pid, version: version}, true
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return l, active, nil
+}
+
+// Commit marks the instance as committed to being active, and returns
+// false if a newer instance took over since the lock was acquired.
+func (l *instanceLock) Commit() (bool, error) {
+	var committed bool
+	err := l.update(func(current instanceRecord, ok bool) (instanceRecord, bool) {
+		if !ok || current.pid != l.pid {
+			return current, false
+		}
+		committed = true
+		current.committed = true
+		return current, true
+	})
+	return committed, err
+}
+
+// Release removes the instance from the lock file, if it is recorded.
+func (l *instanceLock) Release() error {
+	return l.update(func(current instanceRecord, ok bool) (instanceRecord, bool) {
+		if !ok || current.pid != l.pid {
+			return current, false
+		}
+		return instanceRecord{}, true
+	})
+}
+
+// update reads the record of the lock file and replaces it with the
+// record returned by fn, if it returns true, under an exclusive flock.
+// A zero record empties the lock file.
+func (l *instanceLock) update(fn func(current instanceRecord, ok bool) (instanceRecord, bool)) error {
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open instance lock: %w", err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock instance lock: %w", err)
+	}
+	// Closing the file releases the flock.
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("failed to read instance lock: %w", err)
+	}
+	current, ok := parseInstanceRecord(b)
+	record, write := fn(current, ok)
+	if !write {
+		return nil
+	}
+
+	var content string
+	if record != (instanceRecord{}) {
+		content = record.String()
+	}
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("failed to write instance lock: %w", err)
+	}
+	if _, err := f.WriteAt([]byte(content), 0); err != nil {
+		return fmt.Errorf("failed to write instance lock: %w", err)
+	}
+	return nil
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// compareVersions compares two dotted versions numerically. Missing or
+// non-numeric components are treated as zero.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x > y {
+				return 1
+			}
+			return -1
+		}
+	}
+	return 0
+}
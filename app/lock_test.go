@@ -0,0 +1,102 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquireInstanceLock(t *testing.T) {
+	// The parent process stands in for another running instance.
+	otherPid := os.Getppid()
+
+	for name, tc := range map[string]struct {
+		other  *instanceRecord
+		active bool
+	}{
+		"no other instance":        {active: true},
+		"older instance":           {other: &instanceRecord{pid: otherPid, version: "1.0.9"}, active: true},
+		"older committed instance": {other: &instanceRecord{pid: otherPid, version: "1.0.9", committed: true}, active: false},
+		"same version instance":    {other: &instanceRecord{pid: otherPid, version: "1.2.0"}, active: false},
+		"newer instance":           {other: &instanceRecord{pid: otherPid, version: "1.10.0"}, active: false},
+		"stale newer instance":     {other: &instanceRecord{pid: 2147483647, version: "9.9.9", committed: true}, active: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tc.other != nil {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, instanceLockFile), []byte(tc.other.String()), 0o644))
+			}
+
+			lock, active, err := acquireInstanceLock(dir, "1.2.0")
+			require.NoError(t, err)
+			assert.Equal(t, tc.active, active)
+
+			committed, err := lock.Commit()
+			require.NoError(t, err)
+			assert.Equal(t, tc.active, committed)
+
+			require.NoError(t, lock.Release())
+			b, err := os.ReadFile(lock.path)
+			require.NoError(t, err)
+			if tc.active {
+				assert.Empty(t, b)
+			} else {
+				// The record of the other instance is kept.
+				assert.Equal(t, tc.other.String(), string(b))
+			}
+		})
+	}
+}
+
+func TestInstanceLockTakeover(t *testing.T) {
+	dir := t.TempDir()
+
+	older, active, err := acquireInstanceLock(dir, "1.2.0")
+	require.NoError(t, err)
+	require.True(t, active)
+
+	// A newer copy takes over from the older one until it commits.
+	newer := &instanceLock{path: older.path, pid: os.Getppid(), version: "1.3.0"}
+	require.NoError(t, newer.update(func(instanceRecord, bool) (instanceRecord, bool) {
+		return instanceRecord{pid: newer.pid, version: newer.version}, true
+	}))
+
+	committed, err := older.Commit()
+	require.NoError(t, err)
+	assert.False(t, committed)
+	committed, err = newer.Commit()
+	require.NoError(t, err)
+	assert.True(t, committed)
+
+	// The older copy does not release the lock of the newer one.
+	require.NoError(t, older.Release())
+	_, active, err = acquireInstanceLock(dir, "1.2.0")
+	require.NoError(t, err)
+	assert.False(t, active)
+}
+
+func TestCompareVersions(t *testing.T) {
+	assert.Equal(t, 0, compareVersions("1.2.0", "1.2"))
+	assert.Equal(t, 1, compareVersions("1.10.0", "1.9.3"))
+	assert.Equal(t, -1, compareVersions("1.1.0", "1.2.0"))
+}
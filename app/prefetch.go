@@ -0,0 +1,123 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// prefetchTimeout bounds the prefetch of the init, as a whole.
+const prefetchTimeout = secretsTimeout
+
+// prefetchTask is a task of the prefetch of the init.
+type prefetchTask struct {
+	name string
+	// run runs the task and returns whether there was anything to do.
+	run func(ctx context.Context) (bool, error)
+	// required tasks fail the init if they fail.
+	required bool
+}
+
+// prefetch resolves the secrets, probes the APM servers and prefetches
+// the information of the APM server and the central configuration of
+// the agent concurrently, within prefetchTimeout, so that enabling more
+// of them does not add up to the cold start. The duration of each task
+// is recorded as a phase of the init. It returns an error if the
+// secrets cannot be resolved.
+func (app *App) prefetch(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, prefetchTimeout)
+	defer cancel()
+
+	tasks := app.prefetchTasks()
+	ran := make([]bool, len(tasks))
+	errs := make([]error, len(tasks))
+	durations := make([]time.Duration, len(tasks))
+	var wg sync.WaitGroup
+	for i := range tasks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start := time.Now()
+			ran[i], errs[i] = tasks[i].run(ctx)
+			durations[i] = time.Since(start)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, task := range tasks {
+		switch {
+		case errs[i] != nil && task.required:
+			return fmt.Errorf("failed to prefetch the %s: %w", task.name, errs[i])
+		case errs[i] != nil:
+			app.logger.Warnf("Failed to prefetch the %s: %v", task.name, errs[i])
+		case ran[i]:
+			app.initPhases.add(task.name, durations[i])
+		}
+	}
+	return nil
+}
+
+// prefetchTasks returns the tasks of the prefetch of the init.
+func (app *App) prefetchTasks() []prefetchTask {
+	return []prefetchTask{{
+		name: "secrets",
+		run: func(ctx context.Context) (bool, error) {
+			if !app.resolveSecrets {
+				return false, nil
+			}
+			_, err := app.authProvider.Authorization(ctx)
+			return true, err
+		},
+		required: true,
+	}, {
+		// Prefer the fastest of the APM servers, if several are configured
+		name: "apm_server_probe",
+		run: func(ctx context.Context) (bool, error) {
+			return app.apmClient.ProbeServers(ctx), nil
+		},
+	}, {
+		name: "server_info",
+		run: func(ctx context.Context) (bool, error) {
+			if !app.prefetchServerInfo {
+				return false, nil
+			}
+			return true, app.apmClient.PrefetchServerInfo(ctx)
+		},
+	}, {
+		name: "agent_config",
+		run: func(ctx context.Context) (bool, error) {
+			if !app.prefetchAgentConfig {
+				return false, nil
+			}
+			return true, app.apmClient.PrefetchAgentConfig(ctx, agentServiceName(), os.Getenv("ELASTIC_APM_ENVIRONMENT"))
+		},
+	}}
+}
+
+// agentServiceName returns the name of the service of the agent, which
+// defaults to the name of the function.
+func agentServiceName() string {
+	if name := os.Getenv("ELASTIC_APM_SERVICE_NAME"); name != "" {
+		return name
+	}
+	return os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+}
@@ -0,0 +1,87 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestPrefetch(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "my-function")
+
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "ApiKey secret", r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer apmServer.Close()
+
+	l := zaptest.NewLogger(t).Sugar()
+	authProvider := apmproxy.NewRefreshingAuth(func(context.Context) (string, error) {
+		return "ApiKey secret", nil
+	})
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithAuthProvider(authProvider),
+		apmproxy.WithLogger(l),
+	)
+	require.NoError(t, err)
+	app := &App{
+		logger:              l,
+		apmClient:           apmClient,
+		authProvider:        authProvider,
+		resolveSecrets:      true,
+		prefetchServerInfo:  true,
+		prefetchAgentConfig: true,
+	}
+
+	require.NoError(t, app.prefetch(context.Background()))
+	var names []string
+	for _, phase := range app.initPhases.phases {
+		names = append(names, phase.name)
+	}
+	// A single APM server is not probed.
+	assert.Equal(t, []string{"secrets", "server_info", "agent_config"}, names)
+}
+
+func TestPrefetchSecretsError(t *testing.T) {
+	l := zaptest.NewLogger(t).Sugar()
+	authProvider := apmproxy.NewRefreshingAuth(func(context.Context) (string, error) {
+		return "", errors.New("secret not found")
+	})
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL("http://localhost:8200"),
+		apmproxy.WithAuthProvider(authProvider),
+		apmproxy.WithLogger(l),
+	)
+	require.NoError(t, err)
+	app := &App{logger: l, apmClient: apmClient, authProvider: authProvider, resolveSecrets: true}
+
+	err = app.prefetch(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "secret not found")
+}
@@ -25,11 +25,25 @@ import (
 	"fmt"
 	"sync"
 	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// shutdownFlushTimeout bounds the last flush when the deadline of
+	// the shutdown phase is unknown, e.g. when exiting on a signal.
+	shutdownFlushTimeout = 5 * time.Second
+	// shutdownDeadlineMargin is left of the shutdown phase for the
+	// extension to exit once the last flush is aborted.
+	shutdownDeadlineMargin = 100 * time.Millisecond
 )
 
 // Run runs the app.
 func (app *App) Run(ctx context.Context) error {
+	app.logger.Infof("Starting Elastic APM Lambda extension %s", extension.GetBuildInfo())
+
 	// register extension with AWS Extension API
+	registerStart := time.Now()
 	res, err := app.extensionClient.Register(ctx, app.extensionName)
 	if err != nil {
 		app.logger.Errorf("Error: %s", err)
@@ -44,8 +58,47 @@ func (app *App) Run(ctx context.Context) error {
 		return err
 	}
 	app.logger.Debugf("Register response: %v", extension.PrettyPrint(res))
+	app.functionVersion = res.FunctionVersion
+	if app.defaultServiceVersion {
+		app.apmClient.SetServiceVersion(app.functionVersion)
+	}
+	app.initPhases.record("registration", registerStart)
+
+	var lock *instanceLock
+	if app.instanceLockDir != "" {
+		lockStart := time.Now()
+		var active bool
+		lock, active, err = acquireInstanceLock(app.instanceLockDir, extension.Version)
+		if lock != nil {
+			defer func() {
+				if err := lock.Release(); err != nil {
+					app.logger.Warnf("Failed to release the instance lock: %v", err)
+				}
+			}()
+		}
+		if err != nil {
+			app.logger.Warnf("Failed to coordinate with other extension instances: %v", err)
+		} else if !active {
+			app.logger.Warn("Another instance of the extension is active, with the same or a newer version or already started. Check whether the layer is attached more than once. This instance will stay idle.")
+			return app.idle(ctx)
+		}
+		app.initPhases.record("instance_lock", lockStart)
+	}
+
+	// A newer instance may have taken over since the lock was acquired.
+	if lock != nil {
+		if committed, err := lock.Commit(); err != nil {
+			app.logger.Warnf("Failed to coordinate with other extension instances: %v", err)
+		} else if !committed {
+			app.logger.Warn("A newer instance of the extension took over. Check whether the layer is attached more than once. This instance will stay idle.")
+			return app.idle(ctx)
+		}
+	}
+
+	app.recoverFlushJournal()
 
 	// start http server to receive data from agent
+	receiverStart := time.Now()
 	err = app.apmClient.StartReceiver()
 	if err != nil {
 		return fmt.Errorf("failed to start the APM data receiver : %w", err)
@@ -55,16 +108,32 @@ func (app *App) Run(ctx context.Context) error {
 			app.logger.Warnf("Error while shutting down the apm receiver: %v", err)
 		}
 	}()
+	app.initPhases.record("receiver", receiverStart)
+
+	if err := app.prefetch(ctx); err != nil {
+		return err
+	}
+
+	// Keep the connection to the APM Server alive while idle
+	keepAliveCtx, stopKeepAlive := context.WithCancel(ctx)
+	defer stopKeepAlive()
+	go app.apmClient.ForwardKeepAlive(keepAliveCtx)
 
 	if app.logsClient != nil {
-		if err := app.logsClient.StartService([]logsapi.EventType{logsapi.Platform}, app.extensionClient.ExtensionID); err != nil {
+		subscriptionStart := time.Now()
+		if err := app.logsClient.StartService(ctx, app.logsEventTypes, app.extensionClient.ExtensionID); err != nil {
 			app.logger.Warnf("Error while subscribing to the Logs API: %v", err)
 
 			// disable logs API if the service failed to start
 			app.logsClient = nil
 		} else {
+			app.initPhases.record("logs_subscription", subscriptionStart)
 			// Remember to shutdown the log service if available.
 			defer func() {
+				if missing := app.logsClient.MissingMetadata(); missing.Payloads > 0 {
+					app.logger.Warnf("%d payloads (%d bytes) were generated by the extension before any agent metadata was received (fallback: %s)",
+						missing.Payloads, missing.Bytes, missing.Fallback)
+				}
 				if err := app.logsClient.Shutdown(); err != nil {
 					app.logger.Warnf("failed to shutdown the log service: %v", err)
 				}
@@ -72,12 +141,34 @@ func (app *App) Run(ctx context.Context) error {
 		}
 	}
 
-	// Flush all data before shutting down.
+	// shutdownDeadline is the end of the shutdown phase, once the
+	// shutdown event is received.
+	var shutdownDeadline time.Time
+
+	// Flush all data before shutting down. The requests in flight are
+	// aborted at the end of the shutdown phase.
 	defer func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		timeout := shutdownFlushTimeout
+		if !shutdownDeadline.IsZero() {
+			timeout = untilDeadline(shutdownDeadline.Add(-shutdownDeadlineMargin), time.Now())
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
 
-		app.apmClient.FlushAPMData(ctx)
+		app.apmClient.SampleInvocation()
+		app.flush(ctx)
+
+		n, err := app.apmClient.Handoff(ctx)
+		if n > 0 {
+			app.logger.Infof("Handed off %d payloads of agent data that could not be flushed", n)
+		}
+		if err != nil {
+			app.logger.Warnf("Error while handing off agent data: %v", err)
+		}
+		app.apmClient.DropBuffered()
+		if drops := app.apmClient.ResetDropCounts(); len(drops) > 0 {
+			app.logger.Warnw("Agent data was dropped since the last invocation", "extension.dropped", drops)
+		}
 	}()
 
 	// The previous event id is used to validate the received Lambda metrics
@@ -86,6 +177,15 @@ func (app *App) Run(ctx context.Context) error {
 	// active Lambda environment
 	metadataContainer := apmproxy.MetadataContainer{}
 
+	// Signal the start of the environment ahead of the first invocation
+	if app.heartbeatInterval > 0 {
+		heartbeatStart := time.Now()
+		app.heartbeat(ctx, &metadataContainer, heartbeatStart)
+		app.initPhases.record("first_connection", heartbeatStart)
+	}
+	app.logInit()
+	app.deadMan.sentBytes = app.apmClient.SentBytes()
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -102,15 +202,43 @@ func (app *App) Run(ctx context.Context) error {
 			}
 
 			if event.EventType == extension.Shutdown {
+				if event.DeadlineMs > 0 {
+					shutdownDeadline = time.UnixMilli(event.DeadlineMs)
+				}
 				app.logger.Infof("Received shutdown event: %s. Exiting...", event.ShutdownReason)
+				app.logInterruptedInvocations(time.Now())
+				app.emit(LifecycleEvent{Type: Shutdown, ShutdownReason: event.ShutdownReason})
 				return nil
 			}
 			app.logger.Debug("Waiting for background data send to end")
 			backgroundDataSendWg.Wait()
+			app.apmClient.SampleInvocation()
 			if app.apmClient.ShouldFlush() {
 				// Flush APM data now that the function invocation has completed
-				app.apmClient.FlushAPMData(ctx)
+				app.flush(ctx)
+			}
+			app.apmClient.ResetInvocationBytes()
+			counts := app.apmClient.ResetEventCounts()
+			app.logger.Debugf("Forwarded %d transactions, %d spans, %d errors, %d metricsets and %d other events during the invocation",
+				counts.Transactions, counts.Spans, counts.Errors, counts.Metricsets, counts.Other)
+			if counts.Invalid > 0 {
+				app.logger.Warnf("Forwarded %d corrupted lines of agent data during the invocation", counts.Invalid)
+			}
+			if drops := app.apmClient.ResetDropCounts(); len(drops) > 0 {
+				app.logger.Warnw("Agent data was dropped during the invocation", "extension.dropped", drops)
+			}
+			if latency := app.apmClient.ResetAckLatency(); latency.Count > 0 {
+				app.logger.Debugf("Agent data was acknowledged by the APM server in %s on average, %s at most", latency.Avg(), latency.Max)
 			}
+			// The data sent by the extension on its own below does
+			// not tell that the telemetry works.
+			sentBytes := app.apmClient.SentBytes()
+			if app.reportInitDuration {
+				app.reportInit(ctx, &metadataContainer)
+			}
+			app.reportDataLoss(ctx, &metadataContainer)
+			app.heartbeat(ctx, &metadataContainer, time.Now())
+			app.checkDataSent(ctx, &metadataContainer, sentBytes)
 			prevEvent = event
 		}
 	}
@@ -131,6 +259,8 @@ func (app *App) processEvent(
 
 	// call Next method of extension API.  This long polling HTTP method
 	// will block until there's an invocation of the function
+	// The previous invocation is over
+	app.invocationFields.Set()
 	app.logger.Infof("Waiting for next event...")
 	event, err := app.extensionClient.NextEvent(ctx)
 	if err != nil {
@@ -148,6 +278,21 @@ func (app *App) processEvent(
 
 	// Used to compute Lambda Timeout
 	event.Timestamp = time.Now()
+	if event.EventType == extension.Invoke {
+		// Scope all the logs of the extension to the invocation until the next event
+		app.invocationFields.Set(zap.String("faas.execution", event.RequestID), zap.String("faas.id", event.InvokedFunctionArn))
+		app.emit(LifecycleEvent{Type: InvocationStart, RequestID: event.RequestID})
+		app.checkFunctionVersion(event, metadataContainer)
+		if app.defaultServiceVersion {
+			app.apmClient.SetServiceVersion(app.serviceVersion(event))
+		}
+		if app.flushJournal != nil {
+			app.flushJournal.invocation(event.RequestID)
+		}
+		if app.logsClient != nil {
+			app.logsClient.RegisterInvocation(event)
+		}
+	}
 	app.logger.Debug("Received event.")
 	app.logger.Debugf("%v", extension.PrettyPrint(event))
 
@@ -159,11 +304,14 @@ func (app *App) processEvent(
 	backgroundDataSendWg.Add(1)
 	go func() {
 		defer backgroundDataSendWg.Done()
-		if err := app.apmClient.ForwardApmData(invocationCtx, metadataContainer); err != nil {
+		if err := app.apmClient.ForwardApmData(ctx, invocationCtx.Done(), metadataContainer); err != nil {
 			app.logger.Error(err)
 		}
 	}()
 
+	// Platform metrics are sent on their own pipeline, if configured
+	go app.apmClient.ForwardMetricsData(ctx, invocationCtx.Done())
+
 	// Lambda Service Logs Processing, also used to extract metrics from APM logs
 	// This goroutine should not be started if subscription failed
 	runtimeDone := make(chan struct{})
@@ -182,7 +330,7 @@ func (app *App) processEvent(
 
 	// Calculate how long to wait for a runtimeDoneSignal or AgentDoneSignal signal
 	flushDeadlineMs := event.DeadlineMs - 100
-	durationUntilFlushDeadline := time.Until(time.Unix(flushDeadlineMs/1000, 0))
+	durationUntilFlushDeadline := untilDeadline(time.UnixMilli(flushDeadlineMs), event.Timestamp)
 
 	// Create a timer that expires after durationUntilFlushDeadline
 	timer := time.NewTimer(durationUntilFlushDeadline)
@@ -200,9 +348,102 @@ func (app *App) processEvent(
 		app.logger.Debug("APM client has pending flush signals")
 	case <-runtimeDone:
 		app.logger.Debug("Received runtimeDone signal")
+		app.emit(LifecycleEvent{Type: RuntimeDone, RequestID: event.RequestID})
+		app.waitForAgentFlush(timer.C)
 	case <-timer.C:
 		app.logger.Info("Time expired waiting for agent signal or runtimeDone event")
 	}
 
 	return event, nil
 }
+
+// waitForAgentFlush waits for the agent flush signal for up to the agent
+// flush grace period. The runtimeDone event can be processed before the
+// final payload of the agent arrives: waiting for it ensures the data of
+// the invocation is flushed along with it.
+func (app *App) waitForAgentFlush(deadline <-chan time.Time) {
+	if app.agentFlushGracePeriod <= 0 || !app.apmClient.AgentConnected() {
+		return
+	}
+
+	gracePeriod := time.NewTimer(app.agentFlushGracePeriod)
+	defer gracePeriod.Stop()
+
+	select {
+	case <-app.apmClient.WaitForFlush():
+		app.logger.Debug("Received agent flush signal after runtimeDone")
+	case <-gracePeriod.C:
+		app.logger.Debug("Grace period expired waiting for agent flush signal after runtimeDone")
+	case <-deadline:
+		app.logger.Info("Time expired waiting for agent flush signal after runtimeDone")
+	}
+}
+
+// idle consumes the events of the Extensions API without processing
+// them, until the environment shuts down.
+func (app *App) idle(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		event, err := app.extensionClient.NextEvent(ctx)
+		if err != nil {
+			return err
+		}
+
+		if event.EventType == extension.Shutdown {
+			return nil
+		}
+	}
+}
+
+// checkFunctionVersion resets the agent metadata if the environment is
+// reused for another version of the function, so that the data of the
+// new version is not attributed to the previous one.
+func (app *App) checkFunctionVersion(event *extension.NextEventResponse, metadataContainer *apmproxy.MetadataContainer) {
+	version, ok := event.FunctionVersion()
+	if !ok {
+		return
+	}
+	if app.functionVersion != "" && version != app.functionVersion {
+		app.logger.Infof("Function version changed from %s to %s, resetting the agent metadata", app.functionVersion, version)
+		*metadataContainer = apmproxy.MetadataContainer{}
+	}
+	app.functionVersion = version
+}
+
+// serviceVersion returns the service version of the agent data of the
+// invocation without one: the version of the function, or the alias it
+// was invoked through when running the unpublished $LATEST version.
+func (app *App) serviceVersion(event *extension.NextEventResponse) string {
+	if app.functionVersion == "$LATEST" {
+		if alias, ok := event.FunctionAlias(); ok {
+			return alias
+		}
+	}
+	return app.functionVersion
+}
+
+// logInterruptedInvocations logs the invocations whose platform report was
+// not received before the shutdown, grouped by their status, inferred from
+// the records received so far when their runtimeDone record is missing.
+func (app *App) logInterruptedInvocations(now time.Time) {
+	if app.logsClient == nil {
+		return
+	}
+	byStatus := make(map[string][]string)
+	for _, inv := range app.logsClient.InFlightInvocations() {
+		status := inv.InferStatus(now)
+		byStatus[status] = append(byStatus[status], inv.RequestID)
+	}
+	switch {
+	case len(byStatus) == 0:
+	case len(byStatus) == 1 && byStatus[logsapi.StatusSuccess] != nil:
+		app.logger.Debugw("Invocations without platform report at shutdown", "faas.invocations", byStatus)
+	default:
+		app.logger.Warnw("Invocations did not complete successfully before the shutdown", "faas.invocations", byStatus)
+	}
+}
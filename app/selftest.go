@@ -0,0 +1,213 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+	"github.com/elastic/apm-aws-lambda/extension"
+	"github.com/elastic/apm-aws-lambda/logsapi"
+)
+
+const (
+	selfTestMetadata    = `{"metadata":{"service":{"name":"self-test","agent":{"name":"self-test","version":"0.0.0"}},"process":{"pid":1}}}`
+	selfTestTransaction = `{"transaction":{"id":"945254c567a5417e","trace_id":"0123456789abcdef0123456789abcdef","name":"self-test","type":"request","duration":32.592981,"span_count":{"started":0}}}`
+	selfTestTimeout     = 5 * time.Second
+)
+
+// SelfTest runs the data pipeline outside of AWS Lambda: synthetic agent
+// data and platform events are sent through the receiver and forwarded
+// to an embedded mock APM Server. The result of each step is reported
+// to w. It returns an error if any step failed.
+func SelfTest(ctx context.Context, w io.Writer, opts ...configOption) error {
+	c := appConfig{}
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	l, _, _, err := buildLogger(c.logLevel, nil)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		received []byte
+	)
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/intake/v2/events" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err == nil {
+			body, err = apmproxy.GetUncompressedBytes(body, r.Header.Get("Content-Encoding"))
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		received = append(received, body...)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	receiverAddr, err := selfTestAddr()
+	if err != nil {
+		return err
+	}
+
+	apmClient, err := apmproxy.NewClient(
+		apmproxy.WithURL(apmServer.URL),
+		apmproxy.WithReceiverAddress(receiverAddr),
+		apmproxy.WithLogger(l),
+	)
+	if err != nil {
+		return err
+	}
+
+	var failed bool
+	report := func(step string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Fprintf(w, "FAIL %s: %v\n", step, err)
+			return
+		}
+		fmt.Fprintf(w, "PASS %s\n", step)
+	}
+
+	err = apmClient.StartReceiver()
+	report("start receiver", err)
+	if err != nil {
+		return errors.New("self-test failed")
+	}
+	defer func() {
+		if err := apmClient.Shutdown(); err != nil {
+			l.Warnf("Error while shutting down the apm receiver: %v", err)
+		}
+	}()
+
+	report("receive agent data", selfTestSendAgentData(ctx, receiverAddr))
+
+	select {
+	case <-apmClient.WaitForFlush():
+		report("receive agent flush signal", nil)
+	case <-ctx.Done():
+		report("receive agent flush signal", ctx.Err())
+	}
+
+	metadataContainer := apmproxy.MetadataContainer{Metadata: []byte(selfTestMetadata)}
+	now := time.Now()
+	metrics, err := logsapi.ProcessPlatformReport(&metadataContainer, &extension.NextEventResponse{
+		Timestamp:          now,
+		EventType:          extension.Invoke,
+		DeadlineMs:         now.UnixMilli() + 3000,
+		RequestID:          "self-test",
+		InvokedFunctionArn: "arn:aws:lambda:us-east-1:000000000000:function:self-test",
+	}, logsapi.LogEvent{
+		Time: now,
+		Type: logsapi.Report,
+		Record: logsapi.LogEventRecord{
+			RequestID: "self-test",
+			Metrics: logsapi.PlatformMetrics{
+				DurationMs:       10,
+				BilledDurationMs: 10,
+				MemorySizeMB:     128,
+				MaxMemoryUsedMB:  64,
+			},
+		},
+	})
+	report("process platform report", err)
+	if err == nil {
+		apmClient.EnqueueAPMData(metrics)
+	}
+
+	report("flush agent data", apmClient.FlushAPMData(ctx))
+
+	mu.Lock()
+	forwarded := string(received)
+	mu.Unlock()
+
+	for _, check := range []struct {
+		step     string
+		expected string
+	}{
+		{step: "forward agent data", expected: selfTestTransaction},
+		{step: "forward platform metrics", expected: "faas.billed_duration"},
+	} {
+		if strings.Contains(forwarded, check.expected) {
+			report(check.step, nil)
+		} else {
+			report(check.step, errors.New("data not received by the APM server"))
+		}
+	}
+
+	if failed {
+		return errors.New("self-test failed")
+	}
+	return nil
+}
+
+func selfTestSendAgentData(ctx context.Context, receiverAddr string) error {
+	body := selfTestMetadata + "\n" + selfTestTransaction + "\n"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://%s/intake/v2/events?flushed=true", receiverAddr), bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// selfTestAddr returns a free local address for the receiver.
+func selfTestAddr() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("failed to find a free port: %w", err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().String(), nil
+}
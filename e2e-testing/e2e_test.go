@@ -38,7 +38,7 @@ import (
 )
 
 var rebuildPtr = flag.Bool("rebuild", false, "rebuild lambda functions")
-var langPtr = flag.String("lang", "nodejs", "the language of the Lambda test function : Java, Node, or Python")
+var langPtr = flag.String("lang", "nodejs", "the language of the Lambda test function : Java, Node, Python, .NET or Ruby")
 var timerPtr = flag.Int("timer", 20, "the timeout of the test lambda function")
 var javaAgentVerPtr = flag.String("java-agent-ver", "1.28.4", "the version of the java APM agent")
 
@@ -63,7 +63,7 @@ func TestEndToEnd(t *testing.T) {
 	l.Info("If the end-to-end tests are failing unexpectedly, please verify that Docker is running on your machine.")
 
 	languageName := strings.ToLower(*langPtr)
-	supportedLanguages := []string{"nodejs", "python", "java"}
+	supportedLanguages := []string{"nodejs", "python", "java", "dotnet", "ruby"}
 	if !IsStringInSlice(languageName, supportedLanguages) {
 		ProcessError(l, fmt.Errorf(fmt.Sprintf("Unsupported language %s ! Supported languages are %v", languageName, supportedLanguages)))
 	}
@@ -0,0 +1,36 @@
+
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http:#www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+using System;
+using System.Collections.Generic;
+using Amazon.Lambda.Core;
+using Elastic.Apm;
+
+[assembly: LambdaSerializer(typeof(Amazon.Lambda.Serialization.SystemTextJson.DefaultLambdaJsonSerializer))]
+
+namespace SamTestingDotnet
+{
+    public class Function
+    {
+        public Dictionary<string, object> FunctionHandler(Dictionary<string, object> input, ILambdaContext context)
+        {
+            return Agent.Tracer.CaptureTransaction(Environment.GetEnvironmentVariable("APM_AWS_EXTENSION_TEST_UUID"), "request", () =>
+                new Dictionary<string, object> { { "statusCode", 200 }, { "body", "{\"message\":\"hello world\"}" } });
+        }
+    }
+}
@@ -23,6 +23,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -37,13 +39,60 @@ type RegisterResponse struct {
 
 // NextEventResponse is the response for /event/next
 type NextEventResponse struct {
-	Timestamp          time.Time `json:"timestamp,omitempty"`
-	EventType          EventType `json:"eventType"`
-	ShutdownReason     string    `json:"shutdownReason,omitempty"`
-	DeadlineMs         int64     `json:"deadlineMs"`
-	RequestID          string    `json:"requestId"`
-	InvokedFunctionArn string    `json:"invokedFunctionArn"`
-	Tracing            Tracing   `json:"tracing"`
+	Timestamp          time.Time      `json:"timestamp,omitempty"`
+	EventType          EventType      `json:"eventType"`
+	ShutdownReason     ShutdownReason `json:"shutdownReason,omitempty"`
+	DeadlineMs         int64          `json:"deadlineMs"`
+	RequestID          string         `json:"requestId"`
+	InvokedFunctionArn string         `json:"invokedFunctionArn"`
+	Tracing            Tracing        `json:"tracing"`
+}
+
+// Deadline returns the time at which the invocation times out.
+func (e *NextEventResponse) Deadline() time.Time {
+	return time.UnixMilli(e.DeadlineMs)
+}
+
+// WithDeadline returns a copy of parent canceled when the invocation
+// times out.
+func (e *NextEventResponse) WithDeadline(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithDeadline(parent, e.Deadline())
+}
+
+// FunctionVersion returns the version of the function invoked, from the
+// qualifier of the invoked function ARN. Unqualified ARNs invoke $LATEST.
+// It returns false if the function was invoked through an alias, whose
+// version can't be told from the ARN.
+func (e *NextEventResponse) FunctionVersion() (string, bool) {
+	// arn:partition:lambda:region:account:function:name[:qualifier]
+	parts := strings.Split(e.InvokedFunctionArn, ":")
+	switch {
+	case len(parts) == 7 && parts[5] == "function":
+		return "$LATEST", true
+	case len(parts) == 8 && parts[5] == "function":
+		qualifier := parts[7]
+		if qualifier == "$LATEST" {
+			return qualifier, true
+		}
+		if _, err := strconv.ParseUint(qualifier, 10, 64); err == nil {
+			return qualifier, true
+		}
+	}
+	return "", false
+}
+
+// FunctionAlias returns the alias the function was invoked through, from
+// the qualifier of the invoked function ARN, or false if it was invoked
+// through a version or an unqualified ARN.
+func (e *NextEventResponse) FunctionAlias() (string, bool) {
+	parts := strings.Split(e.InvokedFunctionArn, ":")
+	if len(parts) != 8 || parts[5] != "function" {
+		return "", false
+	}
+	if _, ok := e.FunctionVersion(); ok {
+		return "", false
+	}
+	return parts[7], parts[7] != ""
 }
 
 // Tracing is part of the response for /event/next
@@ -72,6 +121,37 @@ const (
 	extensionErrorType       = "Lambda-Extension-Function-Error-Type"
 )
 
+// ShutdownReason is the reason of a shutdown event
+type ShutdownReason string
+
+const (
+	// Spindown is a shutdown of an idle environment
+	Spindown ShutdownReason = "spindown"
+
+	// Timeout is a shutdown after the extension timed out
+	Timeout ShutdownReason = "timeout"
+
+	// Failure is a shutdown after an error, such as a crash of the runtime
+	Failure ShutdownReason = "failure"
+)
+
+// StatusError is the error returned when the Extensions API
+// responds with an unexpected status code.
+type StatusError struct {
+	// Request is the name of the failed request
+	Request    string
+	Status     string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s request failed with status %s", e.Request, e.Status)
+}
+
+func newStatusError(request string, res *http.Response) *StatusError {
+	return &StatusError{Request: request, Status: res.Status, StatusCode: res.StatusCode}
+}
+
 // Client is a simple Client for the Lambda Extensions API
 type Client struct {
 	baseURL     string
@@ -113,7 +193,7 @@ func (e *Client) Register(ctx context.Context, filename string) (*RegisterRespon
 	defer httpRes.Body.Close()
 
 	if httpRes.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("extension register request failed with status %s", httpRes.Status)
+		return nil, newStatusError("extension register", httpRes)
 	}
 	res := RegisterResponse{}
 	if err := json.NewDecoder(httpRes.Body).Decode(&res); err != nil {
@@ -141,7 +221,7 @@ func (e *Client) NextEvent(ctx context.Context) (*NextEventResponse, error) {
 	defer httpRes.Body.Close()
 
 	if httpRes.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("next event request failed with status %s", httpRes.Status)
+		return nil, newStatusError("next event", httpRes)
 	}
 	res := NextEventResponse{}
 	if err := json.NewDecoder(httpRes.Body).Decode(&res); err != nil {
@@ -168,7 +248,7 @@ func (e *Client) InitError(ctx context.Context, errorType string) (*StatusRespon
 	defer httpRes.Body.Close()
 
 	if httpRes.StatusCode > 299 {
-		return nil, fmt.Errorf("initialization error request failed with status %s", httpRes.Status)
+		return nil, newStatusError("initialization error", httpRes)
 	}
 	res := StatusResponse{}
 	if err := json.NewDecoder(httpRes.Body).Decode(&res); err != nil {
@@ -195,7 +275,7 @@ func (e *Client) ExitError(ctx context.Context, errorType string) (*StatusRespon
 	defer httpRes.Body.Close()
 
 	if httpRes.StatusCode > 299 {
-		return nil, fmt.Errorf("exit error request failed with status %s", httpRes.Status)
+		return nil, newStatusError("exit error", httpRes)
 	}
 	res := StatusResponse{}
 	if err := json.NewDecoder(httpRes.Body).Decode(&res); err != nil {
@@ -19,10 +19,12 @@ package extension
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -94,3 +96,81 @@ func TestNextEvent(t *testing.T) {
 	assert.Equal(t, "X-Amzn-Trace-Id", res.Tracing.Type)
 	assert.Equal(t, "Root=1-6221fd44-5e7e917c1a0d50a7191543b5;Parent=561be8d807d7147c;Sampled=0", res.Tracing.Value)
 }
+
+func TestNextEventShutdown(t *testing.T) {
+	runtimeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte(`{"eventType":"SHUTDOWN","shutdownReason":"spindown","deadlineMs":1646394703586}`))
+		assert.NoError(t, err)
+	}))
+	defer runtimeServer.Close()
+
+	client := NewClient(runtimeServer.Listener.Addr().String(), zaptest.NewLogger(t).Sugar())
+	res, err := client.NextEvent(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, Shutdown, res.EventType)
+	assert.Equal(t, Spindown, res.ShutdownReason)
+	assert.Equal(t, time.UnixMilli(1646394703586), res.Deadline())
+
+	ctx, cancel := res.WithDeadline(context.Background())
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	require.True(t, ok)
+	assert.Equal(t, res.Deadline(), deadline)
+}
+
+func TestFunctionVersion(t *testing.T) {
+	testCases := map[string]struct {
+		version string
+		ok      bool
+	}{
+		"arn:aws:lambda:us-east-1:123456789012:function:foo":         {version: "$LATEST", ok: true},
+		"arn:aws:lambda:us-east-1:123456789012:function:foo:$LATEST": {version: "$LATEST", ok: true},
+		"arn:aws:lambda:us-east-1:123456789012:function:foo:42":      {version: "42", ok: true},
+		"arn:aws-cn:lambda:cn-north-1:123456789012:function:foo:7":   {version: "7", ok: true},
+		"arn:aws:lambda:us-east-1:123456789012:function:foo:prod":    {},
+		"arn:aws:lambda:us-east-1:123456789012:layer:foo:1":          {},
+		"": {},
+	}
+
+	for arn, tc := range testCases {
+		event := NextEventResponse{InvokedFunctionArn: arn}
+		version, ok := event.FunctionVersion()
+		assert.Equal(t, tc.ok, ok, arn)
+		assert.Equal(t, tc.version, version, arn)
+	}
+}
+
+func TestFunctionAlias(t *testing.T) {
+	testCases := map[string]string{
+		"arn:aws:lambda:us-east-1:123456789012:function:foo":         "",
+		"arn:aws:lambda:us-east-1:123456789012:function:foo:$LATEST": "",
+		"arn:aws:lambda:us-east-1:123456789012:function:foo:42":      "",
+		"arn:aws:lambda:us-east-1:123456789012:function:foo:prod":    "prod",
+		"arn:aws:lambda:us-east-1:123456789012:layer:foo:prod":       "",
+		"": "",
+	}
+
+	for arn, alias := range testCases {
+		event := NextEventResponse{InvokedFunctionArn: arn}
+		got, ok := event.FunctionAlias()
+		assert.Equal(t, alias != "", ok, arn)
+		assert.Equal(t, alias, got, arn)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	runtimeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer runtimeServer.Close()
+
+	client := NewClient(runtimeServer.Listener.Addr().String(), zaptest.NewLogger(t).Sugar())
+	_, err := client.Register(context.Background(), "helloWorld")
+	require.Error(t, err)
+
+	var statusErr *StatusError
+	require.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, "extension register", statusErr.Request)
+	assert.Equal(t, http.StatusForbidden, statusErr.StatusCode)
+	assert.Equal(t, "extension register request failed with status 403 Forbidden", err.Error())
+}
@@ -0,0 +1,50 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package extension implements a client of the AWS Lambda Extensions API.
+//
+// The client registers the extension for the invoke and shutdown events,
+// waits for the next event and reports errors to the platform. It can be
+// used to build other extensions written in Go:
+//
+//	c := extension.NewClient(os.Getenv("AWS_LAMBDA_RUNTIME_API"), logger)
+//	if _, err := c.Register(ctx, filepath.Base(os.Args[0])); err != nil {
+//		return err
+//	}
+//
+//	for {
+//		event, err := c.NextEvent(ctx)
+//		if err != nil {
+//			var statusErr *extension.StatusError
+//			if errors.As(err, &statusErr) {
+//				// The Extensions API rejected the request.
+//			}
+//			return err
+//		}
+//		if event.EventType == extension.Shutdown {
+//			return nil
+//		}
+//
+//		invocationCtx, cancel := event.WithDeadline(ctx)
+//		process(invocationCtx, event)
+//		cancel()
+//	}
+//
+// The name given to Register must match the file name of the
+// extension, and the extension ID it sets on the client is needed to
+// subscribe to the Logs API, see package logsapi.
+package extension
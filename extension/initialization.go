@@ -0,0 +1,41 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import "os"
+
+// InitializationType is how the execution environment was initialized.
+type InitializationType string
+
+const (
+	// OnDemand environments are initialized for an invocation.
+	OnDemand InitializationType = "on-demand"
+	// ProvisionedConcurrency environments are initialized ahead of
+	// the invocations and kept warm.
+	ProvisionedConcurrency InitializationType = "provisioned-concurrency"
+	// SnapStart environments are restored from a snapshot of an
+	// initialized environment.
+	SnapStart InitializationType = "snap-start"
+)
+
+// GetInitializationType returns the initialization type of the execution
+// environment, set by Lambda in AWS_LAMBDA_INITIALIZATION_TYPE. It is empty
+// if unknown, e.g. with the runtime interface emulator.
+func GetInitializationType() InitializationType {
+	return InitializationType(os.Getenv("AWS_LAMBDA_INITIALIZATION_TYPE"))
+}
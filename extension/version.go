@@ -17,6 +17,37 @@
 
 package extension
 
-const (
-	Version = "1.1.0"
+import "fmt"
+
+// Build information of the extension. Commit and BuildDate are set at
+// build time, e.g. with -ldflags "-X github.com/elastic/apm-aws-lambda/extension.Commit=<sha>".
+var (
+	Version   = "1.1.0"
+	Commit    = "unknown"
+	BuildDate = "unknown"
 )
+
+// BuildInfo holds the build information of the extension.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	FIPS      bool   `json:"fips,omitempty"`
+}
+
+// GetBuildInfo returns the build information of the extension.
+func GetBuildInfo() BuildInfo {
+	return BuildInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		FIPS:      FIPS,
+	}
+}
+
+func (b BuildInfo) String() string {
+	if b.FIPS {
+		return fmt.Sprintf("%s (commit %s, built %s, FIPS)", b.Version, b.Commit, b.BuildDate)
+	}
+	return fmt.Sprintf("%s (commit %s, built %s)", b.Version, b.Commit, b.BuildDate)
+}
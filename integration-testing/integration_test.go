@@ -0,0 +1,211 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package integrationTesting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+	"github.com/elastic/apm-aws-lambda/extension"
+	"github.com/elastic/apm-aws-lambda/logsapi"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+// receiverAddress is the address the extension receives the agent data on.
+const receiverAddress = "localhost:18200"
+
+func TestIntegration(t *testing.T) {
+	if getenv("RUN_INTEGRATION_TESTS", "false") != "true" {
+		t.Skip("Skipping integration tests. Please set the env. variable RUN_INTEGRATION_TESTS=true if you want to run them.")
+	}
+	apmServerURL := getenv("APM_SERVER_URL", "http://localhost:8200")
+	esURL := getenv("ELASTICSEARCH_URL", "http://localhost:9200")
+	secretToken := getenv("APM_SECRET_TOKEN", "integration-test-token")
+
+	// The documents of each run are told apart by the service name.
+	now := time.Now()
+	serviceName := fmt.Sprintf("integration-%d", now.UnixNano())
+	requestID := fmt.Sprintf("8476a536-e9f4-11e8-9739-%012x", now.UnixNano()&0xffffffffffff)
+	payload := recordedPayload(t, serviceName, requestID, now)
+
+	t.Run("pipeline", func(t *testing.T) {
+		apmClient, err := apmproxy.NewClient(
+			apmproxy.WithURL(apmServerURL),
+			apmproxy.WithSecretToken(secretToken),
+			apmproxy.WithReceiverAddress(receiverAddress),
+			apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		)
+		require.NoError(t, err)
+		require.NoError(t, apmClient.StartReceiver())
+		defer func() {
+			require.NoError(t, apmClient.Shutdown())
+		}()
+
+		// The server information is proxied to the agent, authenticated
+		// by the extension.
+		resp, err := http.Get("http://" + receiverAddress + "/")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, string(body), `"version"`)
+
+		// The agent sends its data to the extension.
+		resp, err = http.Post("http://"+receiverAddress+"/intake/v2/events", "application/x-ndjson", bytes.NewReader(payload))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+		// The platform report of the invocation is turned into metrics.
+		metadata, err := apmproxy.ProcessMetadata(apmproxy.AgentData{Data: payload})
+		require.NoError(t, err)
+		metrics, err := logsapi.ProcessPlatformReport(
+			&apmproxy.MetadataContainer{Metadata: metadata},
+			&extension.NextEventResponse{
+				Timestamp:          now,
+				EventType:          extension.Invoke,
+				DeadlineMs:         now.UnixMilli() + 5000,
+				RequestID:          requestID,
+				InvokedFunctionArn: "arn:aws:lambda:us-east-1:123456789012:function:integration",
+			},
+			logsapi.LogEvent{
+				Time: now,
+				Type: logsapi.Report,
+				Record: logsapi.LogEventRecord{
+					RequestID: requestID,
+					Metrics: logsapi.PlatformMetrics{
+						DurationMs:       182.43,
+						BilledDurationMs: 183,
+						MemorySizeMB:     128,
+						MaxMemoryUsedMB:  76,
+						InitDurationMs:   422.97,
+					},
+				},
+			},
+		)
+		require.NoError(t, err)
+		apmClient.EnqueueAPMData(metrics)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		require.NoError(t, apmClient.FlushAPMData(ctx))
+		assert.Empty(t, apmClient.ResetDropCounts())
+		assert.Equal(t, apmproxy.Healthy, apmClient.Status)
+
+		service := term("service.name", serviceName)
+		assertCount(t, esURL, "traces-apm*", 2, service, term("processor.event", "transaction"), term("service.version", "1.0.0"))
+		assertCount(t, esURL, "traces-apm*", 1, service, term("faas.execution", requestID), term("faas.coldstart", true))
+		assertCount(t, esURL, "traces-apm*", 1, service, term("processor.event", "span"), term("span.subtype", "postgresql"))
+		assertCount(t, esURL, "logs-apm*", 1, service, term("processor.event", "error"), term("error.exception.type", "KeyError"))
+		assertCount(t, esURL, "metrics-apm*", 1, service, term("faas.execution", requestID), exists("faas.billed_duration"), exists("faas.coldstart_duration"))
+	})
+
+	t.Run("authentication", func(t *testing.T) {
+		apmClient, err := apmproxy.NewClient(
+			apmproxy.WithURL(apmServerURL),
+			apmproxy.WithSecretToken("invalid"),
+			apmproxy.WithLogger(zaptest.NewLogger(t).Sugar()),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, apmClient.PostToApmServer(context.Background(), apmproxy.AgentData{Data: payload}))
+		assert.Equal(t, apmproxy.Failing, apmClient.Status)
+		assert.Equal(t, int64(1), apmClient.ResetDropCounts()[apmproxy.DropRejected].Payloads)
+	})
+}
+
+// recordedPayload returns the agent data recorded in testdata, with the
+// service name, request ID and timestamps of the run.
+func recordedPayload(t *testing.T, serviceName, requestID string, now time.Time) []byte {
+	data, err := os.ReadFile("testdata/agent.ndjson")
+	require.NoError(t, err)
+	return []byte(strings.NewReplacer(
+		"{{SERVICE_NAME}}", serviceName,
+		"{{REQUEST_ID}}", requestID,
+		"{{TIMESTAMP}}", strconv.FormatInt(now.UnixMicro(), 10),
+	).Replace(string(data)))
+}
+
+func term(field string, value interface{}) map[string]interface{} {
+	return map[string]interface{}{"term": map[string]interface{}{field: value}}
+}
+
+func exists(field string) map[string]interface{} {
+	return map[string]interface{}{"exists": map[string]interface{}{"field": field}}
+}
+
+// assertCount asserts that the number of documents of the indices matching
+// the filters reaches expected, within the time the APM Server takes to
+// index them, and stays there.
+func assertCount(t *testing.T, esURL, index string, expected int, filters ...map[string]interface{}) {
+	t.Helper()
+	query, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{"bool": map[string]interface{}{"filter": filters}},
+	})
+	require.NoError(t, err)
+
+	var count int
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		count = countDocuments(t, esURL, index, query)
+		if count >= expected {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	assert.Equal(t, expected, count, "documents of %s matching %s", index, query)
+}
+
+func countDocuments(t *testing.T, esURL, index string, query []byte) int {
+	t.Helper()
+	resp, err := http.Post(esURL+"/"+index+"/_refresh?allow_no_indices=true", "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	resp, err = http.Post(esURL+"/"+index+"/_count?allow_no_indices=true", "application/json", bytes.NewReader(query))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result struct {
+		Count int `json:"count"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	return result.Count
+}
+
+func getenv(name, defaultValue string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return defaultValue
+}
@@ -0,0 +1,82 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logger
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Fields holds fields added to all the entries of the loggers built
+// with WithFields. Unlike the fields of zap.Logger.With, they can be
+// changed at any time, e.g. to scope the logs to the current invocation.
+// A nil Fields has no fields.
+type Fields struct {
+	fields atomic.Pointer[[]zapcore.Field]
+}
+
+// Set replaces the fields, calling it without fields clears them.
+func (f *Fields) Set(fields ...zapcore.Field) {
+	if f == nil {
+		return
+	}
+	f.fields.Store(&fields)
+}
+
+func (f *Fields) get() []zapcore.Field {
+	if f == nil {
+		return nil
+	}
+	if fields := f.fields.Load(); fields != nil {
+		return *fields
+	}
+	return nil
+}
+
+// WithFields returns a logger adding the fields of f to the entries of l.
+func WithFields(l *zap.SugaredLogger, f *Fields) *zap.SugaredLogger {
+	return l.Desugar().WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return &fieldsCore{Core: c, fields: f}
+	})).Sugar()
+}
+
+// fieldsCore is a zapcore.Core adding the current fields to the entries.
+type fieldsCore struct {
+	zapcore.Core
+	fields *Fields
+}
+
+func (c *fieldsCore) With(fields []zapcore.Field) zapcore.Core {
+	return &fieldsCore{Core: c.Core.With(fields), fields: c.fields}
+}
+
+func (c *fieldsCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c *fieldsCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	if extra := c.fields.get(); len(extra) > 0 {
+		fields = append(fields[:len(fields):len(fields)], extra...)
+	}
+	return c.Core.Write(e, fields)
+}
@@ -64,3 +64,72 @@ func ParseLogLevel(s string) (zapcore.Level, error) {
 	}
 	return zapcore.InfoLevel, fmt.Errorf("invalid log level string %s", s)
 }
+
+// ParseComponentLogLevels parses s as a comma separated list of log levels.
+// An entry without a component sets the default level, entries in the form
+// component=level override the level of the named component.
+// For example "info,apmproxy=debug,logsapi=warn".
+func ParseComponentLogLevels(s string) (zapcore.Level, map[string]zapcore.Level, error) {
+	level := zapcore.InfoLevel
+	components := make(map[string]zapcore.Level)
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, value, found := strings.Cut(entry, "=")
+		if !found {
+			l, err := ParseLogLevel(entry)
+			if err != nil {
+				return zapcore.InfoLevel, nil, err
+			}
+			level = l
+			continue
+		}
+
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			return zapcore.InfoLevel, nil, fmt.Errorf("missing component name in log level %s", entry)
+		}
+
+		l, err := ParseLogLevel(strings.TrimSpace(value))
+		if err != nil {
+			return zapcore.InfoLevel, nil, fmt.Errorf("invalid log level for component %s: %w", name, err)
+		}
+		components[name] = l
+	}
+
+	return level, components, nil
+}
+
+// Named returns a child logger of l with the given name, only logging
+// entries enabled by level, such as a zapcore.Level or a zap.AtomicLevel.
+// The level cannot be lower than the one l was built with.
+func Named(l *zap.SugaredLogger, name string, level zapcore.LevelEnabler) *zap.SugaredLogger {
+	return l.Desugar().WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return &levelFilterCore{Core: c, level: level}
+	})).Named(name).Sugar()
+}
+
+// levelFilterCore is a zapcore.Core dropping entries below level.
+type levelFilterCore struct {
+	zapcore.Core
+	level zapcore.LevelEnabler
+}
+
+func (c *levelFilterCore) Enabled(l zapcore.Level) bool {
+	return c.level.Enabled(l) && c.Core.Enabled(l)
+}
+
+func (c *levelFilterCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelFilterCore{Core: c.Core.With(fields), level: c.level}
+}
+
+func (c *levelFilterCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.level.Enabled(e.Level) {
+		return ce
+	}
+	return c.Core.Check(e, ce)
+}
@@ -20,6 +20,7 @@ package logger_test
 import (
 	"github.com/elastic/apm-aws-lambda/logger"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -135,3 +136,108 @@ func TestLoggerSetOffLevel(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "", string(tempFileContents))
 }
+
+func TestLoggerParseComponentLogLevels(t *testing.T) {
+	testCases := map[string]struct {
+		level              string
+		expectedLevel      zapcore.Level
+		expectedComponents map[string]zapcore.Level
+		expectedErr        bool
+	}{
+		"default only": {
+			level:              "warning",
+			expectedLevel:      zapcore.WarnLevel,
+			expectedComponents: map[string]zapcore.Level{},
+		},
+		"components": {
+			level:         "info, apmproxy=debug,LogsAPI=warn",
+			expectedLevel: zapcore.InfoLevel,
+			expectedComponents: map[string]zapcore.Level{
+				"apmproxy": zapcore.DebugLevel,
+				"logsapi":  zapcore.WarnLevel,
+			},
+		},
+		"components only": {
+			level:         "extension=error",
+			expectedLevel: zapcore.InfoLevel,
+			expectedComponents: map[string]zapcore.Level{
+				"extension": zapcore.ErrorLevel,
+			},
+		},
+		"invalid default": {
+			level:       "foo,apmproxy=debug",
+			expectedErr: true,
+		},
+		"invalid component level": {
+			level:       "info,apmproxy=foo",
+			expectedErr: true,
+		},
+		"missing component name": {
+			level:       "info,=debug",
+			expectedErr: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			l, components, err := logger.ParseComponentLogLevels(tc.level)
+			if tc.expectedErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tc.expectedLevel, l)
+				assert.Equal(t, tc.expectedComponents, components)
+			}
+		})
+	}
+}
+
+func TestLoggerNamed(t *testing.T) {
+	tempFile, err := os.CreateTemp(t.TempDir(), "tempFileLoggerTest-")
+	require.NoError(t, err)
+	defer tempFile.Close()
+
+	l, err := logger.New(
+		logger.WithOutputPaths(tempFile.Name()),
+		logger.WithLevel(zap.DebugLevel),
+	)
+	require.NoError(t, err)
+
+	logger.Named(l, "verbose", zap.DebugLevel).Debug("logger-test-verbose")
+	logger.Named(l, "quiet", zap.WarnLevel).Info("logger-test-quiet")
+
+	tempFileContents, err := os.ReadFile(tempFile.Name())
+	require.NoError(t, err)
+
+	assert.Contains(t, string(tempFileContents), "logger-test-verbose")
+	assert.Contains(t, string(tempFileContents), `"verbose"`)
+	assert.NotContains(t, string(tempFileContents), "logger-test-quiet")
+}
+
+func TestLoggerWithFields(t *testing.T) {
+	tempFile, err := os.CreateTemp(t.TempDir(), "tempFileLoggerTest-")
+	require.NoError(t, err)
+	defer tempFile.Close()
+
+	l, err := logger.New(
+		logger.WithOutputPaths(tempFile.Name()),
+		logger.WithLevel(zap.DebugLevel),
+	)
+	require.NoError(t, err)
+
+	fields := &logger.Fields{}
+	l = logger.WithFields(l, fields)
+	named := logger.Named(l, "component", zap.DebugLevel).With("key", "value")
+
+	fields.Set(zap.String("faas.execution", "request-1"))
+	named.Info("logger-test-invocation")
+	fields.Set()
+	named.Info("logger-test-between-invocations")
+
+	tempFileContents, err := os.ReadFile(tempFile.Name())
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(tempFileContents)), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"faas.execution":"request-1"`)
+	assert.Contains(t, lines[0], `"key":"value"`)
+	assert.NotContains(t, lines[1], "faas.execution")
+}
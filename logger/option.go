@@ -30,6 +30,14 @@ func WithLevel(level zapcore.Level) option {
 	}
 }
 
+// WithAtomicLevel sets the level of the logger, which can
+// then be changed at runtime with level.SetLevel.
+func WithAtomicLevel(level zap.AtomicLevel) option {
+	return func(c *zap.Config) {
+		c.Level = level
+	}
+}
+
 func WithEncoderConfig(encoderConfig zapcore.EncoderConfig) option {
 	return func(c *zap.Config) {
 		c.EncoderConfig = encoderConfig
@@ -0,0 +1,146 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"sort"
+	"sync"
+)
+
+// processedRecordTypes are the record types the extension processes.
+var processedRecordTypes = []SubEventType{Start, RuntimeDone, Report, InitReport, RestoreStart}
+
+// ignoredRecordTypes are the record types of the Logs API
+// the extension knows about but does not process.
+var ignoredRecordTypes = []SubEventType{
+	Fault,
+	End,
+	"platform.extension",
+	LogsSubscription,
+	LogsDropped,
+	FunctionLog,
+	"extension",
+	InitStart,
+	InitRuntimeDone,
+	RestoreRuntimeDone,
+	RestoreReport,
+	TelemetrySubscription,
+}
+
+// Capabilities describes how the client handles the records
+// received from the Logs API.
+type Capabilities struct {
+	Subscribed   bool           `json:"subscribed"`
+	Processed    []SubEventType `json:"processed"`
+	Ignored      []SubEventType `json:"ignored"`
+	Unrecognized []SubEventType `json:"unrecognized"`
+	// PortCollision tells whether the configured listener address was
+	// used by another extension, and another port was used instead.
+	PortCollision bool `json:"port_collision,omitempty"`
+}
+
+// Capabilities returns the capabilities of the client, including
+// the unrecognized record types received so far.
+func (lc *Client) Capabilities() Capabilities {
+	c := Capabilities{
+		Subscribed:    lc.subscribed.Load(),
+		Processed:     processedRecordTypes,
+		Ignored:       ignoredRecordTypes,
+		Unrecognized:  lc.recordTypes.unrecognizedTypes(),
+		PortCollision: lc.portCollision.Load(),
+	}
+	var processed []SubEventType
+	if lc.crashReporting {
+		processed = append(processed, Fault)
+	}
+	if lc.crashReporting || lc.powertoolsLogs || lc.controlHandler != nil {
+		processed = append(processed, FunctionLog)
+	}
+	if len(processed) > 0 {
+		c.Processed = append(append([]SubEventType{}, processedRecordTypes...), processed...)
+		c.Ignored = nil
+		for _, t := range ignoredRecordTypes {
+			if !containsRecordType(processed, t) {
+				c.Ignored = append(c.Ignored, t)
+			}
+		}
+	}
+	return c
+}
+
+func containsRecordType(types []SubEventType, t SubEventType) bool {
+	for _, v := range types {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// recordTypes keeps track of the unrecognized record types received
+// from the Logs API, so that they are only reported once.
+type recordTypes struct {
+	mu           sync.Mutex
+	unrecognized map[SubEventType]struct{}
+}
+
+// observe records the type of a received record. It returns true the
+// first time a record type unknown to the extension is received.
+func (r *recordTypes) observe(t SubEventType) bool {
+	if isRecognized(t) {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.unrecognized[t]; ok {
+		return false
+	}
+	if r.unrecognized == nil {
+		r.unrecognized = make(map[SubEventType]struct{})
+	}
+	r.unrecognized[t] = struct{}{}
+	return true
+}
+
+func (r *recordTypes) unrecognizedTypes() []SubEventType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	types := make([]SubEventType, 0, len(r.unrecognized))
+	for t := range r.unrecognized {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+func isRecognized(t SubEventType) bool {
+	for _, known := range processedRecordTypes {
+		if t == known {
+			return true
+		}
+	}
+	for _, known := range ignoredRecordTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
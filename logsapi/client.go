@@ -23,6 +23,8 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -35,25 +37,86 @@ type ClientOption func(*Client)
 type Client struct {
 	httpClient     *http.Client
 	logsAPIBaseURL string
+	telemetryAPI   bool
 	logsChannel    chan LogEvent
 	listenerAddr   string
+	forceIPv4      bool
 	server         *http.Server
 	logger         *zap.SugaredLogger
+	pricing        *Pricing
+	crashReporting bool
+	powertoolsLogs bool
+	functionLogs   bool
+	traceContext   bool
+	controlHandler func(ControlRecord)
+	environment    environment
+	invocations    invocations
+	recordTypes    recordTypes
+	teeConfig      *Tee
+	tee            *teeForwarder
+	processors     processors
+	subscribed     atomic.Bool
+	readTimeouts   atomic.Int64
+	portCollision  atomic.Bool
+	lagThreshold   time.Duration
+	lag            lagTracker
+	resubscribing  atomic.Bool
+
+	// subscriptionMu protects the subscription and its buffering,
+	// which is increased when the listener does not keep up.
+	subscriptionMu sync.Mutex
+	subscription   *subscription
+	buffering      BufferingCfg
+
+	// otelResource are the OpenTelemetry resource attributes of the
+	// function, nil unless the attributes are dual-written.
+	otelResource map[string]string
+
+	metadataFallback        MetadataFallback
+	missingMetadataPayloads atomic.Int64
+	missingMetadataBytes    atomic.Int64
 }
 
+// defaultLogBuffer is the size of the buffer storing
+// queued logs when not set with WithLogBuffer.
+const defaultLogBuffer = 100
+
 // NewClient returns a new Client with the given URL.
 func NewClient(opts ...ClientOption) (*Client, error) {
 	c := Client{
-		server:     &http.Server{},
-		httpClient: &http.Client{},
+		server:       &http.Server{},
+		httpClient:   &http.Client{},
+		environment:  newEnvironment(),
+		lagThreshold: defaultLagThreshold,
+		buffering: BufferingCfg{
+			MaxItems:  10000,
+			MaxBytes:  262144,
+			TimeoutMS: 25,
+		},
 	}
 
 	for _, opt := range opts {
 		opt(&c)
 	}
 
+	if c.logsChannel == nil {
+		c.logsChannel = make(chan LogEvent, defaultLogBuffer)
+	}
+
+	if c.teeConfig != nil {
+		c.tee = newTeeForwarder(*c.teeConfig, c.logger)
+	}
+
+	c.processors.logger = c.logger
+	c.processors.queue = make(chan LogEvent, defaultProcessorBuffer)
+	c.processors.done = make(chan struct{})
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", handleLogEventsRequest(c.logger, c.logsChannel))
+	var inject func(LogEvent) (string, bool)
+	if c.traceContext {
+		inject = c.injectRecordTraceContext
+	}
+	mux.HandleFunc("/", handleLogEventsRequest(c.logger, c.logsChannel, &c.recordTypes, &c.readTimeouts, c.tee, inject, c.observeEvents))
 
 	c.server.Handler = mux
 
@@ -68,8 +131,14 @@ func NewClient(opts ...ClientOption) (*Client, error) {
 	return &c, nil
 }
 
+// ReadTimeouts returns the number of deliveries of the Logs API
+// which timed out while being read.
+func (lc *Client) ReadTimeouts() int64 {
+	return lc.readTimeouts.Load()
+}
+
 // StartService starts the HTTP server listening for log events and subscribes to the Logs API.
-func (lc *Client) StartService(eventTypes []EventType, extensionID string) error {
+func (lc *Client) StartService(ctx context.Context, eventTypes []EventType, extensionID string) error {
 	addr, err := lc.startHTTPServer()
 	if err != nil {
 		return err
@@ -93,13 +162,21 @@ func (lc *Client) StartService(eventTypes []EventType, extensionID string) error
 
 	uri := fmt.Sprintf("http://%s", net.JoinHostPort(host, port))
 
-	if err := lc.subscribe(eventTypes, extensionID, uri); err != nil {
+	if lc.tee != nil {
+		lc.tee.start()
+	}
+
+	lc.subscriptionMu.Lock()
+	defer lc.subscriptionMu.Unlock()
+	if err := lc.subscribe(ctx, eventTypes, extensionID, uri); err != nil {
 		if err := lc.Shutdown(); err != nil {
 			lc.logger.Warnf("failed to shutdown the server: %v", err)
 		}
 		return err
 	}
+	lc.subscription = &subscription{eventTypes: eventTypes, extensionID: extensionID, uri: uri}
 
+	lc.subscribed.Store(true)
 	return nil
 }
 
@@ -108,5 +185,20 @@ func (lc *Client) Shutdown() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	return lc.server.Shutdown(ctx)
+	if err := lc.server.Shutdown(ctx); err != nil {
+		return err
+	}
+	err := lc.processors.stop(ctx)
+	if lc.tee != nil {
+		if teeErr := lc.tee.stop(ctx); teeErr != nil {
+			return teeErr
+		}
+	}
+	return err
+}
+
+// observeEvents observes the records of every delivery of the Logs API.
+func (lc *Client) observeEvents(events []LogEvent) {
+	lc.observeLag(events)
+	lc.processors.dispatch(events)
 }
@@ -19,11 +19,14 @@ package logsapi_test
 
 import (
 	"bytes"
+	"context"
 	"github.com/elastic/apm-aws-lambda/logsapi"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -107,9 +110,9 @@ func TestSubscribe(t *testing.T) {
 			require.NoError(t, err)
 
 			if tc.expectedErr {
-				require.Error(t, c.StartService([]logsapi.EventType{logsapi.Platform}, "foo"))
+				require.Error(t, c.StartService(context.Background(), []logsapi.EventType{logsapi.Platform}, "foo"))
 			} else {
-				require.NoError(t, c.StartService([]logsapi.EventType{logsapi.Platform}, "foo"))
+				require.NoError(t, c.StartService(context.Background(), []logsapi.EventType{logsapi.Platform}, "foo"))
 			}
 
 			require.NoError(t, c.Shutdown())
@@ -143,7 +146,7 @@ func TestSubscribeAWSRequest(t *testing.T) {
 
 			c, err := logsapi.NewClient(append(tc.opts, logsapi.WithLogsAPIBaseURL(s.URL), logsapi.WithLogBuffer(1))...)
 			require.NoError(t, err)
-			require.NoError(t, c.StartService([]logsapi.EventType{logsapi.Platform}, "testID"))
+			require.NoError(t, c.StartService(context.Background(), []logsapi.EventType{logsapi.Platform}, "testID"))
 
 			// Create a request to send to the logs listener
 			platformDoneEvent := `{
@@ -167,3 +170,129 @@ func TestSubscribeAWSRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestClientEvents(t *testing.T) {
+	uris := make(chan string, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var subRequest logsapi.SubscribeRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&subRequest))
+		uris <- subRequest.Destination.URI
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	c, err := logsapi.NewClient(
+		logsapi.WithLogsAPIBaseURL(s.URL),
+		logsapi.WithListenerAddress("localhost:0"),
+		logsapi.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.StartService(context.Background(), []logsapi.EventType{logsapi.Platform}, "testID"))
+	defer func() {
+		require.NoError(t, c.Shutdown())
+	}()
+
+	body := []byte(`[
+		{"time":"2021-02-04T20:00:05.123Z","type":"platform.start","record":{"requestId":"6f7f0961f83442118a7af6fe80b88","version":"$LATEST"}},
+		{"time":"2021-02-04T20:00:06.123Z","type":"platform.logsDropped","record":{"reason":"Consumer seems to have fallen behind","droppedRecords":3,"droppedBytes":420}}
+	]`)
+	rsp, err := http.Post(<-uris, "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	require.NoError(t, rsp.Body.Close())
+
+	start := <-c.Events()
+	require.Equal(t, logsapi.Start, start.Type)
+	require.Equal(t, "6f7f0961f83442118a7af6fe80b88", start.Record.RequestID)
+	require.Equal(t, "$LATEST", start.Record.Version)
+
+	dropped := <-c.Events()
+	require.Equal(t, logsapi.LogsDropped, dropped.Type)
+	require.Equal(t, 3, dropped.Record.DroppedRecords)
+	require.Equal(t, 420, dropped.Record.DroppedBytes)
+	require.Equal(t, "Consumer seems to have fallen behind", dropped.Record.Reason)
+}
+
+func TestSubscribePortCollision(t *testing.T) {
+	// Another extension listens on the configured port
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer other.Close()
+
+	var uri string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var subRequest logsapi.SubscribeRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&subRequest))
+		uri = subRequest.Destination.URI
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	c, err := logsapi.NewClient(
+		logsapi.WithLogsAPIBaseURL(s.URL),
+		logsapi.WithListenerAddress(other.Addr().String()),
+		logsapi.WithLogger(zaptest.NewLogger(t).Sugar()),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.StartService(context.Background(), []logsapi.EventType{logsapi.Platform}, "testID"))
+	defer func() {
+		require.NoError(t, c.Shutdown())
+	}()
+
+	require.True(t, c.Capabilities().PortCollision)
+	u, err := url.Parse(uri)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", u.Hostname())
+	require.NotEqual(t, strconv.Itoa(other.Addr().(*net.TCPAddr).Port), u.Port())
+}
+
+func TestSubscribeTelemetryAPI(t *testing.T) {
+	uris := make(chan string, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/2022-07-01/telemetry", r.URL.Path)
+		var subRequest logsapi.SubscribeRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&subRequest))
+		require.Equal(t, logsapi.SchemaVersion(logsapi.SchemaVersion20221213), subRequest.SchemaVersion)
+		uris <- subRequest.Destination.URI
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	c, err := logsapi.NewClient(
+		logsapi.WithLogsAPIBaseURL(s.URL),
+		logsapi.WithListenerAddress("localhost:0"),
+		logsapi.WithLogger(zaptest.NewLogger(t).Sugar()),
+		logsapi.WithTelemetryAPI(),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.StartService(context.Background(), []logsapi.EventType{logsapi.Platform}, "testID"))
+	defer func() {
+		require.NoError(t, c.Shutdown())
+	}()
+
+	body := []byte(`[
+		{"time":"2022-10-12T00:00:15.064Z","type":"platform.initReport","record":{"initializationType":"on-demand","phase":"init","status":"success","metrics":{"durationMs":125.33}}},
+		{"time":"2022-10-12T00:00:15.064Z","type":"platform.restoreStart","record":{"runtimeVersion":"java11.v15","functionName":"my-function","functionVersion":"3"}},
+		{"time":"2022-10-12T00:01:15.000Z","type":"platform.runtimeDone","record":{"requestId":"6d68ca91-49c9-448d-89b8-7ca3e6dc66aa","status":"success","metrics":{"durationMs":140.0,"producedBytes":16},"spans":[{"name":"responseLatency","start":"2022-10-12T00:01:14.860Z","durationMs":23.02},{"name":"responseDuration","start":"2022-10-12T00:01:14.883Z","durationMs":20}]}}
+	]`)
+	rsp, err := http.Post(<-uris, "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	require.NoError(t, rsp.Body.Close())
+
+	initReport := <-c.Events()
+	require.Equal(t, logsapi.InitReport, initReport.Type)
+	require.Equal(t, "on-demand", string(initReport.Record.InitializationType))
+	require.Equal(t, "init", initReport.Record.Phase)
+	require.Equal(t, float32(125.33), initReport.Record.Metrics.DurationMs)
+
+	restoreStart := <-c.Events()
+	require.Equal(t, logsapi.RestoreStart, restoreStart.Type)
+
+	runtimeDone := <-c.Events()
+	require.Equal(t, logsapi.RuntimeDone, runtimeDone.Type)
+	require.Equal(t, "success", runtimeDone.Record.Status)
+	require.Len(t, runtimeDone.Record.Spans, 2)
+	require.Equal(t, "responseLatency", runtimeDone.Record.Spans[0].Name)
+	require.Equal(t, 23.02, runtimeDone.Record.Spans[0].DurationMs)
+
+	require.Empty(t, c.Capabilities().Unrecognized)
+}
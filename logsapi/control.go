@@ -0,0 +1,60 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// controlPrefix marks the function log lines holding a control record,
+// e.g. `ELASTIC_APM_CTL {"logLevel":"debug"}`.
+const controlPrefix = "ELASTIC_APM_CTL "
+
+// ControlRecord is a change of the settings of the extension requested
+// at runtime by the function, through a line of its logs. Empty fields
+// leave the settings unchanged.
+type ControlRecord struct {
+	LogLevel     string `json:"logLevel,omitempty"`
+	SendStrategy string `json:"sendStrategy,omitempty"`
+	Paused       *bool  `json:"paused,omitempty"`
+}
+
+// parseControlRecords returns the control records found in a function
+// log record. The prefix can be preceded by the fields added by the
+// runtime, such as the timestamp and the request ID.
+func parseControlRecords(record string) ([]ControlRecord, error) {
+	var records []ControlRecord
+	for _, line := range strings.FieldsFunc(record, func(r rune) bool { return r == '\n' || r == '\r' }) {
+		i := strings.Index(line, controlPrefix)
+		if i < 0 {
+			continue
+		}
+
+		d := json.NewDecoder(bytes.NewReader([]byte(line[i+len(controlPrefix):])))
+		d.DisallowUnknownFields()
+		var r ControlRecord
+		if err := d.Decode(&r); err != nil {
+			return records, fmt.Errorf("failed to decode control record: %w", err)
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
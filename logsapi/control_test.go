@@ -0,0 +1,71 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseControlRecords(t *testing.T) {
+	paused := true
+
+	testCases := map[string]struct {
+		record      string
+		expected    []ControlRecord
+		expectedErr bool
+	}{
+		"no control record": {
+			record: "START RequestId: 6f7f0961f83442118a7af6fe80b88 Version: $LATEST",
+		},
+		"log level": {
+			record:   `ELASTIC_APM_CTL {"logLevel":"debug"}`,
+			expected: []ControlRecord{{LogLevel: "debug"}},
+		},
+		"runtime prefix": {
+			record:   "2022-09-01T10:00:00.000Z\t6f7f0961f83442118a7af6fe80b88\tINFO\t" + `ELASTIC_APM_CTL {"sendStrategy":"background","paused":true}`,
+			expected: []ControlRecord{{SendStrategy: "background", Paused: &paused}},
+		},
+		"several lines": {
+			record:   "ELASTIC_APM_CTL {\"logLevel\":\"debug\"}\rELASTIC_APM_CTL {\"logLevel\":\"info\"}",
+			expected: []ControlRecord{{LogLevel: "debug"}, {LogLevel: "info"}},
+		},
+		"unknown setting": {
+			record:      `ELASTIC_APM_CTL {"apiKey":"foo"}`,
+			expectedErr: true,
+		},
+		"invalid json": {
+			record:      `ELASTIC_APM_CTL {"logLevel":`,
+			expectedErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			records, err := parseControlRecords(tc.record)
+			if tc.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, records)
+		})
+	}
+}
@@ -0,0 +1,50 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+// Pricing holds the AWS Lambda prices, in USD, used to estimate
+// the cost of an invocation.
+type Pricing struct {
+	// GBSecond is the price of one GB-second of compute time.
+	GBSecond float64
+	// Request is the price of a single request.
+	Request float64
+}
+
+// defaultPricing is the on-demand pricing of the us-east-1 region,
+// keyed by GOARCH.
+var defaultPricing = map[string]Pricing{
+	"amd64": {GBSecond: 0.0000166667, Request: 0.0000002},
+	"arm64": {GBSecond: 0.0000133334, Request: 0.0000002},
+}
+
+// DefaultPricing returns the default pricing for the given architecture,
+// as reported by runtime.GOARCH. It returns false if the architecture
+// is unknown.
+func DefaultPricing(arch string) (Pricing, bool) {
+	p, ok := defaultPricing[arch]
+	return p, ok
+}
+
+// Cost returns the estimated cost of an invocation from its billed
+// duration and the memory size of the function.
+func (p Pricing) Cost(billedDurationMs int32, memorySizeMB int32) float64 {
+	// AWS uses binary multiples to compute memory.
+	gbSeconds := float64(memorySizeMB) / 1024 * float64(billedDurationMs) / 1000
+	return gbSeconds*p.GBSecond + p.Request
+}
@@ -0,0 +1,40 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi_test
+
+import (
+	"testing"
+
+	"github.com/elastic/apm-aws-lambda/logsapi"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPricingCost(t *testing.T) {
+	pricing, ok := logsapi.DefaultPricing("arm64")
+	require.True(t, ok)
+
+	// 1024MB for 1s is one GB-second.
+	assert.InDelta(t, 0.0000133334+0.0000002, pricing.Cost(1000, 1024), 1e-12)
+	// 128MB for 100ms.
+	assert.InDelta(t, 0.0000133334/80+0.0000002, pricing.Cost(100, 128), 1e-12)
+
+	_, ok = logsapi.DefaultPricing("s390x")
+	assert.False(t, ok)
+}
@@ -0,0 +1,319 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// crashKind is the kind of crash report being parsed.
+type crashKind int
+
+const (
+	goPanic crashKind = iota + 1
+	pythonTraceback
+)
+
+var (
+	// goFileLine matches the file line of a frame of a Go panic,
+	// e.g. "\t/var/task/main.go:12 +0x25".
+	goFileLine = regexp.MustCompile(`^\t(.+):(\d+)(?: \+0x[0-9a-f]+)?$`)
+	// pythonFrame matches a frame of a Python traceback,
+	// e.g. `  File "/var/task/app.py", line 3, in handler`.
+	pythonFrame = regexp.MustCompile(`^\s*File "(.+)", line (\d+), in (.+)$`)
+	// pythonException matches the exception closing a Python
+	// traceback, e.g. "ValueError: boom".
+	pythonException = regexp.MustCompile(`^([A-Za-z_][\w.]*)(?:: (.*))?$`)
+	// nodeFrame matches a frame of a Node.js stack,
+	// e.g. "    at Runtime.handler (/var/task/index.js:3:9)".
+	nodeFrame = regexp.MustCompile(`^\s*at (?:(.+?) \()?(.+?):(\d+):\d+\)?$`)
+	// faultRequestID matches the request ID of the invocation
+	// affected by a platform fault, e.g. "RequestId: 6f7f0961-...".
+	faultRequestID = regexp.MustCompile(`RequestId: ([\w-]+)`)
+	// faultType matches the error type closing the record of a
+	// platform fault, e.g. "Runtime.ExitError" or "Extension.Crash".
+	faultType = regexp.MustCompile(`^[A-Z]\w*\.\w+$`)
+)
+
+// nodeCrashSignatures are the messages logged by the Lambda
+// Node.js runtime before the description of a crash.
+var nodeCrashSignatures = []string{"Uncaught Exception", "Unhandled Promise Rejection"}
+
+// crash is a crash of the function detected in its logs.
+type crash struct {
+	Time    time.Time
+	Type    string
+	Message string
+	// Frames are ordered from the most recent call.
+	Frames []stackFrame
+	// Source is where the crash was detected, "function_logs"
+	// when empty.
+	Source string
+	// RequestID is the request ID of the crashed invocation,
+	// when known from the record.
+	RequestID string
+}
+
+// parseFault returns the crash described by the record of a platform
+// fault, such as the runtime or an extension exiting during an invocation.
+func parseFault(t time.Time, record string) crash {
+	c := crash{Time: t, Source: "platform_fault"}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(record), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if n := len(lines); n > 1 && faultType.MatchString(lines[n-1]) {
+		c.Type, lines = lines[n-1], lines[:n-1]
+	}
+	c.Message = strings.Join(lines, "\n")
+
+	if m := faultRequestID.FindStringSubmatch(record); m != nil {
+		c.RequestID = m[1]
+	}
+	return c
+}
+
+type stackFrame struct {
+	Function string `json:"function,omitempty"`
+	Filename string `json:"filename"`
+	Line     int    `json:"lineno,omitempty"`
+}
+
+// crashParser detects crash reports, such as Go panics, Python tracebacks
+// and uncaught Node.js exceptions, in the logs of the function.
+type crashParser struct {
+	current *crash
+	kind    crashKind
+	// skip is true when the frames of a Go panic that are
+	// not part of the panicking goroutine are reached.
+	skip bool
+	// lastError is the exception of the last "[ERROR]" line logged by
+	// the Lambda Python runtime, which precedes the traceback.
+	lastError string
+}
+
+// add parses a function log record and returns the crashes
+// it completed. Records can span several lines.
+func (p *crashParser) add(t time.Time, record string) []crash {
+	var crashes []crash
+	for _, line := range strings.FieldsFunc(record, func(r rune) bool { return r == '\n' || r == '\r' }) {
+		crashes = append(crashes, p.addLine(t, line)...)
+	}
+	return crashes
+}
+
+// flush returns the crash being parsed, if any.
+func (p *crashParser) flush() []crash {
+	return p.complete()
+}
+
+// complete ends the crash being parsed and returns it, if any.
+func (p *crashParser) complete() []crash {
+	c := p.current
+	p.current, p.kind, p.skip = nil, 0, false
+	if c == nil || (c.Type == "" && c.Message == "" && len(c.Frames) == 0) {
+		return nil
+	}
+	return []crash{*c}
+}
+
+func (p *crashParser) addLine(t time.Time, line string) []crash {
+	switch p.kind {
+	case goPanic:
+		if p.addGoLine(line) {
+			return nil
+		}
+		// The line following a panic can start another crash.
+		return append(p.complete(), p.addLine(t, line)...)
+	case pythonTraceback:
+		return p.addPythonLine(line)
+	}
+
+	lastError := p.lastError
+	p.lastError = ""
+
+	switch {
+	case strings.HasPrefix(line, "panic: "):
+		p.kind = goPanic
+		p.current = &crash{
+			Time:    t,
+			Type:    "panic",
+			Message: strings.TrimSuffix(strings.TrimPrefix(line, "panic: "), " [recovered]"),
+		}
+	case strings.HasPrefix(line, "Traceback (most recent call last):"):
+		p.kind = pythonTraceback
+		p.current = &crash{Time: t}
+		if lastError != "" {
+			p.current.Type, p.current.Message = splitException(lastError)
+		}
+	case strings.HasPrefix(line, "[ERROR] "):
+		p.lastError = strings.TrimPrefix(line, "[ERROR] ")
+	default:
+		if c := parseNodeCrash(t, line); c != nil {
+			return []crash{*c}
+		}
+	}
+	return nil
+}
+
+// addGoLine adds a line to a Go panic. It returns
+// false if the line is not part of the panic.
+func (p *crashParser) addGoLine(line string) bool {
+	c := p.current
+	switch {
+	case line == "" || strings.HasPrefix(line, "[signal "):
+	case strings.HasPrefix(line, "goroutine "):
+		p.skip = len(c.Frames) > 0
+	case strings.HasPrefix(line, "\t"):
+		if m := goFileLine.FindStringSubmatch(line); m != nil && !p.skip && len(c.Frames) > 0 {
+			frame := &c.Frames[len(c.Frames)-1]
+			frame.Filename = m[1]
+			frame.Line, _ = strconv.Atoi(m[2])
+		}
+	case strings.HasSuffix(line, ")") && strings.Contains(line, "("):
+		if !p.skip {
+			function := strings.TrimPrefix(line, "created by ")
+			c.Frames = append(c.Frames, stackFrame{Function: function[:strings.LastIndex(function, "(")]})
+		}
+	case strings.HasPrefix(line, "created by "):
+	default:
+		return false
+	}
+	return true
+}
+
+// addPythonLine adds a line to a Python traceback, which is
+// completed by the line describing the exception.
+func (p *crashParser) addPythonLine(line string) []crash {
+	c := p.current
+	if m := pythonFrame.FindStringSubmatch(line); m != nil {
+		lineno, _ := strconv.Atoi(m[2])
+		// Python lists the most recent call last.
+		c.Frames = append([]stackFrame{{Function: m[3], Filename: m[1], Line: lineno}}, c.Frames...)
+		return nil
+	}
+	if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+		// Source code of the frame.
+		return nil
+	}
+	if pythonException.MatchString(line) {
+		c.Type, c.Message = splitException(line)
+	}
+	return p.complete()
+}
+
+// parseNodeCrash parses the description of a crash logged by the Lambda
+// Node.js runtime, e.g. "Uncaught Exception \t{"errorType":"Error",...}".
+func parseNodeCrash(t time.Time, line string) *crash {
+	for _, signature := range nodeCrashSignatures {
+		i := strings.Index(line, signature)
+		if i < 0 {
+			continue
+		}
+		j := strings.Index(line[i:], "{")
+		if j < 0 {
+			return nil
+		}
+
+		var e struct {
+			ErrorType    string   `json:"errorType"`
+			ErrorMessage string   `json:"errorMessage"`
+			Stack        []string `json:"stack"`
+		}
+		if err := json.Unmarshal([]byte(line[i+j:]), &e); err != nil {
+			return nil
+		}
+
+		c := &crash{Time: t, Type: e.ErrorType, Message: e.ErrorMessage}
+		for _, s := range e.Stack {
+			for _, frameLine := range strings.Split(s, "\n") {
+				if m := nodeFrame.FindStringSubmatch(frameLine); m != nil {
+					lineno, _ := strconv.Atoi(m[3])
+					c.Frames = append(c.Frames, stackFrame{Function: m[1], Filename: m[2], Line: lineno})
+				}
+			}
+		}
+		return c
+	}
+	return nil
+}
+
+// splitException splits an exception such as
+// "ValueError: boom" into its type and message.
+func splitException(s string) (string, string) {
+	exceptionType, message, _ := strings.Cut(s, ": ")
+	return exceptionType, message
+}
+
+// errorEvent returns the crash as an error event of the intake
+// API, labelled with the request ID of the invocation and the
+// attributes.
+func (c crash) errorEvent(requestID string, attributes map[string]string) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	type exception struct {
+		Message    string       `json:"message,omitempty"`
+		Type       string       `json:"type,omitempty"`
+		Handled    bool         `json:"handled"`
+		Stacktrace []stackFrame `json:"stacktrace,omitempty"`
+	}
+	var event struct {
+		Error struct {
+			ID        string    `json:"id"`
+			Timestamp int64     `json:"timestamp"`
+			Culprit   string    `json:"culprit,omitempty"`
+			Exception exception `json:"exception"`
+			Context   struct {
+				Tags map[string]string `json:"tags"`
+			} `json:"context"`
+		} `json:"error"`
+	}
+
+	e := &event.Error
+	e.ID = hex.EncodeToString(id)
+	e.Timestamp = c.Time.UnixMicro()
+	e.Exception = exception{Message: c.Message, Type: c.Type, Stacktrace: c.Frames}
+	if e.Exception.Message == "" && e.Exception.Type == "" {
+		e.Exception.Message = "function crashed"
+	}
+	if len(c.Frames) > 0 {
+		e.Culprit = c.Frames[0].Function
+	}
+	e.Context.Tags = make(map[string]string, len(attributes)+2)
+	for k, v := range attributes {
+		e.Context.Tags[k] = v
+	}
+	e.Context.Tags["faas_execution"] = requestID
+	e.Context.Tags["crash_source"] = "function_logs"
+	if c.Source != "" {
+		e.Context.Tags["crash_source"] = c.Source
+	}
+
+	return json.Marshal(event)
+}
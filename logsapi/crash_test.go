@@ -0,0 +1,227 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestCrashParser(t *testing.T) {
+	testCases := map[string]struct {
+		records  []string
+		expected []crash
+	}{
+		"go panic": {
+			records: []string{
+				"panic: runtime error: index out of range [3] with length 3",
+				"",
+				"goroutine 1 [running]:",
+				"main.handler({0x0, 0x0})",
+				"\t/var/task/main.go:12 +0x25",
+				"main.main()",
+				"\t/var/task/main.go:20 +0x1d",
+				"",
+				"goroutine 6 [select]:",
+				"net/http.(*persistConn).writeLoop(0xc000110000)",
+				"\t/usr/local/go/src/net/http/transport.go:2410 +0xf2",
+				"created by net/http.(*Transport).dialConn in goroutine 5",
+				"exit status 2",
+			},
+			expected: []crash{{
+				Type:    "panic",
+				Message: "runtime error: index out of range [3] with length 3",
+				Frames: []stackFrame{
+					{Function: "main.handler", Filename: "/var/task/main.go", Line: 12},
+					{Function: "main.main", Filename: "/var/task/main.go", Line: 20},
+				},
+			}},
+		},
+		"python traceback": {
+			records: []string{
+				"Traceback (most recent call last):",
+				`  File "/var/task/app.py", line 8, in handler`,
+				"    return compute(event)",
+				`  File "/var/task/app.py", line 3, in compute`,
+				`    raise ValueError("boom")`,
+				"ValueError: boom",
+				"END RequestId: 6f7f0961f83442118a7af6fe80b88",
+			},
+			expected: []crash{{
+				Type:    "ValueError",
+				Message: "boom",
+				Frames: []stackFrame{
+					{Function: "compute", Filename: "/var/task/app.py", Line: 3},
+					{Function: "handler", Filename: "/var/task/app.py", Line: 8},
+				},
+			}},
+		},
+		"python runtime error": {
+			records: []string{
+				"[ERROR] KeyError: 'id'\rTraceback (most recent call last):\r  File \"/var/task/app.py\", line 2, in handler\r    return event['id']",
+			},
+			expected: []crash{{
+				Type:    "KeyError",
+				Message: "'id'",
+				Frames: []stackFrame{
+					{Function: "handler", Filename: "/var/task/app.py", Line: 2},
+				},
+			}},
+		},
+		"node uncaught exception": {
+			records: []string{
+				"2022-09-01T10:00:00.000Z\t6f7f0961f83442118a7af6fe80b88\tERROR\tUncaught Exception \t" +
+					`{"errorType":"TypeError","errorMessage":"Cannot read properties of undefined (reading 'id')","stack":["TypeError: Cannot read properties of undefined (reading 'id')","    at Runtime.handler (/var/task/index.js:3:22)","    at /var/runtime/Runtime.js:1:1"]}`,
+			},
+			expected: []crash{{
+				Type:    "TypeError",
+				Message: "Cannot read properties of undefined (reading 'id')",
+				Frames: []stackFrame{
+					{Function: "Runtime.handler", Filename: "/var/task/index.js", Line: 3},
+					{Filename: "/var/runtime/Runtime.js", Line: 1},
+				},
+			}},
+		},
+		"regular logs": {
+			records: []string{
+				"START RequestId: 6f7f0961f83442118a7af6fe80b88 Version: $LATEST",
+				"[ERROR]\t2022-09-01T10:00:00.000Z\t6f7f0961f83442118a7af6fe80b88\tfailed to fetch the order",
+				"2022-09-01T10:00:00.000Z\t6f7f0961f83442118a7af6fe80b88\tERROR\tInvoke Error \t{\"errorType\":\"Error\"}",
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var p crashParser
+			var crashes []crash
+			for _, record := range tc.records {
+				crashes = append(crashes, p.add(time.Time{}, record)...)
+			}
+			crashes = append(crashes, p.flush()...)
+			assert.Equal(t, tc.expected, crashes)
+		})
+	}
+}
+
+func TestCrashErrorEvent(t *testing.T) {
+	c := crash{
+		Time:    time.UnixMicro(1662026400000000),
+		Type:    "ValueError",
+		Message: "boom",
+		Frames:  []stackFrame{{Function: "handler", Filename: "/var/task/app.py", Line: 3}},
+	}
+
+	event, err := c.errorEvent("6f7f0961f83442118a7af6fe80b88", nil)
+	require.NoError(t, err)
+
+	var e map[string]map[string]interface{}
+	require.NoError(t, json.Unmarshal(event, &e))
+	assert.Len(t, e["error"]["id"], 32)
+	assert.Equal(t, float64(1662026400000000), e["error"]["timestamp"])
+	assert.Equal(t, "handler", e["error"]["culprit"])
+	assert.Equal(t, map[string]interface{}{
+		"message": "boom",
+		"type":    "ValueError",
+		"handled": false,
+		"stacktrace": []interface{}{
+			map[string]interface{}{"function": "handler", "filename": "/var/task/app.py", "lineno": float64(3)},
+		},
+	}, e["error"]["exception"])
+	assert.Equal(t, map[string]interface{}{
+		"tags": map[string]interface{}{"faas_execution": "6f7f0961f83442118a7af6fe80b88", "crash_source": "function_logs"},
+	}, e["error"]["context"])
+}
+
+func TestParseFault(t *testing.T) {
+	now := time.Now()
+	testCases := map[string]struct {
+		record string
+		crash  crash
+	}{
+		"runtime exit": {
+			record: "RequestId: d783b35e-a91d-4251-af17-035953428a2c Error: Runtime exited with error: exit status 2\nRuntime.ExitError",
+			crash: crash{
+				Type:      "Runtime.ExitError",
+				Message:   "RequestId: d783b35e-a91d-4251-af17-035953428a2c Error: Runtime exited with error: exit status 2",
+				RequestID: "d783b35e-a91d-4251-af17-035953428a2c",
+			},
+		},
+		"process exit": {
+			record: "RequestId: d783b35e-a91d-4251-af17-035953428a2c Process exited before completing request",
+			crash: crash{
+				Message:   "RequestId: d783b35e-a91d-4251-af17-035953428a2c Process exited before completing request",
+				RequestID: "d783b35e-a91d-4251-af17-035953428a2c",
+			},
+		},
+		"extension crash": {
+			record: "Extension.Crash",
+			crash:  crash{Message: "Extension.Crash"},
+		},
+		"unknown": {
+			record: "Unknown application error occurred",
+			crash:  crash{Message: "Unknown application error occurred"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tc.crash.Time = now
+			tc.crash.Source = "platform_fault"
+			assert.Equal(t, tc.crash, parseFault(now, tc.record))
+		})
+	}
+}
+
+func TestProcessLogsFault(t *testing.T) {
+	l := zaptest.NewLogger(t).Sugar()
+	lc, err := NewClient(WithLogsAPIBaseURL("http://example.com"), WithLogger(l), WithCrashReporting())
+	require.NoError(t, err)
+	apmClient, err := apmproxy.NewClient(apmproxy.WithURL("http://example.com"), apmproxy.WithLogger(l))
+	require.NoError(t, err)
+
+	now := time.Now()
+	for _, e := range []LogEvent{
+		{Type: Fault, Time: now, StringRecord: "RequestId: previous Error: Runtime exited without providing a reason\nRuntime.ExitError"},
+		{Type: Fault, Time: now, StringRecord: "Extension.Crash"},
+		{Type: RuntimeDone, Time: now, Record: LogEventRecord{RequestID: "current"}},
+	} {
+		lc.logsChannel <- e
+	}
+
+	runtimeDone := make(chan struct{}, 1)
+	metadataContainer := &apmproxy.MetadataContainer{Metadata: []byte(`{"metadata":{}}`)}
+	require.NoError(t, lc.ProcessLogs(context.Background(), "current", apmClient, metadataContainer, runtimeDone, nil))
+
+	require.Len(t, apmClient.DataChannel, 2)
+	runtimeFault := string((<-apmClient.DataChannel).Data)
+	assert.Contains(t, runtimeFault, `"type":"Runtime.ExitError"`)
+	assert.Contains(t, runtimeFault, `"faas_execution":"previous"`)
+	assert.Contains(t, runtimeFault, `"crash_source":"platform_fault"`)
+	extensionFault := string((<-apmClient.DataChannel).Data)
+	assert.Contains(t, extensionFault, `"message":"Extension.Crash"`)
+	assert.Contains(t, extensionFault, `"faas_execution":"current"`)
+}
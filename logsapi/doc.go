@@ -0,0 +1,60 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package logsapi implements a client of the AWS Lambda Logs API.
+//
+// The client starts an HTTP listener, subscribes it to the Logs API and
+// decodes the received records into typed LogEvent values. It can be
+// embedded in other extensions written in Go:
+//
+//	c, err := logsapi.NewClient(
+//		logsapi.WithLogsAPIBaseURL("http://"+os.Getenv("AWS_LAMBDA_RUNTIME_API")),
+//		logsapi.WithListenerAddress("sandbox:0"),
+//		logsapi.WithLogger(logger),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	if err := c.StartService(ctx, []logsapi.EventType{logsapi.Platform}, extensionID); err != nil {
+//		return err
+//	}
+//	defer c.Shutdown()
+//
+//	for event := range c.Events() {
+//		if event.Type == logsapi.Report {
+//			fmt.Println(event.Record.RequestID, event.Record.Metrics.BilledDurationMs)
+//		}
+//	}
+//
+// The extension ID is returned by the registration to the Extensions API,
+// see package extension.
+//
+// Processors registered with RegisterProcessor handle the records in a
+// background worker, along with the processing done by the extension,
+// e.g. to audit them:
+//
+//	c.RegisterProcessor(func(e logsapi.LogEvent) error {
+//		if e.Type == logsapi.Fault {
+//			return audit(e.Time, e.StringRecord)
+//		}
+//		return nil
+//	})
+//
+// With WithTelemetryAPI, the client subscribes to the Telemetry API
+// instead, which delivers the same records along with the platform.init*
+// and platform.restore* records, and the spans of the invocations.
+package logsapi
@@ -0,0 +1,122 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"os"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/extension"
+)
+
+// thawThreshold is the minimum time between two invocations for the
+// execution environment to be considered frozen in between. Lambda
+// freezes idle environments, back-to-back invocations are not frozen.
+const thawThreshold = 100 * time.Millisecond
+
+// environment keeps track of the reuse of the execution environment,
+// inferred from the platform records.
+//
+// The wall clock of the environment may be off after a thaw until it is
+// synchronized again, so durations are only computed between timestamps
+// of the same source: either the platform records, or the monotonic
+// clock of the extension.
+type environment struct {
+	// instance is the name of the log stream of the environment,
+	// which is unique to the environment.
+	instance string
+	// initType is how the environment was initialized.
+	initType extension.InitializationType
+	// initDuration is the duration of the initialization, reported by
+	// the initReport record of the Telemetry API.
+	initDuration time.Duration
+	start        time.Time
+	invocations  int64
+	thaws        int64
+	lastDone     time.Time
+}
+
+// environmentStats are the statistics of the execution environment
+// reported along with the platform metrics.
+type environmentStats struct {
+	Instance           string
+	InitializationType extension.InitializationType
+	InitDuration       time.Duration
+	Invocations        int64
+	Age                time.Duration
+	Thaws              int64
+}
+
+func newEnvironment() environment {
+	return environment{
+		instance: os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME"),
+		initType: extension.GetInitializationType(),
+		start:    time.Now(),
+	}
+}
+
+// started records the start of an invocation at t.
+func (e *environment) started(t time.Time) {
+	if !e.lastDone.IsZero() && t.Sub(e.lastDone) > thawThreshold {
+		e.thaws++
+	}
+}
+
+// done records the end of an invocation at t.
+func (e *environment) done(t time.Time) {
+	e.invocations++
+	e.lastDone = t
+}
+
+// initialized records the initialization of the environment reported by
+// the initReport record.
+func (e *environment) initialized(initType extension.InitializationType, durationMs float32) {
+	if initType != "" {
+		e.initType = initType
+	}
+	e.initDuration = time.Duration(float64(durationMs) * float64(time.Millisecond))
+}
+
+// restored records the restoration of the environment from a SnapStart
+// snapshot at now, read from the clock of the extension. The restored
+// environment is new, although the extension was initialized before.
+func (e *environment) restored(now time.Time) {
+	e.initType = extension.SnapStart
+	e.initDuration = 0
+	e.start = now
+	e.invocations = 0
+	e.thaws = 0
+	e.lastDone = time.Time{}
+}
+
+// stats returns the statistics of the environment at t, which must be
+// read from the clock of the extension.
+func (e *environment) stats(t time.Time) environmentStats {
+	age := t.Sub(e.start)
+	if age < 0 {
+		age = 0
+	}
+	return environmentStats{
+		Instance:           e.instance,
+		InitializationType: e.initType,
+		InitDuration:       e.initDuration,
+		Invocations:        e.invocations,
+		Age:                age,
+		Thaws:              e.thaws,
+	}
+}
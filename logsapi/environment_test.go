@@ -0,0 +1,91 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/extension"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvironment(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_LOG_STREAM_NAME", "2022/09/01/[$LATEST]8f2d6c3e2a6b4b1f9d4e2c1a0b9c8d7e")
+	t.Setenv("AWS_LAMBDA_INITIALIZATION_TYPE", "provisioned-concurrency")
+	env := newEnvironment()
+	start := env.start
+
+	// Cold start
+	env.started(start.Add(time.Second))
+	env.done(start.Add(2 * time.Second))
+	// Back-to-back invocation
+	env.started(start.Add(2*time.Second + 10*time.Millisecond))
+	env.done(start.Add(3 * time.Second))
+	// Invocation after a freeze
+	env.started(start.Add(time.Minute))
+
+	assert.Equal(t, environmentStats{
+		Instance:           "2022/09/01/[$LATEST]8f2d6c3e2a6b4b1f9d4e2c1a0b9c8d7e",
+		InitializationType: extension.ProvisionedConcurrency,
+		Invocations:        2,
+		Age:                time.Minute,
+		Thaws:              1,
+	}, env.stats(start.Add(time.Minute)))
+}
+
+func TestEnvironmentClockJump(t *testing.T) {
+	env := newEnvironment()
+	start := env.start
+
+	env.started(start.Add(time.Second))
+	env.done(start.Add(2 * time.Second))
+	// The clock jumped backwards after a thaw
+	env.started(start.Add(-time.Minute))
+
+	stats := env.stats(start.Add(-time.Minute))
+	assert.Equal(t, time.Duration(0), stats.Age)
+	assert.Equal(t, int64(0), stats.Thaws)
+}
+
+func TestEnvironmentTelemetryAPI(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_INITIALIZATION_TYPE", "")
+	env := newEnvironment()
+	start := env.start
+
+	env.initialized(extension.OnDemand, 125.5)
+	env.started(start.Add(time.Second))
+	env.done(start.Add(2 * time.Second))
+
+	stats := env.stats(start.Add(2 * time.Second))
+	assert.Equal(t, extension.OnDemand, stats.InitializationType)
+	assert.Equal(t, 125500*time.Microsecond, stats.InitDuration)
+	assert.Equal(t, int64(1), stats.Invocations)
+
+	// The environment was restored from a snapshot
+	env.restored(start.Add(time.Hour))
+	env.started(start.Add(time.Hour + time.Second))
+
+	stats = env.stats(start.Add(time.Hour + time.Minute))
+	assert.Equal(t, extension.SnapStart, stats.InitializationType)
+	assert.Equal(t, time.Duration(0), stats.InitDuration)
+	assert.Equal(t, int64(0), stats.Invocations)
+	assert.Equal(t, int64(0), stats.Thaws)
+	assert.Equal(t, time.Minute, stats.Age)
+}
@@ -41,10 +41,23 @@ type SubEventType string
 
 const (
 	// RuntimeDone event is sent when lambda function is finished it's execution
-	RuntimeDone SubEventType = "platform.runtimeDone"
-	Fault       SubEventType = "platform.fault"
-	Report      SubEventType = "platform.report"
-	Start       SubEventType = "platform.start"
+	RuntimeDone      SubEventType = "platform.runtimeDone"
+	Fault            SubEventType = "platform.fault"
+	Report           SubEventType = "platform.report"
+	Start            SubEventType = "platform.start"
+	End              SubEventType = "platform.end"
+	LogsSubscription SubEventType = "platform.logsSubscription"
+	LogsDropped      SubEventType = "platform.logsDropped"
+	// The records below are only sent by the Telemetry API.
+	InitStart             SubEventType = "platform.initStart"
+	InitRuntimeDone       SubEventType = "platform.initRuntimeDone"
+	InitReport            SubEventType = "platform.initReport"
+	RestoreStart          SubEventType = "platform.restoreStart"
+	RestoreRuntimeDone    SubEventType = "platform.restoreRuntimeDone"
+	RestoreReport         SubEventType = "platform.restoreReport"
+	TelemetrySubscription SubEventType = "platform.telemetrySubscription"
+	// FunctionLog is a log record of the function, sent as a string
+	FunctionLog SubEventType = "function"
 )
 
 // LogEvent represents an event received from the Logs API
@@ -55,11 +68,42 @@ type LogEvent struct {
 	Record       LogEventRecord
 }
 
-// LogEventRecord is a sub-object in a Logs API event
+// LogEventRecord is a sub-object in a Logs API event. Fields
+// not sent for the type of the event are left empty.
 type LogEventRecord struct {
 	RequestID string          `json:"requestId"`
 	Status    string          `json:"status"`
 	Metrics   PlatformMetrics `json:"metrics"`
+	// Version is the version of the function, sent with platform.start.
+	Version string `json:"version,omitempty"`
+	// DroppedRecords, DroppedBytes and Reason describe the
+	// records dropped by the Logs API, sent with platform.logsDropped.
+	DroppedRecords int    `json:"droppedRecords,omitempty"`
+	DroppedBytes   int    `json:"droppedBytes,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+	// InitializationType and Phase describe the initialization of the
+	// environment, sent with the platform.init* records of the Telemetry API.
+	InitializationType extension.InitializationType `json:"initializationType,omitempty"`
+	Phase              string                       `json:"phase,omitempty"`
+	// Spans are the phases of the invocation, sent with platform.runtimeDone
+	// by the Telemetry API, e.g. responseLatency and responseDuration.
+	Spans []Span `json:"spans,omitempty"`
+}
+
+// Span is a phase of an invocation or of the initialization of the
+// environment reported by the Telemetry API.
+type Span struct {
+	Name       string    `json:"name"`
+	Start      time.Time `json:"start"`
+	DurationMs float64   `json:"durationMs"`
+}
+
+// Events returns the channel of the events received from the Logs API,
+// for the extensions embedding the client and processing the events
+// themselves. ProcessLogs consumes the same channel, only one of them
+// should be used.
+func (lc *Client) Events() <-chan LogEvent {
+	return lc.logsChannel
 }
 
 // ProcessLogs consumes events until a RuntimeDone event corresponding
@@ -72,6 +116,11 @@ func (lc *Client) ProcessLogs(
 	runtimeDoneSignal chan struct{},
 	prevEvent *extension.NextEventResponse,
 ) error {
+	var crashes crashParser
+	defer func() {
+		lc.reportCrashes(crashes.flush(), requestID, apmClient, metadataContainer)
+	}()
+
 	for {
 		select {
 		case logEvent := <-lc.logsChannel:
@@ -79,28 +128,112 @@ func (lc *Client) ProcessLogs(
 			switch logEvent.Type {
 			// Check the logEvent for runtimeDone and compare the RequestID
 			// to the id that came in via the Next API
+			case Start:
+				lc.environment.started(logEvent.Time)
+				lc.invocations.started(logEvent.Record.RequestID, logEvent.Time)
 			case RuntimeDone:
+				lc.environment.done(logEvent.Time)
+				lc.invocations.done(logEvent.Record.RequestID, logEvent.Time, logEvent.Record.Status, logEvent.Record.Spans)
 				if logEvent.Record.RequestID == requestID {
 					lc.logger.Info("Received runtimeDone event for this function invocation")
+					lc.reportCrashes(crashes.flush(), requestID, apmClient, metadataContainer)
 					runtimeDoneSignal <- struct{}{}
 					return nil
 				}
 
+				if f, ok := lc.invocations.lookupFinalized(logEvent.Record.RequestID); ok {
+					lc.logger.Debugf("Ignoring late runtimeDone event of finalized invocation %s (trace %q)", f.RequestID, f.TraceID)
+					break
+				}
 				lc.logger.Debug("Log API runtimeDone event request id didn't match")
-			// Check if the logEvent contains metrics and verify that they can be linked to the previous invocation
-			case Report:
-				if prevEvent != nil && logEvent.Record.RequestID == prevEvent.RequestID {
-					lc.logger.Debug("Received platform report for the previous function invocation")
-					processedMetrics, err := ProcessPlatformReport(metadataContainer, prevEvent, logEvent)
+			// Record the initialization and restoration of the environment,
+			// only reported by the Telemetry API
+			case InitReport:
+				lc.environment.initialized(logEvent.Record.InitializationType, logEvent.Record.Metrics.DurationMs)
+			case RestoreStart:
+				lc.logger.Debug("Execution environment restored from a snapshot")
+				lc.environment.restored(time.Now())
+			// Report the faults of the runtime and extensions, which
+			// interrupt the invocation
+			case Fault:
+				if fault := parseFault(logEvent.Time, logEvent.StringRecord); fault.RequestID != "" {
+					lc.invocations.failed(fault.RequestID)
+				} else {
+					lc.invocations.failed(requestID)
+				}
+				if lc.crashReporting {
+					lc.reportCrashes([]crash{parseFault(logEvent.Time, logEvent.StringRecord)}, requestID, apmClient, metadataContainer)
+				}
+			// Look for crashes of the function the agent could not report,
+			// and for control records changing settings at runtime
+			case FunctionLog:
+				if lc.powertoolsLogs && lc.reportPowertoolsLog(logEvent.Time, logEvent.StringRecord, requestID, apmClient, metadataContainer) {
+					break
+				}
+				if lc.functionLogs {
+					lc.reportFunctionLog(logEvent.Time, logEvent.StringRecord, requestID, apmClient, metadataContainer)
+				}
+				if lc.crashReporting {
+					lc.reportCrashes(crashes.add(logEvent.Time, logEvent.StringRecord), requestID, apmClient, metadataContainer)
+				}
+				if lc.controlHandler != nil {
+					records, err := parseControlRecords(logEvent.StringRecord)
 					if err != nil {
-						lc.logger.Errorf("Error processing Lambda platform metrics : %v", err)
-					} else {
-						apmClient.EnqueueAPMData(processedMetrics)
+						lc.logger.Warnf("Ignoring invalid control record: %v", err)
 					}
-				} else {
+					for _, r := range records {
+						lc.controlHandler(r)
+					}
+				}
+			// Check if the logEvent contains metrics and verify that they can be linked to a registered
+			// invocation, or to the previous invocation
+			case Report:
+				functionData := prevEvent
+				var start time.Time
+				var spans []Span
+				if inv, ok := lc.invocations.finalize(logEvent.Record.RequestID); ok {
+					functionData, start, spans = inv.event, inv.start, inv.spans
+				} else if f, ok := lc.invocations.lookupFinalized(logEvent.Record.RequestID); ok {
+					lc.logger.Debugf("Ignoring duplicate report event of finalized invocation %s (status %q)", f.RequestID, f.Status)
+					break
+				} else if prevEvent == nil || logEvent.Record.RequestID != prevEvent.RequestID {
 					lc.logger.Warn("report event request id didn't match the previous event id")
 					lc.logger.Debug("Log API runtimeDone event request id didn't match")
+					break
 				}
+
+				lc.logger.Debug("Received platform report for a previous function invocation")
+				envStats := lc.environment.stats(time.Now())
+				bufferStats := apmClient.BufferStats()
+				ackLatency := apmClient.LastAckLatency()
+				drops := apmClient.LastDropCounts()
+				readTimeouts := lc.ReadTimeouts()
+				logsLag := lc.lag.reset()
+				processedMetrics, err := processPlatformReport(metadataContainer, functionData, logEvent, reportExtras{
+					pricing:        lc.pricing,
+					env:            &envStats,
+					buffer:         &bufferStats,
+					ackLatency:     &ackLatency,
+					drops:          drops,
+					otelAttributes: lc.otelAttributes(logEvent.Record.RequestID),
+					start:          start,
+					spans:          spans,
+					logsLag:        &logsLag,
+					readTimeouts:   &readTimeouts,
+					portCollisions: lc.portCollisions(),
+				})
+				if err != nil {
+					lc.logger.Errorf("Error processing Lambda platform metrics : %v", err)
+					break
+				}
+				if metadataContainer.Metadata == nil {
+					var ok bool
+					if processedMetrics, ok = lc.applyMetadataFallback(processedMetrics); !ok {
+						lc.logger.Debug("Dropped platform metrics sent before any agent metadata was received")
+						break
+					}
+				}
+				apmClient.EnqueueMetricsData(processedMetrics)
 			}
 		case <-ctx.Done():
 			lc.logger.Debug("Current invocation over. Interrupting logs processing goroutine")
@@ -108,3 +241,107 @@ func (lc *Client) ProcessLogs(
 		}
 	}
 }
+
+// reportCrashes sends the crashes detected in the function logs as error events.
+func (lc *Client) reportCrashes(crashes []crash, requestID string, apmClient *apmproxy.Client, metadataContainer *apmproxy.MetadataContainer) {
+	for _, c := range crashes {
+		lc.logger.Infof("Detected a crash of the function: %s %s", c.Type, c.Message)
+		crashRequestID := c.RequestID
+		if crashRequestID == "" {
+			crashRequestID = requestID
+			// Logs of a finalized invocation may arrive late, during a
+			// later invocation: attribute them by the time they were written.
+			if f, ok := lc.invocations.finalizedAt(c.Time); ok {
+				crashRequestID = f.RequestID
+			}
+		}
+		lc.invocations.failed(crashRequestID)
+		event, err := c.errorEvent(crashRequestID, lc.otelAttributes(crashRequestID))
+		if err != nil {
+			lc.logger.Errorf("Error creating error event for the crash: %v", err)
+			continue
+		}
+		if !lc.enqueueEvent(event, apmClient, metadataContainer) {
+			lc.logger.Debug("Dropped crash error event sent before any agent metadata was received")
+		}
+	}
+}
+
+// reportPowertoolsLog sends the function log record as a log event if it
+// was written by a Powertools logger, and returns false otherwise.
+func (lc *Client) reportPowertoolsLog(t time.Time, record string, requestID string, apmClient *apmproxy.Client, metadataContainer *apmproxy.MetadataContainer) bool {
+	l, t, ok := parsePowertoolsLog(t, record)
+	if !ok {
+		return false
+	}
+
+	attributesRequestID := l.FunctionRequestID
+	if attributesRequestID == "" {
+		attributesRequestID = requestID
+	}
+	if lc.traceContext && l.XRayTraceID == "" {
+		if inv, ok := lc.invocations.lookup(attributesRequestID); ok {
+			l.XRayTraceID = xrayHeaderTraceID(inv.TraceID)
+		}
+	}
+	event, err := l.logEvent(t, requestID, lc.otelAttributes(attributesRequestID))
+	if err != nil {
+		lc.logger.Errorf("Error creating log event for the Powertools log: %v", err)
+		return true
+	}
+	if !lc.enqueueEvent(event, apmClient, metadataContainer) {
+		lc.logger.Debug("Dropped Powertools log event sent before any agent metadata was received")
+	}
+	return true
+}
+
+// reportFunctionLog sends the function log record as a log event. The
+// invocation of the record is the one of the request ID it contains, or
+// the one whose execution includes the time of the record.
+func (lc *Client) reportFunctionLog(t time.Time, record string, requestID string, apmClient *apmproxy.Client, metadataContainer *apmproxy.MetadataContainer) {
+	l, ok := parseFunctionLog(record)
+	if !ok {
+		return
+	}
+
+	var inv InvocationRecord
+	if l.RequestID != "" {
+		inv, ok = lc.invocations.lookup(l.RequestID)
+		requestID = l.RequestID
+	} else if inv, ok = lc.invocations.at(t); ok {
+		requestID = inv.RequestID
+	}
+	var traceID string
+	if ok {
+		traceID = xrayTraceID(xrayHeaderTraceID(inv.TraceID))
+	}
+	if l.Level == "error" || l.Level == "fatal" {
+		lc.invocations.failed(requestID)
+	}
+
+	event, err := l.logEvent(t, requestID, traceID, lc.otelAttributes(requestID))
+	if err != nil {
+		lc.logger.Errorf("Error creating log event for the function log: %v", err)
+		return
+	}
+	if !lc.enqueueEvent(event, apmClient, metadataContainer) {
+		lc.logger.Debug("Dropped function log event sent before any agent metadata was received")
+	}
+}
+
+// enqueueEvent enqueues the event created by the extension with the agent
+// metadata, or the fallback metadata. It returns false if the event was
+// dropped as no metadata is available.
+func (lc *Client) enqueueEvent(event []byte, apmClient *apmproxy.Client, metadataContainer *apmproxy.MetadataContainer) bool {
+	data := apmproxy.AgentData{Data: event}
+	if metadataContainer.Metadata != nil {
+		data.Data = append(append(append([]byte{}, metadataContainer.Metadata...), '\n'), event...)
+	} else {
+		var ok bool
+		if data, ok = lc.applyMetadataFallback(data); !ok {
+			return false
+		}
+	}
+	apmClient.EnqueueAPMData(data)
+	return true
+}
@@ -0,0 +1,91 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+)
+
+// MetadataFallback is the behavior applied to the data generated by the
+// extension, such as platform metrics, when no agent sent metadata.
+type MetadataFallback string
+
+const (
+	// MetadataFallbackNone ships the data without metadata.
+	MetadataFallbackNone MetadataFallback = "none"
+	// MetadataFallbackSynthesize ships the data with metadata built
+	// from the environment of the Lambda function.
+	MetadataFallbackSynthesize MetadataFallback = "synthesize"
+	// MetadataFallbackDrop drops the data.
+	MetadataFallbackDrop MetadataFallback = "drop"
+)
+
+// ParseMetadataFallback parses the name of a metadata fallback.
+func ParseMetadataFallback(s string) (MetadataFallback, error) {
+	switch f := MetadataFallback(strings.ToLower(s)); f {
+	case MetadataFallbackNone, MetadataFallbackSynthesize, MetadataFallbackDrop:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown metadata fallback %q", s)
+}
+
+// MissingMetadata summarizes the data generated while no agent
+// metadata was available.
+type MissingMetadata struct {
+	Fallback MetadataFallback
+	Payloads int64
+	Bytes    int64
+}
+
+// MissingMetadata returns how much data was generated while no agent
+// metadata was available, and how it was handled.
+func (lc *Client) MissingMetadata() MissingMetadata {
+	fallback := lc.metadataFallback
+	if fallback == "" {
+		fallback = MetadataFallbackNone
+	}
+	return MissingMetadata{
+		Fallback: fallback,
+		Payloads: lc.missingMetadataPayloads.Load(),
+		Bytes:    lc.missingMetadataBytes.Load(),
+	}
+}
+
+// applyMetadataFallback applies the metadata fallback to data generated
+// by the extension without metadata. It returns false if the data must
+// be dropped.
+func (lc *Client) applyMetadataFallback(data apmproxy.AgentData) (apmproxy.AgentData, bool) {
+	lc.missingMetadataPayloads.Add(1)
+	lc.missingMetadataBytes.Add(int64(len(data.Data)))
+
+	switch lc.metadataFallback {
+	case MetadataFallbackDrop:
+		return apmproxy.AgentData{}, false
+	case MetadataFallbackSynthesize:
+		metadata, err := apmproxy.SynthesizeMetadata()
+		if err != nil {
+			lc.logger.Warnf("Failed to synthesize metadata: %v", err)
+			return data, true
+		}
+		data.Data = append(append(metadata, '\n'), data.Data...)
+	}
+	return data, true
+}
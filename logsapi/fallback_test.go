@@ -0,0 +1,95 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestParseMetadataFallback(t *testing.T) {
+	f, err := ParseMetadataFallback("Synthesize")
+	require.NoError(t, err)
+	assert.Equal(t, MetadataFallbackSynthesize, f)
+
+	_, err = ParseMetadataFallback("dead-letter")
+	assert.Error(t, err)
+}
+
+func TestApplyMetadataFallback(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "my-function")
+	t.Setenv("AWS_REGION", "eu-central-1")
+	metrics := []byte(`{"metricset":{"samples":{}}}`)
+
+	testCases := []struct {
+		name     string
+		fallback MetadataFallback
+		shipped  bool
+		metadata bool
+	}{
+		{name: "default", shipped: true},
+		{name: "none", fallback: MetadataFallbackNone, shipped: true},
+		{name: "synthesize", fallback: MetadataFallbackSynthesize, shipped: true, metadata: true},
+		{name: "drop", fallback: MetadataFallbackDrop},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lc := Client{logger: zaptest.NewLogger(t).Sugar(), metadataFallback: tc.fallback}
+
+			data, ok := lc.applyMetadataFallback(apmproxy.AgentData{Data: metrics})
+			require.Equal(t, tc.shipped, ok)
+
+			missing := lc.MissingMetadata()
+			assert.Equal(t, int64(1), missing.Payloads)
+			assert.Equal(t, int64(len(metrics)), missing.Bytes)
+
+			if !tc.shipped {
+				return
+			}
+			if !tc.metadata {
+				assert.Equal(t, metrics, data.Data)
+				return
+			}
+
+			metadata, rest, _ := bytes.Cut(data.Data, []byte("\n"))
+			assert.Equal(t, metrics, rest)
+
+			var m struct {
+				Metadata struct {
+					Service struct {
+						Name string `json:"name"`
+					} `json:"service"`
+					Cloud struct {
+						Region string `json:"region"`
+					} `json:"cloud"`
+				} `json:"metadata"`
+			}
+			require.NoError(t, json.Unmarshal(metadata, &m))
+			assert.Equal(t, "my-function", m.Metadata.Service.Name)
+			assert.Equal(t, "eu-central-1", m.Metadata.Cloud.Region)
+		})
+	}
+}
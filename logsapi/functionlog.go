@@ -0,0 +1,126 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+)
+
+// functionLogLevels are the levels written by the runtime loggers, e.g.
+// the console of the Node.js runtime or the logging module of Python.
+var functionLogLevels = map[string]string{
+	"TRACE":    "trace",
+	"DEBUG":    "debug",
+	"INFO":     "info",
+	"WARN":     "warn",
+	"WARNING":  "warn",
+	"ERROR":    "error",
+	"FATAL":    "fatal",
+	"CRITICAL": "fatal",
+}
+
+// functionLog is a function log line.
+type functionLog struct {
+	Message   string
+	Level     string
+	RequestID string
+}
+
+// parseFunctionLog extracts the message, level and request ID from the
+// function log record, when written in the formats of the runtime
+// loggers or as JSON with a level and a message. Other records are
+// forwarded as is, as the message. It returns false for empty records.
+func parseFunctionLog(record string) (functionLog, bool) {
+	record = strings.TrimRight(record, "\r\n")
+	if strings.TrimSpace(record) == "" {
+		return functionLog{}, false
+	}
+
+	if strings.HasPrefix(record, "{") {
+		var j struct {
+			Level     string `json:"level"`
+			Message   string `json:"message"`
+			Msg       string `json:"msg"`
+			RequestID string `json:"requestId"`
+		}
+		if err := json.Unmarshal([]byte(record), &j); err == nil && (j.Message != "" || j.Msg != "") {
+			l := functionLog{Message: j.Message, Level: strings.ToLower(j.Level), RequestID: j.RequestID}
+			if l.Message == "" {
+				l.Message = j.Msg
+			}
+			return l, true
+		}
+		return functionLog{Message: record}, true
+	}
+
+	// Node.js: "<timestamp>\t<request ID>\t<LEVEL>\t<message>"
+	// Python: "[<LEVEL>]\t<timestamp>\t<request ID>\t<message>"
+	fields := strings.SplitN(record, "\t", 4)
+	if len(fields) == 4 {
+		if level, ok := functionLogLevels[strings.Trim(fields[0], "[]")]; ok && strings.HasPrefix(fields[0], "[") {
+			return functionLog{Message: fields[3], Level: level, RequestID: fields[2]}, true
+		}
+		if level, ok := functionLogLevels[fields[2]]; ok {
+			return functionLog{Message: fields[3], Level: level, RequestID: fields[1]}, true
+		}
+	}
+	return functionLog{Message: record}, true
+}
+
+// logEvent returns the APM log event of the function log, mapped to ECS
+// and correlated with the invocation of the given request ID and its
+// trace, if known. The attributes are added as labels.
+func (l functionLog) logEvent(t time.Time, requestID string, traceID string, attributes map[string]string) ([]byte, error) {
+	type faas struct {
+		Execution string `json:"execution,omitempty"`
+		Name      string `json:"name,omitempty"`
+		Version   string `json:"version,omitempty"`
+	}
+	var event struct {
+		Log struct {
+			Timestamp int64  `json:"timestamp"`
+			Message   string `json:"message"`
+			TraceID   string `json:"trace_id,omitempty"`
+			Log       struct {
+				Level  string `json:"level,omitempty"`
+				Logger string `json:"logger"`
+			} `json:"log"`
+			FaaS   faas              `json:"faas"`
+			Labels map[string]string `json:"labels,omitempty"`
+		} `json:"log"`
+	}
+
+	e := &event.Log
+	e.Timestamp = t.UnixMicro()
+	e.Message = l.Message
+	e.TraceID = traceID
+	e.Log.Level = l.Level
+	e.Log.Logger = "function"
+	e.FaaS = faas{
+		Execution: requestID,
+		Name:      os.Getenv("AWS_LAMBDA_FUNCTION_NAME"),
+		Version:   os.Getenv("AWS_LAMBDA_FUNCTION_VERSION"),
+	}
+	if len(attributes) > 0 {
+		e.Labels = attributes
+	}
+	return json.Marshal(event)
+}
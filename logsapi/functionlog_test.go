@@ -0,0 +1,124 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+	"github.com/elastic/apm-aws-lambda/extension"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestParseFunctionLog(t *testing.T) {
+	for name, tc := range map[string]struct {
+		record   string
+		expected functionLog
+		ok       bool
+	}{
+		"nodejs": {
+			record:   "2024-01-02T03:04:05.678Z\tc6af9ac6-7b61-11e6-9a41-93e812345678\tWARN\tCart is empty\n",
+			expected: functionLog{Message: "Cart is empty", Level: "warn", RequestID: "c6af9ac6-7b61-11e6-9a41-93e812345678"},
+			ok:       true,
+		},
+		"python": {
+			record:   "[ERROR]\t2024-01-02T03:04:05.678Z\t52fdfc07-2182-154f-163f-5f0f9a621d72\tPayment failed\n",
+			expected: functionLog{Message: "Payment failed", Level: "error", RequestID: "52fdfc07-2182-154f-163f-5f0f9a621d72"},
+			ok:       true,
+		},
+		"json": {
+			record:   `{"level":"INFO","msg":"Collecting payment","requestId":"52fdfc07-2182-154f-163f-5f0f9a621d72"}`,
+			expected: functionLog{Message: "Collecting payment", Level: "info", RequestID: "52fdfc07-2182-154f-163f-5f0f9a621d72"},
+			ok:       true,
+		},
+		"json without message": {
+			record:   `{"cart":"empty"}`,
+			expected: functionLog{Message: `{"cart":"empty"}`},
+			ok:       true,
+		},
+		"plain": {
+			record:   "Collecting payment\n",
+			expected: functionLog{Message: "Collecting payment"},
+			ok:       true,
+		},
+		"empty": {
+			record: " \n",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			l, ok := parseFunctionLog(tc.record)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.expected, l)
+		})
+	}
+}
+
+func TestFunctionLogEvent(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "test")
+	t.Setenv("AWS_LAMBDA_FUNCTION_VERSION", "$LATEST")
+	l := functionLog{Message: "Cart is empty", Level: "warn"}
+	event, err := l.logEvent(time.UnixMicro(1000), "request", "5759e988bd862e3fe1be46a994272793", nil)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"log":{
+		"timestamp":1000,
+		"message":"Cart is empty",
+		"trace_id":"5759e988bd862e3fe1be46a994272793",
+		"log":{"level":"warn","logger":"function"},
+		"faas":{"execution":"request","name":"test","version":"$LATEST"}
+	}}`, string(event))
+}
+
+func TestProcessLogsFunctionLogs(t *testing.T) {
+	l := zaptest.NewLogger(t).Sugar()
+	lc, err := NewClient(WithLogsAPIBaseURL("http://example.com"), WithLogger(l), WithFunctionLogs(), WithPowertoolsLogs())
+	require.NoError(t, err)
+	apmClient, err := apmproxy.NewClient(apmproxy.WithURL("http://example.com"), apmproxy.WithLogger(l))
+	require.NoError(t, err)
+
+	lc.RegisterInvocation(&extension.NextEventResponse{
+		RequestID: "current",
+		Tracing:   extension.Tracing{Type: "X-Amzn-Trace-Id", Value: "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"},
+	})
+	now := time.Now()
+	for _, e := range []LogEvent{
+		{Type: Start, Time: now, Record: LogEventRecord{RequestID: "current"}},
+		{Type: FunctionLog, Time: now, StringRecord: powertoolsPythonLog},
+		{Type: FunctionLog, Time: now, StringRecord: "Collecting payment\n"},
+		{Type: RuntimeDone, Time: now, Record: LogEventRecord{RequestID: "current"}},
+	} {
+		lc.logsChannel <- e
+	}
+
+	runtimeDone := make(chan struct{}, 1)
+	metadataContainer := &apmproxy.MetadataContainer{Metadata: []byte(`{"metadata":{}}`)}
+	require.NoError(t, lc.ProcessLogs(context.Background(), "current", apmClient, metadataContainer, runtimeDone, nil))
+
+	// The Powertools log is forwarded with its structure only.
+	require.Len(t, apmClient.DataChannel, 2)
+	assert.Contains(t, string((<-apmClient.DataChannel).Data), `"logger":"powertools"`)
+	data := string((<-apmClient.DataChannel).Data)
+	assert.Contains(t, data, `{"metadata":{}}`+"\n"+`{"log":`)
+	assert.Contains(t, data, `"message":"Collecting payment"`)
+	assert.Contains(t, data, `"trace_id":"5759e988bd862e3fe1be46a994272793"`)
+	assert.Contains(t, data, `"execution":"current"`)
+}
@@ -0,0 +1,382 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/extension"
+)
+
+// maxInFlightInvocations bounds the number of invocations tracked, as the
+// platform report of an invocation may never be received, e.g. when the
+// Logs API dropped it.
+const maxInFlightInvocations = 16
+
+// maxFinalizedInvocations bounds the number of recently finalized
+// invocations remembered to correlate the records arriving late.
+const maxFinalizedInvocations = 32
+
+// invocation is an invocation registered with the client, correlated
+// with the platform records by request ID.
+type invocation struct {
+	event *extension.NextEventResponse
+	// start is the platform timestamp of the start of the invocation.
+	start time.Time
+	// end is the platform timestamp of the runtimeDone record of the
+	// invocation, and status the status it reported.
+	end    time.Time
+	status string
+	// spans are the phases of the invocation reported by the runtimeDone
+	// record of the Telemetry API.
+	spans []Span
+	// errored is set once an error of the invocation was seen.
+	errored bool
+}
+
+// record returns an immutable snapshot of the invocation.
+func (inv *invocation) record() InvocationRecord {
+	return InvocationRecord{
+		RequestID:          inv.event.RequestID,
+		InvokedFunctionArn: inv.event.InvokedFunctionArn,
+		TraceID:            inv.event.Tracing.Value,
+		Deadline:           inv.event.Deadline(),
+		Start:              inv.start,
+		End:                inv.end,
+		Status:             inv.status,
+		Errored:            inv.errored,
+	}
+}
+
+// InvocationRecord is a snapshot of an invocation tracked by the client.
+// Records are copies: they can be kept and shared without synchronization,
+// and are not updated as the records of the invocation are processed.
+type InvocationRecord struct {
+	RequestID          string
+	InvokedFunctionArn string
+	// TraceID is the X-Ray tracing header of the invocation, if any.
+	TraceID  string
+	Deadline time.Time
+	// Start and End are the platform timestamps of the start and
+	// runtimeDone records of the invocation, zero until received.
+	Start, End time.Time
+	// Status is the status reported by the runtimeDone record.
+	Status string
+	// Errored is true once an error of the invocation was seen: a crash,
+	// a fault or a function log at the error level.
+	Errored bool
+	// Finalized is true once the platform report was processed.
+	Finalized bool
+}
+
+// The statuses of the invocations, as reported by the runtimeDone records
+// or inferred for the invocations interrupted before, see InferStatus.
+const (
+	StatusSuccess = "success"
+	StatusFailure = "failure"
+	StatusTimeout = "timeout"
+)
+
+// InferStatus returns the status reported by the runtimeDone record of the
+// invocation, if received. Otherwise, e.g. for an invocation interrupted by
+// a shutdown, it is inferred from the evidence available at the given time:
+// timeout if the deadline passed, failure if an error was seen, and
+// success otherwise.
+func (r InvocationRecord) InferStatus(now time.Time) string {
+	switch {
+	case r.Status != "":
+		return r.Status
+	// The deadline is unknown when not set by the invocation event.
+	case r.Deadline.UnixMilli() > 0 && !now.Before(r.Deadline):
+		return StatusTimeout
+	case r.Errored:
+		return StatusFailure
+	default:
+		return StatusSuccess
+	}
+}
+
+// invocations tracks the invocations from their registration until their
+// platform report is processed. The Extensions API delivers invocations one
+// at a time, but runtimes or emulators may interleave them: records are
+// correlated by request ID rather than with a single current invocation.
+type invocations struct {
+	mu       sync.Mutex
+	inFlight map[string]*invocation
+	// order holds the request IDs in flight in registration order.
+	order []string
+	// finalized holds the most recently finalized invocations, the most
+	// recently used last, so that the records arriving after the report
+	// of an invocation are not misattributed to the current invocation.
+	finalized []InvocationRecord
+}
+
+// registration is the outcome of the registration of an invocation.
+type registration int
+
+const (
+	registered registration = iota
+	// registeredDuplicate means the invocation was already in flight,
+	// e.g. redelivered by the Extensions API, and the events are merged.
+	registeredDuplicate
+	// registeredFinalized means the invocation was already finalized,
+	// the registration is ignored.
+	registeredFinalized
+)
+
+// register starts tracking the invocation, evicting the oldest
+// invocation in flight if too many are tracked. Registering the same
+// invocation again is idempotent: the fields missing from the first
+// event are filled from the new one, and the fields conflicting between
+// both events are returned, the values of the first event are kept.
+func (i *invocations) register(event *extension.NextEventResponse) (registration, []string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if inv, ok := i.inFlight[event.RequestID]; ok {
+		merged, conflicts := mergeEvents(*inv.event, *event)
+		inv.event = &merged
+		return registeredDuplicate, conflicts
+	}
+	for _, f := range i.finalized {
+		if f.RequestID == event.RequestID {
+			return registeredFinalized, nil
+		}
+	}
+
+	if i.inFlight == nil {
+		i.inFlight = make(map[string]*invocation)
+	}
+	if len(i.order) >= maxInFlightInvocations {
+		delete(i.inFlight, i.order[0])
+		i.order = i.order[1:]
+	}
+	i.inFlight[event.RequestID] = &invocation{event: event}
+	i.order = append(i.order, event.RequestID)
+	return registered, nil
+}
+
+// mergeEvents fills the fields missing from the event with the ones of
+// the other event of the same invocation. It returns the names of the
+// fields set to different values in both events.
+func mergeEvents(event, other extension.NextEventResponse) (extension.NextEventResponse, []string) {
+	var conflicts []string
+	switch {
+	case event.InvokedFunctionArn == "":
+		event.InvokedFunctionArn = other.InvokedFunctionArn
+	case other.InvokedFunctionArn != "" && other.InvokedFunctionArn != event.InvokedFunctionArn:
+		conflicts = append(conflicts, "invokedFunctionArn")
+	}
+	switch {
+	case event.DeadlineMs == 0:
+		event.DeadlineMs = other.DeadlineMs
+	case other.DeadlineMs != 0 && other.DeadlineMs != event.DeadlineMs:
+		conflicts = append(conflicts, "deadlineMs")
+	}
+	if event.Tracing.Value == "" {
+		event.Tracing = other.Tracing
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = other.Timestamp
+	}
+	return event, conflicts
+}
+
+// started records the platform timestamp of the start of the invocation.
+func (i *invocations) started(requestID string, t time.Time) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if inv, ok := i.inFlight[requestID]; ok {
+		inv.start = t
+	}
+}
+
+// done records the platform timestamp, the status and the spans of the
+// runtimeDone record of the invocation.
+func (i *invocations) done(requestID string, t time.Time, status string, spans []Span) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if inv, ok := i.inFlight[requestID]; ok {
+		inv.end, inv.status, inv.spans = t, status, spans
+	}
+}
+
+// failed records that an error of the invocation was seen.
+func (i *invocations) failed(requestID string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if inv, ok := i.inFlight[requestID]; ok {
+		inv.errored = true
+	}
+}
+
+// finalize stops tracking the invocation and returns it, if it was in
+// flight. The invocation is remembered as recently finalized.
+func (i *invocations) finalize(requestID string) (invocation, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	inv, ok := i.inFlight[requestID]
+	if !ok {
+		return invocation{}, false
+	}
+	delete(i.inFlight, requestID)
+	for n, id := range i.order {
+		if id == requestID {
+			i.order = append(i.order[:n], i.order[n+1:]...)
+			break
+		}
+	}
+
+	if len(i.finalized) >= maxFinalizedInvocations {
+		i.finalized = i.finalized[1:]
+	}
+	record := inv.record()
+	record.Finalized = true
+	i.finalized = append(i.finalized, record)
+	return *inv, true
+}
+
+// lookup returns a snapshot of the invocation in flight or recently
+// finalized, if any.
+func (i *invocations) lookup(requestID string) (InvocationRecord, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if inv, ok := i.inFlight[requestID]; ok {
+		return inv.record(), true
+	}
+	for _, f := range i.finalized {
+		if f.RequestID == requestID {
+			return f, true
+		}
+	}
+	return InvocationRecord{}, false
+}
+
+// snapshot returns the snapshots of the invocations in flight, in
+// registration order.
+func (i *invocations) snapshot() []InvocationRecord {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	records := make([]InvocationRecord, 0, len(i.order))
+	for _, id := range i.order {
+		records = append(records, i.inFlight[id].record())
+	}
+	return records
+}
+
+// lookupFinalized returns the recently finalized invocation, if any,
+// marking it as the most recently used.
+func (i *invocations) lookupFinalized(requestID string) (InvocationRecord, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for n, f := range i.finalized {
+		if f.RequestID == requestID {
+			i.finalized = append(append(i.finalized[:n], i.finalized[n+1:]...), f)
+			return f, true
+		}
+	}
+	return InvocationRecord{}, false
+}
+
+// finalizedAt returns the recently finalized invocation whose execution,
+// from its start to its runtimeDone record, includes t, if any.
+func (i *invocations) finalizedAt(t time.Time) (InvocationRecord, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for n := len(i.finalized) - 1; n >= 0; n-- {
+		f := i.finalized[n]
+		if f.Start.IsZero() || f.End.IsZero() {
+			continue
+		}
+		if !t.Before(f.Start) && !t.After(f.End) {
+			return f, true
+		}
+	}
+	return InvocationRecord{}, false
+}
+
+// at returns the invocation whose execution includes t: a recently
+// finalized invocation, or the only invocation in flight if it started
+// before t.
+func (i *invocations) at(t time.Time) (InvocationRecord, bool) {
+	if f, ok := i.finalizedAt(t); ok {
+		return f, true
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if len(i.order) != 1 {
+		return InvocationRecord{}, false
+	}
+	inv := i.inFlight[i.order[0]]
+	if !inv.start.IsZero() && t.Before(inv.start) {
+		return InvocationRecord{}, false
+	}
+	return inv.record(), true
+}
+
+// len returns the number of invocations in flight.
+func (i *invocations) len() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return len(i.inFlight)
+}
+
+// RegisterInvocation registers the invocation received from the Extensions
+// API, so that the platform records of the invocation, including its report,
+// are correlated with it by request ID, even if invocations are interleaved.
+//
+// Registering an invocation again, e.g. when the Extensions API redelivers
+// it, is idempotent. A warning is logged if the events conflict.
+func (lc *Client) RegisterInvocation(event *extension.NextEventResponse) {
+	// The environment was thawed to run the invocation.
+	lc.lag.running(time.Now())
+	switch r, conflicts := lc.invocations.register(event); r {
+	case registeredDuplicate:
+		if len(conflicts) > 0 {
+			lc.logger.Warnf("Invocation %s registered again with a different %s, keeping the first values", event.RequestID, strings.Join(conflicts, " and "))
+		} else {
+			lc.logger.Debugf("Invocation %s registered again", event.RequestID)
+		}
+	case registeredFinalized:
+		lc.logger.Debugf("Ignoring the registration of finalized invocation %s", event.RequestID)
+	}
+}
+
+// Invocation returns a snapshot of the invocation with the given request
+// ID, whether it is in flight or was recently finalized.
+func (lc *Client) Invocation(requestID string) (InvocationRecord, bool) {
+	return lc.invocations.lookup(requestID)
+}
+
+// InFlightInvocations returns the snapshots of the invocations registered
+// whose platform report was not processed yet, in registration order.
+func (lc *Client) InFlightInvocations() []InvocationRecord {
+	return lc.invocations.snapshot()
+}
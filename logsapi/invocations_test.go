@@ -0,0 +1,290 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+	"github.com/elastic/apm-aws-lambda/extension"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestInvocations(t *testing.T) {
+	var i invocations
+	now := time.Now()
+
+	i.register(&extension.NextEventResponse{RequestID: "1"})
+	i.register(&extension.NextEventResponse{RequestID: "2"})
+	i.started("2", now)
+	i.started("unknown", now)
+	assert.Equal(t, 2, i.len())
+
+	inv, ok := i.finalize("2")
+	require.True(t, ok)
+	assert.Equal(t, "2", inv.event.RequestID)
+	assert.Equal(t, now, inv.start)
+	_, ok = i.finalize("2")
+	assert.False(t, ok)
+
+	// The oldest invocations are evicted
+	for n := 0; n < maxInFlightInvocations; n++ {
+		i.register(&extension.NextEventResponse{RequestID: fmt.Sprint("new-", n)})
+	}
+	assert.Equal(t, maxInFlightInvocations, i.len())
+	_, ok = i.finalize("1")
+	assert.False(t, ok)
+}
+
+func TestInvocationsDuplicateRegistration(t *testing.T) {
+	var i invocations
+	now := time.Now()
+	arn := "arn:aws:lambda:us-east-1:123456789012:function:foo"
+
+	r, conflicts := i.register(&extension.NextEventResponse{RequestID: "1", DeadlineMs: 1000})
+	assert.Equal(t, registered, r)
+	assert.Empty(t, conflicts)
+	i.started("1", now)
+
+	// Missing fields are merged, the invocation is tracked once.
+	r, conflicts = i.register(&extension.NextEventResponse{RequestID: "1", InvokedFunctionArn: arn, Tracing: extension.Tracing{Value: "Root=1-abc"}})
+	assert.Equal(t, registeredDuplicate, r)
+	assert.Empty(t, conflicts)
+	assert.Equal(t, 1, i.len())
+
+	// Conflicting fields keep their first value.
+	r, conflicts = i.register(&extension.NextEventResponse{RequestID: "1", InvokedFunctionArn: arn + ":alias", DeadlineMs: 2000})
+	assert.Equal(t, registeredDuplicate, r)
+	assert.Equal(t, []string{"invokedFunctionArn", "deadlineMs"}, conflicts)
+
+	inv, ok := i.finalize("1")
+	require.True(t, ok)
+	assert.Equal(t, now, inv.start)
+	assert.Equal(t, arn, inv.event.InvokedFunctionArn)
+	assert.Equal(t, int64(1000), inv.event.DeadlineMs)
+	assert.Equal(t, "Root=1-abc", inv.event.Tracing.Value)
+
+	// Finalized invocations are not registered again.
+	r, _ = i.register(&extension.NextEventResponse{RequestID: "1"})
+	assert.Equal(t, registeredFinalized, r)
+	assert.Zero(t, i.len())
+}
+
+func TestInvocationSnapshots(t *testing.T) {
+	lc, err := NewClient(WithLogsAPIBaseURL("http://example.com"), WithLogger(zaptest.NewLogger(t).Sugar()))
+	require.NoError(t, err)
+	start := time.Now()
+	deadline := start.Add(3 * time.Second).Truncate(time.Millisecond)
+
+	lc.RegisterInvocation(&extension.NextEventResponse{RequestID: "1", InvokedFunctionArn: "arn:1", DeadlineMs: deadline.UnixMilli()})
+	lc.RegisterInvocation(&extension.NextEventResponse{RequestID: "2"})
+	lc.invocations.started("1", start)
+
+	records := lc.InFlightInvocations()
+	require.Len(t, records, 2)
+	assert.Equal(t, "1", records[0].RequestID)
+	assert.Equal(t, "2", records[1].RequestID)
+
+	record, ok := lc.Invocation("1")
+	require.True(t, ok)
+	assert.Equal(t, InvocationRecord{RequestID: "1", InvokedFunctionArn: "arn:1", Deadline: deadline, Start: start}, record)
+
+	// Snapshots are not updated with the invocation.
+	lc.invocations.done("1", start.Add(time.Second), "success", nil)
+	_, ok = lc.invocations.finalize("1")
+	require.True(t, ok)
+	assert.True(t, records[0].End.IsZero())
+	assert.False(t, record.Finalized)
+
+	record, ok = lc.Invocation("1")
+	require.True(t, ok)
+	assert.True(t, record.Finalized)
+	assert.Equal(t, "success", record.Status)
+	assert.Len(t, lc.InFlightInvocations(), 1)
+
+	_, ok = lc.Invocation("unknown")
+	assert.False(t, ok)
+}
+
+func TestInvocationInferStatus(t *testing.T) {
+	var i invocations
+	now := time.Now()
+	deadline := now.Add(time.Second).UnixMilli()
+
+	i.register(&extension.NextEventResponse{RequestID: "done", DeadlineMs: deadline})
+	i.register(&extension.NextEventResponse{RequestID: "errored", DeadlineMs: deadline})
+	i.register(&extension.NextEventResponse{RequestID: "running", DeadlineMs: deadline})
+	i.register(&extension.NextEventResponse{RequestID: "no deadline"})
+	i.done("done", now, "error", nil)
+	i.failed("errored")
+	i.failed("unknown")
+
+	status := func(at time.Time) map[string]string {
+		statuses := make(map[string]string)
+		for _, r := range i.snapshot() {
+			statuses[r.RequestID] = r.InferStatus(at)
+		}
+		return statuses
+	}
+	assert.Equal(t, map[string]string{
+		"done":        "error",
+		"errored":     StatusFailure,
+		"running":     StatusSuccess,
+		"no deadline": StatusSuccess,
+	}, status(now))
+	assert.Equal(t, map[string]string{
+		"done":        "error",
+		"errored":     StatusTimeout,
+		"running":     StatusTimeout,
+		"no deadline": StatusSuccess,
+	}, status(now.Add(2*time.Second)))
+}
+
+func TestProcessLogsInterleavedInvocations(t *testing.T) {
+	l := zaptest.NewLogger(t).Sugar()
+	lc, err := NewClient(WithLogsAPIBaseURL("http://example.com"), WithLogger(l))
+	require.NoError(t, err)
+	apmClient, err := apmproxy.NewClient(apmproxy.WithURL("http://example.com"), apmproxy.WithLogger(l))
+	require.NoError(t, err)
+
+	start := time.Now()
+	first := &extension.NextEventResponse{RequestID: "first", InvokedFunctionArn: "arn:first", DeadlineMs: start.UnixMilli() + 3000}
+	second := &extension.NextEventResponse{RequestID: "second", InvokedFunctionArn: "arn:second", DeadlineMs: start.UnixMilli() + 3000}
+	lc.RegisterInvocation(first)
+	lc.RegisterInvocation(second)
+
+	// The records of both invocations are interleaved, the reports
+	// arrive in the reverse order of the invocations.
+	for _, e := range []LogEvent{
+		{Type: Start, Time: start, Record: LogEventRecord{RequestID: "first"}},
+		{Type: Start, Time: start, Record: LogEventRecord{RequestID: "second"}},
+		{Type: Report, Time: start, Record: LogEventRecord{RequestID: "second"}},
+		{Type: Report, Time: start, Record: LogEventRecord{RequestID: "first"}},
+		{Type: RuntimeDone, Time: start, Record: LogEventRecord{RequestID: "current"}},
+	} {
+		lc.logsChannel <- e
+	}
+
+	runtimeDone := make(chan struct{}, 1)
+	metadataContainer := &apmproxy.MetadataContainer{Metadata: []byte(`{"metadata":{}}`)}
+	require.NoError(t, lc.ProcessLogs(context.Background(), "current", apmClient, metadataContainer, runtimeDone, nil))
+
+	require.Len(t, apmClient.DataChannel, 2)
+	secondReport := string((<-apmClient.DataChannel).Data)
+	assert.Contains(t, secondReport, `"execution":"second"`)
+	assert.Contains(t, secondReport, `"id":"arn:second"`)
+	assert.Contains(t, secondReport, `"faas.timeout":{"value":3000}`)
+	firstReport := string((<-apmClient.DataChannel).Data)
+	assert.Contains(t, firstReport, `"execution":"first"`)
+	assert.Contains(t, firstReport, `"id":"arn:first"`)
+	assert.Equal(t, 0, lc.invocations.len())
+}
+
+func TestFinalizedInvocations(t *testing.T) {
+	var i invocations
+	start := time.Now()
+
+	i.register(&extension.NextEventResponse{RequestID: "1", Tracing: extension.Tracing{Value: "Root=1-abc"}})
+	i.started("1", start)
+	i.done("1", start.Add(time.Second), "success", nil)
+	_, ok := i.lookupFinalized("1")
+	assert.False(t, ok)
+	_, ok = i.finalize("1")
+	require.True(t, ok)
+
+	f, ok := i.lookupFinalized("1")
+	require.True(t, ok)
+	assert.Equal(t, InvocationRecord{
+		RequestID: "1",
+		TraceID:   "Root=1-abc",
+		Deadline:  time.UnixMilli(0),
+		Status:    "success",
+		Start:     start,
+		End:       start.Add(time.Second),
+		Finalized: true,
+	}, f)
+
+	f, ok = i.finalizedAt(start.Add(500 * time.Millisecond))
+	require.True(t, ok)
+	assert.Equal(t, "1", f.RequestID)
+	_, ok = i.finalizedAt(start.Add(2 * time.Second))
+	assert.False(t, ok)
+
+	// The least recently used invocations are forgotten
+	for n := 0; n < maxFinalizedInvocations-1; n++ {
+		id := fmt.Sprint("new-", n)
+		i.register(&extension.NextEventResponse{RequestID: id})
+		i.finalize(id)
+	}
+	_, ok = i.lookupFinalized("1")
+	require.True(t, ok)
+	i.register(&extension.NextEventResponse{RequestID: "last"})
+	i.finalize("last")
+	_, ok = i.lookupFinalized("1")
+	assert.True(t, ok)
+	_, ok = i.lookupFinalized("new-0")
+	assert.False(t, ok)
+}
+
+func TestProcessLogsLateRecords(t *testing.T) {
+	l := zaptest.NewLogger(t).Sugar()
+	lc, err := NewClient(WithLogsAPIBaseURL("http://example.com"), WithLogger(l))
+	require.NoError(t, err)
+	apmClient, err := apmproxy.NewClient(apmproxy.WithURL("http://example.com"), apmproxy.WithLogger(l))
+	require.NoError(t, err)
+
+	start := time.Now()
+	first := &extension.NextEventResponse{RequestID: "first", DeadlineMs: start.UnixMilli() + 3000}
+	lc.RegisterInvocation(first)
+	lc.RegisterInvocation(&extension.NextEventResponse{RequestID: "current", DeadlineMs: start.UnixMilli() + 3000})
+
+	// The runtimeDone and report records of the first invocation are
+	// received twice, the duplicates are ignored.
+	for _, e := range []LogEvent{
+		{Type: Start, Time: start, Record: LogEventRecord{RequestID: "first"}},
+		{Type: RuntimeDone, Time: start.Add(time.Second), Record: LogEventRecord{RequestID: "first", Status: "success"}},
+		{Type: Report, Time: start.Add(time.Second), Record: LogEventRecord{RequestID: "first"}},
+		{Type: RuntimeDone, Time: start.Add(time.Second), Record: LogEventRecord{RequestID: "first", Status: "success"}},
+		{Type: Report, Time: start.Add(time.Second), Record: LogEventRecord{RequestID: "first"}},
+		{Type: RuntimeDone, Time: start.Add(2 * time.Second), Record: LogEventRecord{RequestID: "current"}},
+	} {
+		lc.logsChannel <- e
+	}
+
+	runtimeDone := make(chan struct{}, 1)
+	metadataContainer := &apmproxy.MetadataContainer{Metadata: []byte(`{"metadata":{}}`)}
+	require.NoError(t, lc.ProcessLogs(context.Background(), "current", apmClient, metadataContainer, runtimeDone, first))
+	require.Len(t, apmClient.DataChannel, 1)
+	assert.Contains(t, string((<-apmClient.DataChannel).Data), `"execution":"first"`)
+
+	// A crash logged during the first invocation, received late,
+	// is attributed to the first invocation.
+	lc.reportCrashes([]crash{
+		{Time: start.Add(500 * time.Millisecond), Type: "ValueError"},
+		{Time: start.Add(1500 * time.Millisecond), Type: "ValueError"},
+	}, "current", apmClient, metadataContainer)
+	require.Len(t, apmClient.DataChannel, 2)
+	assert.Contains(t, string((<-apmClient.DataChannel).Data), `"faas_execution":"first"`)
+	assert.Contains(t, string((<-apmClient.DataChannel).Data), `"faas_execution":"current"`)
+}
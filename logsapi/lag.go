@@ -0,0 +1,166 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultLagThreshold is the lag of the platform records above which
+	// the listener is considered not keeping up, when not set with
+	// WithLagThreshold.
+	defaultLagThreshold = time.Second
+	// lagBudget is the number of consecutive deliveries whose lag exceeds
+	// the threshold tolerated before the buffering is increased.
+	lagBudget = 3
+	// maxBufferingBytes is the maximum buffering size of the Logs API.
+	maxBufferingBytes = 1048576
+)
+
+// lagTracker tracks the lag between the time of the platform records and
+// their delivery to the listener. The records emitted before the latest
+// thaw of the environment are ignored: their lag includes the time the
+// environment was frozen.
+type lagTracker struct {
+	mu           sync.Mutex
+	runningSince time.Time
+	// max and exceeded are the maximum lag and the number of deliveries
+	// whose lag exceeded the threshold since the last reset.
+	max      time.Duration
+	exceeded int64
+	// consecutive is the number of consecutive deliveries whose lag
+	// exceeded the threshold.
+	consecutive int
+}
+
+// logsLag is the lag of the platform records delivered by the Logs API.
+type logsLag struct {
+	Max      time.Duration
+	Exceeded int64
+}
+
+// running records that the environment is running since t.
+func (l *lagTracker) running(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.runningSince = t
+}
+
+// observe records the lag of a delivery of records emitted at times,
+// received at now. It returns the lag and whether the lag exceeded the
+// threshold for lagBudget consecutive deliveries.
+func (l *lagTracker) observe(times []time.Time, now time.Time, threshold time.Duration) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var lag time.Duration
+	for _, t := range times {
+		if t.Before(l.runningSince) {
+			continue
+		}
+		if d := now.Sub(t); d > lag {
+			lag = d
+		}
+	}
+	if lag > l.max {
+		l.max = lag
+	}
+
+	if threshold <= 0 || lag <= threshold {
+		l.consecutive = 0
+		return lag, false
+	}
+	l.exceeded++
+	l.consecutive++
+	if l.consecutive < lagBudget {
+		return lag, false
+	}
+	l.consecutive = 0
+	return lag, true
+}
+
+// reset returns the lag since the last reset.
+func (l *lagTracker) reset() logsLag {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lag := logsLag{Max: l.max, Exceeded: l.exceeded}
+	l.max, l.exceeded = 0, 0
+	return lag
+}
+
+// observeLag records the lag of a delivery of records, and increases the
+// buffering of the Logs API if the listener does not keep up with it.
+func (lc *Client) observeLag(events []LogEvent) {
+	var times []time.Time
+	for _, e := range events {
+		if strings.HasPrefix(string(e.Type), "platform.") && !e.Time.IsZero() {
+			times = append(times, e.Time)
+		}
+	}
+	if len(times) == 0 {
+		return
+	}
+
+	lag, exhausted := lc.lag.observe(times, time.Now(), lc.lagThreshold)
+	if !exhausted {
+		return
+	}
+	lc.logger.Warnf("The Logs API records are processed %s after they were emitted, above the threshold of %s: the listener does not keep up", lag, lc.lagThreshold)
+	if !lc.resubscribing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer lc.resubscribing.Store(false)
+		lc.increaseBuffering()
+	}()
+}
+
+// increaseBuffering subscribes again with a doubled buffering size, so
+// that the records are delivered in fewer, larger batches.
+func (lc *Client) increaseBuffering() {
+	lc.subscriptionMu.Lock()
+	defer lc.subscriptionMu.Unlock()
+
+	if lc.subscription == nil {
+		return
+	}
+	if lc.buffering.MaxBytes >= maxBufferingBytes {
+		lc.logger.Warn("The Logs API buffering is already at its maximum")
+		return
+	}
+
+	buffering := lc.buffering
+	lc.buffering.MaxBytes *= 2
+	if lc.buffering.MaxBytes > maxBufferingBytes {
+		lc.buffering.MaxBytes = maxBufferingBytes
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := lc.subscription
+	if err := lc.subscribe(ctx, s.eventTypes, s.extensionID, s.uri); err != nil {
+		lc.buffering = buffering
+		lc.logger.Warnf("Failed to increase the Logs API buffering: %v", err)
+		return
+	}
+	lc.logger.Infof("Increased the Logs API buffering to %d bytes", lc.buffering.MaxBytes)
+}
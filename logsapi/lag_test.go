@@ -0,0 +1,107 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestLagTracker(t *testing.T) {
+	var l lagTracker
+	now := time.Now()
+	l.running(now.Add(-time.Minute))
+
+	// Records emitted before the thaw are ignored
+	lag, exhausted := l.observe([]time.Time{now.Add(-time.Hour), now.Add(-100 * time.Millisecond)}, now, time.Second)
+	assert.Equal(t, 100*time.Millisecond, lag)
+	assert.False(t, exhausted)
+
+	for i := 1; i < lagBudget; i++ {
+		_, exhausted = l.observe([]time.Time{now.Add(-2 * time.Second)}, now, time.Second)
+		assert.False(t, exhausted)
+	}
+	lag, exhausted = l.observe([]time.Time{now.Add(-3 * time.Second)}, now, time.Second)
+	assert.Equal(t, 3*time.Second, lag)
+	assert.True(t, exhausted)
+
+	// The budget is consumed by consecutive deliveries only
+	l.observe([]time.Time{now.Add(-2 * time.Second)}, now, time.Second)
+	l.observe([]time.Time{now}, now, time.Second)
+	_, exhausted = l.observe([]time.Time{now.Add(-2 * time.Second)}, now, time.Second)
+	assert.False(t, exhausted)
+
+	assert.Equal(t, logsLag{Max: 3 * time.Second, Exceeded: int64(lagBudget + 2)}, l.reset())
+	assert.Equal(t, logsLag{}, l.reset())
+
+	// A threshold of 0 only tracks the lag
+	lag, exhausted = l.observe([]time.Time{now.Add(-time.Minute)}, now, 0)
+	assert.Equal(t, time.Minute, lag)
+	assert.False(t, exhausted)
+	assert.Equal(t, logsLag{Max: time.Minute}, l.reset())
+}
+
+func TestIncreaseBuffering(t *testing.T) {
+	buffering := make(chan BufferingCfg, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var subRequest SubscribeRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&subRequest))
+		buffering <- subRequest.BufferingCfg
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	lc, err := NewClient(
+		WithLogsAPIBaseURL(s.URL),
+		WithListenerAddress("localhost:0"),
+		WithLogger(zaptest.NewLogger(t).Sugar()),
+		WithLagThreshold(time.Second),
+	)
+	require.NoError(t, err)
+	require.NoError(t, lc.StartService(context.Background(), []EventType{Platform}, "testID"))
+	defer func() {
+		require.NoError(t, lc.Shutdown())
+	}()
+	assert.Equal(t, uint32(262144), (<-buffering).MaxBytes)
+
+	// The listener does not keep up
+	for i := 0; i < lagBudget; i++ {
+		lc.observeLag([]LogEvent{{Type: Start, Time: time.Now().Add(-5 * time.Second)}, {Type: FunctionLog}})
+	}
+	select {
+	case b := <-buffering:
+		assert.Equal(t, uint32(524288), b.MaxBytes)
+		assert.Equal(t, uint32(10000), b.MaxItems)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the subscription")
+	}
+
+	lc.increaseBuffering()
+	assert.Equal(t, uint32(maxBufferingBytes), (<-buffering).MaxBytes)
+	// The buffering is at its maximum
+	lc.increaseBuffering()
+	assert.Empty(t, buffering)
+}
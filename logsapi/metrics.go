@@ -19,6 +19,9 @@ package logsapi
 
 import (
 	"math"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/elastic/apm-aws-lambda/apmproxy"
 	"github.com/elastic/apm-aws-lambda/extension"
@@ -32,6 +35,17 @@ type PlatformMetrics struct {
 	MemorySizeMB     int32   `json:"memorySizeMB"`
 	MaxMemoryUsedMB  int32   `json:"maxMemoryUsedMB"`
 	InitDurationMs   float32 `json:"initDurationMs"`
+	// RestoreDurationMs is the duration of the restoration of a SnapStart
+	// snapshot, sent by the Telemetry API with the first invocation.
+	RestoreDurationMs float32 `json:"restoreDurationMs,omitempty"`
+}
+
+// spanMetrics are the names of the metrics of the spans of the runtimeDone
+// record of the Telemetry API. Other spans are ignored.
+var spanMetrics = map[string]string{
+	"responseLatency":  "faas.response_latency",
+	"responseDuration": "faas.response_duration",
+	"runtimeOverhead":  "faas.runtime_overhead",
 }
 
 type MetricsContainer struct {
@@ -63,6 +77,40 @@ func (mc MetricsContainer) MarshalFastJSON(json *fastjson.Writer) error {
 }
 
 func ProcessPlatformReport(metadataContainer *apmproxy.MetadataContainer, functionData *extension.NextEventResponse, platformReport LogEvent) (apmproxy.AgentData, error) {
+	return processPlatformReport(metadataContainer, functionData, platformReport, reportExtras{})
+}
+
+// reportExtras are the optional data added to the metricset of a platform
+// report, the data is only added when set.
+type reportExtras struct {
+	// pricing is used to estimate the cost of the invocation.
+	pricing *Pricing
+	// env holds the statistics of the execution environment.
+	env *environmentStats
+	// buffer holds the statistics of the agent data buffer.
+	buffer *apmproxy.BufferStats
+	// ackLatency is the delivery delay of the agent data of the invocation.
+	ackLatency *apmproxy.AckLatency
+	// drops is the agent data dropped during the invocation.
+	drops apmproxy.DropCounts
+	// otelAttributes are the OpenTelemetry attributes added as labels.
+	otelAttributes map[string]string
+	// start is the platform timestamp of the start of the invocation.
+	start time.Time
+	// readTimeouts is the number of Logs API deliveries which timed out.
+	readTimeouts *int64
+	// portCollisions are the listeners of the extension which could not
+	// use their configured port, used by another extension.
+	portCollisions []string
+	// spans are the phases of the invocation reported by the Telemetry API.
+	spans []Span
+	// logsLag is the lag of the records delivered by the Logs API.
+	logsLag *logsLag
+}
+
+// processPlatformReport converts the platform report to a metricset.
+func processPlatformReport(metadataContainer *apmproxy.MetadataContainer, functionData *extension.NextEventResponse, platformReport LogEvent, extras reportExtras) (apmproxy.AgentData, error) {
+	pricing, env, buffer, ackLatency := extras.pricing, extras.env, extras.buffer, extras.ackLatency
 	var metricsData []byte
 	metricsContainer := MetricsContainer{
 		Metrics: &model.Metrics{},
@@ -74,11 +122,51 @@ func ProcessPlatformReport(metadataContainer *apmproxy.MetadataContainer, functi
 	// Timestamp
 	metricsContainer.Metrics.Timestamp = model.Time(platformReport.Time)
 
+	// Build information of the extension, to correlate data with layer builds.
+	// Labels are sorted lexicographically.
+	metricsContainer.Metrics.Labels = model.StringMap{
+		{Key: "apm_lambda_extension_commit", Value: extension.Commit},
+		{Key: "apm_lambda_extension_version", Value: extension.Version},
+	}
+	if len(extras.drops) > 0 {
+		// The reasons the agent data of the invocation was dropped,
+		// to search the invocations which lost data.
+		reasons := make([]string, 0, len(extras.drops))
+		for reason := range extras.drops {
+			reasons = append(reasons, string(reason))
+		}
+		sort.Strings(reasons)
+		metricsContainer.Metrics.Labels = append(metricsContainer.Metrics.Labels, model.StringMapItem{Key: "extension_dropped_data", Value: strings.Join(reasons, ",")})
+	}
+	if len(extras.portCollisions) > 0 {
+		// Extensions of other vendors in the same environment
+		metricsContainer.Metrics.Labels = append(metricsContainer.Metrics.Labels, model.StringMapItem{Key: "extension_port_collisions", Value: strings.Join(extras.portCollisions, ",")})
+	}
+	if env != nil && env.InitializationType != "" {
+		metricsContainer.Metrics.Labels = append(metricsContainer.Metrics.Labels, model.StringMapItem{Key: "faas_initialization_type", Value: string(env.InitializationType)})
+	}
+	if env != nil && env.Instance != "" {
+		metricsContainer.Metrics.Labels = append(metricsContainer.Metrics.Labels, model.StringMapItem{Key: "faas_instance", Value: env.Instance})
+	}
+	if traceID := xrayTraceID(xrayHeaderTraceID(functionData.Tracing.Value)); traceID != "" {
+		// Metricsets have no trace context, the trace of the invocation
+		// is added as a label to correlate its metrics with its trace.
+		metricsContainer.Metrics.Labels = append(metricsContainer.Metrics.Labels, model.StringMapItem{Key: "trace_id", Value: traceID})
+	}
+	if len(extras.otelAttributes) > 0 {
+		for k, v := range extras.otelAttributes {
+			metricsContainer.Metrics.Labels = append(metricsContainer.Metrics.Labels, model.StringMapItem{Key: k, Value: v})
+		}
+		sort.Slice(metricsContainer.Metrics.Labels, func(i, j int) bool {
+			return metricsContainer.Metrics.Labels[i].Key < metricsContainer.Metrics.Labels[j].Key
+		})
+	}
+
 	// FaaS Fields
 	metricsContainer.Metrics.FAAS = &model.FAAS{
 		Execution: platformReport.Record.RequestID,
 		ID:        functionData.InvokedFunctionArn,
-		Coldstart: platformReportMetrics.InitDurationMs > 0,
+		Coldstart: platformReportMetrics.InitDurationMs > 0 || platformReportMetrics.RestoreDurationMs > 0,
 	}
 
 	// System
@@ -90,11 +178,76 @@ func ProcessPlatformReport(metadataContainer *apmproxy.MetadataContainer, functi
 	metricsContainer.Add("faas.duration", float64(platformReportMetrics.DurationMs))               // Unit : Milliseconds
 	metricsContainer.Add("faas.billed_duration", float64(platformReportMetrics.BilledDurationMs))  // Unit : Milliseconds
 	metricsContainer.Add("faas.coldstart_duration", float64(platformReportMetrics.InitDurationMs)) // Unit : Milliseconds
+	if platformReportMetrics.RestoreDurationMs > 0 {
+		metricsContainer.Add("faas.restore_duration", float64(platformReportMetrics.RestoreDurationMs)) // Unit : Milliseconds
+	}
+	for _, span := range extras.spans {
+		if name, ok := spanMetrics[span.Name]; ok {
+			metricsContainer.Add(name, span.DurationMs) // Unit : Milliseconds
+		}
+	}
 	// In AWS Lambda, the Timeout is configured as an integer number of seconds. We use this assumption to derive the Timeout from
 	// - The epoch corresponding to the end of the current invocation (its "deadline")
 	// - The epoch corresponding to the start of the current invocation
 	// - The multiplication / division then rounds the value to obtain a number of ms that can be expressed a multiple of 1000 (see initial assumption)
-	metricsContainer.Add("faas.timeout", math.Ceil(float64(functionData.DeadlineMs-functionData.Timestamp.UnixMilli())/1e3)*1e3) // Unit : Milliseconds
+	// The deadline is set by the platform, so the start is preferably taken from the platform start record: the clock of the
+	// extension may be off after the environment thawed.
+	start := functionData.Timestamp
+	if !extras.start.IsZero() {
+		start = extras.start
+	}
+	metricsContainer.Add("faas.timeout", math.Max(0, math.Ceil(float64(functionData.DeadlineMs-start.UnixMilli())/1e3)*1e3)) // Unit : Milliseconds
+
+	if pricing != nil {
+		metricsContainer.Add("faas.estimated_cost", pricing.Cost(platformReportMetrics.BilledDurationMs, platformReportMetrics.MemorySizeMB)) // Unit : USD
+	}
+
+	if env != nil {
+		metricsContainer.Add("faas.environment.invocations", float64(env.Invocations))
+		metricsContainer.Add("faas.environment.age", float64(env.Age.Milliseconds())) // Unit : Milliseconds
+		metricsContainer.Add("faas.environment.thaws", float64(env.Thaws))
+		if env.InitDuration > 0 {
+			metricsContainer.Add("faas.environment.init_duration", float64(env.InitDuration.Microseconds())/1e3) // Unit : Milliseconds
+		}
+	}
+
+	if buffer != nil {
+		metricsContainer.Add("extension.buffer.depth", float64(buffer.Depth))
+		metricsContainer.Add("extension.buffer.capacity", float64(buffer.Capacity))
+		metricsContainer.Add("extension.buffer.high_watermark", float64(buffer.HighWatermark))
+		metricsContainer.Add("extension.buffer.dropped", float64(buffer.Dropped))
+		metricsContainer.Add("extension.buffer.evicted", float64(buffer.Evicted))
+		metricsContainer.Add("extension.buffer.expired", float64(buffer.Expired))
+		metricsContainer.Add("extension.buffer.bytes", float64(buffer.Bytes))
+		metricsContainer.Add("extension.buffer.metadata_bytes", float64(buffer.MetadataBytes))
+		metricsContainer.Add("extension.buffer.high_watermark_bytes", float64(buffer.HighWatermarkBytes))
+		if buffer.SpilledBytes > 0 {
+			metricsContainer.Add("extension.buffer.spilled_bytes", float64(buffer.SpilledBytes))
+		}
+	}
+
+	for reason, stats := range extras.drops {
+		prefix := "extension.dropped." + string(reason)
+		metricsContainer.Add(prefix+".payloads", float64(stats.Payloads))
+		metricsContainer.Add(prefix+".bytes", float64(stats.Bytes))
+		metricsContainer.Add(prefix+".transactions", float64(stats.Events.Transactions))
+		metricsContainer.Add(prefix+".spans", float64(stats.Events.Spans))
+		metricsContainer.Add(prefix+".errors", float64(stats.Events.Errors))
+	}
+
+	if extras.readTimeouts != nil {
+		metricsContainer.Add("extension.logs_api.read_timeouts", float64(*extras.readTimeouts))
+	}
+
+	if extras.logsLag != nil {
+		metricsContainer.Add("extension.logs_api.lag.max", float64(extras.logsLag.Max.Microseconds())/1e3) // Unit : Milliseconds
+		metricsContainer.Add("extension.logs_api.lag.exceeded", float64(extras.logsLag.Exceeded))
+	}
+
+	if ackLatency != nil && ackLatency.Count > 0 {
+		metricsContainer.Add("extension.ack_latency.avg", float64(ackLatency.Avg().Microseconds())/1e3) // Unit : Milliseconds
+		metricsContainer.Add("extension.ack_latency.max", float64(ackLatency.Max.Microseconds())/1e3)   // Unit : Milliseconds
+	}
 
 	var jsonWriter fastjson.Writer
 	if err := metricsContainer.MarshalFastJSON(&jsonWriter); err != nil {
@@ -73,7 +73,7 @@ func Test_processPlatformReportColdstart(t *testing.T) {
 
 	desiredOutputMetadata := fmt.Sprintf(`{"metadata":{"service":{"agent":{"name":"apm-lambda-extension","version":"%s"},"framework":{"name":"AWS Lambda","version":""},"language":{"name":"python","version":"3.9.8"},"runtime":{"name":"","version":""},"node":{}},"user":{},"process":{"pid":0},"system":{"container":{"id":""},"kubernetes":{"node":{},"pod":{}}},"cloud":{"provider":"","instance":{},"machine":{},"account":{},"project":{},"service":{}}}}`, extension.Version)
 
-	desiredOutputMetrics := fmt.Sprintf(`{"metricset":{"samples":{"faas.coldstart_duration":{"value":422.9700012207031},"faas.timeout":{"value":5000},"system.memory.total":{"value":1.34217728e+08},"system.memory.actual.free":{"value":5.4525952e+07},"faas.duration":{"value":182.42999267578125},"faas.billed_duration":{"value":183}},"timestamp":%d,"faas":{"coldstart":true,"execution":"6f7f0961f83442118a7af6fe80b88d56","id":"arn:aws:lambda:us-east-2:123456789012:function:custom-runtime"}}}`, timestamp.UnixNano()/1e3)
+	desiredOutputMetrics := fmt.Sprintf(`{"metricset":{"samples":{"faas.coldstart_duration":{"value":422.9700012207031},"faas.timeout":{"value":5000},"system.memory.total":{"value":1.34217728e+08},"system.memory.actual.free":{"value":5.4525952e+07},"faas.duration":{"value":182.42999267578125},"faas.billed_duration":{"value":183}},"tags":{"apm_lambda_extension_commit":"%s","apm_lambda_extension_version":"%s"},"timestamp":%d,"faas":{"coldstart":true,"execution":"6f7f0961f83442118a7af6fe80b88d56","id":"arn:aws:lambda:us-east-2:123456789012:function:custom-runtime"}}}`, extension.Commit, extension.Version, timestamp.UnixNano()/1e3)
 
 	rawBytes, err := ProcessPlatformReport(&mc, &event, logEvent)
 	require.NoError(t, err)
@@ -133,7 +133,7 @@ func Test_processPlatformReportNoColdstart(t *testing.T) {
 
 	desiredOutputMetadata := fmt.Sprintf(`{"metadata":{"service":{"agent":{"name":"apm-lambda-extension","version":"%s"},"framework":{"name":"AWS Lambda","version":""},"language":{"name":"python","version":"3.9.8"},"runtime":{"name":"","version":""},"node":{}},"user":{},"process":{"pid":0},"system":{"container":{"id":""},"kubernetes":{"node":{},"pod":{}}},"cloud":{"provider":"","instance":{},"machine":{},"account":{},"project":{},"service":{}}}}`, extension.Version)
 
-	desiredOutputMetrics := fmt.Sprintf(`{"metricset":{"samples":{"faas.coldstart_duration":{"value":0},"faas.timeout":{"value":5000},"system.memory.total":{"value":1.34217728e+08},"system.memory.actual.free":{"value":5.4525952e+07},"faas.duration":{"value":182.42999267578125},"faas.billed_duration":{"value":183}},"timestamp":%d,"faas":{"coldstart":false,"execution":"6f7f0961f83442118a7af6fe80b88d56","id":"arn:aws:lambda:us-east-2:123456789012:function:custom-runtime"}}}`, timestamp.UnixNano()/1e3)
+	desiredOutputMetrics := fmt.Sprintf(`{"metricset":{"samples":{"faas.coldstart_duration":{"value":0},"faas.timeout":{"value":5000},"system.memory.total":{"value":1.34217728e+08},"system.memory.actual.free":{"value":5.4525952e+07},"faas.duration":{"value":182.42999267578125},"faas.billed_duration":{"value":183}},"tags":{"apm_lambda_extension_commit":"%s","apm_lambda_extension_version":"%s"},"timestamp":%d,"faas":{"coldstart":false,"execution":"6f7f0961f83442118a7af6fe80b88d56","id":"arn:aws:lambda:us-east-2:123456789012:function:custom-runtime"}}}`, extension.Commit, extension.Version, timestamp.UnixNano()/1e3)
 
 	rawBytes, err := ProcessPlatformReport(&mc, &event, logEvent)
 	require.NoError(t, err)
@@ -149,3 +149,230 @@ func Test_processPlatformReportNoColdstart(t *testing.T) {
 	assert.JSONEq(t, desiredOutputMetadata, processingResult[0])
 	assert.JSONEq(t, desiredOutputMetrics, processingResult[1])
 }
+
+func Test_processPlatformReportCostEstimation(t *testing.T) {
+	timestamp := time.Now()
+
+	logEvent := LogEvent{
+		Time: timestamp,
+		Type: "platform.report",
+		Record: LogEventRecord{
+			RequestID: "6f7f0961f83442118a7af6fe80b88d56",
+			Status:    "Available",
+			Metrics: PlatformMetrics{
+				DurationMs:       182.43,
+				BilledDurationMs: 1000,
+				MemorySizeMB:     2048,
+				MaxMemoryUsedMB:  76,
+			},
+		},
+	}
+
+	event := extension.NextEventResponse{
+		Timestamp:          timestamp,
+		EventType:          extension.Invoke,
+		DeadlineMs:         timestamp.UnixNano()/1e6 + 4584, // Milliseconds
+		RequestID:          "8476a536-e9f4-11e8-9739-2dfe598c3fcd",
+		InvokedFunctionArn: "arn:aws:lambda:us-east-2:123456789012:function:custom-runtime",
+	}
+
+	pricing := Pricing{GBSecond: 0.5, Request: 0.25}
+	rawBytes, err := processPlatformReport(&apmproxy.MetadataContainer{}, &event, logEvent, reportExtras{pricing: &pricing})
+	require.NoError(t, err)
+	assert.Contains(t, string(rawBytes.Data), `"faas.estimated_cost":{"value":1.25}`)
+
+	rawBytes, err = processPlatformReport(&apmproxy.MetadataContainer{}, &event, logEvent, reportExtras{})
+	require.NoError(t, err)
+	assert.NotContains(t, string(rawBytes.Data), "faas.estimated_cost")
+}
+
+func Test_processPlatformReportEnvironment(t *testing.T) {
+	timestamp := time.Now()
+
+	logEvent := LogEvent{
+		Time: timestamp,
+		Type: "platform.report",
+		Record: LogEventRecord{
+			RequestID: "6f7f0961f83442118a7af6fe80b88d56",
+			Metrics: PlatformMetrics{
+				DurationMs:       182.43,
+				BilledDurationMs: 183,
+				MemorySizeMB:     128,
+				MaxMemoryUsedMB:  76,
+			},
+		},
+	}
+
+	event := extension.NextEventResponse{
+		Timestamp:          timestamp,
+		EventType:          extension.Invoke,
+		DeadlineMs:         timestamp.UnixNano()/1e6 + 4584, // Milliseconds
+		RequestID:          "8476a536-e9f4-11e8-9739-2dfe598c3fcd",
+		InvokedFunctionArn: "arn:aws:lambda:us-east-2:123456789012:function:custom-runtime",
+	}
+
+	env := environmentStats{Instance: "2022/09/01/[$LATEST]8f2d6c3e", InitializationType: extension.SnapStart, Invocations: 12, Age: 90 * time.Second, Thaws: 4}
+	rawBytes, err := processPlatformReport(&apmproxy.MetadataContainer{}, &event, logEvent, reportExtras{env: &env})
+	require.NoError(t, err)
+	assert.Contains(t, string(rawBytes.Data), `"faas.environment.invocations":{"value":12}`)
+	assert.Contains(t, string(rawBytes.Data), `"faas.environment.age":{"value":90000}`)
+	assert.Contains(t, string(rawBytes.Data), `"faas.environment.thaws":{"value":4}`)
+	assert.Contains(t, string(rawBytes.Data), `"faas_initialization_type":"snap-start","faas_instance":"2022/09/01/[$LATEST]8f2d6c3e"`)
+}
+
+func Test_processPlatformReportTelemetryAPI(t *testing.T) {
+	timestamp := time.Now()
+
+	logEvent := LogEvent{
+		Time: timestamp,
+		Type: "platform.report",
+		Record: LogEventRecord{
+			RequestID: "6f7f0961f83442118a7af6fe80b88d56",
+			Metrics: PlatformMetrics{
+				DurationMs:        182.43,
+				BilledDurationMs:  183,
+				MemorySizeMB:      128,
+				MaxMemoryUsedMB:   76,
+				RestoreDurationMs: 312.5,
+			},
+		},
+	}
+
+	event := extension.NextEventResponse{
+		Timestamp:          timestamp,
+		EventType:          extension.Invoke,
+		DeadlineMs:         timestamp.UnixNano()/1e6 + 4584, // Milliseconds
+		RequestID:          "8476a536-e9f4-11e8-9739-2dfe598c3fcd",
+		InvokedFunctionArn: "arn:aws:lambda:us-east-2:123456789012:function:custom-runtime",
+	}
+
+	env := environmentStats{InitDuration: 125500 * time.Microsecond}
+	spans := []Span{
+		{Name: "responseLatency", DurationMs: 23.5},
+		{Name: "responseDuration", DurationMs: 20},
+		{Name: "extensionOverhead", DurationMs: 1},
+	}
+	rawBytes, err := processPlatformReport(&apmproxy.MetadataContainer{}, &event, logEvent, reportExtras{env: &env, spans: spans})
+	require.NoError(t, err)
+	assert.Contains(t, string(rawBytes.Data), `"coldstart":true`)
+	assert.Contains(t, string(rawBytes.Data), `"faas.restore_duration":{"value":312.5}`)
+	assert.Contains(t, string(rawBytes.Data), `"faas.response_latency":{"value":23.5}`)
+	assert.Contains(t, string(rawBytes.Data), `"faas.response_duration":{"value":20}`)
+	assert.Contains(t, string(rawBytes.Data), `"faas.environment.init_duration":{"value":125.5}`)
+	assert.NotContains(t, string(rawBytes.Data), "overhead")
+}
+
+func Test_processPlatformReportSelfMetrics(t *testing.T) {
+	timestamp := time.Now()
+
+	logEvent := LogEvent{
+		Time: timestamp,
+		Type: "platform.report",
+		Record: LogEventRecord{
+			RequestID: "6f7f0961f83442118a7af6fe80b88d56",
+			Metrics: PlatformMetrics{
+				DurationMs:       182.43,
+				BilledDurationMs: 183,
+				MemorySizeMB:     128,
+				MaxMemoryUsedMB:  76,
+			},
+		},
+	}
+
+	event := extension.NextEventResponse{
+		Timestamp:          timestamp,
+		EventType:          extension.Invoke,
+		DeadlineMs:         timestamp.UnixNano()/1e6 + 4584, // Milliseconds
+		RequestID:          "8476a536-e9f4-11e8-9739-2dfe598c3fcd",
+		InvokedFunctionArn: "arn:aws:lambda:us-east-2:123456789012:function:custom-runtime",
+	}
+
+	buffer := apmproxy.BufferStats{Depth: 3, Capacity: 100, HighWatermark: 42, Dropped: 2, Evicted: 1, Bytes: 2048, MetadataBytes: 256, HighWatermarkBytes: 4096}
+	ackLatency := apmproxy.AckLatency{Count: 2, Sum: 300 * time.Millisecond, Max: 250 * time.Millisecond}
+	readTimeouts := int64(3)
+	drops := apmproxy.DropCounts{
+		apmproxy.DropSendFailed: {Payloads: 2, Bytes: 512, Events: apmproxy.EventCounts{Transactions: 1, Spans: 4}},
+		apmproxy.DropBufferFull: {Payloads: 1, Bytes: 128, Events: apmproxy.EventCounts{Errors: 1}},
+	}
+	rawBytes, err := processPlatformReport(&apmproxy.MetadataContainer{}, &event, logEvent, reportExtras{buffer: &buffer, ackLatency: &ackLatency, readTimeouts: &readTimeouts, drops: drops, portCollisions: []string{"logs_api"}, logsLag: &logsLag{Max: 1500 * time.Millisecond, Exceeded: 2}})
+	require.NoError(t, err)
+	assert.Contains(t, string(rawBytes.Data), `"extension_dropped_data":"buffer_full,send_failed","extension_port_collisions":"logs_api"`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.logs_api.lag.max":{"value":1500}`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.logs_api.lag.exceeded":{"value":2}`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.dropped.send_failed.payloads":{"value":2}`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.dropped.send_failed.bytes":{"value":512}`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.dropped.send_failed.transactions":{"value":1}`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.dropped.send_failed.spans":{"value":4}`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.dropped.buffer_full.errors":{"value":1}`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.buffer.depth":{"value":3}`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.buffer.capacity":{"value":100}`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.buffer.high_watermark":{"value":42}`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.buffer.dropped":{"value":2}`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.buffer.evicted":{"value":1}`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.buffer.bytes":{"value":2048}`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.buffer.metadata_bytes":{"value":256}`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.buffer.high_watermark_bytes":{"value":4096}`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.ack_latency.avg":{"value":150}`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.ack_latency.max":{"value":250}`)
+	assert.Contains(t, string(rawBytes.Data), `"extension.logs_api.read_timeouts":{"value":3}`)
+}
+
+func Test_processPlatformReportClockJump(t *testing.T) {
+	start := time.Now()
+
+	logEvent := LogEvent{
+		Time: start.Add(200 * time.Millisecond),
+		Type: "platform.report",
+		Record: LogEventRecord{
+			RequestID: "6f7f0961f83442118a7af6fe80b88d56",
+		},
+	}
+
+	// The clock of the extension lagged 10s behind after the thaw
+	event := extension.NextEventResponse{
+		Timestamp:          start.Add(-10 * time.Second),
+		EventType:          extension.Invoke,
+		DeadlineMs:         start.UnixMilli() + 4990, // Milliseconds
+		RequestID:          "6f7f0961f83442118a7af6fe80b88d56",
+		InvokedFunctionArn: "arn:aws:lambda:us-east-2:123456789012:function:custom-runtime",
+	}
+
+	rawBytes, err := processPlatformReport(&apmproxy.MetadataContainer{}, &event, logEvent, reportExtras{start: start})
+	require.NoError(t, err)
+	assert.Contains(t, string(rawBytes.Data), `"faas.timeout":{"value":5000}`)
+
+	// Without the platform start, the timeout is never negative
+	event.Timestamp = start.Add(time.Minute)
+	rawBytes, err = processPlatformReport(&apmproxy.MetadataContainer{}, &event, logEvent, reportExtras{})
+	require.NoError(t, err)
+	assert.Contains(t, string(rawBytes.Data), `"faas.timeout":{"value":0}`)
+}
+
+func Test_processPlatformReportTraceID(t *testing.T) {
+	logEvent := LogEvent{
+		Time: time.Now(),
+		Type: "platform.report",
+		Record: LogEventRecord{
+			RequestID: "6f7f0961f83442118a7af6fe80b88d56",
+			Metrics: PlatformMetrics{
+				DurationMs:       182.43,
+				BilledDurationMs: 183,
+				MemorySizeMB:     128,
+				MaxMemoryUsedMB:  76,
+			},
+		},
+	}
+	event := extension.NextEventResponse{
+		Timestamp: time.Now(),
+		RequestID: "6f7f0961f83442118a7af6fe80b88d56",
+		Tracing: extension.Tracing{
+			Type:  "X-Amzn-Trace-Id",
+			Value: "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1",
+		},
+	}
+
+	rawBytes, err := processPlatformReport(&apmproxy.MetadataContainer{}, &event, logEvent, reportExtras{})
+	require.NoError(t, err)
+	assert.Contains(t, string(rawBytes.Data), `"trace_id":"5759e988bd862e3fe1be46a994272793"`)
+	assert.Contains(t, string(rawBytes.Data), `"execution":"6f7f0961f83442118a7af6fe80b88d56"`)
+}
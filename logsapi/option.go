@@ -17,7 +17,11 @@
 
 package logsapi
 
-import "go.uber.org/zap"
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
 
 // WithListenerAddress sets the listener address of the
 // server listening for logs event.
@@ -27,6 +31,31 @@ func WithListenerAddress(s string) ClientOption {
 	}
 }
 
+// WithServerTimeout sets the read and write timeouts of the
+// server listening for logs event.
+func WithServerTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.server.ReadTimeout = timeout
+		c.server.WriteTimeout = timeout
+	}
+}
+
+// WithServerMaxHeaderBytes sets the maximum size of the request
+// headers of the server listening for logs event.
+func WithServerMaxHeaderBytes(size int) ClientOption {
+	return func(c *Client) {
+		c.server.MaxHeaderBytes = size
+	}
+}
+
+// WithForceIPv4 restricts the server listening for logs
+// event to IPv4.
+func WithForceIPv4() ClientOption {
+	return func(c *Client) {
+		c.forceIPv4 = true
+	}
+}
+
 // WithLogsAPIBaseURL sets the logs api base url.
 func WithLogsAPIBaseURL(s string) ClientOption {
 	return func(c *Client) {
@@ -34,6 +63,26 @@ func WithLogsAPIBaseURL(s string) ClientOption {
 	}
 }
 
+// WithTelemetryAPI subscribes the client to the Telemetry API instead
+// of the Logs API. The Telemetry API delivers the records of the Logs
+// API along with records describing the initialization and restoration
+// of the environment, and the phases of the invocations.
+func WithTelemetryAPI() ClientOption {
+	return func(c *Client) {
+		c.telemetryAPI = true
+	}
+}
+
+// WithLagThreshold sets the lag between the emission of the platform
+// records and their delivery above which the listener is considered not
+// keeping up with the Logs API: warnings are logged and the buffering of
+// the Logs API is increased. A threshold of 0 disables them.
+func WithLagThreshold(threshold time.Duration) ClientOption {
+	return func(c *Client) {
+		c.lagThreshold = threshold
+	}
+}
+
 // WithLogBuffer sets the size of the buffer
 // storing queued logs for processing.
 func WithLogBuffer(size int) ClientOption {
@@ -48,3 +97,85 @@ func WithLogger(logger *zap.SugaredLogger) ClientOption {
 		c.logger = logger
 	}
 }
+
+// WithCostEstimation enables the estimation of the cost of each
+// invocation, reported along with the platform metrics.
+func WithCostEstimation(pricing Pricing) ClientOption {
+	return func(c *Client) {
+		c.pricing = &pricing
+	}
+}
+
+// WithMetadataFallback sets the behavior applied to the data generated
+// by the extension when no agent sent metadata.
+func WithMetadataFallback(fallback MetadataFallback) ClientOption {
+	return func(c *Client) {
+		c.metadataFallback = fallback
+	}
+}
+
+// WithCrashReporting enables the creation of error events from the
+// crashes of the function found in its logs. The client must be
+// subscribed to the function logs.
+func WithCrashReporting() ClientOption {
+	return func(c *Client) {
+		c.crashReporting = true
+	}
+}
+
+// WithPowertoolsLogs enables the forwarding of the structured logs of the
+// function written by the AWS Lambda Powertools loggers as log events,
+// correlated with the invocations and traces. The client must be
+// subscribed to the function logs.
+func WithPowertoolsLogs() ClientOption {
+	return func(c *Client) {
+		c.powertoolsLogs = true
+	}
+}
+
+// WithFunctionLogs enables the forwarding of the function logs as log
+// events, correlated with the invocations and traces. The Powertools
+// logs are forwarded with their structure if WithPowertoolsLogs is
+// also set. The client must be subscribed to the function logs.
+func WithFunctionLogs() ClientOption {
+	return func(c *Client) {
+		c.functionLogs = true
+	}
+}
+
+// WithTraceContextInjection enables the injection of the trace ID of the
+// invocation into the JSON function logs lacking trace context, when the
+// invocation is known, so that they are correlated with the traces. It
+// applies to the function logs forwarded to the tee endpoint and to the
+// Powertools logs.
+func WithTraceContextInjection() ClientOption {
+	return func(c *Client) {
+		c.traceContext = true
+	}
+}
+
+// WithOTelAttributes enables the dual-writing of the attributes of the
+// OpenTelemetry semantic conventions along with the ECS fields, as labels
+// of the events created by the extension.
+func WithOTelAttributes() ClientOption {
+	return func(c *Client) {
+		c.otelResource = otelResource()
+	}
+}
+
+// WithTee enables the forwarding of the batches of records delivered by
+// the Logs API, unmodified, to an HTTP endpoint.
+func WithTee(tee Tee) ClientOption {
+	return func(c *Client) {
+		c.teeConfig = &tee
+	}
+}
+
+// WithControlHandler sets the function called with the control records
+// logged by the function to change settings at runtime. The client must
+// be subscribed to the function logs.
+func WithControlHandler(handler func(ControlRecord)) ClientOption {
+	return func(c *Client) {
+		c.controlHandler = handler
+	}
+}
@@ -0,0 +1,71 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"os"
+	"strconv"
+)
+
+// otelResource returns the attributes of the OpenTelemetry semantic
+// conventions describing the function, detected from the environment
+// as the OpenTelemetry Lambda resource detector does.
+func otelResource() map[string]string {
+	attributes := map[string]string{
+		"cloud.provider": "aws",
+		"cloud.platform": "aws_lambda",
+	}
+	for attribute, env := range map[string]string{
+		"cloud.region":         "AWS_REGION",
+		"faas.name":            "AWS_LAMBDA_FUNCTION_NAME",
+		"faas.version":         "AWS_LAMBDA_FUNCTION_VERSION",
+		"faas.instance":        "AWS_LAMBDA_LOG_STREAM_NAME",
+		"aws.log.group.names":  "AWS_LAMBDA_LOG_GROUP_NAME",
+		"aws.log.stream.names": "AWS_LAMBDA_LOG_STREAM_NAME",
+	} {
+		if value := os.Getenv(env); value != "" {
+			attributes[attribute] = value
+		}
+	}
+	// The memory is configured in MiB, the attribute is in bytes.
+	if mb, err := strconv.ParseInt(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"), 10, 64); err == nil {
+		attributes["faas.max_memory"] = strconv.FormatInt(mb*1024*1024, 10)
+	}
+	return attributes
+}
+
+// otelAttributes returns the OpenTelemetry attributes of the events created
+// by the extension for the invocation of the given request ID, to dual-write
+// along with the ECS fields, or nil if disabled.
+func (lc *Client) otelAttributes(requestID string) map[string]string {
+	if lc.otelResource == nil {
+		return nil
+	}
+	attributes := make(map[string]string, len(lc.otelResource)+2)
+	for k, v := range lc.otelResource {
+		attributes[k] = v
+	}
+	if requestID == "" {
+		return attributes
+	}
+	attributes["faas.invocation_id"] = requestID
+	if inv, ok := lc.invocations.lookup(requestID); ok && inv.InvokedFunctionArn != "" {
+		attributes["aws.lambda.invoked_arn"] = inv.InvokedFunctionArn
+	}
+	return attributes
+}
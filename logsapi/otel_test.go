@@ -0,0 +1,101 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+	"github.com/elastic/apm-aws-lambda/extension"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestOTelAttributes(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "foo")
+	t.Setenv("AWS_LAMBDA_FUNCTION_VERSION", "$LATEST")
+	t.Setenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE", "128")
+	t.Setenv("AWS_LAMBDA_LOG_GROUP_NAME", "/aws/lambda/foo")
+	t.Setenv("AWS_LAMBDA_LOG_STREAM_NAME", "2022/09/01/[$LATEST]8f2d6c3e")
+
+	lc, err := NewClient(WithLogsAPIBaseURL("http://example.com"), WithLogger(zaptest.NewLogger(t).Sugar()), WithOTelAttributes())
+	require.NoError(t, err)
+	lc.RegisterInvocation(&extension.NextEventResponse{RequestID: "1", InvokedFunctionArn: "arn:aws:lambda:eu-west-1:123456789012:function:foo"})
+
+	assert.Equal(t, map[string]string{
+		"cloud.provider":         "aws",
+		"cloud.platform":         "aws_lambda",
+		"cloud.region":           "eu-west-1",
+		"faas.name":              "foo",
+		"faas.version":           "$LATEST",
+		"faas.instance":          "2022/09/01/[$LATEST]8f2d6c3e",
+		"faas.max_memory":        "134217728",
+		"faas.invocation_id":     "1",
+		"aws.log.group.names":    "/aws/lambda/foo",
+		"aws.log.stream.names":   "2022/09/01/[$LATEST]8f2d6c3e",
+		"aws.lambda.invoked_arn": "arn:aws:lambda:eu-west-1:123456789012:function:foo",
+	}, lc.otelAttributes("1"))
+
+	// Unknown invocations only get the request ID.
+	attributes := lc.otelAttributes("2")
+	assert.Equal(t, "2", attributes["faas.invocation_id"])
+	assert.NotContains(t, attributes, "aws.lambda.invoked_arn")
+
+	// The attributes are dual-written as labels.
+	l := powertoolsLog{Level: "INFO", Message: json.RawMessage(`"hello"`), CorrelationID: "abc"}
+	event, err := l.logEvent(time.Now(), "1", lc.otelAttributes("1"))
+	require.NoError(t, err)
+	var e struct {
+		Log struct {
+			FaaS struct {
+				Execution string `json:"execution"`
+			} `json:"faas"`
+			Labels map[string]string `json:"labels"`
+		} `json:"log"`
+	}
+	require.NoError(t, json.Unmarshal(event, &e))
+	assert.Equal(t, "1", e.Log.FaaS.Execution)
+	assert.Equal(t, "1", e.Log.Labels["faas.invocation_id"])
+	assert.Equal(t, "abc", e.Log.Labels["correlation_id"])
+}
+
+func TestOTelAttributesDisabled(t *testing.T) {
+	lc, err := NewClient(WithLogsAPIBaseURL("http://example.com"), WithLogger(zaptest.NewLogger(t).Sugar()))
+	require.NoError(t, err)
+	assert.Nil(t, lc.otelAttributes("1"))
+}
+
+func TestOTelAttributesPlatformMetrics(t *testing.T) {
+	logEvent := LogEvent{
+		Time:   time.Now(),
+		Type:   "platform.report",
+		Record: LogEventRecord{RequestID: "1"},
+	}
+	event := extension.NextEventResponse{RequestID: "1"}
+	rawBytes, err := processPlatformReport(&apmproxy.MetadataContainer{}, &event, logEvent, reportExtras{
+		otelAttributes: map[string]string{"faas.invocation_id": "1", "cloud.provider": "aws"},
+	})
+	require.NoError(t, err)
+	// Labels are sorted.
+	assert.Contains(t, string(rawBytes.Data), `"tags":{"apm_lambda_extension_commit":"unknown","apm_lambda_extension_version":"`+extension.Version+`","cloud.provider":"aws","faas.invocation_id":"1"}`)
+}
@@ -0,0 +1,169 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// powertoolsTimeLayouts are the layouts of the timestamps of the
+// Powertools loggers: Python uses its logging format by default,
+// TypeScript an RFC 3339 timestamp.
+var powertoolsTimeLayouts = []string{
+	"2006-01-02 15:04:05,000-0700",
+	"2006-01-02 15:04:05,000Z0700",
+	time.RFC3339Nano,
+}
+
+// powertoolsLog is a structured log record of the AWS Lambda Powertools
+// loggers for Python and TypeScript.
+type powertoolsLog struct {
+	Level string `json:"level"`
+	// Message is a string, or any JSON value logged as a message.
+	Message            json.RawMessage `json:"message"`
+	Timestamp          string          `json:"timestamp"`
+	Service            string          `json:"service"`
+	Location           string          `json:"location"`
+	ColdStart          *bool           `json:"cold_start"`
+	FunctionName       string          `json:"function_name"`
+	FunctionRequestID  string          `json:"function_request_id"`
+	XRayTraceID        string          `json:"xray_trace_id"`
+	CorrelationID      string          `json:"correlation_id"`
+	FunctionARN        string          `json:"function_arn"`
+	FunctionMemorySize int             `json:"function_memory_size"`
+}
+
+// parsePowertoolsLog parses a function log record written by a Powertools
+// logger. It returns false if the record is not a Powertools log.
+func parsePowertoolsLog(t time.Time, record string) (powertoolsLog, time.Time, bool) {
+	record = strings.TrimSpace(record)
+	if !strings.HasPrefix(record, "{") {
+		return powertoolsLog{}, time.Time{}, false
+	}
+
+	var l powertoolsLog
+	if err := json.Unmarshal([]byte(record), &l); err != nil {
+		return powertoolsLog{}, time.Time{}, false
+	}
+	// The level, message and service are always logged, the fields of
+	// the Lambda context only when it is injected in the logger.
+	if l.Level == "" || l.Service == "" || len(l.Message) == 0 {
+		return powertoolsLog{}, time.Time{}, false
+	}
+	if l.FunctionRequestID == "" && l.XRayTraceID == "" && l.ColdStart == nil && l.Location == "" {
+		return powertoolsLog{}, time.Time{}, false
+	}
+
+	for _, layout := range powertoolsTimeLayouts {
+		if ts, err := time.Parse(layout, l.Timestamp); err == nil {
+			t = ts
+			break
+		}
+	}
+	return l, t, true
+}
+
+// xrayTraceID returns the trace ID in the W3C format of an X-Ray trace ID,
+// e.g. "1-5759e988-bd862e3fe1be46a994272793", as propagated by the X-Ray
+// propagators of OpenTelemetry, or an empty string if it is not valid.
+func xrayTraceID(id string) string {
+	parts := strings.Split(id, "-")
+	if len(parts) != 3 || parts[0] != "1" || len(parts[1]) != 8 || len(parts[2]) != 24 {
+		return ""
+	}
+	traceID := strings.ToLower(parts[1] + parts[2])
+	for _, r := range traceID {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return ""
+		}
+	}
+	return traceID
+}
+
+// logEvent returns the APM log event of the Powertools log, its fields
+// mapped to ECS, correlated with the invocation of the given request ID
+// if the log does not tell it. The attributes are added as labels.
+func (l powertoolsLog) logEvent(t time.Time, requestID string, attributes map[string]string) ([]byte, error) {
+	type file struct {
+		Name string `json:"name,omitempty"`
+		Line int    `json:"line,omitempty"`
+	}
+	type origin struct {
+		Function string `json:"function,omitempty"`
+		File     *file  `json:"file,omitempty"`
+	}
+	type faas struct {
+		Execution string `json:"execution,omitempty"`
+		Coldstart *bool  `json:"coldstart,omitempty"`
+		Name      string `json:"name,omitempty"`
+		ID        string `json:"id,omitempty"`
+	}
+	var event struct {
+		Log struct {
+			Timestamp int64  `json:"timestamp"`
+			Message   string `json:"message"`
+			TraceID   string `json:"trace_id,omitempty"`
+			Log       struct {
+				Level  string  `json:"level"`
+				Logger string  `json:"logger"`
+				Origin *origin `json:"origin,omitempty"`
+			} `json:"log"`
+			Service struct {
+				Name string `json:"name"`
+			} `json:"service"`
+			FaaS   faas              `json:"faas"`
+			Labels map[string]string `json:"labels,omitempty"`
+		} `json:"log"`
+	}
+
+	e := &event.Log
+	e.Timestamp = t.UnixMicro()
+	if err := json.Unmarshal(l.Message, &e.Message); err != nil {
+		e.Message = string(l.Message)
+	}
+	e.TraceID = xrayTraceID(l.XRayTraceID)
+	e.Log.Level = strings.ToLower(l.Level)
+	e.Log.Logger = "powertools"
+	e.Service.Name = l.Service
+	e.FaaS = faas{Execution: l.FunctionRequestID, Coldstart: l.ColdStart, Name: l.FunctionName, ID: l.FunctionARN}
+	if e.FaaS.Execution == "" {
+		e.FaaS.Execution = requestID
+	}
+
+	// Python logs the location as "module.function:line".
+	if function, line, found := strings.Cut(l.Location, ":"); found {
+		o := &origin{Function: function}
+		if n, err := strconv.Atoi(line); err == nil {
+			o.File = &file{Line: n}
+		}
+		e.Log.Origin = o
+	}
+	if l.CorrelationID != "" || len(attributes) > 0 {
+		e.Labels = make(map[string]string, len(attributes)+1)
+		for k, v := range attributes {
+			e.Labels[k] = v
+		}
+		if l.CorrelationID != "" {
+			e.Labels["correlation_id"] = l.CorrelationID
+		}
+	}
+	return json.Marshal(event)
+}
@@ -0,0 +1,136 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+const (
+	powertoolsPythonLog     = `{"level":"INFO","location":"collect.handler:7","message":"Collecting payment","timestamp":"2021-05-03 11:47:12,494+0200","service":"payment","cold_start":true,"function_name":"test","function_memory_size":128,"function_arn":"arn:aws:lambda:eu-west-1:12345678910:function:test","function_request_id":"52fdfc07-2182-154f-163f-5f0f9a621d72","xray_trace_id":"1-5759e988-bd862e3fe1be46a994272793","correlation_id":"correlation_id_value"}`
+	powertoolsTypeScriptLog = `{"cold_start":false,"function_arn":"arn:aws:lambda:eu-west-1:123456789012:function:shopping-cart-api-lambda-prod-eu-west-1","function_memory_size":128,"function_request_id":"c6af9ac6-7b61-11e6-9a41-93e812345678","function_name":"shopping-cart-api-lambda-prod-eu-west-1","level":"WARN","message":{"cart":"empty"},"service":"serverlessAirline","timestamp":"2021-12-12T21:21:08.921Z","xray_trace_id":"abcdef123456abcdef123456abcdef123456"}`
+)
+
+func TestParsePowertoolsLog(t *testing.T) {
+	now := time.Now()
+	for name, tc := range map[string]struct {
+		record   string
+		expected map[string]interface{}
+	}{
+		"python": {
+			record: powertoolsPythonLog,
+			expected: map[string]interface{}{
+				"timestamp": float64(1620035232494000),
+				"message":   "Collecting payment",
+				"trace_id":  "5759e988bd862e3fe1be46a994272793",
+				"log": map[string]interface{}{
+					"level":  "info",
+					"logger": "powertools",
+					"origin": map[string]interface{}{"function": "collect.handler", "file": map[string]interface{}{"line": float64(7)}},
+				},
+				"service": map[string]interface{}{"name": "payment"},
+				"faas": map[string]interface{}{
+					"execution": "52fdfc07-2182-154f-163f-5f0f9a621d72",
+					"coldstart": true,
+					"name":      "test",
+					"id":        "arn:aws:lambda:eu-west-1:12345678910:function:test",
+				},
+				"labels": map[string]interface{}{"correlation_id": "correlation_id_value"},
+			},
+		},
+		"typescript": {
+			record: powertoolsTypeScriptLog,
+			expected: map[string]interface{}{
+				"timestamp": float64(1639344068921000),
+				"message":   `{"cart":"empty"}`,
+				"log":       map[string]interface{}{"level": "warn", "logger": "powertools"},
+				"service":   map[string]interface{}{"name": "serverlessAirline"},
+				"faas": map[string]interface{}{
+					"execution": "c6af9ac6-7b61-11e6-9a41-93e812345678",
+					"coldstart": false,
+					"name":      "shopping-cart-api-lambda-prod-eu-west-1",
+					"id":        "arn:aws:lambda:eu-west-1:123456789012:function:shopping-cart-api-lambda-prod-eu-west-1",
+				},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			l, ts, ok := parsePowertoolsLog(now, tc.record)
+			require.True(t, ok)
+			event, err := l.logEvent(ts, "current", nil)
+			require.NoError(t, err)
+
+			var e map[string]map[string]interface{}
+			require.NoError(t, json.Unmarshal(event, &e))
+			assert.Equal(t, tc.expected, e["log"])
+		})
+	}
+
+	for name, record := range map[string]string{
+		"plain text":      "START RequestId: 1 Version: $LATEST",
+		"invalid json":    `{"level":`,
+		"other json":      `{"msg":"hello","level":"info"}`,
+		"no lambda field": `{"level":"INFO","message":"hello","service":"payment","timestamp":"2021-12-12T21:21:08.921Z"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, ok := parsePowertoolsLog(now, record)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestXRayTraceID(t *testing.T) {
+	assert.Equal(t, "5759e988bd862e3fe1be46a994272793", xrayTraceID("1-5759e988-bd862e3fe1be46a994272793"))
+	assert.Empty(t, xrayTraceID("abcdef123456abcdef123456abcdef123456"))
+	assert.Empty(t, xrayTraceID("1-5759e988-bd862e3fe1be46a99427279z"))
+}
+
+func TestProcessLogsPowertools(t *testing.T) {
+	l := zaptest.NewLogger(t).Sugar()
+	lc, err := NewClient(WithLogsAPIBaseURL("http://example.com"), WithLogger(l), WithPowertoolsLogs())
+	require.NoError(t, err)
+	apmClient, err := apmproxy.NewClient(apmproxy.WithURL("http://example.com"), apmproxy.WithLogger(l))
+	require.NoError(t, err)
+
+	now := time.Now()
+	for _, e := range []LogEvent{
+		{Type: FunctionLog, Time: now, StringRecord: powertoolsPythonLog},
+		{Type: FunctionLog, Time: now, StringRecord: "not a powertools log"},
+		{Type: RuntimeDone, Time: now, Record: LogEventRecord{RequestID: "current"}},
+	} {
+		lc.logsChannel <- e
+	}
+
+	runtimeDone := make(chan struct{}, 1)
+	metadataContainer := &apmproxy.MetadataContainer{Metadata: []byte(`{"metadata":{}}`)}
+	require.NoError(t, lc.ProcessLogs(context.Background(), "current", apmClient, metadataContainer, runtimeDone, nil))
+
+	require.Len(t, apmClient.DataChannel, 1)
+	data := string((<-apmClient.DataChannel).Data)
+	assert.Contains(t, data, `{"metadata":{}}`+"\n"+`{"log":`)
+	assert.Contains(t, data, `"message":"Collecting payment"`)
+}
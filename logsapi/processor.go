@@ -0,0 +1,126 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// defaultProcessorBuffer is the number of records queued for the
+// processors, further records are dropped.
+const defaultProcessorBuffer = 1000
+
+// Processor handles the records delivered by the Logs API, e.g. to audit
+// them. Processors run in a single background worker, in registration
+// order: a slow processor delays the other processors, but never the
+// listener of the Logs API. The errors are logged.
+type Processor func(LogEvent) error
+
+// processors runs the registered processors on the records in the
+// background.
+type processors struct {
+	logger     *zap.SugaredLogger
+	mu         sync.RWMutex
+	processors []Processor
+	queue      chan LogEvent
+	done       chan struct{}
+	started    atomic.Bool
+	stopped    atomic.Bool
+	dropped    atomic.Int64
+}
+
+// RegisterProcessor registers a processor of the records delivered by
+// the Logs API, including the function logs if the client is subscribed
+// to them. Processors should be registered before the service starts,
+// the records delivered before are not processed.
+func (lc *Client) RegisterProcessor(p Processor) {
+	lc.processors.register(p)
+}
+
+// DroppedProcessorRecords returns the number of records which were not
+// processed because the processors did not keep up.
+func (lc *Client) DroppedProcessorRecords() int64 {
+	return lc.processors.dropped.Load()
+}
+
+// register adds the processor and starts the worker, once.
+func (ps *processors) register(p Processor) {
+	ps.mu.Lock()
+	ps.processors = append(ps.processors, p)
+	ps.mu.Unlock()
+
+	if !ps.started.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer close(ps.done)
+		for e := range ps.queue {
+			ps.process(e)
+		}
+	}()
+}
+
+func (ps *processors) process(e LogEvent) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	for _, p := range ps.processors {
+		if err := p(e); err != nil {
+			ps.logger.Warnf("Error processing log event %s: %v", e.Type, err)
+		}
+	}
+}
+
+// dispatch queues the records for the processors without blocking.
+func (ps *processors) dispatch(events []LogEvent) {
+	if !ps.started.Load() || ps.stopped.Load() {
+		return
+	}
+	for n, e := range events {
+		select {
+		case ps.queue <- e:
+		default:
+			dropped := len(events) - n
+			ps.dropped.Add(int64(dropped))
+			ps.logger.Warnf("Log processors queue full: dropping %d log events", dropped)
+			return
+		}
+	}
+}
+
+// stop processes the queued records until ctx is done. No record must
+// be dispatched afterwards.
+func (ps *processors) stop(ctx context.Context) error {
+	if !ps.stopped.CompareAndSwap(false, true) {
+		return nil
+	}
+	close(ps.queue)
+	if !ps.started.Load() {
+		return nil
+	}
+	select {
+	case <-ps.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to process the queued log events: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,80 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestRegisterProcessor(t *testing.T) {
+	lc, err := NewClient(WithLogsAPIBaseURL("http://example.com"), WithLogger(zaptest.NewLogger(t).Sugar()))
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var first, second []SubEventType
+	lc.RegisterProcessor(func(e LogEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		first = append(first, e.Type)
+		return errors.New("failed")
+	})
+	lc.RegisterProcessor(func(e LogEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		second = append(second, e.Type)
+		return nil
+	})
+
+	batch := []byte(`[{"time":"2020-08-20T12:31:32.123Z","type":"platform.runtimeDone","record":{"requestId":"6f7f0961f83442118a7af6fe80b88d56","status":"success"}},` +
+		` {"time":"2020-08-20T12:31:32.123Z","type":"function","record":"hello"}]`)
+	rec := httptest.NewRecorder()
+	lc.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(batch)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// The queued records are processed on shutdown, whatever the errors.
+	require.NoError(t, lc.Shutdown())
+	assert.Equal(t, []SubEventType{RuntimeDone, FunctionLog}, first)
+	assert.Equal(t, []SubEventType{RuntimeDone, FunctionLog}, second)
+	assert.Len(t, lc.logsChannel, 2)
+}
+
+func TestProcessorsQueueFull(t *testing.T) {
+	lc, err := NewClient(WithLogsAPIBaseURL("http://example.com"), WithLogger(zaptest.NewLogger(t).Sugar()))
+	require.NoError(t, err)
+
+	// A slow processor does not block the dispatch.
+	release := make(chan struct{})
+	lc.RegisterProcessor(func(e LogEvent) error {
+		<-release
+		return nil
+	})
+	events := make([]LogEvent, defaultProcessorBuffer+2)
+	lc.processors.dispatch(events)
+	assert.GreaterOrEqual(t, lc.DroppedProcessorRecords(), int64(1))
+	close(release)
+	require.NoError(t, lc.Shutdown())
+}
@@ -18,29 +18,77 @@
 package logsapi
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
+	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 )
 
-func handleLogEventsRequest(logger *zap.SugaredLogger, logsChannel chan LogEvent) func(w http.ResponseWriter, r *http.Request) {
+func handleLogEventsRequest(logger *zap.SugaredLogger, logsChannel chan LogEvent, types *recordTypes, readTimeouts *atomic.Int64, tee *teeForwarder, inject func(LogEvent) (string, bool), observe func([]LogEvent)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var logEvents []LogEvent
-		if err := json.NewDecoder(r.Body).Decode(&logEvents); err != nil {
+		// Keep a copy of the raw batch for the tee endpoint.
+		var body io.Reader = r.Body
+		var raw bytes.Buffer
+		if tee != nil {
+			body = io.TeeReader(r.Body, &raw)
+		}
+
+		// Events are decoded one by one so that an event
+		// that cannot be decoded does not drop the batch.
+		var rawEvents []json.RawMessage
+		if err := json.NewDecoder(body).Decode(&rawEvents); err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				readTimeouts.Add(1)
+				logger.Warnf("Timed out reading log events, consider increasing the Logs API server timeout: %v", err)
+				w.WriteHeader(http.StatusRequestTimeout)
+				return
+			}
 			logger.Errorf("Error unmarshalling log events: %+v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		for idx := range logEvents {
-			if logEvents[idx].Type == "" {
-				logger.Errorf("Error reading log event: %+v", logEvents[idx])
-				w.WriteHeader(http.StatusInternalServerError)
+		if tee != nil {
+			// The decoder may not have read the end of the batch.
+			if _, err := io.Copy(io.Discard, body); err != nil {
+				logger.Warnf("Failed to read the end of the log events: %v", err)
+			}
+			batch := raw.Bytes()
+			if inject != nil {
+				batch = injectBatchTraceContext(batch, rawEvents, inject)
+			}
+			tee.forward(batch)
+		}
+
+		events := make([]LogEvent, 0, len(rawEvents))
+		for _, rawEvent := range rawEvents {
+			var logEvent LogEvent
+			if err := logEvent.UnmarshalJSON(rawEvent); err != nil {
+				logger.Errorf("Error unmarshalling log event: %v", err)
 				continue
 			}
-			logsChannel <- logEvents[idx]
+
+			if logEvent.Type == "" {
+				logger.Errorf("Error reading log event: %+v", logEvent)
+				continue
+			}
+
+			if types.observe(logEvent.Type) {
+				logger.Infof("Received log events of unrecognized type %s, ignoring them", logEvent.Type)
+			}
+			logsChannel <- logEvent
+			events = append(events, logEvent)
+		}
+
+		if observe != nil {
+			observe(events)
 		}
 	}
 }
@@ -58,11 +106,15 @@ func (le *LogEvent) UnmarshalJSON(data []byte) error {
 	le.Time = b.Time
 	le.Type = b.Type
 
-	if len(b.Record) > 0 && b.Record[0] == '{' {
+	// Records of other kinds than objects and strings, possibly
+	// introduced by future versions of the API, are ignored.
+	switch {
+	case len(b.Record) == 0:
+	case b.Record[0] == '{':
 		if err := json.Unmarshal(b.Record, &(le.Record)); err != nil {
 			return err
 		}
-	} else {
+	case b.Record[0] == '"':
 		if err := json.Unmarshal(b.Record, &(le.StringRecord)); err != nil {
 			return err
 		}
@@ -18,12 +18,18 @@
 package logsapi
 
 import (
+	"bytes"
 	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 func TestLogEventUnmarshalReport(t *testing.T) {
@@ -137,3 +143,110 @@ func Test_unmarshalRuntimeDoneFaultRecordString(t *testing.T) {
 	assert.Equal(t, Fault, le.Type)
 	assert.Equal(t, "Unknown application error occurred", le.StringRecord)
 }
+
+func TestLogEventUnmarshalUnknownRecord(t *testing.T) {
+	for name, record := range map[string]string{
+		"array":  `["a"]`,
+		"number": `42`,
+		"null":   `null`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			le := new(LogEvent)
+			require.NoError(t, le.UnmarshalJSON([]byte(`{"time":"2020-08-20T12:31:32.123Z","type":"platform.future","record":`+record+`}`)))
+			assert.Equal(t, SubEventType("platform.future"), le.Type)
+			assert.Empty(t, le.StringRecord)
+			assert.Equal(t, LogEventRecord{}, le.Record)
+		})
+	}
+}
+
+func TestHandleLogEventsRequestTolerant(t *testing.T) {
+	body := `[
+		{"time":"2020-08-20T12:31:32.123Z","type":"platform.future","record":{"version":"2","newField":{}}},
+		{"time":"not a time","type":"platform.runtimeDone","record":{"requestId":"1"}},
+		{"time":"2020-08-20T12:31:32.123Z","type":"platform.future","record":[]},
+		{"time":"2020-08-20T12:31:32.123Z","type":"platform.runtimeDone","record":{"requestId":"2","status":"success","unknown":1}}
+	]`
+
+	logsChannel := make(chan LogEvent, 10)
+	types := &recordTypes{}
+	handler := handleLogEventsRequest(zap.NewNop().Sugar(), logsChannel, types, &atomic.Int64{}, nil, nil, nil)
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(body))))
+
+	require.Len(t, logsChannel, 3)
+	assert.Equal(t, SubEventType("platform.future"), (<-logsChannel).Type)
+	assert.Equal(t, SubEventType("platform.future"), (<-logsChannel).Type)
+	assert.Equal(t, "2", (<-logsChannel).Record.RequestID)
+
+	assert.Equal(t, []SubEventType{"platform.future"}, types.unrecognizedTypes())
+	assert.False(t, types.observe("platform.future"))
+	assert.False(t, types.observe(RuntimeDone))
+}
+
+func TestHandleLogEventsRequestTimeout(t *testing.T) {
+	c, err := NewClient(
+		WithLogsAPIBaseURL("http://example.com"),
+		WithListenerAddress("localhost:0"),
+		WithServerTimeout(50*time.Millisecond),
+		WithServerMaxHeaderBytes(4096),
+		WithLogger(zap.NewNop().Sugar()),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 4096, c.server.MaxHeaderBytes)
+
+	addr, err := c.startHTTPServer()
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, c.Shutdown())
+	}()
+
+	// The delivery is slower than the server timeout
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100\r\n\r\n[{"))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool { return c.ReadTimeouts() == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func FuzzLogEventUnmarshal(f *testing.F) {
+	f.Add([]byte(`{"time":"2020-08-20T12:31:32.123Z","type":"platform.report","record":{"requestId":"6f7f0961f83442118a7af6fe80b88d56","metrics":{"durationMs":101.51}}}`))
+	f.Add([]byte(`{"time":"2020-08-20T12:31:32.123Z","type":"function","record":"log line"}`))
+	f.Add([]byte(`{"record":null}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Arbitrary input must not panic.
+		le := new(LogEvent)
+		_ = le.UnmarshalJSON(data)
+	})
+}
+
+func FuzzHandleLogEventsRequest(f *testing.F) {
+	f.Add([]byte(`[{"time":"2020-08-20T12:31:32.123Z","type":"platform.runtimeDone","record":{"requestId":"6f7f0961f83442118a7af6fe80b88d56","status":"success"}}]`))
+	f.Add([]byte(`[{"type":""}]`))
+	f.Add([]byte(`{}`))
+
+	logsChannel := make(chan LogEvent, 100)
+	handler := handleLogEventsRequest(zap.NewNop().Sugar(), logsChannel, &recordTypes{}, &atomic.Int64{}, nil, nil, nil)
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		}()
+
+		// Drain the channel so that large batches do not block the handler.
+		for {
+			select {
+			case <-logsChannel:
+			case <-done:
+				for len(logsChannel) > 0 {
+					<-logsChannel
+				}
+				return
+			}
+		}
+	})
+}
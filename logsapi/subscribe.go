@@ -19,12 +19,14 @@ package logsapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"syscall"
 )
 
 // SubscribeRequest is the request body that is sent to Logs API on subscribe
@@ -41,6 +43,8 @@ type SchemaVersion string
 const (
 	SchemaVersion20210318 = "2021-03-18"
 	SchemaVersionLatest   = SchemaVersion20210318
+	// SchemaVersion20221213 is the schema version of the Telemetry API.
+	SchemaVersion20221213 = "2022-12-13"
 )
 
 // BufferingCfg is the configuration set for receiving logs from Logs API. Whichever of the conditions below is met first, the logs will be sent
@@ -61,8 +65,27 @@ type Destination struct {
 	Encoding   string `json:"encoding"`
 }
 
+// subscription holds the parameters of the subscription of the client,
+// to subscribe again with another buffering.
+type subscription struct {
+	eventTypes  []EventType
+	extensionID string
+	uri         string
+}
+
 func (lc *Client) startHTTPServer() (string, error) {
-	listener, err := net.Listen("tcp", lc.listenerAddr)
+	network := "tcp"
+	if lc.forceIPv4 {
+		network = "tcp4"
+	}
+	listener, err := net.Listen(network, lc.listenerAddr)
+	if host, port, splitErr := net.SplitHostPort(lc.listenerAddr); errors.Is(err, syscall.EADDRINUSE) && splitErr == nil && port != "0" {
+		// The port is used by another extension, e.g. of another vendor.
+		// The Logs API is given the address of the listener, so any port works.
+		lc.logger.Warnf("The Logs API listener address %s is already in use, likely by another extension, listening on another port", lc.listenerAddr)
+		lc.portCollision.Store(true)
+		listener, err = net.Listen(network, net.JoinHostPort(host, "0"))
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to listen on %s: %w", lc.listenerAddr, err)
 	}
@@ -80,15 +103,27 @@ func (lc *Client) startHTTPServer() (string, error) {
 	return addr, nil
 }
 
-func (lc *Client) subscribe(types []EventType, extensionID string, uri string) error {
+// portCollisions returns the listeners of the client which could not use
+// their configured port, used by another extension.
+func (lc *Client) portCollisions() []string {
+	if lc.portCollision.Load() {
+		return []string{"logs_api"}
+	}
+	return nil
+}
+
+func (lc *Client) subscribe(ctx context.Context, types []EventType, extensionID string, uri string) error {
+	// The Telemetry API takes the same subscription request as the Logs
+	// API, and delivers a superset of its records.
+	api, path, schemaVersion := "logs API", "2020-08-15/logs", SchemaVersion(SchemaVersionLatest)
+	if lc.telemetryAPI {
+		api, path, schemaVersion = "telemetry API", "2022-07-01/telemetry", SchemaVersion20221213
+	}
+
 	data, err := json.Marshal(&SubscribeRequest{
-		SchemaVersion: SchemaVersionLatest,
+		SchemaVersion: schemaVersion,
 		EventTypes:    types,
-		BufferingCfg: BufferingCfg{
-			MaxItems:  10000,
-			MaxBytes:  262144,
-			TimeoutMS: 25,
-		},
+		BufferingCfg:  lc.buffering,
 		Destination: Destination{
 			Protocol:   "HTTP",
 			URI:        uri,
@@ -100,15 +135,15 @@ func (lc *Client) subscribe(types []EventType, extensionID string, uri string) e
 		return fmt.Errorf("failed to marshal SubscribeRequest: %w", err)
 	}
 
-	url := fmt.Sprintf("%s/2020-08-15/logs", lc.logsAPIBaseURL)
-	resp, err := lc.sendRequest(url, data, extensionID)
+	url := fmt.Sprintf("%s/%s", lc.logsAPIBaseURL, path)
+	resp, err := lc.sendRequest(ctx, url, data, extensionID)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusAccepted {
-		return errors.New("logs API is not supported in this environment")
+		return fmt.Errorf("%s is not supported in this environment", api)
 	}
 
 	if resp.StatusCode != http.StatusOK {
@@ -123,8 +158,8 @@ func (lc *Client) subscribe(types []EventType, extensionID string, uri string) e
 	return nil
 }
 
-func (lc *Client) sendRequest(url string, data []byte, extensionID string) (*http.Response, error) {
-	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(data))
+func (lc *Client) sendRequest(ctx context.Context, url string, data []byte, extensionID string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewBuffer(data))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -0,0 +1,132 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultTeeBuffer is the number of batches of records queued
+	// for the tee endpoint, further batches are dropped.
+	defaultTeeBuffer = 100
+	// defaultTeeTimeout is the timeout of the requests to the tee endpoint.
+	defaultTeeTimeout = 5 * time.Second
+)
+
+// Tee is an HTTP endpoint the batches of records delivered by the Logs API
+// are forwarded to, unmodified, independently of the APM data.
+type Tee struct {
+	URL string
+	// Authorization is the value of the Authorization header of the
+	// requests to the endpoint, if set.
+	Authorization string
+}
+
+// teeForwarder posts the raw batches of records to the tee endpoint in
+// the background, so that a slow endpoint does not delay the Logs API.
+type teeForwarder struct {
+	tee     Tee
+	client  *http.Client
+	logger  *zap.SugaredLogger
+	queue   chan []byte
+	done    chan struct{}
+	started atomic.Bool
+	stopped atomic.Bool
+}
+
+func newTeeForwarder(tee Tee, logger *zap.SugaredLogger) *teeForwarder {
+	return &teeForwarder{
+		tee:    tee,
+		client: &http.Client{Timeout: defaultTeeTimeout},
+		logger: logger,
+		queue:  make(chan []byte, defaultTeeBuffer),
+		done:   make(chan struct{}),
+	}
+}
+
+// start starts forwarding the queued batches, once.
+func (f *teeForwarder) start() {
+	if !f.started.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer close(f.done)
+		for batch := range f.queue {
+			if err := f.post(batch); err != nil {
+				f.logger.Warnf("Failed to forward log events to the tee endpoint: %v", err)
+			}
+		}
+	}()
+}
+
+// forward queues the batch without blocking.
+func (f *teeForwarder) forward(batch []byte) {
+	select {
+	case f.queue <- batch:
+	default:
+		f.logger.Warn("Tee endpoint queue full: dropping a batch of log events")
+	}
+}
+
+// stop forwards the queued batches until ctx is done. No batch must be
+// forwarded afterwards.
+func (f *teeForwarder) stop(ctx context.Context) error {
+	if !f.stopped.CompareAndSwap(false, true) {
+		return nil
+	}
+	close(f.queue)
+	if !f.started.Load() {
+		return nil
+	}
+	select {
+	case <-f.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to forward the queued log events to the tee endpoint: %w", ctx.Err())
+	}
+}
+
+func (f *teeForwarder) post(batch []byte) error {
+	req, err := http.NewRequest(http.MethodPost, f.tee.URL, bytes.NewReader(batch))
+	if err != nil {
+		return fmt.Errorf("failed to create tee request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if f.tee.Authorization != "" {
+		req.Header.Set("Authorization", f.tee.Authorization)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("tee request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("tee request failed with status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestTee(t *testing.T) {
+	received := make(chan []byte, 10)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer foo", r.Header.Get("Authorization"))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		received <- body
+	}))
+	defer endpoint.Close()
+
+	tee := newTeeForwarder(Tee{URL: endpoint.URL, Authorization: "Bearer foo"}, zaptest.NewLogger(t).Sugar())
+	logsChannel := make(chan LogEvent, 10)
+	handler := handleLogEventsRequest(zaptest.NewLogger(t).Sugar(), logsChannel, &recordTypes{}, &atomic.Int64{}, tee, nil, nil)
+
+	// The batch is forwarded as is, including the records
+	// which are not processed.
+	batch := []byte(`[{"time":"2020-08-20T12:31:32.123Z","type":"platform.runtimeDone","record":{"requestId":"6f7f0961f83442118a7af6fe80b88d56","status":"success"}},` +
+		` {"time":"2020-08-20T12:31:32.123Z","type":"function","record":"hello"}, {"type":""}]` + "\n")
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(batch)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Len(t, logsChannel, 2)
+
+	// Invalid batches are not forwarded.
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(`[{`))))
+
+	// The batches queued before the start are forwarded.
+	tee.start()
+	require.NoError(t, tee.stop(context.Background()))
+	require.Len(t, received, 1)
+	assert.Equal(t, batch, <-received)
+
+	// Stopping again is a no-op.
+	require.NoError(t, tee.stop(context.Background()))
+}
+
+func TestTeeQueueFull(t *testing.T) {
+	tee := newTeeForwarder(Tee{URL: "http://localhost:1"}, zaptest.NewLogger(t).Sugar())
+	for i := 0; i < defaultTeeBuffer+1; i++ {
+		tee.forward([]byte(`[]`))
+	}
+	assert.Len(t, tee.queue, defaultTeeBuffer)
+	require.NoError(t, tee.stop(context.Background()))
+}
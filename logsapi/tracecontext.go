@@ -0,0 +1,130 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// traceContextFields are the fields of JSON logs holding a trace ID,
+// as written by the ECS loggers, Powertools and other common loggers.
+// The logs having one of them are not rewritten.
+var traceContextFields = []string{"trace.id", "trace_id", "traceId", "xray_trace_id"}
+
+// xrayHeaderTraceID returns the trace ID in the X-Ray format, e.g.
+// "1-5759e988-bd862e3fe1be46a994272793", of the root of the X-Ray
+// tracing header of an invocation, or an empty string if there is none.
+func xrayHeaderTraceID(header string) string {
+	for _, part := range strings.Split(header, ";") {
+		if k, v, found := strings.Cut(strings.TrimSpace(part), "="); found && k == "Root" {
+			return v
+		}
+	}
+	return ""
+}
+
+// injectTraceContext returns the function log record with a trace.id
+// field holding traceID, if it is a JSON object lacking trace context.
+// The record is otherwise unchanged, e.g. its fields keep their order.
+func injectTraceContext(record string, traceID string) (string, bool) {
+	start, end := strings.Index(record, "{"), strings.LastIndex(record, "}")
+	if traceID == "" || start < 0 || end < start || strings.TrimSpace(record[:start]) != "" {
+		return record, false
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(record[start:end+1]), &fields); err != nil {
+		return record, false
+	}
+	for _, f := range traceContextFields {
+		if _, ok := fields[f]; ok {
+			return record, false
+		}
+	}
+	if trace, ok := fields["trace"]; ok {
+		var t struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(trace, &t); err == nil && t.ID != "" {
+			return record, false
+		}
+	}
+
+	separator := ","
+	if len(fields) == 0 {
+		separator = ""
+	}
+	return record[:end] + separator + `"trace.id":"` + traceID + `"` + record[end:], true
+}
+
+// injectRecordTraceContext returns the function log record with the trace
+// ID of its invocation, if the record is a JSON log lacking trace context,
+// and the invocation is known. The invocation is the one whose execution
+// includes the time of the record, or the only invocation in flight.
+func (lc *Client) injectRecordTraceContext(e LogEvent) (string, bool) {
+	inv, ok := lc.invocations.at(e.Time)
+	if !ok {
+		return "", false
+	}
+	return injectTraceContext(e.StringRecord, xrayTraceID(xrayHeaderTraceID(inv.TraceID)))
+}
+
+// injectBatchTraceContext returns the batch of records with the trace
+// context injected into the function log records, or batch if none of
+// them was rewritten.
+func injectBatchTraceContext(batch []byte, rawEvents []json.RawMessage, inject func(LogEvent) (string, bool)) []byte {
+	events := make([]json.RawMessage, len(rawEvents))
+	rewritten := false
+	for n, rawEvent := range rawEvents {
+		events[n] = rawEvent
+
+		var e LogEvent
+		if err := e.UnmarshalJSON(rawEvent); err != nil || e.Type != FunctionLog || e.StringRecord == "" {
+			continue
+		}
+		record, ok := inject(e)
+		if !ok {
+			continue
+		}
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(rawEvent, &fields); err != nil {
+			continue
+		}
+		r, err := json.Marshal(record)
+		if err != nil {
+			continue
+		}
+		fields["record"] = r
+		if events[n], err = json.Marshal(fields); err != nil {
+			events[n] = rawEvent
+			continue
+		}
+		rewritten = true
+	}
+
+	if !rewritten {
+		return batch
+	}
+	b, err := json.Marshal(events)
+	if err != nil {
+		return batch
+	}
+	return b
+}
@@ -0,0 +1,176 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/apmproxy"
+	"github.com/elastic/apm-aws-lambda/extension"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+const testTraceHeader = "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"
+
+func TestInjectTraceContext(t *testing.T) {
+	traceID := "5759e988bd862e3fe1be46a994272793"
+	for name, tc := range map[string]struct {
+		record   string
+		expected string
+	}{
+		"json log": {
+			record:   `{"level":"info","message":"hello"}` + "\n",
+			expected: `{"level":"info","message":"hello","trace.id":"5759e988bd862e3fe1be46a994272793"}` + "\n",
+		},
+		"empty object": {
+			record:   `{}`,
+			expected: `{"trace.id":"5759e988bd862e3fe1be46a994272793"}`,
+		},
+		"ecs log": {
+			record: `{"message":"hello","trace.id":"0af7651916cd43dd8448eb211c80319c"}`,
+		},
+		"nested trace id": {
+			record: `{"message":"hello","trace":{"id":"0af7651916cd43dd8448eb211c80319c"}}`,
+		},
+		"powertools log": {
+			record: `{"message":"hello","xray_trace_id":"1-5759e988-bd862e3fe1be46a994272793"}`,
+		},
+		"text log": {
+			record: "2023-01-01T00:00:00Z hello {world}\n",
+		},
+		"invalid json": {
+			record: `{"message":`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			record, ok := injectTraceContext(tc.record, traceID)
+			if tc.expected == "" {
+				assert.False(t, ok)
+				assert.Equal(t, tc.record, record)
+				return
+			}
+			assert.True(t, ok)
+			assert.Equal(t, tc.expected, record)
+		})
+	}
+
+	_, ok := injectTraceContext(`{"message":"hello"}`, "")
+	assert.False(t, ok)
+}
+
+func TestXRayHeaderTraceID(t *testing.T) {
+	assert.Equal(t, "1-5759e988-bd862e3fe1be46a994272793", xrayHeaderTraceID(testTraceHeader))
+	assert.Equal(t, "1-5759e988-bd862e3fe1be46a994272793", xrayHeaderTraceID("Sampled=0; Root=1-5759e988-bd862e3fe1be46a994272793"))
+	assert.Empty(t, xrayHeaderTraceID(""))
+}
+
+func TestTeeTraceContext(t *testing.T) {
+	received := make(chan []byte, 10)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		received <- body
+	}))
+	defer endpoint.Close()
+
+	lc, err := NewClient(
+		WithLogsAPIBaseURL("http://example.com"),
+		WithLogger(zaptest.NewLogger(t).Sugar()),
+		WithTee(Tee{URL: endpoint.URL}),
+		WithTraceContextInjection(),
+	)
+	require.NoError(t, err)
+	handler := handleLogEventsRequest(lc.logger, lc.logsChannel, &lc.recordTypes, &lc.readTimeouts, lc.tee, lc.injectRecordTraceContext, nil)
+
+	// The invocation is unknown: the batch is forwarded as is.
+	batch := []byte(`[{"time":"2020-08-20T12:31:32.123Z","type":"function","record":"{\"message\":\"hello\"}\n"}]`)
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(batch)))
+
+	lc.RegisterInvocation(&extension.NextEventResponse{RequestID: "1", Tracing: extension.Tracing{Value: testTraceHeader}})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(batch)))
+
+	lc.tee.start()
+	require.NoError(t, lc.tee.stop(context.Background()))
+	require.Len(t, received, 2)
+	assert.Equal(t, batch, <-received)
+	assert.JSONEq(t, `[{"time":"2020-08-20T12:31:32.123Z","type":"function","record":"{\"message\":\"hello\",\"trace.id\":\"5759e988bd862e3fe1be46a994272793\"}\n"}]`, string(<-received))
+
+	// The records processed by the extension are unchanged.
+	require.Len(t, lc.logsChannel, 2)
+	assert.Equal(t, "{\"message\":\"hello\"}\n", (<-lc.logsChannel).StringRecord)
+}
+
+func TestInvocationsAt(t *testing.T) {
+	var i invocations
+	start := time.Now()
+	_, ok := i.at(start)
+	assert.False(t, ok)
+
+	i.register(&extension.NextEventResponse{RequestID: "1"})
+	i.started("1", start)
+	inv, ok := i.at(start.Add(time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, "1", inv.RequestID)
+	_, ok = i.at(start.Add(-time.Second))
+	assert.False(t, ok)
+
+	// The invocation is ambiguous
+	i.register(&extension.NextEventResponse{RequestID: "2"})
+	_, ok = i.at(start.Add(time.Second))
+	assert.False(t, ok)
+
+	// The finalized invocation is found by the time of its execution
+	i.done("1", start.Add(2*time.Second), "success", nil)
+	i.finalize("1")
+	inv, ok = i.at(start.Add(time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, "1", inv.RequestID)
+}
+
+func TestProcessLogsPowertoolsTraceContext(t *testing.T) {
+	l := zaptest.NewLogger(t).Sugar()
+	lc, err := NewClient(WithLogsAPIBaseURL("http://example.com"), WithLogger(l), WithPowertoolsLogs(), WithTraceContextInjection())
+	require.NoError(t, err)
+	apmClient, err := apmproxy.NewClient(apmproxy.WithURL("http://example.com"), apmproxy.WithLogger(l))
+	require.NoError(t, err)
+
+	lc.RegisterInvocation(&extension.NextEventResponse{RequestID: "current", Tracing: extension.Tracing{Value: testTraceHeader}})
+	now := time.Now()
+	for _, e := range []LogEvent{
+		{Type: FunctionLog, Time: now, StringRecord: `{"level":"INFO","message":"hello","service":"payment","location":"handler:1"}`},
+		{Type: RuntimeDone, Time: now, Record: LogEventRecord{RequestID: "current"}},
+	} {
+		lc.logsChannel <- e
+	}
+
+	runtimeDone := make(chan struct{}, 1)
+	metadataContainer := &apmproxy.MetadataContainer{Metadata: []byte(`{"metadata":{}}`)}
+	require.NoError(t, lc.ProcessLogs(context.Background(), "current", apmClient, metadataContainer, runtimeDone, nil))
+
+	require.Len(t, apmClient.DataChannel, 1)
+	assert.Contains(t, string((<-apmClient.DataChannel).Data), `"trace_id":"5759e988bd862e3fe1be46a994272793"`)
+}
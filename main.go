@@ -19,6 +19,8 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -27,9 +29,19 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/elastic/apm-aws-lambda/app"
+	"github.com/elastic/apm-aws-lambda/extension"
 )
 
 func main() {
+	selfTest := flag.Bool("self-test", false, "run the data pipeline against an embedded mock APM Server and exit")
+	version := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("%s %s\n", filepath.Base(os.Args[0]), extension.GetBuildInfo())
+		return
+	}
+
 	// Global context
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
 	defer cancel()
@@ -39,11 +51,32 @@ func main() {
 		log.Fatalf("failed to load AWS default config: %v", err)
 	}
 
+	// ELASTIC_APM_LOG_LEVEL is shared with the APM agents, the extension
+	// specific variable allows per-component overrides agents don't understand.
+	logLevel := os.Getenv("ELASTIC_APM_LOG_LEVEL")
+	if level, ok := os.LookupEnv("ELASTIC_APM_LAMBDA_LOG_LEVEL"); ok {
+		logLevel = level
+	}
+
+	if *selfTest {
+		// Only log if requested, to keep the report readable.
+		if logLevel == "" {
+			logLevel = "off"
+		}
+		if err := app.SelfTest(ctx, os.Stdout, app.WithLogLevel(logLevel)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	app, err := app.New(ctx,
 		app.WithExtensionName(filepath.Base(os.Args[0])),
 		app.WithLambdaRuntimeAPI(os.Getenv("AWS_LAMBDA_RUNTIME_API")),
-		app.WithLogLevel(os.Getenv("ELASTIC_APM_LOG_LEVEL")),
+		app.WithLogLevel(logLevel),
 		app.WithAWSConfig(cfg),
+		app.WithInstanceLockDir(filepath.Join(os.TempDir(), "elastic-apm-lambda-extension")),
+		app.WithFlushJournal(filepath.Join(os.TempDir(), "elastic-apm-lambda-extension-flush.json")),
+		app.WithSpillDir(filepath.Join(os.TempDir(), "elastic-apm-lambda-extension-spill")),
 	)
 	if err != nil {
 		log.Fatalf("failed to create the app: %v", err)
@@ -51,6 +51,7 @@ const (
 	InvokeStandard                     MockEventType = "Standard"
 	InvokeStandardInfo                 MockEventType = "StandardInfo"
 	InvokeStandardFlush                MockEventType = "StandardFlush"
+	InvokeStandardFlushEndpoint        MockEventType = "StandardFlushEndpoint"
 	InvokeStandardMetadata             MockEventType = "StandardMetadata"
 	InvokeLateFlush                    MockEventType = "LateFlush"
 	InvokeWaitgroupsRace               MockEventType = "InvokeWaitgroupsRace"
@@ -177,16 +178,17 @@ func newMockLambdaServer(t *testing.T, logsapiAddr string, eventsChannel chan Mo
 				sendNextEventInfo(w, currId, nextEvent, l)
 				go processMockEvent(currId, nextEvent, os.Getenv("ELASTIC_APM_DATA_RECEIVER_SERVER_PORT"), logsapiAddr, &lambdaServerInternals, l)
 			default:
+				// The shutdown phase lasts up to 2 seconds.
 				finalShutDown := MockEvent{
 					Type:              Shutdown,
 					ExecutionDuration: 0,
-					Timeout:           0,
+					Timeout:           2,
 				}
 				sendNextEventInfo(w, currId, finalShutDown, l)
 				go processMockEvent(currId, finalShutDown, os.Getenv("ELASTIC_APM_DATA_RECEIVER_SERVER_PORT"), logsapiAddr, &lambdaServerInternals, l)
 			}
-		// Logs API subscription request
-		case "/2020-08-15/logs":
+		// Logs API or Telemetry API subscription request
+		case "/2020-08-15/logs", "/2022-07-01/telemetry":
 			w.WriteHeader(http.StatusOK)
 		}
 	}))
@@ -256,6 +258,16 @@ func processMockEvent(currId string, event MockEvent, extensionPort string, logs
 		if _, err := client.Do(reqData); err != nil {
 			l.Error(err.Error())
 		}
+	case InvokeStandardFlushEndpoint:
+		time.Sleep(delay)
+		reqData, _ := http.NewRequest("POST", fmt.Sprintf("http://localhost:%s/intake/v2/events", extensionPort), bytes.NewBuffer([]byte(event.APMServerBehavior)))
+		if _, err := client.Do(reqData); err != nil {
+			l.Error(err.Error())
+		}
+		reqFlush, _ := http.NewRequest("POST", fmt.Sprintf("http://localhost:%s/flush", extensionPort), nil)
+		if _, err := client.Do(reqFlush); err != nil {
+			l.Error(err.Error())
+		}
 	case InvokeLateFlush:
 		time.Sleep(delay)
 		reqData, _ := http.NewRequest("POST", fmt.Sprintf("http://localhost:%s/intake/v2/events?flushed=true", extensionPort), bytes.NewBuffer([]byte(event.APMServerBehavior)))
@@ -433,6 +445,28 @@ func TestFlush(t *testing.T) {
 	}
 }
 
+// TestFlushEndpoint checks if the data is shipped when the agent signals the end of the invocation on the flush endpoint
+func TestFlushEndpoint(t *testing.T) {
+	l, err := logger.New(logger.WithLevel(zapcore.DebugLevel))
+	require.NoError(t, err)
+
+	eventsChannel := newTestStructs(t)
+	apmServerInternals, _ := newMockApmServer(t, l)
+	logsapiAddr := randomAddr()
+	newMockLambdaServer(t, logsapiAddr, eventsChannel, l)
+
+	eventsChain := []MockEvent{
+		{Type: InvokeStandardFlushEndpoint, APMServerBehavior: TimelyResponse, ExecutionDuration: 1, Timeout: 5},
+	}
+	eventQueueGenerator(eventsChain, eventsChannel)
+	select {
+	case <-runApp(t, logsapiAddr):
+		assert.Contains(t, apmServerInternals.Data, TimelyResponse)
+	case <-time.After(timeout):
+		t.Fatalf("timed out waiting for app to finish")
+	}
+}
+
 // TestLateFlush checks if there is no race condition between RuntimeDone and AgentDone
 // The test is built so that the AgentDone signal is received after RuntimeDone, which causes the next event to be interrupted.
 func TestLateFlush(t *testing.T) {
@@ -457,6 +491,31 @@ func TestLateFlush(t *testing.T) {
 	}
 }
 
+// TestLateFlushGracePeriod checks that the agent flush signal received after RuntimeDone
+// is awaited within the agent flush grace period.
+func TestLateFlushGracePeriod(t *testing.T) {
+	l, err := logger.New(logger.WithLevel(zapcore.DebugLevel))
+	require.NoError(t, err)
+
+	eventsChannel := newTestStructs(t)
+	apmServerInternals, _ := newMockApmServer(t, l)
+	logsapiAddr := randomAddr()
+	newMockLambdaServer(t, logsapiAddr, eventsChannel, l)
+	t.Setenv("ELASTIC_APM_LAMBDA_AGENT_FLUSH_GRACE_PERIOD", "1s")
+
+	eventsChain := []MockEvent{
+		{Type: InvokeStandardFlush, APMServerBehavior: TimelyResponse, ExecutionDuration: 0, Timeout: 5},
+		{Type: InvokeLateFlush, APMServerBehavior: TimelyResponse, ExecutionDuration: 0, Timeout: 5},
+	}
+	eventQueueGenerator(eventsChain, eventsChannel)
+	select {
+	case <-runApp(t, logsapiAddr):
+		assert.Contains(t, apmServerInternals.Data, TimelyResponse+TimelyResponse)
+	case <-time.After(timeout):
+		t.Fatalf("timed out waiting for app to finish")
+	}
+}
+
 // TestWaitGroup checks if there is no race condition between the main waitgroups (issue #128)
 func TestWaitGroup(t *testing.T) {
 	l, err := logger.New(logger.WithLevel(zapcore.DebugLevel))
@@ -0,0 +1,326 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Command smoke-testing deploys a canary function with the extension
+// layer, invokes it with representative events and verifies that the
+// data of the invocations reached Elasticsearch through the APM Server.
+// It prints a pass/fail report and exits with a non-zero status on failure.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type config struct {
+	stackName      string
+	layerARN       string
+	apmServerURL   string
+	apmSecretToken string
+	apmAPIKey      string
+	esURL          string
+	esAPIKey       string
+	eventsDir      string
+	timeout        time.Duration
+	keep           bool
+}
+
+// Report is the result of a smoke test run.
+type Report struct {
+	ServiceName string  `json:"service_name"`
+	Passed      bool    `json:"passed"`
+	Checks      []Check `json:"checks"`
+}
+
+// Check is the result of a step of a smoke test run.
+type Check struct {
+	Name     string        `json:"name"`
+	Passed   bool          `json:"passed"`
+	Detail   string        `json:"detail,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// runFunc runs a command in dir and returns its standard output.
+type runFunc func(ctx context.Context, dir string, name string, args ...string) ([]byte, error)
+
+func runCommand(ctx context.Context, dir string, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s failed: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// smokeTest is a smoke test run.
+type smokeTest struct {
+	cfg         config
+	dir         string
+	serviceName string
+	run         runFunc
+	httpClient  *http.Client
+	// pollInterval is the interval between the queries to Elasticsearch.
+	pollInterval time.Duration
+}
+
+func (s *smokeTest) functionName() string {
+	return s.cfg.stackName + "-canary"
+}
+
+// Run runs all the steps, stopping at the first failing one,
+// and returns the report.
+func (s *smokeTest) Run(ctx context.Context) (report Report) {
+	report = Report{ServiceName: s.serviceName, Passed: true}
+	check := func(name string, f func() (string, error)) bool {
+		start := time.Now()
+		detail, err := f()
+		c := Check{Name: name, Passed: err == nil, Detail: detail, Duration: time.Since(start)}
+		if err != nil {
+			c.Detail = err.Error()
+			report.Passed = false
+		}
+		log.Printf("%s: passed=%t %s", c.Name, c.Passed, c.Detail)
+		report.Checks = append(report.Checks, c)
+		return c.Passed
+	}
+
+	if !check("deploy", s.deploy) {
+		return report
+	}
+	if !s.cfg.keep {
+		// The report is a named result for the deferred
+		// check to be added to it.
+		defer check("delete", s.delete)
+	}
+
+	events, err := filepath.Glob(filepath.Join(s.dir, s.cfg.eventsDir, "*.json"))
+	if err == nil && len(events) == 0 {
+		err = fmt.Errorf("no event found in %s", s.cfg.eventsDir)
+	}
+	if err != nil {
+		check("events", func() (string, error) { return "", err })
+		return report
+	}
+	sort.Strings(events)
+	for _, event := range events {
+		event := event
+		name := "invoke " + strings.TrimSuffix(filepath.Base(event), ".json")
+		if !check(name, func() (string, error) { return s.invoke(ctx, event) }) {
+			return report
+		}
+	}
+
+	check("documents", func() (string, error) { return s.verifyDocuments(ctx) })
+	return report
+}
+
+func (s *smokeTest) deploy() (string, error) {
+	params := []string{
+		"ExtensionLayerArn=" + s.cfg.layerARN,
+		"ApmServerURL=" + s.cfg.apmServerURL,
+		"ServiceName=" + s.serviceName,
+	}
+	if s.cfg.apmSecretToken != "" {
+		params = append(params, "ApmSecretToken="+s.cfg.apmSecretToken)
+	}
+	if s.cfg.apmAPIKey != "" {
+		params = append(params, "ApmApiKey="+s.cfg.apmAPIKey)
+	}
+
+	args := []string{"deploy",
+		"--template-file", "template.yml",
+		"--stack-name", s.cfg.stackName,
+		"--capabilities", "CAPABILITY_IAM",
+		"--resolve-s3",
+		"--no-confirm-changeset",
+		"--no-fail-on-empty-changeset",
+		"--parameter-overrides",
+	}
+	if _, err := s.run(context.Background(), s.dir, "sam", append(args, params...)...); err != nil {
+		return "", err
+	}
+	return "stack " + s.cfg.stackName, nil
+}
+
+func (s *smokeTest) delete() (string, error) {
+	_, err := s.run(context.Background(), s.dir, "sam", "delete", "--stack-name", s.cfg.stackName, "--no-prompts")
+	return "", err
+}
+
+// invoke invokes the canary function with the event of the given file.
+func (s *smokeTest) invoke(ctx context.Context, event string) (string, error) {
+	out := filepath.Join(os.TempDir(), "smoke-test-response.json")
+	stdout, err := s.run(ctx, s.dir, "aws", "lambda", "invoke",
+		"--function-name", s.functionName(),
+		"--payload", "fileb://"+event,
+		out,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		StatusCode    int    `json:"StatusCode"`
+		FunctionError string `json:"FunctionError"`
+	}
+	if err := json.Unmarshal(stdout, &result); err != nil {
+		return "", fmt.Errorf("failed to parse the invocation result: %w", err)
+	}
+	if result.FunctionError != "" {
+		return "", fmt.Errorf("function error: %s", result.FunctionError)
+	}
+	if result.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d", result.StatusCode)
+	}
+	return fmt.Sprintf("status %d", result.StatusCode), nil
+}
+
+// verifyDocuments waits for the metrics of the canary invocations,
+// reported by the extension, to be indexed in Elasticsearch.
+func (s *smokeTest) verifyDocuments(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.timeout)
+	defer cancel()
+
+	for {
+		count, err := s.countDocuments(ctx)
+		if err == nil && count > 0 {
+			return fmt.Sprintf("%d metric documents found", count), nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return "", fmt.Errorf("no document found: %w", err)
+			}
+			return "", fmt.Errorf("no document found for service %s after %s", s.serviceName, s.cfg.timeout)
+		case <-time.After(s.pollInterval):
+		}
+	}
+}
+
+// countDocuments returns the number of metric documents of the service.
+func (s *smokeTest) countDocuments(ctx context.Context) (int, error) {
+	query, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{"service.name": s.serviceName},
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	u := strings.TrimSuffix(s.cfg.esURL, "/") + "/metrics-apm*/_count"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(query))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.cfg.esAPIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+s.cfg.esAPIKey)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("elasticsearch returned %s: %s", resp.Status, body)
+	}
+
+	var result struct {
+		Count int `json:"count"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return 0, fmt.Errorf("failed to parse the count response: %w", err)
+	}
+	return result.Count, nil
+}
+
+func main() {
+	var cfg config
+	var reportPath string
+	flag.StringVar(&cfg.stackName, "stack-name", "apm-lambda-extension-smoke-test", "the name of the CloudFormation stack of the canary function")
+	flag.StringVar(&cfg.layerARN, "layer-arn", "", "the ARN of the extension layer under test")
+	flag.StringVar(&cfg.apmServerURL, "apm-server-url", os.Getenv("ELASTIC_APM_SERVER_URL"), "the URL of the APM server")
+	flag.StringVar(&cfg.apmSecretToken, "apm-secret-token", os.Getenv("ELASTIC_APM_SECRET_TOKEN"), "the secret token of the APM server")
+	flag.StringVar(&cfg.apmAPIKey, "apm-api-key", os.Getenv("ELASTIC_APM_API_KEY"), "the API key of the APM server")
+	flag.StringVar(&cfg.esURL, "es-url", os.Getenv("ELASTICSEARCH_URL"), "the URL of the Elasticsearch cluster of the APM server")
+	flag.StringVar(&cfg.esAPIKey, "es-api-key", os.Getenv("ELASTICSEARCH_API_KEY"), "the API key to query Elasticsearch")
+	flag.StringVar(&cfg.eventsDir, "events", "events", "the directory of the events the canary function is invoked with")
+	flag.DurationVar(&cfg.timeout, "timeout", 5*time.Minute, "how long to wait for the documents to be indexed")
+	flag.BoolVar(&cfg.keep, "keep", false, "keep the canary function deployed after the test")
+	flag.StringVar(&reportPath, "report", "", "the file the JSON report is written to, standard output if empty")
+	flag.Parse()
+
+	if cfg.layerARN == "" || cfg.apmServerURL == "" || cfg.esURL == "" {
+		log.Fatal("-layer-arn, -apm-server-url and -es-url are required")
+	}
+
+	s := &smokeTest{
+		cfg:          cfg,
+		dir:          ".",
+		serviceName:  fmt.Sprintf("%s-%d", cfg.stackName, time.Now().Unix()),
+		run:          runCommand,
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+		pollInterval: 10 * time.Second,
+	}
+	report := s.Run(context.Background())
+
+	if err := writeReport(reportPath, report); err != nil {
+		log.Fatalf("Failed to write the report: %v", err)
+	}
+	if !report.Passed {
+		os.Exit(1)
+	}
+}
+
+// writeReport writes the JSON report to the file at path,
+// or to the standard output if path is empty.
+func writeReport(path string, report Report) error {
+	out := os.Stdout
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
@@ -0,0 +1,140 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSmokeTest(t *testing.T) {
+	var queries atomic.Int32
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "/metrics-apm*/_count", r.URL.Path)
+		assert.Equal(t, "ApiKey key", r.Header.Get("Authorization"))
+		assert.Contains(t, string(body), `"service.name":"canary-1"`)
+		// The documents are indexed after a few queries.
+		if queries.Add(1) < 3 {
+			w.Write([]byte(`{"count":0}`))
+			return
+		}
+		w.Write([]byte(`{"count":2}`))
+	}))
+	defer es.Close()
+
+	var commands []string
+	s := &smokeTest{
+		cfg: config{
+			stackName:    "canary",
+			layerARN:     "arn:aws:lambda:us-east-1:123456789012:layer:apm-lambda-extension:1",
+			apmServerURL: "https://apm.example.com",
+			esURL:        es.URL,
+			esAPIKey:     "key",
+			eventsDir:    "events",
+			timeout:      time.Second,
+		},
+		dir:         ".",
+		serviceName: "canary-1",
+		run: func(ctx context.Context, dir string, name string, args ...string) ([]byte, error) {
+			commands = append(commands, name+" "+args[0])
+			if name == "aws" {
+				assert.Contains(t, args, "canary-canary")
+				return []byte(`{"StatusCode":200,"ExecutedVersion":"$LATEST"}`), nil
+			}
+			return nil, nil
+		},
+		httpClient:   es.Client(),
+		pollInterval: time.Millisecond,
+	}
+
+	report := s.Run(context.Background())
+	assert.True(t, report.Passed, report)
+	assert.Equal(t, []string{"sam deploy", "aws lambda", "aws lambda", "aws lambda", "sam delete"}, commands)
+	var names []string
+	for _, c := range report.Checks {
+		names = append(names, c.Name)
+	}
+	assert.Equal(t, []string{"deploy", "invoke api-gateway", "invoke scheduled", "invoke sqs", "documents", "delete"}, names)
+}
+
+func TestSmokeTestFailure(t *testing.T) {
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"count":0}`))
+	}))
+	defer es.Close()
+
+	for name, tc := range map[string]struct {
+		invoke func() ([]byte, error)
+		failed string
+	}{
+		"function error": {
+			invoke: func() ([]byte, error) {
+				return []byte(`{"StatusCode":200,"FunctionError":"Unhandled"}`), nil
+			},
+			failed: "invoke api-gateway",
+		},
+		"invoke error": {
+			invoke: func() ([]byte, error) { return nil, errors.New("aws failed") },
+			failed: "invoke api-gateway",
+		},
+		"no documents": {
+			invoke: func() ([]byte, error) { return []byte(`{"StatusCode":200}`), nil },
+			failed: "documents",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := &smokeTest{
+				cfg:         config{stackName: "canary", esURL: es.URL, eventsDir: "events", timeout: 10 * time.Millisecond},
+				dir:         ".",
+				serviceName: "canary-1",
+				run: func(ctx context.Context, dir string, name string, args ...string) ([]byte, error) {
+					if name == "aws" {
+						return tc.invoke()
+					}
+					return nil, nil
+				},
+				httpClient:   es.Client(),
+				pollInterval: time.Millisecond,
+			}
+
+			report := s.Run(context.Background())
+			assert.False(t, report.Passed)
+			var failed []string
+			for _, c := range report.Checks {
+				if !c.Passed {
+					failed = append(failed, c.Name)
+				}
+			}
+			require.Equal(t, []string{tc.failed}, failed)
+			// The canary is deleted even if the test fails.
+			last := report.Checks[len(report.Checks)-1]
+			assert.True(t, strings.HasPrefix(last.Name, "delete"))
+		})
+	}
+}
@@ -0,0 +1,57 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadTest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cfg := config{invocations: 20, payloadSize: 1024, apmServerLatency: time.Millisecond, logLevel: "error"}
+	r, err := run(ctx, cfg, t.Setenv)
+	require.NoError(t, err)
+
+	assert.Equal(t, 20, r.invocations)
+	require.Len(t, r.addedLatencies, 20)
+	assert.LessOrEqual(t, r.percentile(0.5), r.percentile(0.99))
+	assert.Equal(t, r.addedLatencies[19], r.percentile(1))
+	// The data is compressed by the extension.
+	assert.Positive(t, r.apmServerBytes)
+	assert.Positive(t, r.apmServerRequests)
+	assert.Positive(t, r.peakHeapInuse)
+
+	var out bytes.Buffer
+	printResult(&out, cfg, r)
+	assert.Contains(t, out.String(), "invocations:        20\n")
+}
+
+func TestAgentPayload(t *testing.T) {
+	p := agentPayload(4096)
+	assert.GreaterOrEqual(t, len(p), 4096)
+	assert.Less(t, len(p), 4096+256)
+	assert.True(t, bytes.HasPrefix(p, []byte(agentMetadata+"\n")))
+}
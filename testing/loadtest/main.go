@@ -0,0 +1,69 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Command loadtest measures the overhead of the extension at scale. It runs
+// the extension against a simulated Lambda environment, which invokes it
+// many times with agent data of a configurable size, and a mock APM Server
+// with a configurable latency. It reports the latency the extension adds
+// to the invocations, i.e. the time between the end of the function and
+// the extension asking for the next event, and the memory it uses.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+func main() {
+	var cfg config
+	flag.IntVar(&cfg.invocations, "invocations", 1000, "the number of invocations to simulate")
+	flag.IntVar(&cfg.payloadSize, "payload-size", 4096, "the size in bytes of the agent data sent during each invocation")
+	flag.DurationVar(&cfg.apmServerLatency, "apm-server-latency", 0, "the latency of the responses of the mock APM Server")
+	flag.DurationVar(&cfg.executionDuration, "execution-duration", 0, "the duration of the execution of the simulated function")
+	flag.StringVar(&cfg.logLevel, "log-level", "error", "the log level of the extension")
+	flag.Parse()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	result, err := run(ctx, cfg, func(key, value string) {
+		if err := os.Setenv(key, value); err != nil {
+			log.Fatalf("Failed to set %s: %v", key, err)
+		}
+	})
+	if err != nil {
+		log.Fatalf("Load test failed: %v", err)
+	}
+	printResult(os.Stdout, cfg, result)
+}
+
+func printResult(w io.Writer, cfg config, r result) {
+	fmt.Fprintf(w, "invocations:        %d\n", r.invocations)
+	fmt.Fprintf(w, "payload size:       %d bytes\n", cfg.payloadSize)
+	fmt.Fprintf(w, "APM Server latency: %s\n", cfg.apmServerLatency)
+	fmt.Fprintf(w, "total duration:     %s\n", r.duration)
+	fmt.Fprintf(w, "added latency p50:  %s\n", r.percentile(0.5))
+	fmt.Fprintf(w, "added latency p99:  %s\n", r.percentile(0.99))
+	fmt.Fprintf(w, "added latency max:  %s\n", r.percentile(1))
+	fmt.Fprintf(w, "peak heap in use:   %.1f MB\n", float64(r.peakHeapInuse)/(1<<20))
+	fmt.Fprintf(w, "APM Server data:    %d bytes in %d requests\n", r.apmServerBytes, r.apmServerRequests)
+}
@@ -0,0 +1,321 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/apm-aws-lambda/app"
+	"github.com/elastic/apm-aws-lambda/extension"
+	"github.com/elastic/apm-aws-lambda/logsapi"
+
+	"github.com/google/uuid"
+)
+
+const agentMetadata = `{"metadata":{"service":{"name":"loadtest","agent":{"name":"loadtest","version":"0.0.0"}},"process":{"pid":1}}}`
+
+type config struct {
+	invocations       int
+	payloadSize       int
+	apmServerLatency  time.Duration
+	executionDuration time.Duration
+	logLevel          string
+}
+
+// result holds the measures of a load test.
+type result struct {
+	invocations int
+	duration    time.Duration
+	// addedLatencies are the latencies added by the extension to
+	// each invocation, sorted.
+	addedLatencies    []time.Duration
+	peakHeapInuse     uint64
+	apmServerBytes    int64
+	apmServerRequests int64
+}
+
+// percentile returns the p-th percentile of the added latencies.
+func (r result) percentile(p float64) time.Duration {
+	if len(r.addedLatencies) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(r.addedLatencies)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return r.addedLatencies[i]
+}
+
+// simulator simulates the Lambda environment: it invokes the extension,
+// sends agent data to its receiver as the function would, and delivers
+// the platform records to its Logs API listener.
+type simulator struct {
+	cfg          config
+	logsapiAddr  string
+	receiverAddr string
+	payload      []byte
+	client       *http.Client
+
+	mu sync.Mutex
+	// remaining is the number of invocations left.
+	remaining int
+	// functionEnd is the time the function of the current
+	// invocation ended, zero if no invocation is running.
+	functionEnd    time.Time
+	addedLatencies []time.Duration
+	errs           []error
+}
+
+// agentPayload returns ndjson agent data of about size bytes.
+func agentPayload(size int) []byte {
+	var b bytes.Buffer
+	b.WriteString(agentMetadata + "\n")
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, `{"transaction":{"id":"%016x","trace_id":"0123456789abcdef0123456789abcdef","name":"loadtest","type":"request","duration":1.5,"span_count":{"started":0}}}`+"\n", i)
+	}
+	return b.Bytes()
+}
+
+func (s *simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/2020-01-01/extension/register":
+		w.Header().Set("Lambda-Extension-Identifier", uuid.New().String())
+		s.encode(w, extension.RegisterResponse{FunctionName: "loadtest", FunctionVersion: "$LATEST", Handler: "loadtest"})
+	case "/2020-01-01/extension/event/next":
+		s.next(w)
+	case "/2020-08-15/logs", "/2022-07-01/telemetry":
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// next records the latency added to the previous invocation and
+// starts the next one, or shuts the extension down.
+func (s *simulator) next(w http.ResponseWriter) {
+	now := time.Now()
+	s.mu.Lock()
+	if !s.functionEnd.IsZero() {
+		s.addedLatencies = append(s.addedLatencies, now.Sub(s.functionEnd))
+		s.functionEnd = time.Time{}
+	}
+	invoke := s.remaining > 0
+	s.remaining--
+	s.mu.Unlock()
+
+	event := extension.NextEventResponse{
+		Timestamp:          now,
+		EventType:          extension.Shutdown,
+		ShutdownReason:     extension.Spindown,
+		DeadlineMs:         now.Add(time.Minute).UnixMilli(),
+		RequestID:          uuid.New().String(),
+		InvokedFunctionArn: "arn:aws:lambda:us-east-1:000000000000:function:loadtest",
+	}
+	if invoke {
+		event.EventType = extension.Invoke
+		event.ShutdownReason = ""
+		go s.invoke(event.RequestID)
+	}
+	s.encode(w, event)
+}
+
+// invoke simulates the execution of the function.
+func (s *simulator) invoke(requestID string) {
+	start := time.Now()
+	s.sendLogEvent(logsapi.Start, requestID, start)
+	time.Sleep(s.cfg.executionDuration)
+
+	resp, err := s.client.Post(fmt.Sprintf("http://%s/intake/v2/events?flushed=true", s.receiverAddr), "application/x-ndjson", bytes.NewReader(s.payload))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			err = fmt.Errorf("unexpected status %s from the receiver", resp.Status)
+		}
+	}
+
+	end := time.Now()
+	s.mu.Lock()
+	s.functionEnd = end
+	if err != nil {
+		s.errs = append(s.errs, err)
+	}
+	s.mu.Unlock()
+
+	s.sendLogEvent(logsapi.RuntimeDone, requestID, end)
+	s.sendLogEvent(logsapi.Report, requestID, end)
+}
+
+func (s *simulator) sendLogEvent(t logsapi.SubEventType, requestID string, ts time.Time) {
+	record := map[string]interface{}{"requestId": requestID}
+	if t == logsapi.Report {
+		record["metrics"] = logsapi.PlatformMetrics{DurationMs: 10, BilledDurationMs: 10, MemorySizeMB: 128, MaxMemoryUsedMB: 64}
+	}
+	body, err := json.Marshal([]map[string]interface{}{{"time": ts.Format(time.RFC3339Nano), "type": t, "record": record}})
+	if err != nil {
+		s.fail(err)
+		return
+	}
+
+	resp, err := s.client.Post("http://"+s.logsapiAddr, "application/json", bytes.NewReader(body))
+	if err != nil {
+		s.fail(fmt.Errorf("failed to deliver %s: %w", t, err))
+		return
+	}
+	resp.Body.Close()
+}
+
+func (s *simulator) encode(w http.ResponseWriter, v interface{}) {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.fail(err)
+	}
+}
+
+func (s *simulator) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs = append(s.errs, err)
+}
+
+// freeAddr returns a free local address.
+func freeAddr() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
+
+// run runs the extension against the simulated Lambda environment until
+// all the invocations are done. setenv sets the environment variables
+// configuring the extension.
+func run(ctx context.Context, cfg config, setenv func(key, value string)) (result, error) {
+	var apmServerBytes, apmServerRequests atomic.Int64
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(cfg.apmServerLatency)
+		if r.URL.Path == "/intake/v2/events" {
+			n, _ := io.Copy(io.Discard, r.Body)
+			apmServerBytes.Add(n)
+			apmServerRequests.Add(1)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer apmServer.Close()
+
+	logsapiAddr, err := freeAddr()
+	if err != nil {
+		return result{}, err
+	}
+	receiverAddr, err := freeAddr()
+	if err != nil {
+		return result{}, err
+	}
+	_, receiverPort, _ := net.SplitHostPort(receiverAddr)
+
+	sim := &simulator{
+		cfg:          cfg,
+		logsapiAddr:  logsapiAddr,
+		receiverAddr: receiverAddr,
+		payload:      agentPayload(cfg.payloadSize),
+		client:       &http.Client{Timeout: 10 * time.Second},
+		remaining:    cfg.invocations,
+	}
+	lambda := httptest.NewServer(sim)
+	defer lambda.Close()
+
+	setenv("ELASTIC_APM_LAMBDA_APM_SERVER", apmServer.URL)
+	setenv("ELASTIC_APM_SECRET_TOKEN", "none")
+	setenv("ELASTIC_APM_DATA_RECEIVER_SERVER_PORT", receiverPort)
+
+	a, err := app.New(ctx,
+		app.WithExtensionName("apm-lambda-extension"),
+		app.WithLambdaRuntimeAPI(strings.TrimPrefix(lambda.URL, "http://")),
+		app.WithLogLevel(cfg.logLevel),
+		app.WithLogsapiAddress(logsapiAddr),
+	)
+	if err != nil {
+		return result{}, err
+	}
+
+	var peakHeapInuse uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		var m runtime.MemStats
+		for {
+			runtime.ReadMemStats(&m)
+			if m.HeapInuse > peakHeapInuse {
+				peakHeapInuse = m.HeapInuse
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	start := time.Now()
+	err = a.Run(ctx)
+	duration := time.Since(start)
+	close(done)
+	<-sampled
+	if err != nil {
+		return result{}, err
+	}
+
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	if len(sim.errs) > 0 {
+		return result{}, fmt.Errorf("%d simulation errors, first: %w", len(sim.errs), sim.errs[0])
+	}
+	if len(sim.addedLatencies) != cfg.invocations {
+		return result{}, errors.New("the extension did not complete all the invocations")
+	}
+
+	latencies := append([]time.Duration(nil), sim.addedLatencies...)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return result{
+		invocations:       cfg.invocations,
+		duration:          duration,
+		addedLatencies:    latencies,
+		peakHeapInuse:     peakHeapInuse,
+		apmServerBytes:    apmServerBytes.Load(),
+		apmServerRequests: apmServerRequests.Load(),
+	}, nil
+}